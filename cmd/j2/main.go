@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"github.com/sunshine69/automation-go/lib"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// Build cmd so we have the version into the binary - eg in fish shell
+	// env CGO_ENABLED=0 go build -trimpath -ldflags="-X main.version=v1.0.1+"(date +'%Y%m%d')" -X main.buildTime="(date +'%Y-%m-%d_%H:%M:%S')" -extldflags=-static -w -s" --tags "osusergo,netgo" -o j2 cmd/j2/main.go
+	version   string // Will hold the version number
+	buildTime string // Will hold the build time
+)
+
+func printVersionBuildInfo() {
+	fmt.Printf("Version: %s\nBuild time: %s\n", version, buildTime)
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "[ERROR] %s\n", err)
+	os.Exit(1)
+}
+
+// hostVars returns the resolved vars of host in the inventory dir invDir, as the playbook tasks get them
+func hostVars(invDir, host string) (map[string]any, error) {
+	inv, err := lib.ParseInventoryDirAllErr(invDir)
+	if err == nil {
+		err = inv.ParseAllInventoryVarsErr()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("inventory %s: %w", invDir, err)
+	}
+	h, ok := inv.Hosts[host]
+	if !ok {
+		return nil, fmt.Errorf("host %s is not in the inventory %s", host, invDir)
+	}
+	vars := map[string]any{}
+	for k, v := range h.Vars {
+		vars[k] = v
+	}
+	vars["inventory_hostname"] = host
+	vars["group_names"] = h.Groups
+	return vars, nil
+}
+
+// templateData merges, the later ones winning: the env vars, the inventory host vars, the vars files and the
+// key=value extra vars
+func templateData(envAll bool, envPrefix, invDir, host string, varsFiles, extraVars []string) (map[string]any, error) {
+	data := map[string]any{}
+	if envAll || envPrefix != "" {
+		for _, kv := range os.Environ() {
+			k, v, _ := strings.Cut(kv, "=")
+			if strings.HasPrefix(k, envPrefix) && k != envPrefix {
+				data[strings.TrimPrefix(k, envPrefix)] = v
+			}
+		}
+	}
+	if invDir != "" || host != "" {
+		if invDir == "" || host == "" {
+			return nil, errors.New("--inventory and --host go together")
+		}
+		vars, err := hostVars(invDir, host)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range vars {
+			data[k] = v
+		}
+	}
+	for _, f := range varsFiles {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		// json is yaml too
+		m := map[string]any{}
+		if err := yaml.Unmarshal(b, &m); err != nil {
+			return nil, fmt.Errorf("%s: %w", f, err)
+		}
+		for k, v := range m {
+			data[k] = v
+		}
+	}
+	for _, kv := range extraVars {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("extra var %q is not key=value", kv)
+		}
+		data[k] = v
+	}
+	return data, nil
+}
+
+func main() {
+	optFlag := pflag.NewFlagSet("opt", pflag.ExitOnError)
+	output := optFlag.StringP("output", "o", "", "Output file, stdout if empty. The target directory when the template is a directory")
+	modeStr := optFlag.StringP("mode", "m", "", "Octal mode of the output files, e.g. 0600. Default keeps the mode of an existing file, 0644 for a new one")
+	varsFiles := optFlag.StringArrayP("vars-file", "f", []string{}, "Yaml or json file of variables, can be repeated; the later files win")
+	extraVars := optFlag.StringArrayP("extra-vars", "e", []string{}, "key=value variable, can be repeated. They win over all the other variables")
+	envAll := optFlag.Bool("env", false, "Add the environment variables to the variables, they have the lowest priority")
+	envPrefix := optFlag.String("env-prefix", "", "Add only the environment variables having this prefix, without the prefix, e.g. J2_ makes J2_PORT the variable PORT")
+	invDir := optFlag.StringP("inventory", "i", "", "Inventory dir, with --host the resolved vars of the host are added. They win over the environment variables")
+	host := optFlag.StringP("host", "H", "", "Inventory host whose vars are added, see --inventory")
+	strict := optFlag.Bool("strict", false, "Fail on undefined variables, same as JINJA2_UNDEFINED=strict")
+	engine := optFlag.StringP("engine", "E", "", "Template engine: "+strings.Join(lib.Engines, ", ")+". Default is the engine: of the #jinja2: header, else a #gotmpl: header or the .gotmpl/.go.tmpl extension for a go template, else minijinja")
+	stripSuffix := optFlag.String("strip-suffix", ".j2", "Directory rendering: the suffix removed from the output file names")
+	exclude := optFlag.StringArray("exclude", []string{}, "Directory rendering: glob of the files and directories skipped, can be repeated")
+	optFlag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: %s [template file, directory or - for stdin] [opt]
+Renders a jinja2 template with the lib template engine. Without a template or with - the template is read from stdin.
+A directory is rendered to the --output directory keeping its structure, the changed files are printed.
+
+Examples:
+  j2 nginx.conf.j2 -f vars.yaml -e port=8080 -o /etc/nginx/nginx.conf -m 0644
+  echo 'Hello {{ USER }}' | j2 --env
+  j2 templates/ -i inventory -H web01 -o /tmp/out --strict
+
+Options:
+`, os.Args[0])
+		optFlag.PrintDefaults()
+	}
+	optFlag.Parse(os.Args[1:])
+
+	args := optFlag.Args()
+	if len(args) == 1 && args[0] == "version" {
+		printVersionBuildInfo()
+		os.Exit(0)
+	}
+	if len(args) > 1 {
+		fatal(errors.New("only one template is rendered at once, run with -h for help"))
+	}
+	src := "-"
+	if len(args) == 1 {
+		src = args[0]
+	}
+	writeOpt := lib.WriteFileOptions{}
+	if *modeStr != "" {
+		mode, err := strconv.ParseUint(*modeStr, 8, 32)
+		if err != nil {
+			fatal(fmt.Errorf("mode %q is not an octal mode", *modeStr))
+		}
+		writeOpt.Mode = os.FileMode(mode)
+	}
+	if *strict {
+		os.Setenv("JINJA2_UNDEFINED", lib.UndefinedStrict)
+	}
+	data, err := templateData(*envAll, *envPrefix, *invDir, *host, *varsFiles, *extraVars)
+	if err != nil {
+		fatal(err)
+	}
+
+	if fi, err := os.Stat(src); src != "-" && err == nil && fi.IsDir() {
+		if *output == "" {
+			fatal(errors.New("rendering a directory needs the --output directory"))
+		}
+		changes, err := lib.TemplateDirTreeWithOptions(src, *output, data, lib.DirTreeOptions{StripSuffix: *stripSuffix, Exclude: *exclude, Write: writeOpt})
+		for _, c := range changes {
+			fmt.Printf("%s %s\n", c.Action, c.Path)
+		}
+		if err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	if src == "-" {
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fatal(err)
+		}
+		name := *engine
+		if name == "" {
+			if name, err = lib.DetectEngine("", string(b)); err != nil {
+				fatal(err)
+			}
+		}
+		r, err := lib.NewRenderer(name)
+		if err != nil {
+			fatal(err)
+		}
+		out, err := r.RenderString(string(b), data)
+		if err != nil {
+			fatal(err)
+		}
+		if *output == "" {
+			fmt.Print(out)
+		} else if _, err := lib.WriteFileAtomic(*output, []byte(out), writeOpt); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	r, err := lib.NewRendererForFile(src, *engine)
+	if err != nil {
+		fatal(err)
+	}
+	if *output == "" {
+		err = r.RenderToWriter(os.Stdout, src, data)
+	} else {
+		_, err = r.RenderFile(src, *output, data, writeOpt)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
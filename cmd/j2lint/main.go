@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"github.com/sunshine69/automation-go/lib"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// Build cmd so we have the version into the binary - eg in fish shell
+	// env CGO_ENABLED=0 go build -trimpath -ldflags="-X main.version=v1.0.1+"(date +'%Y%m%d')" -X main.buildTime="(date +'%Y-%m-%d_%H:%M:%S')" -extldflags=-static -w -s" --tags "osusergo,netgo" -o j2lint cmd/j2lint/main.go
+	version   string // Will hold the version number
+	buildTime string // Will hold the build time
+)
+
+func printVersionBuildInfo() {
+	fmt.Printf("Version: %s\nBuild time: %s\n", version, buildTime)
+}
+
+// readVars merges the yaml or json maps of files, the later files win
+func readVars(files []string) (map[string]any, error) {
+	vars := map[string]any{}
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		m := map[string]any{}
+		if err := yaml.Unmarshal(b, &m); err != nil {
+			return nil, fmt.Errorf("%s: %w", f, err)
+		}
+		for k, v := range m {
+			vars[k] = v
+		}
+	}
+	return vars, nil
+}
+
+func main() {
+	optFlag := pflag.NewFlagSet("opt", pflag.ExitOnError)
+	engine := optFlag.StringP("engine", "E", "", "Template engine, minijinja or gonja. Default is the engine: of the #jinja2: header of each file, else minijinja")
+	format := optFlag.StringP("format", "f", "text", "Output format: "+strings.Join(lib.LintFormats, ", ")+". sarif is for the code scanning and code review tools")
+	varsFiles := optFlag.StringArrayP("vars", "v", []string{}, "Yaml or json file of the variables the templates get, can be repeated. With it the variables not in them and not guarded by 'is defined' or '| default' are reported")
+	exts := optFlag.StringSlice("ext", []string{".j2", ".jinja", ".jinja2"}, "Extensions of the template files read in the directories")
+	failOn := optFlag.String("fail-on", "error", "Exit with status 1 when an issue has this level or a higher one: error, warning or never")
+	optFlag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: %s [template file or directory ...] [opt]
+Lints the jinja2 templates without rendering them. The rules are:
+`, os.Args[0])
+		for _, r := range lib.LintRules {
+			fmt.Fprintf(os.Stderr, "  %-20s %-8s %s\n", r.ID, r.Level, r.Description)
+		}
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		optFlag.PrintDefaults()
+	}
+	optFlag.Parse(os.Args[1:])
+
+	paths := optFlag.Args()
+	if len(paths) == 1 && paths[0] == "version" {
+		printVersionBuildInfo()
+		os.Exit(0)
+	}
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	if *engine != "" && *engine != lib.EngineMinijinja && *engine != lib.EngineGonja {
+		fmt.Fprintf(os.Stderr, "[ERROR] engine must be minijinja or gonja, got %q\n", *engine)
+		os.Exit(2)
+	}
+	levels := map[string]int{"error": 1, "warning": 2, "never": 0}
+	maxLevel, ok := levels[*failOn]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "[ERROR] fail-on must be error, warning or never, got %q\n", *failOn)
+		os.Exit(2)
+	}
+
+	opt := lib.LintOptions{Engine: *engine, Extensions: *exts}
+	if len(*varsFiles) > 0 {
+		vars, err := readVars(*varsFiles)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[ERROR] %s\n", err)
+			os.Exit(2)
+		}
+		opt.Vars = vars
+	}
+	issues, err := lib.LintTemplates(paths, opt)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] %s\n", err)
+		os.Exit(2)
+	}
+	if err := lib.WriteLintReport(os.Stdout, issues, *format); err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] %s\n", err)
+		os.Exit(2)
+	}
+	for _, i := range issues {
+		if level, ok := levels[i.Level]; ok && level > 0 && level <= maxLevel {
+			os.Exit(1)
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"strings"
 
 	"github.com/spf13/pflag"
+	"github.com/sunshine69/automation-go/lib"
 	u "github.com/sunshine69/golang-tools/utils"
 )
 
@@ -93,6 +94,8 @@ extract         - Only in blockinfile; it extract the text and return it the con
 	defaultExclude := optFlag.StringP("defaultexclude", "d", `^(\.git|.*\.zip|.*\.gz|.*\.xz|.*\.bz2|.*\.zst|.*\.7z|.*\.dll|.*\.iso|.*\.bin|.*\.tar|.*\.exe)$`, "Default exclude pattern. Set it to empty string if you need to")
 	skipBinary := optFlag.BoolP("skipbinary", "y", false, "Skip binary file")
 	debug := optFlag.Bool("debug", false, "Enable debugging")
+	checkMode := optFlag.Bool("check", false, "Check mode. Run the edit on a temporary copy of each file and report what would change; nothing is written. A missing file is shown as created")
+	diffMode := optFlag.Bool("diff", false, "Print the unified diff of each changed file to stderr. Can be combined with --check")
 	expected_change_count := optFlag.Int("expected", -1, `Expected change count per 1 file. Apply to blockinfile command.
 Default is -1 means do not care. Otherwise the program will panic if the number of change > expected_change_count.
 It will automatically turn on backup`)
@@ -133,6 +136,9 @@ It will automatically turn on backup`)
 	if *expected_change_count != -1 {
 		*backup = true
 	}
+	if *checkMode {
+		*backup = false
+	}
 
 	opt := u.NewLineInfileOpt(&u.LineInfileOpt{
 		Insertafter:   *insertafter,
@@ -170,8 +176,12 @@ It will automatically turn on backup`)
 	}
 
 	testPath, err := os.Stat(file_path)
+	// a missing file is edited as a new empty one, check and diff mode show it as created
+	newFile := err != nil
 	if err != nil {
-		u.FileTouch(file_path)
+		if !*checkMode {
+			u.FileTouch(file_path)
+		}
 		if *grepWithFileNameOpt == "" {
 			grepWithFileName = false
 		}
@@ -182,24 +192,49 @@ It will automatically turn on backup`)
 	}
 
 	err = filepath.Walk(file_path, func(path string, info fs.FileInfo, err error) error {
-		if err != nil {
+		if err != nil && !(newFile && *checkMode && path == file_path) {
 			fmt.Fprintln(os.Stderr, err.Error())
 			return nil
 		}
-		fname := info.Name()
-		if info.IsDir() && ((excludePtn != nil && excludePtn.MatchString(fname)) || (defaultExcludePtn != nil && defaultExcludePtn.MatchString(fname))) {
+		fname := filepath.Base(path)
+		isDir := info != nil && info.IsDir()
+		if isDir && ((excludePtn != nil && excludePtn.MatchString(fname)) || (defaultExcludePtn != nil && defaultExcludePtn.MatchString(fname))) {
 			return filepath.SkipDir
 		}
 		// Check if the file matches the pattern
 
-		if !info.IsDir() && filename_regexp.MatchString(fname) && ((excludePtn == nil) || (excludePtn != nil && !excludePtn.MatchString(fname))) && ((defaultExcludePtn == nil) || (defaultExcludePtn != nil && !defaultExcludePtn.MatchString(fname))) {
+		if !isDir && filename_regexp.MatchString(fname) && ((excludePtn == nil) || (excludePtn != nil && !excludePtn.MatchString(fname))) && ((defaultExcludePtn == nil) || (defaultExcludePtn != nil && !defaultExcludePtn.MatchString(fname))) {
 			if *skipBinary {
 				isbin, err := u.IsBinaryFileSimple(path)
 				if (err == nil) && isbin {
 					return nil
 				}
 			}
-			currentFileHash := u.Sha256SumFile(path)
+			// target is the file we edit; in check mode it is a temporary copy of path
+			target := path
+			var before []byte
+			compare := (*checkMode || *diffMode) && *cmd_mode != "grep"
+			if compare && !newFile {
+				before = u.Must(os.ReadFile(path))
+			}
+			if *checkMode && *cmd_mode != "grep" {
+				tempFile := u.Must(os.CreateTemp("", "lineinfile-check"))
+				tempFile.Close()
+				defer os.Remove(tempFile.Name())
+				u.CheckErr(os.WriteFile(tempFile.Name(), before, 0o600), "Write check mode copy of "+path)
+				target = tempFile.Name()
+			}
+			defer func() {
+				if !compare {
+					return
+				}
+				// a nil before is a new file
+				fc := lib.NewFileChange(path, before, u.Must(os.ReadFile(target)))
+				if *diffMode && fc.Diff != "" {
+					fmt.Fprint(os.Stderr, fc.Diff)
+				}
+			}()
+			currentFileHash := u.Sha256SumFile(target)
 
 			switch *cmd_mode {
 			case "grep":
@@ -212,7 +247,7 @@ It will automatically turn on backup`)
 				u.GrepStream(input, grepPtn, *grepOutputMatchOnly, *grepInverseMatch, grepPrefix, *line)
 
 			case "lineinfile":
-				err, changed := u.LineInFile(path, opt)
+				err, changed := u.LineInFile(target, opt)
 				u.CheckErrNonFatal(err, "main lineinfile")
 				output[path] = []any{map[string]any{"changed": changed, "error": err}}
 				if !isthereChange && changed {
@@ -222,7 +257,7 @@ It will automatically turn on backup`)
 				if *regexptn == "" {
 					panic(`{"error": "option regexp (r) is required"}`)
 				}
-				count := u.SearchReplaceFile(path, *regexptn, *line, -1, *backup)
+				count := u.SearchReplaceFile(target, *regexptn, *line, -1, *backup)
 				output[path] = []any{count, nil}
 				if !isthereChange && count > 0 {
 					isthereChange = true
@@ -244,7 +279,7 @@ It will automatically turn on backup`)
 					output[path] = []any{}
 					for {
 						matchedPattern := [][]string{}
-						block, start_no, end_no, _, matchedPattern = u.ExtractTextBlockContains(path, upperBound, lowerBound, marker, start_line)
+						block, start_no, end_no, _, matchedPattern = u.ExtractTextBlockContains(target, upperBound, lowerBound, marker, start_line)
 						if block == "" {
 							break
 						}
@@ -266,7 +301,7 @@ It will automatically turn on backup`)
 					if start_line > 0 { // If we did once then we dont insert anymore for the rest of text
 						insertIfNotFound = false
 					}
-					oldblock, _, end, _ = u.BlockInFile(path, upperBound, lowerBound, marker, *line, *state == "keepboundary", false, start_line, map[string]any{"insertIfNotFound": insertIfNotFound})
+					oldblock, _, end, _ = u.BlockInFile(target, upperBound, lowerBound, marker, *line, *state == "keepboundary", false, start_line, map[string]any{"insertIfNotFound": insertIfNotFound})
 					if oldblock == "" {
 						break
 					}
@@ -280,7 +315,7 @@ It will automatically turn on backup`)
 				if *expected_change_count > 0 && changed_count != *expected_change_count {
 					panic(fmt.Sprintf("[ERROR] File '%s' | changed_count %d not match with expected_change_count %d\n", path, changed_count, *expected_change_count))
 				}
-				newFileHash := u.Sha256SumFile(path)
+				newFileHash := u.Sha256SumFile(target)
 				if newFileHash != currentFileHash {
 					isthereChange = true
 				} else {
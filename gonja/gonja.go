@@ -13,7 +13,10 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	u "github.com/sunshine69/golang-tools/utils"
@@ -37,59 +40,111 @@ var CustomConfig = config.Config{
 	LeftStripBlocks:     true,
 }
 
-var ptnPerlCapture *regexp.Regexp = regexp.MustCompile(`\\(\d+)`)
+var ptnPerlCapture *regexp.Regexp = regexp.MustCompile(`\\(\d+)|\\g<(\w+)>`)
 
 func convertPerlCapPattern(input string) string {
-	// Define the regular expression to match the pattern \d+
-	// Replace the matched pattern with $ and the digits
+	// Replace the python style \1 and \g<name> group references with ${1} and ${name}
 	result := ptnPerlCapture.ReplaceAllStringFunc(input, func(match string) string {
-		return "$" + match[1:]
+		if strings.HasPrefix(match, `\g<`) {
+			return "${" + match[3:len(match)-1] + "}"
+		}
+		return "${" + match[1:] + "}"
 	})
 
 	return result
 }
 
+// regexCacheSize bounds the compiled patterns kept, the cache is emptied when full
+const regexCacheSize = 512
+
+var (
+	regexCacheMu sync.Mutex
+	regexCache   = map[string]*regexp.Regexp{}
+)
+
+// compileRegex compiles pattern with the ansible ignorecase and multiline flags, the compiled patterns are cached
+func compileRegex(pattern string, ignorecase, multiline bool) (*regexp.Regexp, error) {
+	flags := u.Ternary(ignorecase, "i", "") + u.Ternary(multiline, "m", "")
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	regexCacheMu.Lock()
+	defer regexCacheMu.Unlock()
+	if ptn, ok := regexCache[pattern]; ok {
+		return ptn, nil
+	}
+	ptn, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(regexCache) >= regexCacheSize {
+		regexCache = map[string]*regexp.Regexp{}
+	}
+	regexCache[pattern] = ptn
+	return ptn, nil
+}
+
+// regex_replace(pattern, replacement, ignorecase=False, multiline=False, count=0) like ansible, count 0 replaces all
 var filterFuncRegexReplace exec.FilterFunction = func(e *exec.Evaluator, in *exec.Value, params *exec.VarArgs) *exec.Value {
 	if in.IsError() {
 		return in
 	}
-	// 2 args is mandate, option arg count default val is nil. Backslash \ need to escape like \\ so template compile works
-	// p := params.Expect(2, []*exec.KwArg{{Name: "count", Default: nil}})
-	// if p.IsError() {
-	// 	return exec.AsValue(errors.Wrap(p, "Wrong signature for 'regex_replace'"))
-	// }
-	pattern := params.Args[0].String()
-	new := params.Args[1].String()
-	new = convertPerlCapPattern(new)
-	// count := params.KwArgs["count"]
-
-	ptn := regexp.MustCompile(pattern)
-
-	// if count.IsNil() {
-	// 	return exec.AsValue(ptn.ReplaceAllString(in.String(), new))
-	// }
-
-	// counter := 0
-	// output := ptn.ReplaceAllStringFunc(in.String(), func(value string) string {
-	// 	if counter == count.Integer() {
-	// 		return value
-	// 	}
-	// 	counter++
-	// 	return ptn.ReplaceAllString(value, new)
-	// })
-	output := ptn.ReplaceAllString(in.String(), new)
-	return exec.AsValue(output)
+	var (
+		pattern, new          string
+		ignorecase, multiline bool
+		count                 int
+	)
+	if err := params.Take(
+		exec.PositionalArgument("pattern", nil, exec.StringArgument(&pattern)),
+		exec.PositionalArgument("replacement", nil, exec.StringArgument(&new)),
+		exec.KeywordArgument("ignorecase", exec.AsValue(false), exec.BoolArgument(&ignorecase)),
+		exec.KeywordArgument("multiline", exec.AsValue(false), exec.BoolArgument(&multiline)),
+		exec.KeywordArgument("count", exec.AsValue(0), exec.IntArgument(&count)),
+	); err != nil {
+		return exec.AsValue(exec.ErrInvalidCall(err))
+	}
+	ptn, err := compileRegex(pattern, ignorecase, multiline)
+	if err != nil {
+		return exec.AsValue(errors.Wrap(err, "regex_replace"))
+	}
+	s, new := in.String(), convertPerlCapPattern(new)
+	if count <= 0 {
+		return exec.AsValue(ptn.ReplaceAllString(s, new))
+	}
+	var output []byte
+	last := 0
+	for _, m := range ptn.FindAllStringSubmatchIndex(s, count) {
+		output = append(output, s[last:m[0]]...)
+		output = ptn.ExpandString(output, new, s, m)
+		last = m[1]
+	}
+	output = append(output, s[last:]...)
+	return exec.AsValue(string(output))
 }
 
+// regex_search(pattern, ignorecase=False, multiline=False) gives the match, or the list of groups if the pattern has
+// some
 var filterFuncRegexSearch exec.FilterFunction = func(e *exec.Evaluator, in *exec.Value, params *exec.VarArgs) *exec.Value {
 	if in.IsError() {
 		return in
 	}
+	var (
+		pattern               string
+		ignorecase, multiline bool
+	)
+	if err := params.Take(
+		exec.PositionalArgument("pattern", nil, exec.StringArgument(&pattern)),
+		exec.KeywordArgument("ignorecase", exec.AsValue(false), exec.BoolArgument(&ignorecase)),
+		exec.KeywordArgument("multiline", exec.AsValue(false), exec.BoolArgument(&multiline)),
+	); err != nil {
+		return exec.AsValue(exec.ErrInvalidCall(err))
+	}
 	// Simulate the ansible regex_search filter. Map to golang FindString and FindStringSubMatch
-	ptn := regexp.MustCompile(params.Args[0].String())
-	input := in.String()
-
-	out := ptn.FindStringSubmatch(input)
+	ptn, err := compileRegex(pattern, ignorecase, multiline)
+	if err != nil {
+		return exec.AsValue(errors.Wrap(err, "regex_search"))
+	}
+	out := ptn.FindStringSubmatch(in.String())
 	if len(out) == 1 { // return a match
 		return exec.AsValue(out[0])
 	} // If there is capture then return a list of captures (submatch). Ignoring all args
@@ -99,28 +154,35 @@ var filterFuncRegexSearch exec.FilterFunction = func(e *exec.Evaluator, in *exec
 	return exec.AsValue("")
 }
 
+// toNative converts in to plain go values, maps with string keys
+func toNative(in *exec.Value) (any, error) {
+	out := in.ToGoSimpleType(false)
+	if err, ok := out.(error); ok {
+		return nil, err
+	}
+	return out, nil
+}
+
 var filterFuncToYaml exec.FilterFunction = func(e *exec.Evaluator, in *exec.Value, params *exec.VarArgs) *exec.Value {
 	if in.IsError() {
 		return in
 	}
-	p := params.Expect(0, []*exec.KwArg{{Name: "indent", Default: nil}})
-	if p.IsError() {
-		return exec.AsValue(errors.Wrap(p, "Wrong signature for 'to_yaml'"))
+	indent := 2
+	if err := params.Take(exec.KeywordArgument("indent", exec.AsValue(2), exec.IntArgument(&indent))); err != nil {
+		return exec.AsValue(exec.ErrInvalidCall(err))
+	}
+	native, err := toNative(in)
+	if err != nil {
+		return exec.AsValue(errors.Wrap(err, "to_yaml"))
 	}
-	indent := p.KwArgs["indent"]
 
 	var buf bytes.Buffer
 	// Create a new YAML encoder with a custom indentation level
 	encoder := yaml.NewEncoder(&buf)
-
-	if !indent.IsNil() {
-		encoder.SetIndent(indent.Integer())
-		fmt.Println("WARN indent not supported")
-	}
-	if err := encoder.Encode(in.ToGoSimpleType(true)); err != nil {
-		panic(fmt.Sprintf("Error encoding YAML: %s\n", err))
+	encoder.SetIndent(indent)
+	if err := encoder.Encode(native); err != nil {
+		return exec.AsValue(errors.Wrap(err, "to_yaml"))
 	}
-
 	return exec.AsValue(buf.String())
 }
 
@@ -148,9 +210,9 @@ var filterFuncToJson exec.FilterFunction = func(e *exec.Evaluator, in *exec.Valu
 		return exec.AsValue(errors.Wrap(p, "Wrong signature for 'tojson'"))
 	}
 
-	casted := GonjaCastToList(in)
-	if err, ok := casted.(error); ok {
-		return exec.AsValue(err)
+	casted, err := toNative(in)
+	if err != nil {
+		return exec.AsValue(errors.Wrap(err, "to_json"))
 	}
 
 	indent := p.KwArgs["indent"]
@@ -173,29 +235,38 @@ var filterFuncToJson exec.FilterFunction = func(e *exec.Evaluator, in *exec.Valu
 	return exec.AsSafeValue(out)
 }
 
+// b64encode(wrap=0) breaks the output in lines of wrap characters if wrap > 0, like base64 -w
 var filterFuncB64Encode exec.FilterFunction = func(e *exec.Evaluator, in *exec.Value, params *exec.VarArgs) *exec.Value {
 	if in.IsError() {
 		return in
 	}
-	p := params.Expect(0, []*exec.KwArg{{Name: "wrap", Default: nil}})
-	if p.IsError() {
-		return exec.AsValue(errors.Wrap(p, "Wrong signature for 'to_yaml'"))
+	wrap := 0
+	if err := params.Take(exec.KeywordArgument("wrap", exec.AsValue(0), exec.IntArgument(&wrap))); err != nil {
+		return exec.AsValue(exec.ErrInvalidCall(err))
 	}
-	// wrap is unsupported in golang, try to implement it later on
 	o := b64.StdEncoding.EncodeToString([]byte(in.String()))
-	return exec.AsValue(o)
+	if wrap <= 0 {
+		return exec.AsValue(o)
+	}
+	lines := []string{}
+	for len(o) > wrap {
+		lines = append(lines, o[:wrap])
+		o = o[wrap:]
+	}
+	return exec.AsValue(strings.Join(append(lines, o), "\n"))
 }
 
 var filterFuncB64Decode exec.FilterFunction = func(e *exec.Evaluator, in *exec.Value, params *exec.VarArgs) *exec.Value {
 	if in.IsError() {
 		return in
 	}
-	p := params.Expect(0, []*exec.KwArg{{Name: "wrap", Default: nil}})
-	if p.IsError() {
-		return exec.AsValue(errors.Wrap(p, "Wrong signature for 'to_yaml'"))
+	if p := params.ExpectNothing(); p.IsError() {
+		return exec.AsValue(errors.Wrap(p, "Wrong signature for 'b64decode'"))
+	}
+	o, err := b64.StdEncoding.DecodeString(in.String())
+	if err != nil {
+		return exec.AsValue(errors.Wrap(err, "b64decode"))
 	}
-	// wrap is unsupported in golang, try to implement it later on
-	o := u.Must(b64.StdEncoding.DecodeString(in.String()))
 	return exec.AsValue(string(o))
 }
 
@@ -204,6 +275,9 @@ var filterContainsAll exec.FilterFunction = func(e *exec.Evaluator, in *exec.Val
 		return in
 	}
 	// The sub_list passed as an argument: {{ main_list | contains_all(sub_list) }}
+	if p := params.ExpectArgs(1); p.IsError() {
+		return exec.AsValue(errors.Wrap(p, "Wrong signature for 'contains'"))
+	}
 
 	if !in.IsList() || !params.Args[0].IsList() {
 		return exec.AsValue(false)
@@ -221,6 +295,9 @@ var filterContainsAny exec.FilterFunction = func(e *exec.Evaluator, in *exec.Val
 		return in
 	}
 	// The sub_list passed as an argument: {{ main_list | contains_all(sub_list) }}
+	if p := params.ExpectArgs(1); p.IsError() {
+		return exec.AsValue(errors.Wrap(p, "Wrong signature for 'contains_any'"))
+	}
 
 	if !in.IsList() || !params.Args[0].IsList() {
 		return exec.AsValue(false)
@@ -238,20 +315,148 @@ var filterContainsAny exec.FilterFunction = func(e *exec.Evaluator, in *exec.Val
 	return exec.AsValue(false)
 }
 
+// keys gives the sorted keys of a map, as the lib one
 var filterKeys exec.FilterFunction = func(e *exec.Evaluator, in *exec.Value, params *exec.VarArgs) *exec.Value {
 	if in.IsError() {
 		return in
 	}
-	// The sub_list passed as an argument: {{ main_list | contains_all(sub_list) }}
-
 	if !in.IsDict() {
 		return exec.AsValue([]string{})
 	}
-
-	out := u.MapKeysToSlice(in.ToGoSimpleType(true).(map[any]any))
+	out := []string{}
+	for _, k := range in.Keys() {
+		out = append(out, k.String())
+	}
+	sort.Strings(out)
 	return exec.AsValue(out)
 }
 
+// indent(width=4, first=False, blank=False) like jinja2, the builtin gonja one adds a newline at the end
+var filterIndent exec.FilterFunction = func(e *exec.Evaluator, in *exec.Value, params *exec.VarArgs) *exec.Value {
+	if in.IsError() {
+		return in
+	}
+	var (
+		width        int
+		first, blank bool
+	)
+	if err := params.Take(
+		exec.KeywordArgument("width", exec.AsValue(4), exec.IntArgument(&width)),
+		exec.KeywordArgument("first", exec.AsValue(false), exec.BoolArgument(&first)),
+		exec.KeywordArgument("blank", exec.AsValue(false), exec.BoolArgument(&blank)),
+	); err != nil {
+		return exec.AsValue(exec.ErrInvalidCall(err))
+	}
+	if !in.IsString() {
+		return in
+	}
+	indent := strings.Repeat(" ", width)
+	lines := strings.Split(in.String(), "\n")
+	for i, line := range lines {
+		if i == 0 && !first {
+			continue
+		}
+		if line == "" && !blank {
+			continue
+		}
+		lines[i] = indent + line
+	}
+	return exec.AsValue(strings.Join(lines, "\n"))
+}
+
+// wrap(tag="span", class="") wraps the text in a html tag
+var filterWrap exec.FilterFunction = func(e *exec.Evaluator, in *exec.Value, params *exec.VarArgs) *exec.Value {
+	if in.IsError() {
+		return in
+	}
+	var tag, class string
+	if err := params.Take(
+		exec.KeywordArgument("tag", exec.AsValue("span"), exec.StringArgument(&tag)),
+		exec.KeywordArgument("class", exec.AsValue(""), exec.StringArgument(&class)),
+	); err != nil {
+		return exec.AsValue(exec.ErrInvalidCall(err))
+	}
+	if !in.IsString() {
+		return exec.AsValue(errors.New("wrap expects a string"))
+	}
+	if class != "" {
+		class = fmt.Sprintf(` class="%s"`, class)
+	}
+	return exec.AsSafeValue(fmt.Sprintf("<%s%s>%s</%s>", tag, class, in.String(), tag))
+}
+
+var filterReverseStr exec.FilterFunction = func(e *exec.Evaluator, in *exec.Value, params *exec.VarArgs) *exec.Value {
+	if in.IsError() {
+		return in
+	}
+	if !in.IsString() {
+		return exec.AsValue(errors.New("reverse_str expects a string"))
+	}
+	runes := []rune(in.String())
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return exec.AsValue(string(runes))
+}
+
+// Strftime formats the fmt argument of now, the lib package sets it to its strftime implementation
+var Strftime func(t time.Time, format string) string
+
+// now(layout=time.RFC3339, utc=False, fmt=None), the layout being a go time layout and fmt a strftime one
+func functionNow(_ *exec.Evaluator, params *exec.VarArgs) *exec.Value {
+	var (
+		layout, format string
+		utc            bool
+	)
+	if err := params.Take(
+		exec.KeywordArgument("layout", exec.AsValue(time.RFC3339), exec.StringArgument(&layout)),
+		exec.KeywordArgument("utc", exec.AsValue(false), exec.BoolArgument(&utc)),
+		exec.KeywordArgument("fmt", exec.AsValue(""), exec.StringArgument(&format)),
+	); err != nil {
+		return exec.AsValue(exec.ErrInvalidCall(err))
+	}
+	now := u.Ternary(utc, time.Now().UTC(), time.Now())
+	if format != "" {
+		if Strftime == nil {
+			return exec.AsValue(errors.New("now: fmt needs gonja.Strftime to be set"))
+		}
+		return exec.AsValue(Strftime(now, format))
+	}
+	return exec.AsValue(now.Format(layout))
+}
+
+func testStartWith(_ *exec.Context, in *exec.Value, params *exec.VarArgs) (bool, error) {
+	if len(params.Args) == 0 {
+		return false, errors.New("startswith requires a prefix argument")
+	}
+	if !in.IsString() || !params.Args[0].IsString() {
+		return false, nil
+	}
+	return strings.HasPrefix(in.String(), params.Args[0].String()), nil
+}
+
+func testBetween(_ *exec.Context, in *exec.Value, params *exec.VarArgs) (bool, error) {
+	// the gonja parser gives a test a single argument, between(1, 10) comes as the tuple (1, 10)
+	args := params.Args
+	if len(args) == 1 && args[0].IsList() {
+		tuple := args[0]
+		args = []*exec.Value{}
+		for i := 0; i < tuple.Len(); i++ {
+			args = append(args, exec.ToValue(tuple.Index(i).Val))
+		}
+	}
+	if len(args) < 2 {
+		return false, errors.New("between requires min and max arguments")
+	}
+	if !in.IsInteger() {
+		return false, nil
+	}
+	n := in.Integer()
+	return n >= args[0].Integer() && n <= args[1].Integer(), nil
+}
+
+// CustomEnvironment returns the gonja default environment with the filters, tests and functions of this package.
+// The indent filter is only replaced in the returned copy.
 func CustomEnvironment() *exec.Environment {
 	// combine, extract, or dict2items ???
 	e := gonja.DefaultEnvironment
@@ -282,7 +487,31 @@ func CustomEnvironment() *exec.Environment {
 	if !e.Filters.Exists("keys") {
 		e.Filters.Register("keys", filterKeys)
 	}
-	return e
+	if !e.Filters.Exists("wrap") {
+		e.Filters.Register("wrap", filterWrap)
+	}
+	if !e.Filters.Exists("reverse_str") {
+		e.Filters.Register("reverse_str", filterReverseStr)
+	}
+	if !e.Tests.Exists("startswith") {
+		e.Tests.Register("startswith", testStartWith)
+	}
+	if !e.Tests.Exists("between") {
+		e.Tests.Register("between", testBetween)
+	}
+	if !e.Context.Has("now") {
+		e.Context.Set("now", functionNow)
+	}
+	// the builtin indent adds a trailing newline
+	filters := exec.NewFilterSet(map[string]exec.FilterFunction{}).Update(e.Filters)
+	filters.Replace("indent", filterIndent)
+	return &exec.Environment{
+		Context:           e.Context,
+		Filters:           filters,
+		Tests:             e.Tests,
+		ControlStructures: e.ControlStructures,
+		Methods:           e.Methods,
+	}
 }
 
 // func inspectTemplateFile(inputFilePath string) (needProcess bool, tempfilePath string, customConfig *config.Config) {
@@ -353,9 +582,14 @@ func parseJinja2Config(firstLine, prefix string) (foundConfig bool, jinja2config
 }
 
 func templateFromBytesWithConfig(source []byte, config *config.Config) (*exec.Template, error) {
+	return templateFromBytes(source, "", config, CustomEnvironment())
+}
+
+// templateFromBytes parses source with env, include and import are looked up in dir
+func templateFromBytes(source []byte, dir string, config *config.Config, env *exec.Environment) (*exec.Template, error) {
 	rootID := fmt.Sprintf("root-%s", string(sha256.New().Sum(source)))
 
-	loader, err := loaders.NewFileSystemLoader("")
+	loader, err := loaders.NewFileSystemLoader(dir)
 	if err != nil {
 		return nil, err
 	}
@@ -364,13 +598,33 @@ func templateFromBytesWithConfig(source []byte, config *config.Config) (*exec.Te
 		return nil, err
 	}
 
-	return exec.NewTemplate(rootID, config, shiftedLoader, CustomEnvironment())
+	return exec.NewTemplate(rootID, config, shiftedLoader, env)
 }
 
 func TemplateFromStringWithConfig(source string, config *config.Config) (*exec.Template, error) {
 	return templateFromBytesWithConfig([]byte(source), config)
 }
 
+// TemplateFromStringWithEnvironment is TemplateFromStringWithConfig with env instead of CustomEnvironment, include
+// and import are looked up in dir
+func TemplateFromStringWithEnvironment(source, dir string, config *config.Config, env *exec.Environment) (*exec.Template, error) {
+	return templateFromBytes([]byte(source), dir, config, env)
+}
+
+// NewEnvironment returns a copy of CustomEnvironment with its own filter set holding also filters, so they do not
+// change the shared environment
+func NewEnvironment(filters map[string]exec.FilterFunction) *exec.Environment {
+	base := CustomEnvironment()
+	own := exec.NewFilterSet(map[string]exec.FilterFunction{}).Update(base.Filters).Update(exec.NewFilterSet(filters))
+	return &exec.Environment{
+		Context:           base.Context,
+		Filters:           own,
+		Tests:             base.Tests,
+		ControlStructures: base.ControlStructures,
+		Methods:           base.Methods,
+	}
+}
+
 func templateFromFileWithConfig(filepath string, config *config.Config) (*exec.Template, error) {
 	loader, err := loaders.NewFileSystemLoader(path.Dir(filepath))
 	t, err := exec.NewTemplate(path.Base(filepath), config, loader, CustomEnvironment())
@@ -0,0 +1,111 @@
+package gonja
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	gonja "github.com/sunshine69/sonja/v2"
+	"github.com/sunshine69/sonja/v2/exec"
+)
+
+func TestGonjaFilters(t *testing.T) {
+	data := map[string]any{
+		"text":  "line1\nline2",
+		"name":  "abc",
+		"port":  8080,
+		"conf":  map[string]any{"b": 2, "a": map[string]any{"x": 1}},
+		"items": []any{"a", "b"},
+	}
+	tests := []struct {
+		src, expected string
+	}{
+		{`{{ text | indent(2) }}`, "line1\n  line2"},
+		{`{{ text | indent(width=2, first=True) }}`, "  line1\n  line2"},
+		{`{{ name | wrap }}`, "<span>abc</span>"},
+		{`{{ name | wrap(tag="b", class="x") }}`, `<b class="x">abc</b>`},
+		{`{{ name | reverse_str }}`, "cba"},
+		{`{{ conf | keys | join(",") }}`, "a,b"},
+		{`{{ conf | to_json }}`, `{"a":{"x":1},"b":2}`},
+		{`{{ conf | to_yaml(indent=4) }}`, "a:\n    x: 1\nb: 2\n"},
+		{`{{ "abcdefgh" | b64encode(wrap=4) }}`, "YWJj\nZGVm\nZ2g="},
+		{`{{ "YWJj" | b64decode }}`, "abc"},
+		{`{{ "a-b-c" | regex_replace("-", "_") }}`, "a_b_c"},
+		{`{{ "a-b-c" | regex_replace("-", "_", count=1) }}`, "a_b-c"},
+		{`{{ "ab12" | regex_replace("(?P<l>[a-z]+)(\\d+)", "\\2\\g<l>") }}`, "12ab"},
+		{`{{ "ABC" | regex_replace("b", "x", ignorecase=True) }}`, "AxC"},
+		{`{{ "ver 1.2" | regex_search("(\\d+)\\.(\\d+)") | join(".") }}`, "1.2"},
+		{`{{ items | contains(["a"]) }} {{ items | contains_any(["z", "b"]) }}`, "True True"},
+		{`{{ name is startswith("ab") }} {{ name is startswith("b") }}`, "True False"},
+		{`{{ port is between(1, 9000) }} {{ port is between(1, 80) }}`, "True False"},
+	}
+	for _, tt := range tests {
+		out, err := TemplateStringWithConfig(tt.src, data)
+		if err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+		if out != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.src, tt.expected, out)
+		}
+	}
+
+	for _, src := range []string{
+		`{{ "a" | regex_replace("(", "x") }}`,
+		`{{ "a" | regex_search("[") }}`,
+		`{{ "a" | regex_replace("a") }}`,
+		`{{ "%%%" | b64decode }}`,
+		`{{ items | contains }}`,
+		`{{ port | wrap }}`,
+		`{{ name is between(1) }}`,
+	} {
+		if out, err := TemplateStringWithConfig(src, data); err == nil {
+			t.Errorf("%s: expected an error, got %q", src, out)
+		}
+	}
+}
+
+func TestGonjaDefaultEnvironment(t *testing.T) {
+	CustomEnvironment()
+	tmpl, err := gonja.FromString(`{{ "a\nb" | indent(2) }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the builtin indent of the gonja default environment is kept
+	out, err := tmpl.ExecuteToString(exec.NewContext(nil))
+	if err != nil || out == "a\n  b" {
+		t.Errorf("the default environment should keep its indent, got %q %v", out, err)
+	}
+}
+
+func TestGonjaNow(t *testing.T) {
+	out, err := TemplateStringWithConfig(`{{ now("2006", utc=True) }}`, nil)
+	if err != nil || out != time.Now().UTC().Format("2006") {
+		t.Errorf("unexpected now output %q %v", out, err)
+	}
+	if out, err = TemplateStringWithConfig(`{{ now() }}`, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := time.Parse(time.RFC3339, out); err != nil {
+		t.Errorf("expected a RFC3339 time, got %q", out)
+	}
+	defer func(f func(time.Time, string) string) { Strftime = f }(Strftime)
+	Strftime = func(t time.Time, format string) string { return strings.ReplaceAll(format, "%Y", t.Format("2006")) }
+	if out, err = TemplateStringWithConfig(`{{ now(fmt="y%Y") }}`, nil); err != nil || out != "y"+time.Now().Format("2006") {
+		t.Errorf("unexpected now fmt output %q %v", out, err)
+	}
+}
+
+func TestCompileRegexCache(t *testing.T) {
+	a, err := compileRegex("a+", true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := compileRegex("a+", true, false)
+	if a != b || !a.MatchString("AA") {
+		t.Errorf("expected the cached case insensitive pattern")
+	}
+	if _, err := compileRegex("(", false, false); err == nil {
+		t.Errorf("expected a compile error")
+	}
+}
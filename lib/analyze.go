@@ -0,0 +1,857 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	mj "github.com/mitsuhiko/minijinja/minijinja-go/v2"
+	"github.com/mitsuhiko/minijinja/minijinja-go/v2/syntax"
+	u "github.com/sunshine69/golang-tools/utils"
+)
+
+// Static analysis of jinja2 templates, nothing is rendered. minijinja does not export its parser so this has a
+// small tokenizer of its own; it knows enough of the syntax to tell variables from locals, attributes, filters,
+// tests and function calls.
+
+// TemplateAnalysis is what a template uses. All the lists are sorted.
+type TemplateAnalysis struct {
+	Name string `json:"name"`
+	// Variables are the free variables read, the loop, set, macro, import and with locals excluded
+	Variables []string `json:"variables"`
+	// Optional are the variables and attribute paths guarded somewhere by `is defined`, `is undefined` or
+	// `| default`, like db.port for `db.port | default(5432)`
+	Optional []string `json:"optional,omitempty"`
+	// Attributes are the attribute paths read from the Variables, like db.host
+	Attributes []string `json:"attributes,omitempty"`
+	Filters    []string `json:"filters,omitempty"`
+	Tests      []string `json:"tests,omitempty"`
+	Functions  []string `json:"functions,omitempty"`
+	// Includes are the templates included, imported or extended when given as string literals
+	Includes []string `json:"includes,omitempty"`
+
+	// uses are the reads of the Variables in the order of the template
+	uses []varUse
+}
+
+// varUse is a read of a free variable or attribute path at a line. guard is the length of the path prefix guarded
+// there by `is defined` or `| default`, 0 when the read is not guarded.
+type varUse struct {
+	path  []string
+	line  int
+	guard int
+}
+
+// AnalyzeTemplate analyzes the template file path, honouring its #jinja2: header
+func AnalyzeTemplate(path string) (*TemplateAnalysis, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return AnalyzeTemplateString(path, string(src))
+}
+
+// AnalyzeTemplateString is AnalyzeTemplate of the template text src named name
+func AnalyzeTemplateString(name, src string) (*TemplateAnalysis, error) {
+	_, remain, tc, err := InspectTemplateHeader(src)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return analyzeTemplate(name, remain, tc.Syntax)
+}
+
+// analyzeTemplate is AnalyzeTemplateString of the template body src, its header removed
+func analyzeTemplate(name, src string, cfg syntax.SyntaxConfig) (*TemplateAnalysis, error) {
+	tags, err := splitTemplateTags(src, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	a := &analyzer{scopes: []map[string]bool{{}}, sets: map[string]map[string]bool{}}
+	for _, tag := range tags {
+		toks, err := tokenizeExpr(tag.text)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", name, tag.line, err)
+		}
+		a.line = tag.line
+		if tag.block {
+			a.statement(toks)
+		} else {
+			a.expr(toks)
+		}
+	}
+	for _, use := range a.uses {
+		if use.guard > 0 {
+			a.add("optional", strings.Join(use.path[:use.guard], "."))
+		}
+	}
+	res := &TemplateAnalysis{Name: name, uses: a.uses}
+	for field, dst := range map[string]*[]string{
+		"var": &res.Variables, "optional": &res.Optional, "attr": &res.Attributes, "filter": &res.Filters,
+		"test": &res.Tests, "function": &res.Functions, "include": &res.Includes,
+	} {
+		*dst = sortedKeys(a.sets[field])
+	}
+	return res, nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// templateTag is the content of a {{ }} (block false) or {% %} tag
+type templateTag struct {
+	text  string
+	block bool
+	line  int
+}
+
+// splitTemplateTags returns the variable and block tags of src, skipping comments and raw blocks
+func splitTemplateTags(src string, cfg syntax.SyntaxConfig) ([]templateTag, error) {
+	tags := []templateTag{}
+	pos, inRaw := 0, false
+	lineAt := func(p int) int { return strings.Count(src[:p], "\n") + 1 }
+	for pos < len(src) {
+		// line statements and comments start after optional whitespace at the beginning of a line
+		if cfg.LineStatementPrefix != "" || cfg.LineCommentPrefix != "" {
+			if pos == 0 || src[pos-1] == '\n' {
+				lineEnd := strings.IndexByte(src[pos:], '\n')
+				if lineEnd < 0 {
+					lineEnd = len(src) - pos
+				}
+				line := strings.TrimLeft(src[pos:pos+lineEnd], " \t")
+				if !inRaw && cfg.LineStatementPrefix != "" && strings.HasPrefix(line, cfg.LineStatementPrefix) {
+					tags = append(tags, templateTag{strings.TrimPrefix(line, cfg.LineStatementPrefix), true, lineAt(pos)})
+					pos += lineEnd
+					continue
+				}
+				if !inRaw && cfg.LineCommentPrefix != "" && strings.HasPrefix(line, cfg.LineCommentPrefix) {
+					pos += lineEnd
+					continue
+				}
+			}
+		}
+		next, kind := -1, ""
+		for _, k := range []string{"var", "block", "comment"} {
+			// the longest delimiter wins when two start at the same place
+			if i := strings.Index(src[pos:], startDelim(cfg, k)); i >= 0 && (next < 0 || i < next || i == next && len(startDelim(cfg, k)) > len(startDelim(cfg, kind))) {
+				next, kind = i, k
+			}
+		}
+		if cfg.LineStatementPrefix != "" || cfg.LineCommentPrefix != "" {
+			// stop at the next line to check it for a line statement
+			if nl := strings.IndexByte(src[pos:], '\n'); nl >= 0 && (next < 0 || nl < next) {
+				pos += nl + 1
+				continue
+			}
+		}
+		if next < 0 {
+			break
+		}
+		start := pos + next + len(startDelim(cfg, kind))
+		if kind == "comment" {
+			end := strings.Index(src[start:], cfg.CommentEnd)
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unclosed comment", lineAt(pos+next))
+			}
+			pos = start + end + len(cfg.CommentEnd)
+			continue
+		}
+		endDelim := u.Ternary(kind == "var", cfg.VarEnd, cfg.BlockEnd)
+		end := indexOutsideStrings(src[start:], endDelim)
+		if end < 0 {
+			return nil, fmt.Errorf("line %d: unclosed tag", lineAt(pos+next))
+		}
+		raw := src[start : start+end]
+		text := strings.Trim(raw, "-+ \t\r\n")
+		// the tag line is the one its content starts on
+		textStart := start + len(raw) - len(strings.TrimLeft(raw, "-+ \t\r\n"))
+		pos = start + end + len(endDelim)
+		if kind == "block" {
+			word := strings.SplitN(text, " ", 2)[0]
+			if inRaw {
+				inRaw = word != "endraw"
+				continue
+			}
+			if word == "raw" {
+				inRaw = true
+				continue
+			}
+		} else if inRaw {
+			continue
+		}
+		tags = append(tags, templateTag{text, kind == "block", lineAt(textStart)})
+	}
+	return tags, nil
+}
+
+func startDelim(cfg syntax.SyntaxConfig, kind string) string {
+	switch kind {
+	case "var":
+		return cfg.VarStart
+	case "block":
+		return cfg.BlockStart
+	case "comment":
+		return cfg.CommentStart
+	}
+	return ""
+}
+
+// indexOutsideStrings is strings.Index of delim skipping the quoted strings
+func indexOutsideStrings(s, delim string) int {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quote != 0 && s[i] == '\\':
+			i++
+		case quote != 0 && s[i] == quote:
+			quote = 0
+		case quote != 0:
+		case s[i] == '\'' || s[i] == '"':
+			quote = s[i]
+		case strings.HasPrefix(s[i:], delim):
+			return i
+		}
+	}
+	return -1
+}
+
+type exprToken struct {
+	kind string // name, string, number or op
+	val  string
+	line int // counted from 0, the first line of the tag
+}
+
+// tokenizeExpr splits a tag content into tokens
+func tokenizeExpr(s string) ([]exprToken, error) {
+	toks := []exprToken{}
+	line := 0
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || s[j] >= 'a' && s[j] <= 'z' || s[j] >= 'A' && s[j] <= 'Z' || s[j] >= '0' && s[j] <= '9') {
+				j++
+			}
+			toks = append(toks, exprToken{"name", s[i:j], line})
+			i = j
+		case c >= '0' && c <= '9':
+			j := i + 1
+			for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '.' || s[j] == '_' || s[j] == 'e') {
+				j++
+			}
+			toks = append(toks, exprToken{"number", s[i:j], line})
+			i = j
+		case c == '\'' || c == '"':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(s) && s[j] != c; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				if s[j] == '\n' {
+					line++
+				}
+				sb.WriteByte(s[j])
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			toks = append(toks, exprToken{"string", sb.String(), line})
+			i = j + 1
+		default:
+			op := string(c)
+			for _, two := range []string{"==", "!=", "<=", ">=", "//", "**"} {
+				if strings.HasPrefix(s[i:], two) {
+					op = two
+				}
+			}
+			toks = append(toks, exprToken{"op", op, line})
+			i += len(op)
+		}
+	}
+	return toks, nil
+}
+
+var exprKeywords = map[string]bool{
+	"and": true, "or": true, "not": true, "in": true, "is": true, "if": true, "else": true,
+	"true": true, "false": true, "none": true, "True": true, "False": true, "None": true,
+}
+
+// analyzer walks the tags keeping the scopes of the local names and the paths the enclosing if blocks test defined
+type analyzer struct {
+	scopes []map[string]bool
+	sets   map[string]map[string]bool
+	blocks []guardBlock
+	uses   []varUse
+	line   int // of the tag analyzed
+}
+
+// guardBlock is an open if or for block; active are the paths defined in the current branch of an if, els the
+// ones defined in its else branch
+type guardBlock struct {
+	kind        string
+	active, els [][]string
+}
+
+// definedTest is a path tested by `is [not] defined` or `is [not] undefined`, defined when the test passes only
+// for a defined path
+type definedTest struct {
+	path    []string
+	defined bool
+}
+
+func (a *analyzer) add(set, name string) {
+	if a.sets[set] == nil {
+		a.sets[set] = map[string]bool{}
+	}
+	a.sets[set][name] = true
+}
+
+func (a *analyzer) push(names ...string) {
+	scope := map[string]bool{}
+	for _, n := range names {
+		scope[n] = true
+	}
+	a.scopes = append(a.scopes, scope)
+}
+
+func (a *analyzer) pop() {
+	if len(a.scopes) > 1 {
+		a.scopes = a.scopes[:len(a.scopes)-1]
+	}
+}
+
+func (a *analyzer) declare(names ...string) {
+	for _, n := range names {
+		a.scopes[len(a.scopes)-1][n] = true
+	}
+}
+
+// topBlock returns the innermost open block if it is a kind one
+func (a *analyzer) topBlock(kind string) *guardBlock {
+	if len(a.blocks) == 0 || a.blocks[len(a.blocks)-1].kind != kind {
+		return nil
+	}
+	return &a.blocks[len(a.blocks)-1]
+}
+
+func (a *analyzer) popBlock(kind string) {
+	if a.topBlock(kind) != nil {
+		a.blocks = a.blocks[:len(a.blocks)-1]
+	}
+}
+
+// blockGuards returns the paths the if condition cond defines in the if and else branches from its top level tests
+func blockGuards(cond []exprToken, tests []definedTest) (then, els [][]string) {
+	or, and := indexTop(cond, "or") >= 0, indexTop(cond, "and") >= 0
+	for _, dt := range tests {
+		if dt.defined && !or {
+			then = append(then, dt.path)
+		}
+		if !dt.defined && !and {
+			els = append(els, dt.path)
+		}
+	}
+	return then, els
+}
+
+func (a *analyzer) local(name string) bool {
+	for _, s := range a.scopes {
+		if s[name] {
+			return true
+		}
+	}
+	return name == "self" || name == "super"
+}
+
+// indexTop returns the index of the first name token word outside of brackets, -1 if there is none
+func indexTop(toks []exprToken, words ...string) int {
+	depth := 0
+	for i, t := range toks {
+		if t.kind == "op" {
+			switch t.val {
+			case "(", "[", "{":
+				depth++
+			case ")", "]", "}":
+				depth--
+			}
+		}
+		if depth == 0 && (t.kind == "name" || t.kind == "op") && containsStr(words, t.val) {
+			return i
+		}
+	}
+	return -1
+}
+
+// names returns the name tokens of a target list like `a, b`
+func names(toks []exprToken) []string {
+	out := []string{}
+	for _, t := range toks {
+		if t.kind == "name" {
+			out = append(out, t.val)
+		}
+	}
+	return out
+}
+
+// statement analyzes a {% %} tag
+func (a *analyzer) statement(toks []exprToken) {
+	if len(toks) == 0 {
+		return
+	}
+	kw, rest := toks[0].val, toks[1:]
+	switch kw {
+	case "for":
+		in := indexTop(rest, "in")
+		if in < 0 {
+			a.expr(rest)
+			return
+		}
+		iter := rest[in+1:]
+		cond := []exprToken{}
+		if i := indexTop(iter, "if"); i >= 0 {
+			iter, cond = iter[:i], iter[i+1:]
+		}
+		if i := indexTop(iter, "recursive"); i >= 0 {
+			iter = iter[:i]
+		}
+		a.expr(iter)
+		a.push(append(names(rest[:in]), "loop")...)
+		a.blocks = append(a.blocks, guardBlock{kind: "for"})
+		a.expr(cond)
+	case "if":
+		then, els := blockGuards(rest, a.expr(rest))
+		a.blocks = append(a.blocks, guardBlock{kind: "if", active: then, els: els})
+	case "elif":
+		b := a.topBlock("if")
+		if b == nil {
+			a.expr(rest)
+			return
+		}
+		// the previous conditions are false here
+		b.active = b.els
+		then, els := blockGuards(rest, a.expr(rest))
+		b.active = append(b.els[:len(b.els):len(b.els)], then...)
+		b.els = append(b.els, els...)
+	case "else":
+		if b := a.topBlock("if"); b != nil {
+			b.active = b.els
+		}
+	case "endif":
+		a.popBlock("if")
+	case "do", "autoescape":
+		a.expr(rest)
+	case "set":
+		eq := indexTop(rest, "=")
+		target := rest
+		if eq >= 0 {
+			target = rest[:eq]
+			a.expr(rest[eq+1:])
+		} else if i := indexTop(rest, "|"); i >= 0 {
+			// block set with a filter
+			target = rest[:i]
+			a.expr(rest[i:])
+		}
+		if len(target) > 1 && target[1].val == "." {
+			// set ns.attr = ..., ns is read
+			a.expr(target[:1])
+			return
+		}
+		a.declare(names(target)...)
+	case "macro", "call":
+		body := rest
+		params := []string{}
+		if kw == "call" && len(rest) > 0 && rest[0].val == "(" {
+			end := indexTop(rest, ")")
+			if end < 0 {
+				end = len(rest)
+			}
+			params = a.params(rest[1:end])
+			body = rest[min(end+1, len(rest)):]
+		}
+		if kw == "macro" {
+			if len(body) == 0 {
+				return
+			}
+			a.declare(body[0].val)
+			if len(body) > 1 && body[1].val == "(" {
+				end := len(body)
+				if e := indexTop(body[1:], ")"); e >= 0 {
+					end = e + 1
+				}
+				params = a.params(body[2:end])
+			}
+			a.push(append(params, "varargs", "kwargs", "caller")...)
+			return
+		}
+		a.expr(body)
+		a.push(params...)
+	case "filter":
+		for i, t := range rest {
+			if t.kind == "name" && (i == 0 || rest[i-1].val == "|") {
+				a.add("filter", t.val)
+			}
+		}
+		a.push()
+	case "with":
+		a.push()
+		for _, part := range splitTop(rest, ",") {
+			if eq := indexTop(part, "="); eq >= 0 {
+				a.expr(part[eq+1:])
+				a.declare(names(part[:eq])...)
+			}
+		}
+	case "block":
+		a.push()
+	case "include", "extends":
+		a.templateRefs(rest)
+	case "import":
+		as := indexTop(rest, "as")
+		if as < 0 {
+			a.templateRefs(rest)
+			return
+		}
+		a.templateRefs(rest[:as])
+		a.declare(names(rest[as+1 : as+2])...)
+	case "from":
+		imp := indexTop(rest, "import")
+		if imp < 0 {
+			a.templateRefs(rest)
+			return
+		}
+		a.templateRefs(rest[:imp])
+		imported := rest[imp+1:]
+		if w := indexTop(imported, "with", "without"); w >= 0 {
+			imported = imported[:w]
+		}
+		for _, part := range splitTop(imported, ",") {
+			if len(part) > 0 {
+				a.declare(part[len(part)-1].val)
+			}
+		}
+	case "endfor":
+		a.pop()
+		a.popBlock("for")
+	case "endmacro", "endcall", "endfilter", "endwith", "endblock":
+		a.pop()
+	case "endset", "endautoescape", "break", "continue", "raw", "endraw":
+	default:
+		a.expr(rest)
+	}
+}
+
+// params declares nothing but returns the macro parameter names, the default values are analyzed
+func (a *analyzer) params(toks []exprToken) []string {
+	out := []string{}
+	for _, part := range splitTop(toks, ",") {
+		if len(part) == 0 {
+			continue
+		}
+		out = append(out, part[0].val)
+		if eq := indexTop(part, "="); eq >= 0 {
+			a.expr(part[eq+1:])
+		}
+	}
+	return out
+}
+
+// templateRefs records the string literals of an include, import or extends and analyzes the other names
+func (a *analyzer) templateRefs(toks []exprToken) {
+	for i := 0; i < len(toks); i++ {
+		switch t := toks[i]; {
+		case t.kind == "string":
+			a.add("include", t.val)
+		case t.kind == "name" && containsStr([]string{"ignore", "missing", "with", "without", "context"}, t.val):
+			toks = append(toks[:i:i], toks[i+1:]...)
+			i--
+		}
+	}
+	a.expr(toks)
+}
+
+// splitTop splits toks on the top level sep
+func splitTop(toks []exprToken, sep string) [][]exprToken {
+	parts := [][]exprToken{}
+	for {
+		i := indexTop(toks, sep)
+		if i < 0 {
+			return append(parts, toks)
+		}
+		parts = append(parts, toks[:i])
+		toks = toks[i+1:]
+	}
+}
+
+// expr analyzes an expression and returns its top level `is defined` tests. A use is guarded by the enclosing if
+// blocks, the tests of the expression and a `| default` right after it.
+func (a *analyzer) expr(toks []exprToken) []definedTest {
+	depth := 0
+	uses, tests, top := []varUse{}, []definedTest{}, []definedTest{}
+	for i := 0; i < len(toks); i++ {
+		t := toks[i]
+		if t.kind == "op" {
+			switch t.val {
+			case "(", "[", "{":
+				depth++
+			case ")", "]", "}":
+				depth--
+			}
+			continue
+		}
+		if t.kind != "name" {
+			continue
+		}
+		prev := ""
+		if i > 0 {
+			prev = toks[i-1].val
+		}
+		next := ""
+		if i+1 < len(toks) {
+			next = toks[i+1].val
+		}
+		switch {
+		case prev == ".":
+			continue
+		case prev == "|":
+			a.add("filter", t.val)
+			continue
+		case prev == "is" || prev == "not" && i > 1 && toks[i-2].val == "is":
+			a.add("test", t.val)
+			continue
+		case exprKeywords[t.val]:
+			continue
+		case next == "=" && depth > 0:
+			// keyword argument
+			continue
+		case next == "(":
+			if !a.local(t.val) {
+				a.add("function", t.val)
+			}
+			continue
+		case a.local(t.val):
+			continue
+		}
+		// a free variable and its attribute path
+		a.add("var", t.val)
+		path := []string{t.val}
+		j := i + 1
+		for j+1 < len(toks) {
+			if toks[j].val == "." && toks[j+1].kind == "name" {
+				path = append(path, toks[j+1].val)
+				j += 2
+			} else if toks[j].val == "[" && toks[j+1].kind == "string" && j+2 < len(toks) && toks[j+2].val == "]" {
+				path = append(path, toks[j+1].val)
+				j += 3
+			} else {
+				break
+			}
+		}
+		if j < len(toks) && toks[j].val == "(" && len(path) > 1 {
+			// a method call
+			path = path[:len(path)-1]
+		}
+		if len(path) > 1 {
+			a.add("attr", strings.Join(path, "."))
+		}
+		use := varUse{path: path, line: a.line + t.line}
+		rest := toks[j:]
+		if len(rest) > 1 && rest[0].val == "is" {
+			test, negated := rest[1].val, false
+			if test == "not" && len(rest) > 2 {
+				test, negated = rest[2].val, true
+			}
+			if test == "defined" || test == "undefined" {
+				// a `not` before the path negates the test too
+				dt := definedTest{path, (test == "defined") != negated != (prev == "not")}
+				tests = append(tests, dt)
+				if depth == 0 {
+					top = append(top, dt)
+				}
+			}
+		}
+		if len(rest) > 1 && rest[0].val == "|" && (rest[1].val == "default" || rest[1].val == "d") {
+			use.guard = len(path)
+		}
+		uses = append(uses, use)
+		i = j - 1
+	}
+	guards := [][]string{}
+	for _, b := range a.blocks {
+		guards = append(guards, b.active...)
+	}
+	for _, dt := range tests {
+		guards = append(guards, dt.path)
+	}
+	for _, use := range uses {
+		for _, g := range guards {
+			if len(g) <= len(use.path) && strings.Join(g, ".") == strings.Join(use.path[:len(g)], ".") && (use.guard == 0 || len(g) < use.guard) {
+				use.guard = len(g)
+			}
+		}
+		a.uses = append(a.uses, use)
+	}
+	return top
+}
+
+// TemplateCheck is the problems CheckTemplatesAgainstHost found in a template
+type TemplateCheck struct {
+	Template         string   `json:"template"`
+	Error            string   `json:"error,omitempty"`
+	MissingVars      []string `json:"missing_vars,omitempty"`
+	UnknownFilters   []string `json:"unknown_filters,omitempty"`
+	UnknownTests     []string `json:"unknown_tests,omitempty"`
+	UnknownFunctions []string `json:"unknown_functions,omitempty"`
+}
+
+// CheckTemplatesAgainstHost analyzes every template file (.j2, .jinja and .jinja2) under dir and returns the ones using variables or
+// attribute paths the inventory host does not have (the Optional ones excepted), or filters, tests and functions the
+// jinja2 environment does not have. The host vars are the ones a playbook gives, inventory_hostname and group_names
+// included.
+func CheckTemplatesAgainstHost(dir string, inv *Inventory, host string) ([]TemplateCheck, error) {
+	h, ok := inv.Hosts[host]
+	if !ok {
+		return nil, fmt.Errorf("host %s is not in the inventory", host)
+	}
+	vars := map[string]any{}
+	for k, v := range h.Vars {
+		vars[k] = v
+	}
+	vars["inventory_hostname"] = host
+	vars["group_names"] = h.Groups
+	vars["playbook_dir"] = dir
+
+	probe := newEnvProbe(NewJinjaEnvironment(nil, nil))
+
+	checks := []TemplateCheck{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !containsStr(templateExtensions, filepath.Ext(path)) {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		check := TemplateCheck{Template: filepath.ToSlash(rel)}
+		ta, err := AnalyzeTemplate(path)
+		if err != nil {
+			check.Error = err.Error()
+			checks = append(checks, check)
+			return nil
+		}
+		check.MissingVars = ta.missingVars(vars)
+		for _, f := range ta.Filters {
+			if !probe.filter(f) {
+				check.UnknownFilters = append(check.UnknownFilters, f)
+			}
+		}
+		for _, t := range ta.Tests {
+			if !probe.test(t) {
+				check.UnknownTests = append(check.UnknownTests, t)
+			}
+		}
+		for _, f := range ta.Functions {
+			if !probe.function(f) {
+				check.UnknownFunctions = append(check.UnknownFunctions, f)
+			}
+		}
+		if len(check.MissingVars)+len(check.UnknownFilters)+len(check.UnknownTests)+len(check.UnknownFunctions) > 0 {
+			checks = append(checks, check)
+		}
+		return nil
+	})
+	return checks, err
+}
+
+// missingVars returns the variables and attribute paths of missing
+func (ta *TemplateAnalysis) missingVars(vars map[string]any) []string {
+	var names []string
+	for _, use := range ta.missing(vars) {
+		names = append(names, strings.Join(use.path, "."))
+	}
+	return names
+}
+
+// missing returns the first unguarded use of each variable or attribute path not in vars, its path cut after the
+// missing name. The variables come first, then the attribute paths, each sorted.
+func (ta *TemplateAnalysis) missing(vars map[string]any) []varUse {
+	found := map[string]varUse{}
+	for _, use := range ta.uses {
+		cur := any(vars)
+		for i, part := range use.path {
+			m, ok := cur.(map[string]any)
+			if !ok {
+				// not a map, maybe a method or an item of a list, not checked
+				break
+			}
+			if cur, ok = m[part]; ok {
+				continue
+			}
+			// the guarded prefix may be missing, what is before it may not
+			key := strings.Join(use.path[:i+1], ".")
+			if _, seen := found[key]; !seen && (use.guard == 0 || i+1 < use.guard) {
+				found[key] = varUse{path: use.path[:i+1], line: use.line}
+			}
+			break
+		}
+	}
+	keys := make([]string, 0, len(found))
+	for k := range found {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ai, aj := strings.Contains(keys[i], "."), strings.Contains(keys[j], ".")
+		return u.Ternary(ai == aj, keys[i] < keys[j], !ai)
+	})
+	out := make([]varUse, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, found[k])
+	}
+	return out
+}
+
+// envProbe tells if a minijinja environment has a filter, test or function by rendering a template using it, the
+// answers are cached
+type envProbe struct {
+	env   *mj.Environment
+	known map[string]bool
+}
+
+func newEnvProbe(env *mj.Environment) *envProbe {
+	return &envProbe{env: env, known: map[string]bool{}}
+}
+
+func (p *envProbe) probe(src string, unknown mj.ErrorKind) bool {
+	if v, ok := p.known[src]; ok {
+		return v
+	}
+	tmpl, err := p.env.TemplateFromString(src)
+	out := ""
+	if err == nil {
+		out, err = tmpl.Render(map[string]any{"x": ""})
+	}
+	var me *mj.Error
+	p.known[src] = u.Ternary(unknown == mj.ErrUnknownFunction, out == "true", !errors.As(err, &me) || me.Kind != unknown)
+	return p.known[src]
+}
+
+func (p *envProbe) filter(name string) bool {
+	return p.probe("{{ x | "+name+" }}", mj.ErrUnknownFilter)
+}
+
+func (p *envProbe) test(name string) bool { return p.probe("{{ x is "+name+" }}", mj.ErrUnknownTest) }
+
+func (p *envProbe) function(name string) bool {
+	return p.probe("{{ "+name+" is defined }}", mj.ErrUnknownFunction)
+}
@@ -0,0 +1,94 @@
+package lib
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAnalyzeTemplate(t *testing.T) {
+	src := `{% extends "base.j2" %}{% import 'macros.j2' as m %}{% from "forms.j2" import input as field, label %}
+{# {{ in_comment }} #}{% raw %}{{ in_raw }}{% endraw %}
+{% set port = db.port | default(5432) %}{{ db.host }}:{{ port }} {{ db['name'] | upper }}
+{% for user, cfg in users.items() if cfg.enabled %}{{ loop.index }} {{ user }} {{ cfg.shell | default(default_shell) }} {{ m.row(user, width=cols) }}{% endfor %}
+{% if proxy is defined and proxy %}{{ proxy }}{% endif %}{{ user }}
+{% macro greet(name, greeting=salutation) %}{{ greeting }} {{ name }} {{ caller() }}{% endmacro %}
+{% call greet('x') %}{{ field('a') }} {{ label }}{% endcall %}
+{{ now(fmt='%Y') }} {{ "a{{b}}" ~ lookup('env', 'HOME') | regex_replace('a', 'b') }} {{ items | map('upper') | join(',') }}
+{% with w = width %}{{ w }}{% endwith %}{{ w2 is number }}{% include ['extra.j2', 'default.j2'] ignore missing %}`
+	ta, err := AnalyzeTemplateString("t.j2", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &TemplateAnalysis{
+		Name:       "t.j2",
+		Variables:  []string{"cols", "db", "default_shell", "items", "proxy", "salutation", "user", "users", "w2", "width"},
+		Optional:   []string{"db.port", "proxy"},
+		Attributes: []string{"db.host", "db.name", "db.port"},
+		Filters:    []string{"default", "join", "map", "regex_replace", "upper"},
+		Tests:      []string{"defined", "number"},
+		Functions:  []string{"lookup", "now"},
+		Includes:   []string{"base.j2", "default.j2", "extra.j2", "forms.j2", "macros.j2"},
+	}
+	ta.uses = nil
+	if !reflect.DeepEqual(ta, expected) {
+		t.Errorf("expected\n%+v\ngot\n%+v", expected, ta)
+	}
+
+	// the guards are per use: a default on db.port needs db, an if guards its branch only
+	ta, err = AnalyzeTemplateString("g.j2", `{{ db.port | default(5432) }} {% if x is defined %}{{ x }}{% else %}{{ y }}{% endif %}
+{% if z is not defined %}{{ y | d(1) }}{% elif w is undefined %}{{ z }}{% else %}{{ z.a }} {{ w }}{% endif %}
+{{ x }} {{ v if v is defined }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ta.Optional, []string{"db.port", "v", "w", "x", "y", "z"}) {
+		t.Errorf("unexpected optional %v", ta.Optional)
+	}
+	missing := []string{}
+	for _, use := range ta.missing(map[string]any{}) {
+		missing = append(missing, fmt.Sprintf("%s@%d", strings.Join(use.path, "."), use.line))
+	}
+	if !reflect.DeepEqual(missing, []string{"db@1", "x@3", "y@1"}) {
+		t.Errorf("unexpected missing %v", missing)
+	}
+	if m := ta.missingVars(map[string]any{"db": map[string]any{}, "x": 1, "y": 2}); len(m) != 0 {
+		t.Errorf("unexpected missing %v", m)
+	}
+
+	// the header delimiters and line statements are honoured
+	ta, err = AnalyzeTemplateString("h.j2", "#jinja2: variable_start_string: '[[', variable_end_string: ']]', line_statement_prefix: '%%'\n%% for i in list\n[[ i ]] {{ not_a_var }}\n%% endfor\n")
+	if err != nil || !reflect.DeepEqual(ta.Variables, []string{"list"}) {
+		t.Errorf("unexpected header analysis %+v %v", ta, err)
+	}
+	if _, err := AnalyzeTemplateString("bad.j2", "{{ x "); err == nil {
+		t.Errorf("expected an unclosed tag error")
+	}
+
+	tempDir := t.TempDir()
+	writeFiles(t, tempDir, map[string]string{
+		"ok.j2":       "{{ inventory_hostname }} {{ db.host }} {{ opt | default(1) }}",
+		"missing.j2":  "{{ db.port }} {{ nope }} {{ db.host.x }} {{ db.host | no_such_filter }} {{ db.host is no_such_test }} {{ no_such_func() }} {{ now() }}",
+		"sub/bad.j2":  "{% if %}{{ 'x }}",
+		"sub/good.j2": "{% for g in group_names %}{{ g | upper }}{% endfor %}",
+		"notes.txt":   "{{ not_a_template }}",
+	})
+	inv := NewInventory("")
+	inv.AddHost("web1").Vars["db"] = map[string]any{"host": "db1"}
+	checks, err := CheckTemplatesAgainstHost(tempDir, inv, "web1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(checks) != 2 || checks[0].Template != "missing.j2" || checks[1].Template != "sub/bad.j2" || checks[1].Error == "" {
+		t.Fatalf("unexpected checks %+v", checks)
+	}
+	c := checks[0]
+	if !reflect.DeepEqual(c.MissingVars, []string{"nope", "db.port"}) || !reflect.DeepEqual(c.UnknownFilters, []string{"no_such_filter"}) ||
+		!reflect.DeepEqual(c.UnknownTests, []string{"no_such_test"}) || !reflect.DeepEqual(c.UnknownFunctions, []string{"no_such_func"}) {
+		t.Errorf("unexpected check %+v", c)
+	}
+	if _, err := CheckTemplatesAgainstHost(tempDir, inv, "web2"); err == nil {
+		t.Errorf("expected an unknown host error")
+	}
+}
@@ -22,6 +22,8 @@ package lib
 // in my test last time
 
 import (
+	"fmt"
+
 	"github.com/sunshine69/golang-tools/utils"
 
 	"testing"
@@ -227,3 +229,21 @@ func BenchmarkGonjaWithFunctions(b *testing.B) {
 		_ = gonja.TemplateString(tmpl, complexData)
 	}
 }
+
+// BenchmarkFlattenAllVars benchmarks flattening the vars of a host, the templates are compiled once by the cache
+func BenchmarkFlattenAllVars(b *testing.B) {
+	vars := map[string]any{"domain": "example.com", "env": "prod"}
+	for i := 0; i < 50; i++ {
+		vars[fmt.Sprintf("host_%d", i)] = fmt.Sprintf("web%d.{{ env }}.{{ domain }}", i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data := make(map[string]any, len(vars))
+		for k, v := range vars {
+			data[k] = v
+		}
+		if _, err := FlattenAllVars(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	u "github.com/sunshine69/golang-tools/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// ConformanceCase is one template of a conformance corpus, see LoadConformanceCorpus
+type ConformanceCase struct {
+	// Name is the slash separated template path relative to the corpus dir
+	Name string         `json:"name"`
+	Path string         `json:"path"`
+	Data map[string]any `json:"-"`
+	// Expected is the expected output per engine, the "" key is the one of all engines
+	Expected map[string]string `json:"-"`
+	Engines  []string          `json:"engines"`
+	// Filters are the filters the template uses, to group the differences by filter
+	Filters []string `json:"filters,omitempty"`
+}
+
+// ConformanceResult is the output of one case with one engine
+type ConformanceResult struct {
+	Case   string `json:"case"`
+	Engine string `json:"engine"`
+	Pass   bool   `json:"pass"`
+	Error  string `json:"error,omitempty"`
+	// Diff is the unified diff from the expected output to the rendered one
+	Diff    string   `json:"diff,omitempty"`
+	Filters []string `json:"filters,omitempty"`
+}
+
+// FilterConformance counts the cases using a filter passing and failing with an engine
+type FilterConformance struct {
+	Filter string   `json:"filter"`
+	Engine string   `json:"engine"`
+	Passed int      `json:"passed"`
+	Failed []string `json:"failed,omitempty"`
+}
+
+// ConformanceReport is the result of RunConformance
+type ConformanceReport struct {
+	Results []ConformanceResult `json:"results"`
+	// Filters are sorted by filter and engine
+	Filters []FilterConformance `json:"filters"`
+}
+
+// LoadConformanceCorpus reads the conformance cases of dir. The .j2 files are rendered with minijinja and gonja, the
+// .go.tmpl and .gotmpl ones with gotemplate, and a file having an engine: in its #jinja2: header only with that
+// engine. For the template x.j2 (or x.go.tmpl):
+//
+//	x.txt          the expected output
+//	x.<engine>.txt the expected output of one engine when it differs on purpose, e.g. x.gonja.txt
+//	x.yaml         the data, merged over the data.yaml of the corpus dir
+func LoadConformanceCorpus(dir string) ([]ConformanceCase, error) {
+	shared := map[string]any{}
+	if err := readYamlData(filepath.Join(dir, "data.yaml"), shared); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	cases := []ConformanceCase{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		ext := filepath.Ext(p)
+		if ext != ".j2" && !isGoTemplateName(p) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		src, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		c := ConformanceCase{Name: filepath.ToSlash(rel), Path: p, Data: map[string]any{}, Expected: map[string]string{}}
+		_, _, tc, err := InspectTemplateHeader(string(src))
+		if err != nil {
+			return headerError(p, string(src), err)
+		}
+		switch {
+		case tc.Engine != "":
+			c.Engines = []string{tc.Engine}
+		case isGoTemplateName(p):
+			c.Engines = []string{EngineGoTemplate}
+		default:
+			c.Engines = []string{EngineMinijinja, EngineGonja}
+			if a, err := AnalyzeTemplateString(p, string(src)); err == nil {
+				c.Filters = a.Filters
+			}
+		}
+		base := strings.TrimSuffix(p, ext)
+		for _, engine := range append([]string{""}, c.Engines...) {
+			name := base + u.Ternary(engine == "", "", "."+engine) + ".txt"
+			if b, err := os.ReadFile(name); err == nil {
+				c.Expected[engine] = string(b)
+			} else if !os.IsNotExist(err) {
+				return err
+			}
+		}
+		for _, engine := range c.Engines {
+			if _, ok := c.Expected[engine]; !ok {
+				if _, ok := c.Expected[""]; !ok {
+					return fmt.Errorf("%s: no expected output %s.txt", p, filepath.Base(base))
+				}
+			}
+		}
+		for k, v := range shared {
+			c.Data[k] = v
+		}
+		if err := readYamlData(base+".yaml", c.Data); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		cases = append(cases, c)
+		return nil
+	})
+	return cases, err
+}
+
+// readYamlData merges the yaml map of the file p into data
+func readYamlData(p string, data map[string]any) error {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	m := map[string]any{}
+	if err := yaml.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	for k, v := range m {
+		data[k] = v
+	}
+	return nil
+}
+
+// RunConformance renders every case with its engines, only the ones in engines if given, and compares the outputs to
+// the expected ones.
+func RunConformance(cases []ConformanceCase, engines ...string) ConformanceReport {
+	report := ConformanceReport{Results: []ConformanceResult{}}
+	filters := map[[2]string]*FilterConformance{}
+	for _, c := range cases {
+		for _, engine := range c.Engines {
+			if len(engines) > 0 && !containsStr(engines, engine) {
+				continue
+			}
+			res := c.run(engine)
+			report.Results = append(report.Results, res)
+			for _, f := range c.Filters {
+				fc, ok := filters[[2]string{f, engine}]
+				if !ok {
+					fc = &FilterConformance{Filter: f, Engine: engine}
+					filters[[2]string{f, engine}] = fc
+				}
+				if res.Pass {
+					fc.Passed++
+				} else {
+					fc.Failed = append(fc.Failed, c.Name)
+				}
+			}
+		}
+	}
+	for _, fc := range filters {
+		report.Filters = append(report.Filters, *fc)
+	}
+	sort.Slice(report.Filters, func(i, j int) bool {
+		a, b := report.Filters[i], report.Filters[j]
+		return a.Filter < b.Filter || a.Filter == b.Filter && a.Engine < b.Engine
+	})
+	return report
+}
+
+func (c ConformanceCase) run(engine string) ConformanceResult {
+	res := ConformanceResult{Case: c.Name, Engine: engine, Filters: c.Filters}
+	r, err := NewRenderer(engine)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	var buf bytes.Buffer
+	if err := r.RenderToWriter(&buf, c.Path, c.Data); err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	expected, ok := c.Expected[engine]
+	if !ok {
+		expected = c.Expected[""]
+	}
+	if buf.String() == expected {
+		res.Pass = true
+	} else {
+		res.Diff = UnifiedDiff(expected, buf.String(), "expected", engine, 2)
+	}
+	return res
+}
+
+// Failed returns the failed results of engine, of all engines if empty
+func (r ConformanceReport) Failed(engine string) []ConformanceResult {
+	out := []ConformanceResult{}
+	for _, res := range r.Results {
+		if !res.Pass && (engine == "" || res.Engine == engine) {
+			out = append(out, res)
+		}
+	}
+	return out
+}
+
+// String is a text summary: the pass count per engine, the failed cases and the filters having failures
+func (r ConformanceReport) String() string {
+	var sb strings.Builder
+	counts := map[string][2]int{}
+	for _, res := range r.Results {
+		n := counts[res.Engine]
+		n[u.Ternary(res.Pass, 0, 1)]++
+		counts[res.Engine] = n
+	}
+	for _, engine := range Engines {
+		if n, ok := counts[engine]; ok {
+			fmt.Fprintf(&sb, "%s: %d passed, %d failed\n", engine, n[0], n[1])
+		}
+	}
+	for _, res := range r.Failed("") {
+		fmt.Fprintf(&sb, "FAIL %s [%s]", res.Case, res.Engine)
+		if res.Error != "" {
+			fmt.Fprintf(&sb, ": %s\n", res.Error)
+		} else {
+			fmt.Fprintf(&sb, "\n%s", res.Diff)
+		}
+	}
+	for _, fc := range r.Filters {
+		if len(fc.Failed) > 0 {
+			fmt.Fprintf(&sb, "filter %s [%s]: %d passed, failed in %s\n", fc.Filter, fc.Engine, fc.Passed, strings.Join(fc.Failed, ", "))
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,45 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestConformance renders the corpus of testdata/conformance. minijinja and gotemplate must match, gonja must
+// match the filters cases, its whitespace differences are only logged.
+func TestConformance(t *testing.T) {
+	cases, err := LoadConformanceCorpus("testdata/conformance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := RunConformance(cases)
+	for _, res := range report.Failed("") {
+		if res.Engine != EngineGonja || strings.HasPrefix(res.Case, "filters/") {
+			t.Errorf("%s [%s]: %s%s", res.Case, res.Engine, res.Error, res.Diff)
+		}
+	}
+	t.Logf("conformance report:\n%s", report)
+
+	passed := map[[2]string]bool{}
+	for _, fc := range report.Filters {
+		passed[[2]string{fc.Filter, fc.Engine}] = fc.Passed > 0
+	}
+	for _, f := range []string{"to_json", "indent", "keys", "reverse_str", "b64encode", "regex_replace"} {
+		if !passed[[2]string{f, EngineGonja}] {
+			t.Errorf("expected a passing %s case with gonja", f)
+		}
+	}
+
+	if _, err := LoadConformanceCorpus(filepath.Join(t.TempDir(), "nope")); err == nil {
+		t.Errorf("expected a missing dir error")
+	}
+	tempDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tempDir, "a.j2"), []byte("{{ x }}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConformanceCorpus(tempDir); err == nil {
+		t.Errorf("expected a missing expected output error")
+	}
+}
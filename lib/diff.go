@@ -0,0 +1,325 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	u "github.com/sunshine69/golang-tools/utils"
+	"gopkg.in/ini.v1"
+)
+
+// Check and diff mode. The *Check variants of the file changing helpers compute the would-be content and return a
+// FileChange with a unified diff but write nothing, so a run can be reviewed before it touches production hosts.
+
+// FileChange is what a file changing operation did, or in check mode would do, to a file
+type FileChange struct {
+	Path    string `json:"path"`
+	Changed bool   `json:"changed"`
+	Diff    string `json:"diff,omitempty"`
+}
+
+// NewFileChange compares the before and after content of path. A nil before means the file does not exist.
+func NewFileChange(path string, before, after []byte) FileChange {
+	fc := FileChange{Path: path, Changed: before == nil || !bytes.Equal(before, after)}
+	if fc.Changed {
+		fromName := "a/" + strings.TrimPrefix(path, "/")
+		if before == nil {
+			fromName = "/dev/null"
+		}
+		fc.Diff = UnifiedDiff(string(before), string(after), fromName, "b/"+strings.TrimPrefix(path, "/"), 3)
+	}
+	return fc
+}
+
+// diffOp is one line of an edit script; kind is ' ', '-' or '+'
+type diffOp struct {
+	kind byte
+	line string
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// myersDiff returns the shortest edit script turning a into b (Myers O(ND) algorithm)
+func myersDiff(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	max := n + m
+	if max == 0 {
+		return nil
+	}
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	trace := [][]int{}
+	found := false
+	for d := 0; d <= max && !found; d++ {
+		vc := make([]int, len(v))
+		copy(vc, v)
+		trace = append(trace, vc)
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+	// backtrack. trace[d] holds v before step d
+	ops := []diffOp{}
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		vd := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && vd[offset+k-1] < vd[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := vd[offset+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x, y = x-1, y-1
+			ops = append(ops, diffOp{' ', a[x]})
+		}
+		if x == prevX {
+			y--
+			ops = append(ops, diffOp{'+', b[y]})
+		} else {
+			x--
+			ops = append(ops, diffOp{'-', a[x]})
+		}
+	}
+	for x > 0 && y > 0 {
+		x, y = x-1, y-1
+		ops = append(ops, diffOp{' ', a[x]})
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// UnifiedDiff returns the unified diff (like `diff -u`) between two texts with context lines around each change.
+// It returns an empty string if the texts are equal.
+func UnifiedDiff(before, after, fromName, toName string, context int) string {
+	if before == after {
+		return ""
+	}
+	ops := myersDiff(splitLines(before), splitLines(after))
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+
+	// line numbers (1 based) of each op in a and b
+	aLine, bLine := make([]int, len(ops)), make([]int, len(ops))
+	ai, bi := 1, 1
+	for i, op := range ops {
+		aLine[i], bLine[i] = ai, bi
+		if op.kind != '+' {
+			ai++
+		}
+		if op.kind != '-' {
+			bi++
+		}
+	}
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		start := max(i-context, 0)
+		// extend the hunk while the next change is within 2*context equal lines
+		end := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].kind != ' ' {
+				end = j
+			} else if j-end > 2*context {
+				break
+			}
+		}
+		end = min(end+context, len(ops)-1)
+		aCount, bCount := 0, 0
+		for _, op := range ops[start : end+1] {
+			if op.kind != '+' {
+				aCount++
+			}
+			if op.kind != '-' {
+				bCount++
+			}
+		}
+		aStart, bStart := aLine[start], bLine[start]
+		if aCount == 0 {
+			aStart--
+		}
+		if bCount == 0 {
+			bStart--
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", aStart, aCount, bStart, bCount)
+		for _, op := range ops[start : end+1] {
+			out.WriteByte(op.kind)
+			out.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = end + 1
+	}
+	return out.String()
+}
+
+// renderTemplateFile renders the src template file the same way TemplateFile does but returns the content, mode is
+// the undefined mode, JINJA2_UNDEFINED if empty
+func renderTemplateFile(src string, data map[string]any, mode string) (string, error) {
+	ct, err := DefaultTemplateCache.File(src)
+	if err != nil {
+		return "", err
+	}
+	return ct.Render(data, mode)
+}
+
+// readExisting returns the file content or nil if the file does not exist
+func readExisting(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// TemplateFileCheck is the check mode of TemplateFile. Nothing is written.
+func TemplateFileCheck(src, dest string, data map[string]any) (FileChange, error) {
+	return templateChange(NewTemplateEnv(TemplateSearchPath(src)...), filepath.Base(src), dest, data)
+}
+
+// templateChange renders the template name of te and compares it with dest
+func templateChange(te *TemplateEnv, name, dest string, data map[string]any) (FileChange, error) {
+	out, err := te.Render(name, data)
+	if err != nil {
+		return FileChange{Path: dest}, err
+	}
+	before, err := readExisting(dest)
+	if err != nil {
+		return FileChange{Path: dest}, err
+	}
+	return NewFileChange(dest, before, []byte(out)), nil
+}
+
+// TemplateDirTreeCheck is the check mode of TemplateDirTree, returning the changes of every file in the tree
+func TemplateDirTreeCheck(srcDirpath, targetRoot string, tmplData map[string]any) ([]FileChange, error) {
+	changes := []FileChange{}
+	te := NewTemplateEnv(TemplateSearchPath(filepath.Join(srcDirpath, "_"))...)
+	err := filepath.Walk(srcDirpath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(srcDirpath, path)
+		if err != nil {
+			return err
+		}
+		fc, err := templateChange(te, filepath.ToSlash(relPath), filepath.Join(targetRoot, relPath), tmplData)
+		if err != nil {
+			return fmt.Errorf("template %s: %w", path, err)
+		}
+		changes = append(changes, fc)
+		return nil
+	})
+	return changes, err
+}
+
+// IniSetValCheck is the check mode of IniSetVal
+func IniSetValCheck(inifilepath, section, option, value string) (FileChange, error) {
+	before, err := readExisting(inifilepath)
+	if err != nil {
+		return FileChange{Path: inifilepath}, err
+	}
+	cfg := ini.Empty()
+	if before != nil {
+		if cfg, err = ini.Load(before); err != nil {
+			return FileChange{Path: inifilepath}, err
+		}
+	}
+	cfg.Section(section).Key(option).SetValue(value)
+	var buf bytes.Buffer
+	if _, err := cfg.WriteToIndent(&buf, "  "); err != nil {
+		return FileChange{Path: inifilepath}, err
+	}
+	return NewFileChange(inifilepath, before, buf.Bytes()), nil
+}
+
+// GoTemplateCheck is the check mode of GoTemplate. For a remote host the current dest content is read over the
+// SshExec connection GoTemplate writes with
+func GoTemplateCheck(s *u.SshExec, src, dest string, data map[string]any) (FileChange, error) {
+	if s.SshExecHost == "localhost" || s.SshExecHost == "127.0.0.1" {
+		return TemplateFileCheck(src, dest, data)
+	}
+	out, err := renderTemplateFile(src, data, "")
+	if err != nil {
+		return FileChange{Path: dest}, err
+	}
+	var before []byte
+	if remote, err := sshOutput(s, "test -f "+shellQuote(dest)+" && cat "+shellQuote(dest)+" || echo -n __NOFILE__"); err != nil {
+		return FileChange{Path: dest}, err
+	} else if remote != "__NOFILE__" {
+		before = []byte(remote)
+	}
+	return NewFileChange(s.SshExecHost+":"+dest, before, []byte(out)), nil
+}
+
+// CheckOnCopy runs a file editing function against a temporary copy of path and returns the would-be change. It is
+// how the helpers that can only edit a file in place (u.LineInFile, u.BlockInFile...) get a check mode.
+func CheckOnCopy(path string, edit func(copyPath string) error) (FileChange, error) {
+	before, err := readExisting(path)
+	if err != nil {
+		return FileChange{Path: path}, err
+	}
+	tempDir, err := os.MkdirTemp("", "check-mode")
+	if err != nil {
+		return FileChange{Path: path}, err
+	}
+	defer os.RemoveAll(tempDir)
+	copyPath := filepath.Join(tempDir, filepath.Base(path))
+	if before != nil {
+		if err := os.WriteFile(copyPath, before, 0o600); err != nil {
+			return FileChange{Path: path}, err
+		}
+	}
+	if err := edit(copyPath); err != nil {
+		return FileChange{Path: path}, err
+	}
+	after, err := readExisting(copyPath)
+	if err != nil {
+		return FileChange{Path: path}, err
+	}
+	if before == nil && after == nil {
+		return FileChange{Path: path}, nil
+	}
+	return NewFileChange(path, before, after), nil
+}
+
+// shellQuote quotes s for a posix shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
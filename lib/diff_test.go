@@ -0,0 +1,100 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	before := "a\nb\nc\nd\ne\nf\ng\nh\n"
+	after := "a\nb\nC\nd\ne\nf\ng\nh\ni\n"
+	got := UnifiedDiff(before, after, "a/f", "b/f", 1)
+	expected := `--- a/f
++++ b/f
+@@ -2,3 +2,3 @@
+ b
+-c
++C
+ d
+@@ -8,1 +8,2 @@
+ h
++i
+`
+	if got != expected {
+		t.Errorf("unexpected diff:\n%s", got)
+	}
+	if UnifiedDiff(before, before, "a", "b", 3) != "" {
+		t.Errorf("equal texts must give an empty diff")
+	}
+	if d := UnifiedDiff("", "x", "/dev/null", "b/f", 3); !strings.Contains(d, "@@ -0,0 +1,1 @@\n+x\n\\ No newline at end of file") {
+		t.Errorf("unexpected new file diff:\n%s", d)
+	}
+}
+
+func TestCheckMode(t *testing.T) {
+	tempDir := t.TempDir()
+	src, dest := filepath.Join(tempDir, "t.j2"), filepath.Join(tempDir, "out.txt")
+	os.WriteFile(src, []byte("name={{ name }}\n"), 0o644)
+
+	fc, err := TemplateFileCheck(src, dest, map[string]any{"name": "web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fc.Changed || !strings.Contains(fc.Diff, "+name=web") {
+		t.Errorf("expected a change for a new file, got %+v", fc)
+	}
+	if _, err := os.Stat(dest); err == nil {
+		t.Errorf("check mode must not write %s", dest)
+	}
+
+	os.WriteFile(dest, []byte("name=web"), 0o644) // trailing newline is dropped unless keep_trailing_newline
+	if fc, _ := TemplateFileCheck(src, dest, map[string]any{"name": "web"}); fc.Changed {
+		t.Errorf("expected no change, got %+v", fc)
+	}
+
+	iniFile := filepath.Join(tempDir, "a.ini")
+	os.WriteFile(iniFile, []byte("[main]\nport = 80\n"), 0o644)
+	fc, err = IniSetValCheck(iniFile, "main", "port", "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fc.Changed || !strings.Contains(fc.Diff, "port = 8080") || IniGetVal(iniFile, "main", "port") != "80" {
+		t.Errorf("unexpected ini check result %+v", fc)
+	}
+
+	fc, err = CheckOnCopy(iniFile, func(p string) error { return os.WriteFile(p, []byte("x\n"), 0o644) })
+	if err != nil || !fc.Changed || !strings.Contains(fc.Diff, "+x") {
+		t.Errorf("unexpected CheckOnCopy result %+v %v", fc, err)
+	}
+	if b, _ := os.ReadFile(iniFile); string(b) != "[main]\nport = 80\n" {
+		t.Errorf("CheckOnCopy changed the original file")
+	}
+}
+
+func TestPlaybookCheckMode(t *testing.T) {
+	tempDir := t.TempDir()
+	inv := NewInventory("")
+	inv.AddHost("h1")
+	dest := filepath.Join(tempDir, "out")
+	play := Play{Name: "check", Hosts: "all", Tasks: []Task{
+		{Name: "copy", Module: "copy", Args: map[string]any{"content": "hello\n", "dest": dest}},
+		{Name: "shell", Module: "shell", Args: map[string]any{"cmd": "touch " + dest}},
+	}}
+	runner := NewPlaybookRunner(inv, tempDir)
+	runner.Check, runner.Diff = true, true
+	res := runner.RunPlay(play)
+	if res.Failed() || len(res.Results) != 2 {
+		t.Fatalf("unexpected results %+v", res.Results)
+	}
+	if r := res.Results[0]; !r.Changed || !strings.Contains(r.Diff, "+hello") {
+		t.Errorf("copy should report a change with diff, got %+v", r)
+	}
+	if !res.Results[1].Skipped {
+		t.Errorf("shell must be skipped in check mode")
+	}
+	if _, err := os.Stat(dest); err == nil {
+		t.Errorf("check mode wrote %s", dest)
+	}
+}
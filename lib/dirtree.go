@@ -0,0 +1,289 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	u "github.com/sunshine69/golang-tools/utils"
+)
+
+// DirTreeOptions are the options of TemplateDirTreeWithOptions. The globs are path.Match patterns matched against
+// the slash separated path relative to the source dir if they have a /, against the base name otherwise.
+type DirTreeOptions struct {
+	// Include limits the files to the ones matching one of the globs, all files if empty
+	Include []string
+	// Exclude skips the files and directories matching one of the globs
+	Exclude []string
+	// Copy are the files copied verbatim instead of rendered, binary files are always copied
+	Copy []string
+	// StripSuffix is removed from the output file names, e.g. ".j2"
+	StripSuffix string
+	// TemplatePaths renders the relative paths as templates, e.g. "conf.d/{{ app }}.conf.j2"
+	TemplatePaths bool
+	// Delete removes the files of the target dir that are not produced from the source dir
+	Delete bool
+	// Parallel is the number of files rendered at once, 1 if 0
+	Parallel int
+	// Write are the options of the written files. A Mode of 0 keeps the source file mode for the copied files.
+	Write WriteFileOptions
+}
+
+// The DirTreeChange actions
+const (
+	DirTreeCreated = "created"
+	DirTreeChanged = "changed"
+	DirTreeRemoved = "removed"
+)
+
+// DirTreeChange is a file of the target dir that was created, changed or removed
+type DirTreeChange struct {
+	Path   string `json:"path"`
+	Action string `json:"action"`
+	// Src is the source file, empty for the removed files
+	Src string `json:"src,omitempty"`
+}
+
+// dirTreeJob is a source file and the target file it goes to
+type dirTreeJob struct {
+	name, src, dest string
+	copy            bool
+	mode            os.FileMode
+}
+
+// TemplateDirTreeWithOptions renders the files of srcDirpath to targetRoot keeping the directory structure. The
+// unchanged target files are not rewritten (see WriteFileAtomic) and the changes are returned sorted by path.
+// It stops at the first error, a *TemplateError for the template errors. With JINJA2_UNDEFINED=collect the whole
+// tree is written and the *UndefinedError of all the files returned with the changes.
+func TemplateDirTreeWithOptions(srcDirpath, targetRoot string, tmplData map[string]any, opt DirTreeOptions) ([]DirTreeChange, error) {
+	if fi, err := os.Stat(srcDirpath); err != nil || !fi.IsDir() {
+		return nil, fmt.Errorf("template dir %s does not exist", srcDirpath)
+	}
+	mode, err := undefinedMode("")
+	if err != nil {
+		return nil, err
+	}
+	jobs, err := dirTreeJobs(srcDirpath, targetRoot, tmplData, opt)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		mu        sync.Mutex
+		changes   []DirTreeChange
+		firstErr  error
+		collected = &UndefinedError{}
+		wg        sync.WaitGroup
+		queue     = make(chan dirTreeJob)
+	)
+	// the workers share one environment so every template is parsed once, all of them can include each other by
+	// their path relative to srcDirpath
+	te := NewTemplateEnv(TemplateSearchPath(filepath.Join(srcDirpath, "_"))...)
+	te.Undefined = mode
+	for i := 0; i < max(opt.Parallel, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				change, err := job.run(te, tmplData, opt.Write)
+				mu.Lock()
+				var ue *UndefinedError
+				if !undefinedFatal(err, mode) && errors.As(err, &ue) {
+					collected.Refs = append(collected.Refs, ue.Refs...)
+				} else if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				if change != nil {
+					changes = append(changes, *change)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, job := range jobs {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+	if firstErr != nil {
+		return sortTreeChanges(changes), firstErr
+	}
+
+	if opt.Delete {
+		keep := map[string]bool{}
+		for _, job := range jobs {
+			keep[filepath.Clean(job.dest)] = true
+		}
+		err := filepath.WalkDir(targetRoot, func(p string, d fs.DirEntry, err error) error {
+			// the source dir can be inside the target, its templates are not stale targets
+			if err == nil && d.IsDir() && filepath.Clean(p) == filepath.Clean(srcDirpath) {
+				return fs.SkipDir
+			}
+			if err != nil || d.IsDir() || keep[filepath.Clean(p)] {
+				return err
+			}
+			if err := os.Remove(p); err != nil {
+				return err
+			}
+			changes = append(changes, DirTreeChange{Path: p, Action: DirTreeRemoved})
+			return nil
+		})
+		if err != nil {
+			return sortTreeChanges(changes), err
+		}
+	}
+	if len(collected.Refs) > 0 {
+		return sortTreeChanges(changes), collected
+	}
+	return sortTreeChanges(changes), nil
+}
+
+// dirTreeJobs walks srcDirpath and returns the files to render or copy. The target dirs are created after the
+// walk so a target inside srcDirpath is not walked.
+func dirTreeJobs(srcDirpath, targetRoot string, tmplData map[string]any, opt DirTreeOptions) ([]dirTreeJob, error) {
+	jobs, dirs := []dirTreeJob{}, []string{}
+	err := filepath.WalkDir(srcDirpath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && filepath.Clean(p) == filepath.Clean(targetRoot) {
+			return fs.SkipDir
+		}
+		relPath, err := filepath.Rel(srcDirpath, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(relPath)
+		if name != "." && matchTreeGlob(opt.Exclude, name) {
+			return u.Ternary(d.IsDir(), fs.SkipDir, nil)
+		}
+		if !d.IsDir() && len(opt.Include) > 0 && !matchTreeGlob(opt.Include, name) {
+			return nil
+		}
+		destRel := name
+		if opt.TemplatePaths && name != "." {
+			if destRel, err = TemplateStringWithConfig(name, tmplData, "undefined", UndefinedStrict); err != nil {
+				return fmt.Errorf("path %s: %w", name, err)
+			}
+			if destRel = path.Clean(destRel); destRel == "." || destRel == ".." || strings.HasPrefix(destRel, "../") || path.IsAbs(destRel) {
+				return fmt.Errorf("path %s renders to %q outside of %s", name, destRel, targetRoot)
+			}
+		}
+		if d.IsDir() {
+			dirs = append(dirs, filepath.Join(targetRoot, filepath.FromSlash(destRel)))
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		job := dirTreeJob{name: name, src: p, mode: info.Mode().Perm(), copy: matchTreeGlob(opt.Copy, name)}
+		if !job.copy {
+			if job.copy, err = isBinaryFile(p); err != nil {
+				return err
+			}
+		}
+		if !job.copy && opt.StripSuffix != "" && strings.HasSuffix(destRel, opt.StripSuffix) && path.Base(destRel) != opt.StripSuffix {
+			destRel = strings.TrimSuffix(destRel, opt.StripSuffix)
+		}
+		job.dest = filepath.Join(targetRoot, filepath.FromSlash(destRel))
+		jobs = append(jobs, job)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dirs {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return jobs, nil
+}
+
+// run renders or copies the job file, the change is nil if the target is unchanged
+func (job dirTreeJob) run(te *TemplateEnv, tmplData map[string]any, wo WriteFileOptions) (*DirTreeChange, error) {
+	if err := os.MkdirAll(filepath.Dir(job.dest), 0o755); err != nil {
+		return nil, err
+	}
+	_, statErr := os.Stat(job.dest)
+	var res WriteFileResult
+	var err error
+	if job.copy {
+		content, rerr := os.ReadFile(job.src)
+		if rerr != nil {
+			return nil, rerr
+		}
+		if wo.Mode == 0 {
+			wo.Mode = job.mode
+		}
+		res, err = WriteFileAtomic(job.dest, content, wo)
+	} else {
+		res, err = te.RenderFileSafe(job.name, job.dest, tmplData, wo)
+	}
+	if !res.Changed {
+		return nil, err
+	}
+	return &DirTreeChange{Path: job.dest, Action: u.Ternary(statErr == nil, DirTreeChanged, DirTreeCreated), Src: job.src}, err
+}
+
+// matchTreeGlob is true if name matches one of the globs, see DirTreeOptions
+func matchTreeGlob(globs []string, name string) bool {
+	for _, g := range globs {
+		target := u.Ternary(strings.Contains(g, "/"), name, path.Base(name))
+		if ok, _ := path.Match(g, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isBinaryFile is true if the start of the file has a NUL byte or is not utf8, like git does
+func isBinaryFile(p string) (bool, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	buf := make([]byte, 8000)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	buf = buf[:n]
+	// a multi byte rune can be cut at the end of a full buffer
+	if n == cap(buf) {
+		for i := 1; i <= utf8.UTFMax && i <= n; i++ {
+			if utf8.RuneStart(buf[n-i]) {
+				if !utf8.FullRune(buf[n-i:]) {
+					buf = buf[:n-i]
+				}
+				break
+			}
+		}
+	}
+	return bytes.IndexByte(buf, 0) >= 0 || !utf8.Valid(buf), nil
+}
+
+func sortTreeChanges(changes []DirTreeChange) []DirTreeChange {
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
@@ -0,0 +1,85 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTemplateDirTreeWithOptions(t *testing.T) {
+	tempDir := t.TempDir()
+	src, target := filepath.Join(tempDir, "src"), filepath.Join(tempDir, "target")
+	writeFiles(t, src, map[string]string{
+		"app.conf.j2":             "port={{ port }}\n\n",
+		"{{ name }}/site.conf.j2": "{% include 'partials/inc.j2' %}\n\n",
+		"partials/inc.j2":         "site {{ name }}",
+		"static/raw.txt":          "{{ not rendered }}",
+		"static/logo.png":         "\x89PNG\x00{{ binary }}",
+		"skip/me.j2":              "{{ broken",
+		"notes.bak":               "{{ broken",
+	})
+	writeFiles(t, target, map[string]string{"stale.conf": "old"})
+	opt := DirTreeOptions{
+		Exclude:       []string{"skip", "*.bak", "partials"},
+		Copy:          []string{"static/*.txt"},
+		StripSuffix:   ".j2",
+		TemplatePaths: true,
+		Delete:        true,
+		Parallel:      3,
+	}
+	data := map[string]any{"port": 80, "name": "web"}
+	changes, err := TemplateDirTreeWithOptions(src, target, data, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []DirTreeChange{
+		{filepath.Join(target, "app.conf"), DirTreeCreated, filepath.Join(src, "app.conf.j2")},
+		{filepath.Join(target, "stale.conf"), DirTreeRemoved, ""},
+		{filepath.Join(target, "static/logo.png"), DirTreeCreated, filepath.Join(src, "static/logo.png")},
+		{filepath.Join(target, "static/raw.txt"), DirTreeCreated, filepath.Join(src, "static/raw.txt")},
+		{filepath.Join(target, "web/site.conf"), DirTreeCreated, filepath.Join(src, "{{ name }}/site.conf.j2")},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected\n%v\ngot\n%v", expected, changes)
+	}
+	for p, content := range map[string]string{"app.conf": "port=80\n", "web/site.conf": "site web", "static/raw.txt": "{{ not rendered }}", "static/logo.png": "\x89PNG\x00{{ binary }}"} {
+		if b, _ := os.ReadFile(filepath.Join(target, p)); string(b) != content {
+			t.Errorf("%s: expected %q, got %q", p, content, b)
+		}
+	}
+
+	// a second run changes nothing, a data change only the files using it
+	if changes, err := TemplateDirTreeWithOptions(src, target, data, opt); err != nil || len(changes) != 0 {
+		t.Errorf("expected no changes, got %v %v", changes, err)
+	}
+	data["port"] = 81
+	if changes, err := TemplateDirTreeWithOptions(src, target, data, opt); err != nil || len(changes) != 1 || changes[0].Action != DirTreeChanged {
+		t.Errorf("expected one change, got %v %v", changes, err)
+	}
+	opt.Include = []string{"*.conf.j2"}
+	if changes, err := TemplateDirTreeWithOptions(src, target, data, opt); err != nil || len(changes) != 2 || changes[0].Path != filepath.Join(target, "static/logo.png") {
+		t.Errorf("expected the static files to be removed, got %v %v", changes, err)
+	}
+
+	// the delete keeps the source templates when they are inside the target
+	out := filepath.Join(tempDir, "out")
+	writeFiles(t, out, map[string]string{"templates/a.conf.j2": "a={{ port }}", "stale": "old"})
+	changes, err = TemplateDirTreeWithOptions(filepath.Join(out, "templates"), out, data, DirTreeOptions{StripSuffix: ".j2", Delete: true})
+	if err != nil || len(changes) != 2 || changes[1].Path != filepath.Join(out, "stale") || changes[1].Action != DirTreeRemoved {
+		t.Errorf("expected a create and the stale file removed, got %v %v", changes, err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "templates/a.conf.j2")); err != nil {
+		t.Errorf("expected the source template to be kept: %v", err)
+	}
+
+	if _, err := TemplateDirTreeWithOptions(filepath.Join(tempDir, "nope"), target, nil, DirTreeOptions{}); err == nil {
+		t.Errorf("expected a missing dir error")
+	}
+	if _, err := TemplateDirTreeWithOptions(src, target, map[string]any{"name": "../x"}, DirTreeOptions{TemplatePaths: true, Exclude: []string{"skip", "*.bak"}}); err == nil {
+		t.Errorf("expected an error for a path outside of the target")
+	}
+	if _, err := TemplateDirTreeWithOptions(src, target, data, DirTreeOptions{}); err == nil {
+		t.Errorf("expected the broken templates to fail")
+	}
+}
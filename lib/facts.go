@@ -0,0 +1,500 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	u "github.com/sunshine69/golang-tools/utils"
+)
+
+// Fact gathering. The collector reads /etc/os-release, /proc, uname, df and the network interfaces and returns
+// ansible like facts (ansible_distribution, ansible_memtotal_mb, ansible_default_ipv4 ...) so templates can branch
+// on the OS or the memory size of a host.
+
+// factSource is where the collector reads from - the local machine or a remote host over ssh
+type factSource interface {
+	ReadFile(path string) (string, error)
+	Run(command string) (string, error)
+	Interfaces() ([]netIface, error)
+}
+
+// netIface is what we need to know about a network interface
+type netIface struct {
+	Name    string
+	Mac     string
+	Mtu     int
+	Up      bool
+	Loop    bool
+	Address []netip.Prefix
+}
+
+type localFactSource struct{}
+
+func (localFactSource) ReadFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	return string(data), err
+}
+
+func (localFactSource) Run(command string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return stdout.String(), fmt.Errorf("%s: %w - %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+func (localFactSource) Interfaces() ([]netIface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	out := []netIface{}
+	for _, i := range ifaces {
+		ni := netIface{Name: i.Name, Mac: i.HardwareAddr.String(), Mtu: i.MTU, Up: i.Flags&net.FlagUp != 0, Loop: i.Flags&net.FlagLoopback != 0}
+		addrs, _ := i.Addrs()
+		for _, a := range addrs {
+			if p, err := netip.ParsePrefix(a.String()); err == nil {
+				ni.Address = append(ni.Address, p)
+			}
+		}
+		out = append(out, ni)
+	}
+	return out, nil
+}
+
+type sshFactSource struct {
+	s *u.SshExec
+}
+
+func (r sshFactSource) ReadFile(path string) (string, error) {
+	return sshOutput(r.s, "cat "+shellQuote(path))
+}
+
+func (r sshFactSource) Run(command string) (string, error) {
+	return sshOutput(r.s, command)
+}
+
+// Interfaces parses `ip -o link show` and `ip -o addr show` on the remote host
+func (r sshFactSource) Interfaces() ([]netIface, error) {
+	links, err := sshOutput(r.s, "ip -o link show")
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := sshOutput(r.s, "ip -o addr show")
+	if err != nil {
+		return nil, err
+	}
+	return parseIpCommand(links, addrs), nil
+}
+
+// parseIpCommand builds the interface list from the output of `ip -o link show` and `ip -o addr show`
+func parseIpCommand(links, addrs string) []netIface {
+	out := []netIface{}
+	index := map[string]int{}
+	for _, line := range strings.Split(links, "\n") {
+		// 2: eth0: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc ... link/ether 52:54:00:12:34:56 brd ...
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		name, _, _ := strings.Cut(strings.TrimSuffix(fields[1], ":"), "@")
+		ni := netIface{Name: name}
+		ni.Up = strings.Contains(fields[2], ",UP") || strings.Contains(fields[2], "<UP")
+		ni.Loop = strings.Contains(fields[2], "LOOPBACK")
+		for i := 3; i < len(fields)-1; i++ {
+			switch fields[i] {
+			case "mtu":
+				ni.Mtu, _ = strconv.Atoi(fields[i+1])
+			case "link/ether":
+				ni.Mac = fields[i+1]
+			}
+		}
+		index[name] = len(out)
+		out = append(out, ni)
+	}
+	for _, line := range strings.Split(addrs, "\n") {
+		// 2: eth0    inet 10.0.0.5/24 brd 10.0.0.255 scope global eth0\       valid_lft ...
+		fields := strings.Fields(line)
+		if len(fields) < 4 || (fields[2] != "inet" && fields[2] != "inet6") {
+			continue
+		}
+		i, ok := index[fields[1]]
+		if !ok {
+			continue
+		}
+		if p, err := netip.ParsePrefix(fields[3]); err == nil {
+			out[i].Address = append(out[i].Address, p)
+		}
+	}
+	return out
+}
+
+// GatherFacts collects the facts of the local machine
+func GatherFacts() (map[string]any, error) {
+	return collectFacts(localFactSource{})
+}
+
+// GatherFactsRemote collects the facts of the SshExec host. It needs a posix shell, cat, uname, df and ip on the
+// remote side.
+func GatherFactsRemote(s *u.SshExec) (map[string]any, error) {
+	if s.SshExecHost == "localhost" || s.SshExecHost == "127.0.0.1" {
+		return GatherFacts()
+	}
+	return collectFacts(sshFactSource{s})
+}
+
+// collectFacts runs every collector. A failing collector does not stop the others, all errors are joined.
+func collectFacts(src factSource) (map[string]any, error) {
+	facts := map[string]any{}
+	var errs []error
+	for _, collect := range []func(factSource, map[string]any) error{factsOsRelease, factsUname, factsCpu, factsMemory, factsNetwork, factsMounts} {
+		if err := collect(src, facts); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return facts, errors.Join(errs...)
+}
+
+// ansible names of the os-release ID and the os family it belongs to
+var distributionNames = map[string][2]string{
+	"ubuntu":        {"Ubuntu", "Debian"},
+	"debian":        {"Debian", "Debian"},
+	"linuxmint":     {"Linux Mint", "Debian"},
+	"raspbian":      {"Debian", "Debian"},
+	"rhel":          {"RedHat", "RedHat"},
+	"centos":        {"CentOS", "RedHat"},
+	"fedora":        {"Fedora", "RedHat"},
+	"rocky":         {"Rocky", "RedHat"},
+	"almalinux":     {"AlmaLinux", "RedHat"},
+	"ol":            {"OracleLinux", "RedHat"},
+	"amzn":          {"Amazon", "RedHat"},
+	"alpine":        {"Alpine", "Alpine"},
+	"arch":          {"Archlinux", "Archlinux"},
+	"opensuse-leap": {"openSUSE Leap", "Suse"},
+	"sles":          {"SLES", "Suse"},
+	"gentoo":        {"Gentoo", "Gentoo"},
+}
+
+// parseOsRelease parses the KEY=value lines of /etc/os-release
+func parseOsRelease(content string) map[string]string {
+	out := map[string]string{}
+	for _, line := range strings.Split(content, "\n") {
+		k, v, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || strings.HasPrefix(k, "#") {
+			continue
+		}
+		out[k] = unquote(v)
+	}
+	return out
+}
+
+func factsOsRelease(src factSource, facts map[string]any) error {
+	content, err := src.ReadFile("/etc/os-release")
+	if err != nil {
+		if content, err = src.ReadFile("/usr/lib/os-release"); err != nil {
+			return fmt.Errorf("os-release: %w", err)
+		}
+	}
+	osr := parseOsRelease(content)
+	dist, family := osr["NAME"], osr["NAME"]
+	if names, ok := distributionNames[osr["ID"]]; ok {
+		dist, family = names[0], names[1]
+	} else {
+		for _, like := range strings.Fields(osr["ID_LIKE"]) {
+			if names, ok := distributionNames[like]; ok {
+				family = names[1]
+				break
+			}
+		}
+	}
+	version := osr["VERSION_ID"]
+	major, _, _ := strings.Cut(version, ".")
+	facts["ansible_distribution"] = dist
+	facts["ansible_os_family"] = family
+	facts["ansible_distribution_version"] = version
+	facts["ansible_distribution_major_version"] = major
+	facts["ansible_distribution_release"] = osr["VERSION_CODENAME"]
+	return nil
+}
+
+func factsUname(src factSource, facts map[string]any) error {
+	// one field per line as the kernel version (-v) may contain spaces
+	out, err := src.Run("uname -s; uname -n; uname -r; uname -m")
+	if err != nil {
+		return fmt.Errorf("uname: %w", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 4 {
+		return fmt.Errorf("uname: unexpected output %q", out)
+	}
+	facts["ansible_system"] = lines[0]
+	facts["ansible_nodename"] = lines[1]
+	facts["ansible_hostname"], _, _ = strings.Cut(lines[1], ".")
+	facts["ansible_kernel"] = lines[2]
+	facts["ansible_architecture"] = lines[3]
+	facts["ansible_machine"] = lines[3]
+	if fqdn, err := src.Run("hostname -f"); err == nil && strings.TrimSpace(fqdn) != "" {
+		facts["ansible_fqdn"] = strings.TrimSpace(fqdn)
+	} else {
+		facts["ansible_fqdn"] = lines[1]
+	}
+	return nil
+}
+
+func factsCpu(src factSource, facts map[string]any) error {
+	content, err := src.ReadFile("/proc/cpuinfo")
+	if err != nil {
+		return fmt.Errorf("cpuinfo: %w", err)
+	}
+	vcpus, cores := 0, 0
+	sockets := map[string]bool{}
+	models := []string{}
+	for _, line := range strings.Split(content, "\n") {
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		v = strings.TrimSpace(v)
+		switch strings.TrimSpace(k) {
+		case "processor":
+			vcpus++
+		case "physical id":
+			sockets[v] = true
+		case "cpu cores":
+			cores, _ = strconv.Atoi(v)
+		case "model name":
+			models = append(models, v)
+		}
+	}
+	count := max(len(sockets), 1)
+	if cores == 0 {
+		cores = vcpus / count
+	}
+	facts["ansible_processor_vcpus"] = vcpus
+	facts["ansible_processor_count"] = count
+	facts["ansible_processor_cores"] = cores
+	facts["ansible_processor_threads_per_core"] = max(vcpus/max(count*cores, 1), 1)
+	facts["ansible_processor"] = models
+	return nil
+}
+
+func factsMemory(src factSource, facts map[string]any) error {
+	content, err := src.ReadFile("/proc/meminfo")
+	if err != nil {
+		return fmt.Errorf("meminfo: %w", err)
+	}
+	mem := map[string]int{}
+	for _, line := range strings.Split(content, "\n") {
+		// MemTotal:       16314596 kB
+		fields := strings.Fields(line)
+		if len(fields) >= 2 {
+			kb, _ := strconv.Atoi(fields[1])
+			mem[strings.TrimSuffix(fields[0], ":")] = kb
+		}
+	}
+	facts["ansible_memtotal_mb"] = mem["MemTotal"] / 1024
+	facts["ansible_memfree_mb"] = mem["MemFree"] / 1024
+	facts["ansible_swaptotal_mb"] = mem["SwapTotal"] / 1024
+	facts["ansible_swapfree_mb"] = mem["SwapFree"] / 1024
+	return nil
+}
+
+// defaultRoute returns the interface and gateway of the ipv4 default route from /proc/net/route
+func defaultRoute(content string) (iface, gateway string) {
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags ... - addresses are little endian hex
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		gw, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil {
+			continue
+		}
+		return fields[0], netip.AddrFrom4([4]byte{byte(gw), byte(gw >> 8), byte(gw >> 16), byte(gw >> 24)}).String()
+	}
+	return "", ""
+}
+
+// prefixFacts is the ansible shape of an address of an interface
+func prefixFacts(p netip.Prefix) map[string]any {
+	out := map[string]any{
+		"address": p.Addr().String(),
+		"prefix":  strconv.Itoa(p.Bits()),
+	}
+	if p.Addr().Is4() {
+		mask := net.CIDRMask(p.Bits(), 32)
+		out["netmask"] = net.IP(mask).String()
+		out["network"] = p.Masked().Addr().String()
+		bcast := p.Masked().Addr().As4()
+		for i := range bcast {
+			bcast[i] |= ^mask[i]
+		}
+		out["broadcast"] = netip.AddrFrom4(bcast).String()
+	} else {
+		out["scope"] = u.Ternary(p.Addr().IsLinkLocalUnicast(), "link", "global")
+	}
+	return out
+}
+
+func factsNetwork(src factSource, facts map[string]any) error {
+	ifaces, err := src.Interfaces()
+	if err != nil {
+		return fmt.Errorf("interfaces: %w", err)
+	}
+	names, all4, all6 := []string{}, []string{}, []string{}
+	for _, i := range ifaces {
+		names = append(names, i.Name)
+		ipv4, ipv6 := []map[string]any{}, []map[string]any{}
+		for _, p := range i.Address {
+			if p.Addr().Is4() {
+				ipv4 = append(ipv4, prefixFacts(p))
+				if !i.Loop {
+					all4 = append(all4, p.Addr().String())
+				}
+			} else {
+				ipv6 = append(ipv6, prefixFacts(p))
+				if !i.Loop {
+					all6 = append(all6, p.Addr().String())
+				}
+			}
+		}
+		ifFacts := map[string]any{"device": i.Name, "macaddress": i.Mac, "mtu": i.Mtu, "active": i.Up, "ipv6": ipv6}
+		if len(ipv4) > 0 {
+			ifFacts["ipv4"] = ipv4[0]
+			ifFacts["ipv4_secondaries"] = ipv4[1:]
+		}
+		// ansible replaces - and : in interface names with _
+		facts["ansible_"+strings.NewReplacer("-", "_", ":", "_", ".", "_").Replace(i.Name)] = ifFacts
+	}
+	facts["ansible_interfaces"] = names
+	facts["ansible_all_ipv4_addresses"] = all4
+	facts["ansible_all_ipv6_addresses"] = all6
+
+	facts["ansible_default_ipv4"] = map[string]any{}
+	routes, err := src.ReadFile("/proc/net/route")
+	if err != nil {
+		return fmt.Errorf("default route: %w", err)
+	}
+	ifName, gateway := defaultRoute(routes)
+	for _, i := range ifaces {
+		if i.Name != ifName {
+			continue
+		}
+		def := map[string]any{"interface": i.Name, "gateway": gateway, "macaddress": i.Mac, "mtu": i.Mtu}
+		for _, p := range i.Address {
+			if p.Addr().Is4() {
+				for k, v := range prefixFacts(p) {
+					def[k] = v
+				}
+				break
+			}
+		}
+		facts["ansible_default_ipv4"] = def
+	}
+	return nil
+}
+
+// pseudo filesystems not reported in ansible_mounts
+var pseudoFsTypes = []string{"proc", "sysfs", "devtmpfs", "devpts", "tmpfs", "cgroup", "cgroup2", "securityfs", "pstore",
+	"debugfs", "tracefs", "configfs", "fusectl", "mqueue", "hugetlbfs", "bpf", "autofs", "binfmt_misc", "rpc_pipefs",
+	"nsfs", "efivarfs", "ramfs", "squashfs", "overlay", "fuse.gvfsd-fuse", "fuse.portal"}
+
+func factsMounts(src factSource, facts map[string]any) error {
+	content, err := src.ReadFile("/proc/mounts")
+	if err != nil {
+		return fmt.Errorf("mounts: %w", err)
+	}
+	mounts := []map[string]any{}
+	for _, line := range strings.Split(content, "\n") {
+		// device mountpoint fstype options dump pass. Spaces in paths are octal escaped as \040
+		fields := strings.Fields(line)
+		if len(fields) < 4 || containsStr(pseudoFsTypes, fields[2]) {
+			continue
+		}
+		m := map[string]any{
+			"device":  unescapeMount(fields[0]),
+			"mount":   unescapeMount(fields[1]),
+			"fstype":  fields[2],
+			"options": fields[3],
+		}
+		if out, err := src.Run("df -P -k " + shellQuote(m["mount"].(string))); err == nil {
+			lines := strings.Split(strings.TrimSpace(out), "\n")
+			// Filesystem 1024-blocks Used Available Capacity Mounted on
+			if f := strings.Fields(lines[len(lines)-1]); len(lines) > 1 && len(f) >= 4 {
+				total, _ := strconv.ParseInt(f[1], 10, 64)
+				avail, _ := strconv.ParseInt(f[3], 10, 64)
+				m["size_total"], m["size_available"] = total*1024, avail*1024
+			}
+		}
+		mounts = append(mounts, m)
+	}
+	facts["ansible_mounts"] = mounts
+	return nil
+}
+
+func unescapeMount(s string) string {
+	return strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(s)
+}
+
+// SetHostFacts merges facts into the vars of a host, both as top level ansible_* vars and under `ansible_facts`
+// without the prefix, like ansible does.
+func (inv *Inventory) SetHostFacts(hostname string, facts map[string]any) error {
+	host, ok := inv.Hosts[hostname]
+	if !ok {
+		return fmt.Errorf("host %s not found in inventory", hostname)
+	}
+	if host.Vars == nil {
+		host.Vars = map[string]any{}
+	}
+	ansibleFacts, _ := host.Vars["ansible_facts"].(map[string]any)
+	if ansibleFacts == nil {
+		ansibleFacts = map[string]any{}
+	}
+	for k, v := range facts {
+		host.Vars[k] = v
+		ansibleFacts[strings.TrimPrefix(k, "ansible_")] = v
+	}
+	host.Vars["ansible_facts"] = ansibleFacts
+	return nil
+}
+
+// GatherHostFacts gathers the facts of the hosts matching hostPtn (see MatchHost) and sets them into the host vars.
+// sshFor returns the connection of a host; if it is nil or returns nil the facts are gathered locally.
+func (inv *Inventory) GatherHostFacts(hostPtn string, sshFor func(host *Host) *u.SshExec) error {
+	var errs []error
+	var localFacts map[string]any // gathered once for all local hosts
+	var localErr error
+	for _, hostname := range inv.MatchHost(hostPtn) {
+		var s *u.SshExec
+		if sshFor != nil {
+			s = sshFor(inv.Hosts[hostname])
+		}
+		var facts map[string]any
+		var err error
+		if s == nil {
+			if localFacts == nil {
+				localFacts, localErr = GatherFacts()
+			}
+			facts, err = localFacts, localErr
+		} else {
+			facts, err = GatherFactsRemote(s)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", hostname, err))
+		}
+		errs = append(errs, inv.SetHostFacts(hostname, facts))
+	}
+	return errors.Join(errs...)
+}
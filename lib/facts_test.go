@@ -0,0 +1,103 @@
+package lib
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// fakeFactSource serves canned files and command outputs
+type fakeFactSource struct {
+	files map[string]string
+	cmds  map[string]string
+}
+
+func (f fakeFactSource) ReadFile(path string) (string, error) {
+	if c, ok := f.files[path]; ok {
+		return c, nil
+	}
+	return "", fmt.Errorf("%s: no such file", path)
+}
+
+func (f fakeFactSource) Run(command string) (string, error) {
+	for prefix, out := range f.cmds {
+		if strings.HasPrefix(command, prefix) {
+			return out, nil
+		}
+	}
+	return "", fmt.Errorf("%s: not found", command)
+}
+
+func (f fakeFactSource) Interfaces() ([]netIface, error) {
+	return parseIpCommand(f.cmds["ip -o link show"], f.cmds["ip -o addr show"]), nil
+}
+
+func TestCollectFacts(t *testing.T) {
+	src := fakeFactSource{
+		files: map[string]string{
+			"/etc/os-release": "NAME=\"Ubuntu\"\nVERSION_ID=\"22.04\"\nID=ubuntu\nID_LIKE=debian\nVERSION_CODENAME=jammy\n",
+			"/proc/cpuinfo":   "processor\t: 0\nphysical id\t: 0\ncpu cores\t: 2\nprocessor\t: 1\nphysical id\t: 0\ncpu cores\t: 2\n",
+			"/proc/meminfo":   "MemTotal:        4030656 kB\nMemFree:          102400 kB\n",
+			"/proc/net/route": "Iface\tDestination\tGateway \tFlags\nens3\t00000000\t0100000A\t0003\nens3\t0000000A\t00000000\t0001\n",
+			"/proc/mounts":    "/dev/vda1 / ext4 rw,relatime 0 0\nproc /proc proc rw 0 0\n/dev/vdb /srv/my\\040data xfs rw 0 0\n",
+		},
+		cmds: map[string]string{
+			"uname":           "Linux\nweb1.example.com\n5.15.0-91-generic\nx86_64\n",
+			"hostname -f":     "web1.example.com\n",
+			"df -P -k '/'":    "Filesystem 1024-blocks Used Available Capacity Mounted on\n/dev/vda1 1000 400 600 40% /\n",
+			"ip -o link show": "1: lo: <LOOPBACK,UP,LOWER_UP> mtu 65536 qdisc noqueue state UNKNOWN link/loopback 00:00:00:00:00:00 brd 00:00:00:00:00:00\n2: ens3: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc fq_codel state UP link/ether 52:54:00:12:34:56 brd ff:ff:ff:ff:ff:ff\n",
+			"ip -o addr show": "1: lo    inet 127.0.0.1/8 scope host lo\\       valid_lft forever\n2: ens3    inet 10.0.0.5/24 brd 10.0.0.255 scope global ens3\\       valid_lft forever\n2: ens3    inet6 fe80::1/64 scope link\\       valid_lft forever\n",
+		},
+	}
+	facts, err := collectFacts(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]any{
+		"ansible_distribution":               "Ubuntu",
+		"ansible_os_family":                  "Debian",
+		"ansible_distribution_major_version": "22",
+		"ansible_distribution_release":       "jammy",
+		"ansible_hostname":                   "web1",
+		"ansible_kernel":                     "5.15.0-91-generic",
+		"ansible_processor_vcpus":            2,
+		"ansible_processor_cores":            2,
+		"ansible_memtotal_mb":                3936,
+	} {
+		if facts[k] != v {
+			t.Errorf("%s: expected %v got %v", k, v, facts[k])
+		}
+	}
+	def := facts["ansible_default_ipv4"].(map[string]any)
+	if def["address"] != "10.0.0.5" || def["gateway"] != "10.0.0.1" || def["interface"] != "ens3" || def["netmask"] != "255.255.255.0" || def["macaddress"] != "52:54:00:12:34:56" {
+		t.Errorf("unexpected default ipv4 %v", def)
+	}
+	if all4 := facts["ansible_all_ipv4_addresses"].([]string); len(all4) != 1 || all4[0] != "10.0.0.5" {
+		t.Errorf("unexpected ipv4 addresses %v", all4)
+	}
+	mounts := facts["ansible_mounts"].([]map[string]any)
+	if len(mounts) != 2 || mounts[0]["size_total"] != int64(1024000) || mounts[1]["mount"] != "/srv/my data" {
+		t.Errorf("unexpected mounts %v", mounts)
+	}
+
+	inv := NewInventory("")
+	inv.AddHost("web1")
+	if err := inv.SetHostFacts("web1", facts); err != nil {
+		t.Fatal(err)
+	}
+	out, err := TemplateStringWithConfig(`{% if ansible_facts.os_family == "Debian" and ansible_memtotal_mb > 2048 %}big{% endif %}`, inv.Hosts["web1"].Vars)
+	if err != nil || out != "big" {
+		t.Errorf("expected the facts in host vars, got %q %v", out, err)
+	}
+}
+
+func TestDefaultRoute(t *testing.T) {
+	iface, gw := defaultRoute("Iface\tDestination\tGateway\neth0\t00000000\t0101A8C0\n")
+	if iface != "eth0" || gw != "192.168.1.1" {
+		t.Errorf("got %s %s", iface, gw)
+	}
+	if p := prefixFacts(netip.MustParsePrefix("192.168.1.10/23")); p["network"] != "192.168.0.0" || p["broadcast"] != "192.168.1.255" {
+		t.Errorf("unexpected prefix facts %v", p)
+	}
+}
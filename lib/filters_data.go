@@ -0,0 +1,551 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/jmespath/go-jmespath"
+	mj "github.com/mitsuhiko/minijinja/minijinja-go/v2"
+	"github.com/mitsuhiko/minijinja/minijinja-go/v2/filters"
+	"github.com/mitsuhiko/minijinja/minijinja-go/v2/value"
+	"gopkg.in/yaml.v3"
+)
+
+// Ansible data manipulation filters. They work on native go values (see ValueToNative) and aim to give the same
+// output as ansible so existing .j2 files render identically. Maps have no order here so dict2items sorts by key.
+
+func addDataFilters(env *mj.Environment) {
+	env.AddFilter("combine", filterCombine)
+	env.AddFilter("dict2items", filterDict2Items)
+	env.AddFilter("items2dict", filterItems2Dict)
+	env.AddFilter("from_json", filterFromJson)
+	env.AddFilter("from_yaml", filterFromYaml)
+	env.AddFilter("from_yaml_all", filterFromYamlAll)
+	env.AddFilter("to_nice_json", filterToNiceJson)
+	env.AddFilter("to_nice_yaml", filterToNiceYaml)
+	env.AddFilter("flatten", filterFlatten)
+	// the minijinja unique (case insensitive by default, case_sensitive= and attribute= kwargs) and zip (stops at
+	// the shortest list) are what ansible does
+	env.AddFilter("unique", filters.FilterUnique)
+	env.AddFilter("union", filterUnion)
+	env.AddFilter("intersect", filterIntersect)
+	env.AddFilter("difference", filterDifference)
+	env.AddFilter("symmetric_difference", filterSymmetricDifference)
+	env.AddFilter("zip", filters.FilterZip)
+	env.AddFilter("zip_longest", filterZipLongest)
+	env.AddFilter("subelements", filterSubelements)
+	env.AddFilter("json_query", filterJsonQuery)
+	env.AddFilter("ternary", filterTernary)
+	env.AddFilter("mandatory", filterMandatory)
+}
+
+// kwString returns the string kwarg name or def
+func kwString(kwargs map[string]value.Value, name, def string) string {
+	if v, ok := kwargs[name]; ok {
+		if s, ok := v.AsString(); ok {
+			return s
+		}
+		return v.String()
+	}
+	return def
+}
+
+// kwBool returns the bool kwarg name or def
+func kwBool(kwargs map[string]value.Value, name string, def bool) bool {
+	if v, ok := kwargs[name]; ok {
+		return v.IsTrue()
+	}
+	return def
+}
+
+// kwInt returns the int kwarg name or def
+func kwInt(kwargs map[string]value.Value, name string, def int) int {
+	if v, ok := kwargs[name]; ok {
+		if i, ok := v.AsInt(); ok {
+			return int(i)
+		}
+	}
+	return def
+}
+
+// argOrKw returns the positional arg i if given, otherwise the kwarg name
+func argOrKw(args []value.Value, i int, kwargs map[string]value.Value, name string) (value.Value, bool) {
+	if len(args) > i {
+		return args[i], true
+	}
+	v, ok := kwargs[name]
+	return v, ok
+}
+
+// combineMaps merges b into a (a copy is returned), like ansible combine
+func combineMaps(a, b map[string]any, recursive bool, listMerge string) map[string]any {
+	out := make(map[string]any, len(a))
+	for k, v := range a {
+		out[k] = v
+	}
+	for k, bv := range b {
+		av, exists := out[k]
+		if !exists {
+			out[k] = bv
+			continue
+		}
+		am, aIsMap := av.(map[string]any)
+		bm, bIsMap := bv.(map[string]any)
+		al, aIsList := av.([]any)
+		bl, bIsList := bv.([]any)
+		switch {
+		case recursive && aIsMap && bIsMap:
+			out[k] = combineMaps(am, bm, recursive, listMerge)
+		case aIsList && bIsList:
+			out[k] = mergeLists(al, bl, listMerge)
+		default:
+			out[k] = bv
+		}
+	}
+	return out
+}
+
+func mergeLists(a, b []any, listMerge string) []any {
+	switch listMerge {
+	case "keep":
+		return a
+	case "append":
+		return append(append([]any{}, a...), b...)
+	case "prepend":
+		return append(append([]any{}, b...), a...)
+	case "append_rp":
+		// remove from a the items present in b, then append b
+		return append(nativeListDiff(a, b), b...)
+	case "prepend_rp":
+		return append(append([]any{}, b...), nativeListDiff(a, b)...)
+	default: // replace
+		return b
+	}
+}
+
+// nativeKey is a comparable key of a native value
+func nativeKey(v any) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// nativeListDiff returns the items of a not in b
+func nativeListDiff(a, b []any) []any {
+	inB := map[string]bool{}
+	for _, v := range b {
+		inB[nativeKey(v)] = true
+	}
+	out := []any{}
+	for _, v := range a {
+		if !inB[nativeKey(v)] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// {{ a | combine(b, c, recursive=true, list_merge='append') }}. Args can also be lists of dicts.
+func filterCombine(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	recursive := kwBool(kwargs, "recursive", false)
+	listMerge := kwString(kwargs, "list_merge", "replace")
+	if !containsStr([]string{"replace", "keep", "append", "prepend", "append_rp", "prepend_rp"}, listMerge) {
+		return value.Undefined(), fmt.Errorf("combine: unknown list_merge '%s'", listMerge)
+	}
+	dicts := []value.Value{val}
+	dicts = append(dicts, args...)
+	out := map[string]any{}
+	var merge func(v value.Value) error
+	merge = func(v value.Value) error {
+		switch n := ValueToNative(v).(type) {
+		case map[string]any:
+			out = combineMaps(out, n, recursive, listMerge)
+		case []any:
+			for _, item := range v.Iter() {
+				if err := merge(item); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("combine expects dicts, got %s", v.Kind())
+		}
+		return nil
+	}
+	for _, d := range dicts {
+		if err := merge(d); err != nil {
+			return value.Undefined(), err
+		}
+	}
+	return value.FromAny(out), nil
+}
+
+func filterDict2Items(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	m, ok := val.AsMap()
+	if !ok {
+		return value.Undefined(), fmt.Errorf("dict2items requires a dictionary, got %s", val.Kind())
+	}
+	keyName, valueName := kwString(kwargs, "key_name", "key"), kwString(kwargs, "value_name", "value")
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]value.Value, len(keys))
+	for i, k := range keys {
+		out[i] = value.FromMap(map[string]value.Value{keyName: value.FromString(k), valueName: m[k]})
+	}
+	return value.FromSlice(out), nil
+}
+
+func filterItems2Dict(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	items, ok := val.AsSlice()
+	if !ok {
+		return value.Undefined(), fmt.Errorf("items2dict requires a list, got %s", val.Kind())
+	}
+	keyName, valueName := kwString(kwargs, "key_name", "key"), kwString(kwargs, "value_name", "value")
+	out := map[string]value.Value{}
+	for _, item := range items {
+		k, v := item.GetAttr(keyName), item.GetAttr(valueName)
+		if k.IsUndefined() || v.IsUndefined() {
+			return value.Undefined(), fmt.Errorf("items2dict requires each item to have '%s' and '%s' keys", keyName, valueName)
+		}
+		out[k.String()] = v
+	}
+	return value.FromMap(out), nil
+}
+
+func filterFromJson(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	s, ok := val.AsString()
+	if !ok {
+		return value.Undefined(), fmt.Errorf("from_json expects a string")
+	}
+	var out any
+	if err := json.Unmarshal([]byte(s), &out); err != nil {
+		return value.Undefined(), fmt.Errorf("from_json: %w", err)
+	}
+	return value.FromAny(out), nil
+}
+
+func filterFromYaml(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	s, ok := val.AsString()
+	if !ok {
+		return val, nil // ansible passes non string input through
+	}
+	var out any
+	if err := yaml.Unmarshal([]byte(s), &out); err != nil {
+		return value.Undefined(), fmt.Errorf("from_yaml: %w", err)
+	}
+	return value.FromAny(out), nil
+}
+
+func filterFromYamlAll(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	s, ok := val.AsString()
+	if !ok {
+		return val, nil
+	}
+	out := []any{}
+	dec := yaml.NewDecoder(strings.NewReader(s))
+	for {
+		var doc any
+		err := dec.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return value.Undefined(), fmt.Errorf("from_yaml_all: %w", err)
+		}
+		out = append(out, doc)
+	}
+	return value.FromAny(out), nil
+}
+
+// to_nice_json(indent=4). Keys are always sorted.
+func filterToNiceJson(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", strings.Repeat(" ", kwInt(kwargs, "indent", 4)))
+	if err := enc.Encode(ValueToNative(val)); err != nil {
+		return value.Undefined(), fmt.Errorf("to_nice_json: %w", err)
+	}
+	return value.FromString(strings.TrimSuffix(buf.String(), "\n")), nil
+}
+
+// to_nice_yaml(indent=4)
+func filterToNiceYaml(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(kwInt(kwargs, "indent", 4))
+	if err := enc.Encode(ValueToNative(val)); err != nil {
+		return value.Undefined(), fmt.Errorf("to_nice_yaml: %w", err)
+	}
+	return value.FromString(buf.String()), nil
+}
+
+// flatten(levels=None, skip_nulls=True)
+func filterFlatten(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	items, ok := val.AsSlice()
+	if !ok {
+		return value.Undefined(), fmt.Errorf("flatten expects a list")
+	}
+	levels := -1
+	if l, ok := argOrKw(args, 0, kwargs, "levels"); ok && !l.IsNone() {
+		if i, ok := l.AsInt(); ok {
+			levels = int(i)
+		}
+	}
+	skipNulls := kwBool(kwargs, "skip_nulls", true)
+	var flatten func(items []value.Value, level int) []value.Value
+	flatten = func(items []value.Value, level int) []value.Value {
+		out := []value.Value{}
+		for _, item := range items {
+			if skipNulls && (item.IsNone() || item.IsUndefined() || isNullString(item)) {
+				continue
+			}
+			if sub, ok := item.AsSlice(); ok && item.Kind() == value.KindSeq && (levels < 0 || level < levels) {
+				out = append(out, flatten(sub, level+1)...)
+				continue
+			}
+			out = append(out, item)
+		}
+		return out
+	}
+	return value.FromSlice(flatten(items, 0)), nil
+}
+
+// isNullString is true for the null spellings of a string, as ansible skips them in flatten
+func isNullString(v value.Value) bool {
+	s, ok := v.AsString()
+	return ok && (s == "None" || s == "null")
+}
+
+// setOperands returns the two lists of a set filter
+func setOperands(name string, val value.Value, args []value.Value) (a, b []value.Value, err error) {
+	var ok bool
+	if a, ok = val.AsSlice(); !ok {
+		return nil, nil, fmt.Errorf("%s expects a list", name)
+	}
+	if len(args) == 0 {
+		return nil, nil, fmt.Errorf("%s expects a list argument", name)
+	}
+	if b, ok = args[0].AsSlice(); !ok {
+		return nil, nil, fmt.Errorf("%s expects a list argument", name)
+	}
+	return a, b, nil
+}
+
+func valueIndex(list []value.Value, v value.Value) int {
+	for i, item := range list {
+		if item.Equal(v) {
+			return i
+		}
+	}
+	return -1
+}
+
+// uniqueAppend appends the items not already in out, keeping the order
+func uniqueAppend(out []value.Value, items ...value.Value) []value.Value {
+	for _, item := range items {
+		if valueIndex(out, item) < 0 {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+func filterUnion(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	a, b, err := setOperands("union", val, args)
+	if err != nil {
+		return value.Undefined(), err
+	}
+	return value.FromSlice(uniqueAppend(uniqueAppend([]value.Value{}, a...), b...)), nil
+}
+
+func filterIntersect(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	a, b, err := setOperands("intersect", val, args)
+	if err != nil {
+		return value.Undefined(), err
+	}
+	out := []value.Value{}
+	for _, item := range a {
+		if valueIndex(b, item) >= 0 {
+			out = uniqueAppend(out, item)
+		}
+	}
+	return value.FromSlice(out), nil
+}
+
+func filterDifference(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	a, b, err := setOperands("difference", val, args)
+	if err != nil {
+		return value.Undefined(), err
+	}
+	out := []value.Value{}
+	for _, item := range a {
+		if valueIndex(b, item) < 0 {
+			out = uniqueAppend(out, item)
+		}
+	}
+	return value.FromSlice(out), nil
+}
+
+func filterSymmetricDifference(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	a, b, err := setOperands("symmetric_difference", val, args)
+	if err != nil {
+		return value.Undefined(), err
+	}
+	out := []value.Value{}
+	for _, item := range a {
+		if valueIndex(b, item) < 0 {
+			out = uniqueAppend(out, item)
+		}
+	}
+	for _, item := range b {
+		if valueIndex(a, item) < 0 {
+			out = uniqueAppend(out, item)
+		}
+	}
+	return value.FromSlice(out), nil
+}
+
+// {{ a | zip_longest(b, c, fillvalue='x') }}
+func filterZipLongest(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	lists := [][]value.Value{}
+	longest := 0
+	for _, l := range append([]value.Value{val}, args...) {
+		items, ok := l.AsSlice()
+		if !ok {
+			return value.Undefined(), fmt.Errorf("zip_longest expects lists")
+		}
+		lists = append(lists, items)
+		longest = max(longest, len(items))
+	}
+	fill := value.None()
+	if f, ok := kwargs["fillvalue"]; ok {
+		fill = f
+	}
+	out := make([]value.Value, longest)
+	for i := range longest {
+		row := make([]value.Value, len(lists))
+		for j, l := range lists {
+			row[j] = fill
+			if i < len(l) {
+				row[j] = l[i]
+			}
+		}
+		out[i] = value.FromSlice(row)
+	}
+	return value.FromSlice(out), nil
+}
+
+// {{ users | subelements('groups', skip_missing=True) }} gives [[user, group], ...]. The path may be dotted.
+func filterSubelements(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	items, ok := val.AsSlice()
+	if !ok {
+		if m, ok := val.AsMap(); ok { // ansible accepts a dict and uses its values
+			items = sortedValues(m)
+		} else {
+			return value.Undefined(), fmt.Errorf("subelements expects a list or dict")
+		}
+	}
+	if len(args) == 0 {
+		return value.Undefined(), fmt.Errorf("subelements expects the subelement path")
+	}
+	path := args[0].String()
+	skipMissing := kwBool(kwargs, "skip_missing", false)
+	if len(args) > 1 {
+		if m, ok := args[1].AsMap(); ok {
+			if v, ok := m["skip_missing"]; ok {
+				skipMissing = v.IsTrue()
+			}
+		} else {
+			skipMissing = args[1].IsTrue()
+		}
+	}
+	out := []value.Value{}
+	for _, item := range items {
+		sub := item
+		for _, key := range strings.Split(path, ".") {
+			sub = sub.GetItem(value.FromString(key))
+			if sub.IsUndefined() {
+				break
+			}
+		}
+		if sub.IsUndefined() {
+			if skipMissing {
+				continue
+			}
+			return value.Undefined(), fmt.Errorf("could not find '%s' key in iterated item '%s'", path, item.Repr())
+		}
+		subItems, ok := sub.AsSlice()
+		if !ok {
+			return value.Undefined(), fmt.Errorf("the key '%s' should point to a list, got %s", path, sub.Repr())
+		}
+		for _, s := range subItems {
+			out = append(out, value.FromSlice([]value.Value{item, s}))
+		}
+	}
+	return value.FromSlice(out), nil
+}
+
+// sortedValues returns the values of a map sorted by key
+func sortedValues(m map[string]value.Value) []value.Value {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]value.Value, len(keys))
+	for i, k := range keys {
+		out[i] = m[k]
+	}
+	return out
+}
+
+// json_query uses JMESPath like ansible (community.general.json_query)
+func filterJsonQuery(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	if len(args) == 0 {
+		return value.Undefined(), fmt.Errorf("json_query expects a query")
+	}
+	// round trip through json so numbers are float64 as jmespath expects
+	var data any
+	if err := json.Unmarshal([]byte(nativeKey(ValueToNative(val))), &data); err != nil {
+		return value.Undefined(), fmt.Errorf("json_query: %w", err)
+	}
+	out, err := jmespath.Search(args[0].String(), data)
+	if err != nil {
+		return value.Undefined(), fmt.Errorf("json_query '%s': %w", args[0].String(), err)
+	}
+	return value.FromAny(out), nil
+}
+
+// {{ cond | ternary('yes', 'no', 'none') }}
+func filterTernary(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	trueVal, ok1 := argOrKw(args, 0, kwargs, "true_val")
+	falseVal, ok2 := argOrKw(args, 1, kwargs, "false_val")
+	if !ok1 || !ok2 {
+		return value.Undefined(), fmt.Errorf("ternary expects true_val and false_val")
+	}
+	if noneVal, ok := argOrKw(args, 2, kwargs, "none_val"); ok && val.IsNone() {
+		return noneVal, nil
+	}
+	if val.IsTrue() {
+		return trueVal, nil
+	}
+	return falseVal, nil
+}
+
+// mandatory(msg=None) fails the render if the value is undefined
+func filterMandatory(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	if !val.IsUndefined() {
+		return val, nil
+	}
+	if msg, ok := argOrKw(args, 0, kwargs, "msg"); ok && !msg.IsNone() {
+		return value.Undefined(), errors.New(msg.String())
+	}
+	return value.Undefined(), fmt.Errorf("mandatory variable not defined")
+}
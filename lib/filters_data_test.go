@@ -0,0 +1,76 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+)
+
+// renderCases renders each template with data and compares with the expected output
+func renderCases(t *testing.T, data map[string]any, cases map[string]string) {
+	t.Helper()
+	for src, expected := range cases {
+		out, err := TemplateStringWithConfig(src, data)
+		if err != nil {
+			t.Errorf("%s: %v", src, err)
+			continue
+		}
+		if out != expected {
+			t.Errorf("%s:\nexpected %q\ngot      %q", src, expected, out)
+		}
+	}
+}
+
+func TestDataFilters(t *testing.T) {
+	data := map[string]any{
+		"a":     map[string]any{"x": 1, "l": []any{1, 2}, "sub": map[string]any{"p": 1, "q": 2}},
+		"b":     map[string]any{"y": 2, "l": []any{2, 3}, "sub": map[string]any{"q": 3}},
+		"users": []any{map[string]any{"name": "alice", "groups": []any{"wheel", "dev"}}, map[string]any{"name": "bob"}},
+		"nums":  []any{1, 2, 3, 4},
+		"other": []any{3, 4, 5},
+		"doc":   "a: 1\nb: [x, y]\n",
+	}
+	renderCases(t, data, map[string]string{
+		`{{ a | combine(b) | to_json }}`:                                                                      `{"l":[2,3],"sub":{"q":3},"x":1,"y":2}`,
+		`{{ a | combine(b, recursive=true) | to_json }}`:                                                      `{"l":[2,3],"sub":{"p":1,"q":3},"x":1,"y":2}`,
+		`{{ a | combine(b, list_merge='append') | to_json }}`:                                                 `{"l":[1,2,2,3],"sub":{"q":3},"x":1,"y":2}`,
+		`{{ a | combine(b, list_merge='append_rp') | to_json }}`:                                              `{"l":[1,2,3],"sub":{"q":3},"x":1,"y":2}`,
+		`{{ {'k': 1} | combine([{'k': 2}, {'j': 3}]) | to_json }}`:                                            `{"j":3,"k":2}`,
+		`{{ {'b': 2, 'a': 1} | dict2items | to_json }}`:                                                       `[{"key":"a","value":1},{"key":"b","value":2}]`,
+		`{{ {'a': 1} | dict2items(key_name='k', value_name='v') | to_json }}`:                                 `[{"k":"a","v":1}]`,
+		`{{ [{'key': 'a', 'value': 1}] | items2dict | to_json }}`:                                             `{"a":1}`,
+		`{{ ('{"a": [1, 2]}' | from_json).a[1] }}`:                                                            `2`,
+		`{{ (doc | from_yaml).b | join(',') }}`:                                                               `x,y`,
+		`{{ ("a: 1\n---\na: 2\n" | from_yaml_all) | map(attribute='a') | join(',') }}`:                        `1,2`,
+		`{{ {'b': [1], 'a': '<x>'} | to_nice_json }}`:                                                         "{\n    \"a\": \"<x>\",\n    \"b\": [\n        1\n    ]\n}",
+		`{{ {'a': {'b': 1}} | to_nice_yaml }}`:                                                                "a:\n    b: 1\n",
+		`{{ {'a': {'b': 1}} | to_nice_yaml(indent=2) }}`:                                                      "a:\n  b: 1\n",
+		`{{ [1, [2, [3, [4]]], none] | flatten | to_json }}`:                                                  `[1,2,3,4]`,
+		`{{ [1, none, [2, 'None', ['null', 3]]] | flatten | to_json }}`:                                       `[1,2,3]`,
+		`{{ [1, none, 'null'] | flatten(skip_nulls=False) | to_json }}`:                                       `[1,null,"null"]`,
+		`{{ [1, [2, [3, [4]]]] | flatten(levels=1) | to_json }}`:                                              `[1,2,[3,[4]]]`,
+		`{{ [1, [2, [3]]] | flatten(1) | to_json }}`:                                                          `[1,2,[3]]`,
+		`{{ [3, 1, 3, 'a', 'A', 'b'] | unique | to_json }}`:                                                   `[3,1,"a","b"]`,
+		`{{ ['a', 'A', 'a'] | unique(case_sensitive=True) | to_json }}`:                                       `["a","A"]`,
+		`{{ (users + [{'name': 'alice'}]) | unique(attribute='name') | map(attribute='name') | join(',') }}`:  `alice,bob`,
+		`{{ nums | union(other) | to_json }}`:                                                                 `[1,2,3,4,5]`,
+		`{{ nums | intersect(other) | to_json }}`:                                                             `[3,4]`,
+		`{{ nums | difference(other) | to_json }}`:                                                            `[1,2]`,
+		`{{ nums | symmetric_difference(other) | to_json }}`:                                                  `[1,2,5]`,
+		`{{ [1, 2, 3] | zip(['a', 'b']) | to_json }}`:                                                         `[[1,"a"],[2,"b"]]`,
+		`{{ [1, 2] | zip(['a', 'b'], [true, false]) | to_json }}`:                                             `[[1,"a",true],[2,"b",false]]`,
+		`{{ [1, 2] | zip_longest(['a'], fillvalue='-') | to_json }}`:                                          `[[1,"a"],[2,"-"]]`,
+		`{% for u, g in users | subelements('groups', skip_missing=True) %}{{ u.name }}:{{ g }} {% endfor %}`: `alice:wheel alice:dev `,
+		`{{ users | json_query("[?name=='alice'].groups[0]") | to_json }}`:                                    `["wheel"]`,
+		`{{ users | json_query('[*].name') | join(',') }}`:                                                    `alice,bob`,
+		`{{ (1 > 0) | ternary('yes', 'no') }}`:                                                                `yes`,
+		`{{ none | ternary('yes', 'no', 'null') }}`:                                                           `null`,
+		`{{ nums | mandatory | length }}`:                                                                     `4`,
+	})
+
+	if _, err := TemplateStringWithConfig(`{{ users | subelements('groups') }}`, data); err == nil || !strings.Contains(err.Error(), "could not find 'groups'") {
+		t.Errorf("expected a missing subelement error, got %v", err)
+	}
+	if _, err := TemplateStringWithConfig(`{{ missing | mandatory('missing is required') }}`, data); err == nil || !strings.Contains(err.Error(), "missing is required") {
+		t.Errorf("expected the mandatory error, got %v", err)
+	}
+}
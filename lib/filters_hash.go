@@ -0,0 +1,370 @@
+package lib
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	mrand "math/rand/v2"
+	"strconv"
+	"strings"
+
+	mj "github.com/mitsuhiko/minijinja/minijinja-go/v2"
+	"github.com/mitsuhiko/minijinja/minijinja-go/v2/value"
+	"golang.org/x/crypto/blowfish"
+)
+
+// Ansible hashing filters, password_hash with crypt(3) compatible output so the result can go straight into
+// /etc/shadow or a htpasswd file, and random/shuffle with an optional seed for idempotent per host values.
+
+func addHashFilters(env *mj.Environment) {
+	env.AddFilter("hash", filterHash)
+	env.AddFilter("checksum", func(_ mj.FilterState, val value.Value, _ []value.Value, _ map[string]value.Value) (value.Value, error) {
+		return hashValue("checksum", "sha1", val)
+	})
+	env.AddFilter("md5", func(_ mj.FilterState, val value.Value, _ []value.Value, _ map[string]value.Value) (value.Value, error) {
+		return hashValue("md5", "md5", val)
+	})
+	env.AddFilter("sha1", func(_ mj.FilterState, val value.Value, _ []value.Value, _ map[string]value.Value) (value.Value, error) {
+		return hashValue("sha1", "sha1", val)
+	})
+	env.AddFilter("password_hash", filterPasswordHash)
+	env.AddFilter("random", filterRandom)
+	env.AddFilter("shuffle", filterShuffle)
+}
+
+// newHash returns the hash for a python hashlib algorithm name
+func newHash(name string) (hash.Hash, error) {
+	switch strings.ToLower(name) {
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha224":
+		return sha256.New224(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha384":
+		return sha512.New384(), nil
+	case "sha512":
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported hash type '%s'", name)
+}
+
+// bytesArg returns the bytes of a string or bytes value
+func bytesArg(name string, val value.Value) ([]byte, error) {
+	if b, ok := val.Raw().([]byte); ok {
+		return b, nil
+	}
+	s, err := stringArg(name, val)
+	return []byte(s), err
+}
+
+func hashValue(filter, algo string, val value.Value) (value.Value, error) {
+	data, err := bytesArg(filter, val)
+	if err != nil {
+		return value.Undefined(), err
+	}
+	h, err := newHash(algo)
+	if err != nil {
+		return value.Undefined(), fmt.Errorf("%s: %w", filter, err)
+	}
+	h.Write(data)
+	return value.FromString(hex.EncodeToString(h.Sum(nil))), nil
+}
+
+func filterHash(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	algo := "sha1"
+	if v, ok := argOrKw(args, 0, kwargs, "hashtype"); ok {
+		algo = v.String()
+	}
+	return hashValue("hash", algo, val)
+}
+
+func filterPasswordHash(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	password, err := stringArg("password_hash", val)
+	if err != nil {
+		return value.Undefined(), err
+	}
+	hashType, salt, rounds := "sha512", "", 0
+	if v, ok := argOrKw(args, 0, kwargs, "hashtype"); ok {
+		hashType = v.String()
+	}
+	if v, ok := argOrKw(args, 1, kwargs, "salt"); ok && !v.IsNone() {
+		salt = v.String()
+	}
+	if v, ok := argOrKw(args, 2, kwargs, "rounds"); ok && !v.IsNone() {
+		r, ok := v.AsInt()
+		if !ok {
+			return value.Undefined(), fmt.Errorf("password_hash: rounds must be an int, got %s", v.Kind())
+		}
+		rounds = int(r)
+	}
+	out, err := PasswordHash(password, hashType, salt, rounds, kwString(kwargs, "ident", ""))
+	if err != nil {
+		return value.Undefined(), fmt.Errorf("password_hash: %w", err)
+	}
+	return value.FromString(out), nil
+}
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// randomSalt returns n random chars of the crypt alphabet
+func randomSalt(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	for i := range b {
+		b[i] = cryptAlphabet[int(b[i])%len(cryptAlphabet)]
+	}
+	return string(b)
+}
+
+// PasswordHash returns the crypt(3) hash of password. hashType is sha512 ($6$), sha256 ($5$) or bcrypt (alias
+// blowfish, $2b$). An empty salt is generated randomly, which like ansible makes the result change on every run
+// so pass a salt for idempotent output. rounds 0 is the default (5000 for sha, cost 12 for bcrypt); ident picks
+// the bcrypt variant (2a, 2b or 2y).
+func PasswordHash(password, hashType, salt string, rounds int, ident string) (string, error) {
+	switch strings.ToLower(hashType) {
+	case "sha512", "sha512_crypt":
+		if salt == "" {
+			salt = randomSalt(16)
+		}
+		return shaCrypt(sha512.New, "6", password, salt, rounds)
+	case "sha256", "sha256_crypt":
+		if salt == "" {
+			salt = randomSalt(16)
+		}
+		return shaCrypt(sha256.New, "5", password, salt, rounds)
+	case "bcrypt", "blowfish":
+		if salt == "" {
+			salt = randomSalt(22)
+		}
+		return bcryptHash(password, salt, rounds, ident)
+	}
+	return "", fmt.Errorf("unsupported hash type '%s'", hashType)
+}
+
+// shaCrypt is the SHA-crypt algorithm from https://www.akkadia.org/drepper/SHA-crypt.txt
+func shaCrypt(newHash func() hash.Hash, id, password, salt string, rounds int) (string, error) {
+	customRounds := rounds != 0
+	if !customRounds {
+		rounds = 5000
+	}
+	rounds = max(1000, min(rounds, 999999999))
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+	if strings.ContainsAny(salt, "$:\n") {
+		return "", fmt.Errorf("invalid characters in salt '%s'", salt)
+	}
+	p, s := []byte(password), []byte(salt)
+
+	h := newHash()
+	h.Write(p)
+	h.Write(s)
+	h.Write(p)
+	b := h.Sum(nil)
+	size := len(b)
+
+	h = newHash()
+	h.Write(p)
+	h.Write(s)
+	for n := len(p); n > 0; n -= size {
+		h.Write(b[:min(n, size)])
+	}
+	for n := len(p); n > 0; n >>= 1 {
+		if n&1 == 1 {
+			h.Write(b)
+		} else {
+			h.Write(p)
+		}
+	}
+	a := h.Sum(nil)
+
+	h = newHash()
+	for range len(p) {
+		h.Write(p)
+	}
+	dp := h.Sum(nil)
+	pSeq := make([]byte, 0, len(p))
+	for n := len(p); n > 0; n -= size {
+		pSeq = append(pSeq, dp[:min(n, size)]...)
+	}
+
+	h = newHash()
+	for range 16 + int(a[0]) {
+		h.Write(s)
+	}
+	sSeq := h.Sum(nil)[:len(s)]
+
+	for i := range rounds {
+		h = newHash()
+		if i&1 == 1 {
+			h.Write(pSeq)
+		} else {
+			h.Write(a)
+		}
+		if i%3 != 0 {
+			h.Write(sSeq)
+		}
+		if i%7 != 0 {
+			h.Write(pSeq)
+		}
+		if i&1 == 1 {
+			h.Write(a)
+		} else {
+			h.Write(pSeq)
+		}
+		a = h.Sum(nil)
+	}
+
+	// the digest bytes are encoded in groups of three in this permuted order
+	var order [][3]int
+	if size == 64 {
+		for i := range 21 {
+			order = append(order, [3]int{i * 22 % 63, (i*22 + 21) % 63, (i*22 + 42) % 63})
+		}
+		order = append(order, [3]int{-1, -1, 63})
+	} else {
+		for i := range 10 {
+			order = append(order, [3]int{i * 21 % 30, (i*21 + 10) % 30, (i*21 + 20) % 30})
+		}
+		order = append(order, [3]int{-1, 31, 30})
+	}
+	var enc strings.Builder
+	for _, g := range order {
+		w, n := 0, 4
+		for _, idx := range g {
+			w <<= 8
+			if idx < 0 {
+				n--
+				continue
+			}
+			w |= int(a[idx])
+		}
+		for range n {
+			enc.WriteByte(cryptAlphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+
+	out := "$" + id + "$"
+	if customRounds {
+		out += "rounds=" + strconv.Itoa(rounds) + "$"
+	}
+	return out + salt + "$" + enc.String(), nil
+}
+
+var bcryptEncoding = base64.NewEncoding("./ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789").WithPadding(base64.NoPadding)
+
+// bcryptHash is bcrypt with a caller supplied salt (22 chars of the bcrypt alphabet), which x/crypto/bcrypt does
+// not allow
+func bcryptHash(password, salt string, cost int, ident string) (string, error) {
+	if cost == 0 {
+		cost = 12
+	}
+	if cost < 4 || cost > 31 {
+		return "", fmt.Errorf("bcrypt rounds must be between 4 and 31, got %d", cost)
+	}
+	switch ident {
+	case "":
+		ident = "2b"
+	case "2a", "2b", "2y":
+	default:
+		return "", fmt.Errorf("unsupported bcrypt ident '%s'", ident)
+	}
+	if len(salt) != 22 {
+		return "", fmt.Errorf("bcrypt salt must be 22 chars, got %d", len(salt))
+	}
+	csalt, err := bcryptEncoding.DecodeString(salt)
+	if err != nil {
+		return "", fmt.Errorf("invalid bcrypt salt '%s': %w", salt, err)
+	}
+	if len(password) > 72 {
+		return "", fmt.Errorf("bcrypt password is longer than 72 bytes")
+	}
+	key := append([]byte(password), 0)
+	c, err := blowfish.NewSaltedCipher(key, csalt)
+	if err != nil {
+		return "", err
+	}
+	for i := uint64(0); i < 1<<uint(cost); i++ {
+		blowfish.ExpandKey(key, c)
+		blowfish.ExpandKey(csalt, c)
+	}
+	ctext := []byte("OrpheanBeholderScryDoubt")
+	for i := 0; i < len(ctext); i += 8 {
+		for range 64 {
+			c.Encrypt(ctext[i:i+8], ctext[i:i+8])
+		}
+	}
+	// like the C implementations only 23 of the 24 bytes are encoded
+	return fmt.Sprintf("$%s$%02d$%s%s", ident, cost, bcryptEncoding.EncodeToString(csalt), bcryptEncoding.EncodeToString(ctext[:23])), nil
+}
+
+// newRand returns a rand seeded from seed, or from crypto/rand if there is no seed
+func newRand(kwargs map[string]value.Value) *mrand.Rand {
+	seed, ok := kwargs["seed"]
+	if !ok || seed.IsNone() || seed.IsUndefined() {
+		var b [16]byte
+		rand.Read(b[:])
+		return mrand.New(mrand.NewPCG(binary.LittleEndian.Uint64(b[:8]), binary.LittleEndian.Uint64(b[8:])))
+	}
+	sum := sha256.Sum256([]byte(seed.String()))
+	return mrand.New(mrand.NewPCG(binary.LittleEndian.Uint64(sum[:8]), binary.LittleEndian.Uint64(sum[8:16])))
+}
+
+// filterRandom is ansible random: an int end gives a number in [start, end) by step, a sequence or string gives a
+// random item. The same seed always gives the same result, e.g. random(seed=inventory_hostname).
+func filterRandom(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	r := newRand(kwargs)
+	if end, ok := val.AsInt(); ok && val.IsActualInt() {
+		start, step := int64(0), int64(1)
+		if v, ok := argOrKw(args, 0, kwargs, "start"); ok && !v.IsNone() {
+			start, _ = v.AsInt()
+		}
+		if v, ok := argOrKw(args, 1, kwargs, "step"); ok && !v.IsNone() {
+			step, _ = v.AsInt()
+		}
+		if step <= 0 {
+			return value.Undefined(), fmt.Errorf("random: step must be positive")
+		}
+		n := (end - start + step - 1) / step
+		if n <= 0 {
+			return value.Undefined(), fmt.Errorf("random: empty range [%d, %d)", start, end)
+		}
+		return value.FromInt(start + r.Int64N(n)*step), nil
+	}
+	_, hasStart := kwargs["start"]
+	_, hasStep := kwargs["step"]
+	if len(args) > 0 || hasStart || hasStep {
+		return value.Undefined(), fmt.Errorf("random: start and step can only be used with integer values")
+	}
+	if s, ok := val.AsString(); ok {
+		chars := []rune(s)
+		if len(chars) == 0 {
+			return value.Undefined(), fmt.Errorf("random: empty string")
+		}
+		return value.FromString(string(chars[r.IntN(len(chars))])), nil
+	}
+	items := val.Iter()
+	if len(items) == 0 {
+		return value.Undefined(), fmt.Errorf("random: cannot choose from an empty %s", val.Kind())
+	}
+	return items[r.IntN(len(items))], nil
+}
+
+// filterShuffle returns a shuffled copy of the list, seed works like in random
+func filterShuffle(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	items := append([]value.Value{}, val.Iter()...)
+	r := newRand(kwargs)
+	r.Shuffle(len(items), func(i, j int) { items[i], items[j] = items[j], items[i] })
+	return value.FromSlice(items), nil
+}
@@ -0,0 +1,44 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHashFilters(t *testing.T) {
+	renderCases(t, map[string]any{"host": "web1"}, map[string]string{
+		`{{ 'hello' | hash('sha256') }}`:                                `2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824`,
+		`{{ 'hello' | hash }}`:                                          `aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d`,
+		`{{ 'hello' | checksum }}`:                                      `aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d`,
+		`{{ 'hello' | sha1 }}`:                                          `aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d`,
+		`{{ 'hello' | md5 }}`:                                           `5d41402abc4b2a76b9719d911017c592`,
+		`{{ 'secret' | password_hash('sha512', 'saltsalt') }}`:          `$6$saltsalt$TVLlQcbpFVof5W3Yz4DTP6gRstiNuHwwTt6GLc1E5n0U0aDehy0S5knV8wiOQSpT0Y77vwPZN.Pq.H91p5hVO1`,
+		`{{ 'secret' | password_hash('sha256', salt='saltsalt') }}`:     `$5$saltsalt$0IyaXrmV7.sGNS6tirgqHLqX/G.FBvgkYA.lpPdS5sA`,
+		`{{ 'secret' | password_hash('sha512', 'abc', rounds=10000) }}`: `$6$rounds=10000$abc$3DDOWZMNRRKDT142bUtYQRY52ycK/xshRXOQgIyt2QRXzLDnoPq6v4lO9bA3f/JhGz1mHrAh.QUDGHmaE5RxP.`,
+		`{{ 'abc' | random(seed=host) == 'abc' | random(seed=host) }}`:  `true`,
+		`{{ 'abc' | random(seed=host) in 'abc' }}`:                      `true`,
+		`{{ [5, 10, 15] | random(seed=host) in [5, 10, 15] }}`:          `true`,
+		`{{ 60 | random(seed=host) == 60 | random(seed=host) }}`:        `true`,
+		`{{ (100 | random(10, 10, seed=host)) % 10 }}`:                  `0`,
+		`{{ [1, 2, 3] | shuffle(seed=host) | sort | join(',') }}`:       `1,2,3`,
+	})
+
+	hashed, err := TemplateStringWithConfig(`{{ 'secret' | password_hash('bcrypt', 'abcdefghijklmnopqrstuu', rounds=4) }}`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hashed, "$2b$04$abcdefghijklmnopqrstuu") || bcrypt.CompareHashAndPassword([]byte(hashed), []byte("secret")) != nil {
+		t.Errorf("bcrypt hash %q does not verify", hashed)
+	}
+	if a, _ := PasswordHash("secret", "sha512", "", 0, ""); !strings.HasPrefix(a, "$6$") || len(a) != 3+16+1+86 {
+		t.Errorf("unexpected random salt hash %q", a)
+	}
+	if _, err := TemplateStringWithConfig(`{{ 'x' | hash('nope') }}`, nil); err == nil {
+		t.Errorf("expected an unsupported hash type error")
+	}
+	if _, err := TemplateStringWithConfig(`{{ [1] | random(1) }}`, nil); err == nil {
+		t.Errorf("expected an error for start on a list")
+	}
+}
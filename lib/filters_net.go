@@ -0,0 +1,574 @@
+package lib
+
+import (
+	"fmt"
+	"math/big"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	mj "github.com/mitsuhiko/minijinja/minijinja-go/v2"
+	"github.com/mitsuhiko/minijinja/minijinja-go/v2/value"
+)
+
+// Ansible ipaddr filter family (ansible.utils.ipaddr and friends) on top of net/netip. Like the netaddr based
+// originals they take a single value or a list; an invalid value gives false and is dropped from lists.
+
+func addNetFilters(env *mj.Environment) {
+	env.AddFilter("ipaddr", func(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+		return ipFilter(val, args, kwargs, 0)
+	})
+	env.AddFilter("ipv4", func(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+		return ipFilter(val, args, kwargs, 4)
+	})
+	env.AddFilter("ipv6", func(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+		return ipFilter(val, args, kwargs, 6)
+	})
+	env.AddFilter("ipmath", filterIpmath)
+	env.AddFilter("ipsubnet", filterIpsubnet)
+	env.AddFilter("cidr_merge", filterCidrMerge)
+}
+
+// ipValue is an address with its prefix. bare is set when it was given without a prefix, it then has the full
+// length prefix (/32 or /128).
+type ipValue struct {
+	p    netip.Prefix
+	bare bool
+}
+
+// parseIP parses "addr", "addr/prefix", "addr/netmask" or an int
+func parseIP(val value.Value) (ipValue, bool) {
+	if val.IsActualInt() {
+		n, _ := val.AsInt()
+		addr, ok := intToAddr(big.NewInt(n), n <= 0xffffffff)
+		if !ok {
+			return ipValue{}, false
+		}
+		return ipValue{netip.PrefixFrom(addr, addr.BitLen()), true}, true
+	}
+	s, ok := val.AsString()
+	if !ok {
+		return ipValue{}, false
+	}
+	return parseIPString(strings.TrimSpace(s))
+}
+
+func parseIPString(s string) (ipValue, bool) {
+	addrPart, prefixPart, hasPrefix := strings.Cut(s, "/")
+	addr, err := netip.ParseAddr(addrPart)
+	if err != nil || addr.Zone() != "" {
+		return ipValue{}, false
+	}
+	if !hasPrefix {
+		return ipValue{netip.PrefixFrom(addr, addr.BitLen()), true}, true
+	}
+	bits, err := strconv.Atoi(prefixPart)
+	if err != nil {
+		// a netmask like 255.255.255.0
+		mask, err := netip.ParseAddr(prefixPart)
+		if err != nil || mask.BitLen() != addr.BitLen() {
+			return ipValue{}, false
+		}
+		if bits = maskBits(mask); bits < 0 {
+			return ipValue{}, false
+		}
+	}
+	p := netip.PrefixFrom(addr, bits)
+	return ipValue{p, false}, p.IsValid()
+}
+
+// maskBits returns the prefix length of a netmask, or -1 if it is not contiguous
+func maskBits(mask netip.Addr) int {
+	n := addrToInt(mask)
+	bits := mask.BitLen()
+	ones := 0
+	for ones < bits && n.Bit(bits-1-ones) == 1 {
+		ones++
+	}
+	for i := 0; i < bits-ones; i++ {
+		if n.Bit(i) == 1 {
+			return -1
+		}
+	}
+	return ones
+}
+
+func addrToInt(a netip.Addr) *big.Int {
+	return new(big.Int).SetBytes(a.AsSlice())
+}
+
+// intToAddr converts n to an IPv4 or IPv6 address, false if n does not fit
+func intToAddr(n *big.Int, is4 bool) (netip.Addr, bool) {
+	size := 16
+	if is4 {
+		size = 4
+	}
+	if n.Sign() < 0 || n.BitLen() > size*8 {
+		return netip.Addr{}, false
+	}
+	return netip.AddrFromSlice(n.FillBytes(make([]byte, size)))
+}
+
+// offsetAddr returns a + n
+func offsetAddr(a netip.Addr, n *big.Int) (netip.Addr, bool) {
+	return intToAddr(new(big.Int).Add(addrToInt(a), n), a.Is4())
+}
+
+func (v ipValue) String() string {
+	if v.bare {
+		return v.p.Addr().String()
+	}
+	return v.p.String()
+}
+
+func (v ipValue) addr() netip.Addr    { return v.p.Addr() }
+func (v ipValue) network() netip.Addr { return v.p.Masked().Addr() }
+
+// size is the number of addresses in the network
+func (v ipValue) size() *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(v.p.Addr().BitLen()-v.p.Bits()))
+}
+
+// nth returns the address at offset i of the network, negative counts from the end
+func (v ipValue) nth(i *big.Int) (netip.Addr, bool) {
+	size := v.size()
+	if i.Sign() < 0 {
+		i = new(big.Int).Add(size, i)
+	}
+	if i.Sign() < 0 || i.Cmp(size) >= 0 {
+		return netip.Addr{}, false
+	}
+	return offsetAddr(v.network(), i)
+}
+
+func (v ipValue) last() netip.Addr {
+	a, _ := v.nth(big.NewInt(-1))
+	return a
+}
+
+func (v ipValue) netmask() netip.Addr {
+	mask := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), uint(v.p.Addr().BitLen())), v.size())
+	a, _ := intToAddr(mask, v.p.Addr().Is4())
+	return a
+}
+
+func (v ipValue) hostmask() netip.Addr {
+	a, _ := intToAddr(new(big.Int).Sub(v.size(), big.NewInt(1)), v.p.Addr().Is4())
+	return a
+}
+
+// usable returns the first and last usable host address: the network and broadcast addresses are excluded for
+// networks bigger than 2 addresses
+func (v ipValue) usable() (netip.Addr, netip.Addr) {
+	if v.size().Cmp(big.NewInt(2)) <= 0 {
+		return v.network(), v.last()
+	}
+	return v.network().Next(), v.last().Prev()
+}
+
+// isNetworkOrBroadcast is true when the address is the network or broadcast address of a network bigger than 2
+func (v ipValue) isNetworkOrBroadcast() bool {
+	return v.size().Cmp(big.NewInt(2)) > 0 && (v.addr() == v.network() || v.addr() == v.last())
+}
+
+func (v ipValue) version() int {
+	if v.addr().Is4() {
+		return 4
+	}
+	return 6
+}
+
+func (v ipValue) revdns() string {
+	a := v.addr()
+	var parts []string
+	if a.Is4() {
+		b := a.As4()
+		for i := 3; i >= 0; i-- {
+			parts = append(parts, strconv.Itoa(int(b[i])))
+		}
+		return strings.Join(parts, ".") + ".in-addr.arpa."
+	}
+	b := a.As16()
+	for i := 15; i >= 0; i-- {
+		parts = append(parts, fmt.Sprintf("%x.%x", b[i]&0xf, b[i]>>4))
+	}
+	return strings.Join(parts, ".") + ".ip6.arpa."
+}
+
+func isPublic(a netip.Addr) bool {
+	return a.IsGlobalUnicast() && !a.IsPrivate() && !a.IsLoopback() && !a.IsLinkLocalUnicast()
+}
+
+func bigValue(n *big.Int) value.Value {
+	if n.IsInt64() {
+		return value.FromInt(n.Int64())
+	}
+	return value.FromBigInt(n)
+}
+
+// ipQuery applies an ipaddr query to v. Queries that select (private, public, ...) return the value itself,
+// false is returned when the value does not match the query.
+func ipQuery(v ipValue, query value.Value) (value.Value, error) {
+	no := value.FromBool(false)
+	if query.IsActualInt() {
+		n, _ := query.AsInt()
+		return ipNth(v, big.NewInt(n)), nil
+	}
+	q := strings.ToLower(query.String())
+	if n, err := strconv.ParseInt(q, 10, 64); err == nil {
+		return ipNth(v, big.NewInt(n)), nil
+	}
+	switch q {
+	case "":
+		return value.FromString(v.String()), nil
+	case "bool":
+		return value.FromBool(true), nil
+	case "address", "ip":
+		if !v.bare && v.addr() == v.network() && v.size().Cmp(big.NewInt(2)) > 0 {
+			return no, nil
+		}
+		return value.FromString(v.addr().String()), nil
+	case "host":
+		if v.bare {
+			return value.FromString(netip.PrefixFrom(v.addr(), v.addr().BitLen()).String()), nil
+		}
+		if v.addr() == v.network() && v.size().Cmp(big.NewInt(2)) > 0 {
+			return no, nil
+		}
+		return value.FromString(v.p.String()), nil
+	case "address/prefix", "host/prefix", "ip/prefix":
+		if v.bare || v.isNetworkOrBroadcast() {
+			return no, nil
+		}
+		return value.FromString(v.p.String()), nil
+	case "network", "network_id":
+		return value.FromString(v.network().String()), nil
+	case "subnet", "cidr", "network/prefix":
+		return value.FromString(v.p.Masked().String()), nil
+	case "net":
+		if v.size().Cmp(big.NewInt(1)) > 0 && v.addr() == v.network() {
+			return value.FromString(v.p.Masked().String()), nil
+		}
+		return no, nil
+	case "netmask":
+		return value.FromString(v.netmask().String()), nil
+	case "hostmask":
+		return value.FromString(v.hostmask().String()), nil
+	case "prefix":
+		return value.FromInt(int64(v.p.Bits())), nil
+	case "broadcast":
+		if v.version() == 4 && v.size().Cmp(big.NewInt(2)) > 0 {
+			return value.FromString(v.last().String()), nil
+		}
+		return value.None(), nil
+	case "size":
+		return bigValue(v.size()), nil
+	case "size_usable":
+		first, last := v.usable()
+		return bigValue(new(big.Int).Add(new(big.Int).Sub(addrToInt(last), addrToInt(first)), big.NewInt(1))), nil
+	case "first_usable":
+		first, _ := v.usable()
+		return value.FromString(first.String()), nil
+	case "last_usable":
+		_, last := v.usable()
+		return value.FromString(last.String()), nil
+	case "next_usable":
+		if _, last := v.usable(); v.addr().Less(last) {
+			return value.FromString(v.addr().Next().String()), nil
+		}
+		return no, nil
+	case "previous_usable":
+		if first, _ := v.usable(); first.Less(v.addr()) {
+			return value.FromString(v.addr().Prev().String()), nil
+		}
+		return no, nil
+	case "range_usable":
+		first, last := v.usable()
+		return value.FromString(first.String() + "-" + last.String()), nil
+	case "type":
+		if v.bare || v.size().Cmp(big.NewInt(1)) == 0 || v.addr() != v.network() {
+			return value.FromString("address"), nil
+		}
+		return value.FromString("network"), nil
+	case "version":
+		return value.FromInt(int64(v.version())), nil
+	case "int":
+		n := addrToInt(v.addr())
+		if v.bare {
+			return bigValue(n), nil
+		}
+		return value.FromString(fmt.Sprintf("%s/%d", n, v.p.Bits())), nil
+	case "revdns":
+		return value.FromString(v.revdns()), nil
+	case "wrap":
+		if v.version() == 6 && v.bare {
+			return value.FromString("[" + v.String() + "]"), nil
+		}
+		return value.FromString(v.String()), nil
+	case "ipv4", "v4":
+		if v.version() == 4 {
+			return value.FromString(v.String()), nil
+		}
+		if a := v.addr(); a.Is4In6() && v.p.Bits() >= 96 {
+			out := ipValue{netip.PrefixFrom(a.Unmap(), v.p.Bits()-96), v.bare}
+			return value.FromString(out.String()), nil
+		}
+		return no, nil
+	case "ipv6", "v6":
+		if v.version() == 6 {
+			return value.FromString(v.String()), nil
+		}
+		return value.FromString(netip.PrefixFrom(netip.AddrFrom16(v.addr().As16()), v.p.Bits()+96).String()), nil
+	case "private", "public", "loopback", "lo", "multicast", "link-local", "unicast":
+		a := v.network()
+		match := map[string]bool{
+			"private":    a.IsPrivate(),
+			"public":     isPublic(a),
+			"loopback":   a.IsLoopback(),
+			"lo":         a.IsLoopback(),
+			"multicast":  a.IsMulticast(),
+			"link-local": a.IsLinkLocalUnicast(),
+			"unicast":    !a.IsMulticast() && a.IsValid(),
+		}[q]
+		if match {
+			return value.FromString(v.String()), nil
+		}
+		return no, nil
+	}
+	// a network as query selects the values inside it
+	if network, ok := parseIPString(q); ok {
+		if network.p.Masked().Contains(v.addr()) && v.p.Bits() >= network.p.Bits() {
+			return value.FromString(v.String()), nil
+		}
+		return no, nil
+	}
+	return value.Undefined(), fmt.Errorf("unknown ipaddr query '%s'", q)
+}
+
+// ipNth returns the nth address of the network as addr/prefix, negative counts from the end
+func ipNth(v ipValue, n *big.Int) value.Value {
+	a, ok := v.nth(n)
+	if !ok {
+		return value.FromBool(false)
+	}
+	return value.FromString(netip.PrefixFrom(a, v.p.Bits()).String())
+}
+
+// ipFilter is ipaddr(query=”) on a value or a list, restricted to IP version if not 0
+func ipFilter(val value.Value, args []value.Value, kwargs map[string]value.Value, version int) (value.Value, error) {
+	query := value.FromString("")
+	if v, ok := argOrKw(args, 0, kwargs, "query"); ok && !v.IsNone() {
+		query = v
+	}
+	one := func(item value.Value) (value.Value, error) {
+		v, ok := parseIP(item)
+		if !ok || (version != 0 && v.version() != version) {
+			return value.FromBool(false), nil
+		}
+		return ipQuery(v, query)
+	}
+	if val.Kind() == value.KindSeq || val.Kind() == value.KindIterable {
+		out := []value.Value{}
+		for _, item := range val.Iter() {
+			r, err := one(item)
+			if err != nil {
+				return value.Undefined(), err
+			}
+			if r.IsTrue() {
+				out = append(out, r)
+			}
+		}
+		return value.FromSlice(out), nil
+	}
+	return one(val)
+}
+
+// filterIpmath is ipmath(amount): the address plus amount (which can be negative)
+func filterIpmath(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	v, ok := parseIP(val)
+	if !ok || !v.bare {
+		return value.Undefined(), fmt.Errorf("ipmath: '%s' is not a valid IP address", val)
+	}
+	amount, ok := argOrKw(args, 0, kwargs, "amount")
+	n, isInt := amount.AsInt()
+	if !ok || !isInt {
+		return value.Undefined(), fmt.Errorf("ipmath: amount must be an integer, got %s", amount)
+	}
+	a, ok := offsetAddr(v.addr(), big.NewInt(n))
+	if !ok {
+		return value.Undefined(), fmt.Errorf("ipmath: %s %+d is out of the address space", v.addr(), n)
+	}
+	return value.FromString(a.String()), nil
+}
+
+// filterIpsubnet follows ansible ipsubnet:
+//   - ipsubnet(n): the number of /n subnets of the network, or for a single address the /n network containing it
+//   - ipsubnet(n, i): the i-th /n subnet (negative counts from the end), for an address the i-th supernet from /n
+//   - ipsubnet(network): the 1 based position of the value among the subnets of that size in network
+func filterIpsubnet(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	no := value.FromBool(false)
+	v, ok := parseIP(val)
+	if !ok {
+		return no, nil
+	}
+	net := ipValue{p: v.p.Masked()}
+	query, ok := argOrKw(args, 0, kwargs, "query")
+	if !ok || query.IsNone() || query.String() == "" {
+		return value.FromString(net.String()), nil
+	}
+	bitLen := v.addr().BitLen()
+	if bits, err := strconv.Atoi(query.String()); err == nil {
+		if bits < 0 || bits > bitLen {
+			return no, nil
+		}
+		index, hasIndex := argOrKw(args, 1, kwargs, "index")
+		i, isInt := index.AsInt()
+		if hasIndex && !isInt {
+			return no, nil
+		}
+		if net.size().Cmp(big.NewInt(1)) == 0 {
+			// supernets of the address, from /bits up to /bitLen-1
+			if bits >= bitLen {
+				return no, nil
+			}
+			if !hasIndex {
+				i = 0
+			}
+			if i < 0 {
+				i += int64(bitLen - bits)
+			}
+			if i < 0 || int(i) >= bitLen-bits {
+				return no, nil
+			}
+			return value.FromString(netip.PrefixFrom(v.addr(), bits+int(i)).Masked().String()), nil
+		}
+		count := big.NewInt(0)
+		if bits >= net.p.Bits() {
+			count.Lsh(big.NewInt(1), uint(bits-net.p.Bits()))
+		}
+		if !hasIndex {
+			return value.FromString(count.String()), nil
+		}
+		n := big.NewInt(i)
+		if n.Sign() < 0 {
+			n.Add(n, count)
+		}
+		if n.Sign() < 0 || n.Cmp(count) >= 0 {
+			return no, nil
+		}
+		sub := new(big.Int).Lsh(n, uint(bitLen-bits))
+		a, _ := offsetAddr(net.addr(), sub)
+		return value.FromString(netip.PrefixFrom(a, bits).String()), nil
+	}
+	parent, ok := parseIPString(query.String())
+	if !ok {
+		return value.Undefined(), fmt.Errorf("ipsubnet: invalid query '%s'", query)
+	}
+	parentNet := parent.p.Masked()
+	if parentNet.Addr().BitLen() != bitLen || net.p.Bits() < parentNet.Bits() || !parentNet.Contains(net.addr()) {
+		return no, nil
+	}
+	offset := new(big.Int).Sub(addrToInt(net.addr()), addrToInt(parentNet.Addr()))
+	pos := offset.Rsh(offset, uint(bitLen-net.p.Bits()))
+	return value.FromString(pos.Add(pos, big.NewInt(1)).String()), nil
+}
+
+// filterCidrMerge merges a list of addresses and networks into the smallest list of networks covering the same
+// addresses (action='merge'), or the single smallest network spanning them all (action='span')
+func filterCidrMerge(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	action := "merge"
+	if v, ok := argOrKw(args, 0, kwargs, "action"); ok {
+		action = v.String()
+	}
+	prefixes := []netip.Prefix{}
+	for _, item := range val.Iter() {
+		v, ok := parseIP(item)
+		if !ok {
+			return value.Undefined(), fmt.Errorf("cidr_merge: invalid IP value '%s'", item)
+		}
+		prefixes = append(prefixes, v.p.Masked())
+	}
+	var out []netip.Prefix
+	switch action {
+	case "merge":
+		out = mergePrefixes(prefixes)
+	case "span":
+		if len(prefixes) == 0 {
+			return value.None(), nil
+		}
+		span, err := spanPrefixes(prefixes)
+		if err != nil {
+			return value.Undefined(), fmt.Errorf("cidr_merge: %w", err)
+		}
+		// like ansible a single address spans to a bare address
+		if span.IsSingleIP() {
+			return value.FromString(span.Addr().String()), nil
+		}
+		return value.FromString(span.String()), nil
+	default:
+		return value.Undefined(), fmt.Errorf("cidr_merge: invalid action '%s'", action)
+	}
+	items := make([]value.Value, len(out))
+	for i, p := range out {
+		items[i] = value.FromString(p.String())
+	}
+	return value.FromSlice(items), nil
+}
+
+func comparePrefixes(a, b netip.Prefix) int {
+	if c := a.Addr().Compare(b.Addr()); c != 0 {
+		return c
+	}
+	return a.Bits() - b.Bits()
+}
+
+// mergePrefixes returns the sorted minimal list of networks covering prefixes (which must be masked)
+func mergePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	sorted := slices.Clone(prefixes)
+	slices.SortFunc(sorted, comparePrefixes)
+	stack := []netip.Prefix{}
+	for _, p := range sorted {
+		if n := len(stack); n > 0 && stack[n-1].Overlaps(p) {
+			// sorted by address then size, so the previous one contains p
+			continue
+		}
+		stack = append(stack, p)
+		// merge sibling halves into their parent for as long as possible
+		for n := len(stack); n >= 2; n = len(stack) {
+			a, b := stack[n-2], stack[n-1]
+			if a.Bits() != b.Bits() || a.Bits() == 0 {
+				break
+			}
+			parent, _ := a.Addr().Prefix(a.Bits() - 1)
+			if parent.Addr() != a.Addr() || !parent.Contains(b.Addr()) {
+				break
+			}
+			stack = append(stack[:n-2], parent)
+		}
+	}
+	return stack
+}
+
+// spanPrefixes returns the smallest network containing all prefixes
+func spanPrefixes(prefixes []netip.Prefix) (netip.Prefix, error) {
+	lo, hi := prefixes[0].Addr(), ipValue{p: prefixes[0]}.last()
+	for _, p := range prefixes[1:] {
+		if p.Addr().BitLen() != lo.BitLen() {
+			return netip.Prefix{}, fmt.Errorf("cannot span IPv4 and IPv6 networks")
+		}
+		if p.Addr().Less(lo) {
+			lo = p.Addr()
+		}
+		if last := (ipValue{p: p}).last(); hi.Less(last) {
+			hi = last
+		}
+	}
+	for bits := lo.BitLen(); bits >= 0; bits-- {
+		p, _ := lo.Prefix(bits)
+		if p.Contains(hi) {
+			return p, nil
+		}
+	}
+	return netip.Prefix{}, fmt.Errorf("no network spans %s-%s", lo, hi)
+}
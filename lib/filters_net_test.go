@@ -0,0 +1,56 @@
+package lib
+
+import "testing"
+
+func TestNetFilters(t *testing.T) {
+	data := map[string]any{
+		"addrs": []any{"192.168.1.10", "foo", "2001:db8::1", "10.0.0.0/8"},
+		"nets":  []any{"192.168.0.0/25", "192.168.0.128/25", "10.0.0.1", "10.0.0.0/8", "172.16.0.0/24", "172.16.1.0/24"},
+	}
+	renderCases(t, data, map[string]string{
+		`{{ '192.168.1.10/24' | ipaddr }}`:                            `192.168.1.10/24`,
+		`{{ '192.168.1.10/255.255.255.0' | ipaddr }}`:                 `192.168.1.10/24`,
+		`{{ 'foo' | ipaddr }}`:                                        `false`,
+		`{{ '192.168.1.10/24' | ipaddr('network') }}`:                 `192.168.1.0`,
+		`{{ '192.168.1.10/24' | ipaddr('netmask') }}`:                 `255.255.255.0`,
+		`{{ '192.168.1.10/24' | ipaddr('hostmask') }}`:                `0.0.0.255`,
+		`{{ '192.168.1.10/24' | ipaddr('prefix') + 1 }}`:              `25`,
+		`{{ '192.168.1.10/24' | ipaddr('broadcast') }}`:               `192.168.1.255`,
+		`{{ '192.168.1.10/24' | ipaddr('address') }}`:                 `192.168.1.10`,
+		`{{ '192.168.1.0/24' | ipaddr('address') }}`:                  `false`,
+		`{{ '192.168.1.10' | ipaddr('host') }}`:                       `192.168.1.10/32`,
+		`{{ '192.168.1.10/24' | ipaddr('subnet') }}`:                  `192.168.1.0/24`,
+		`{{ '192.168.1.10/24' | ipaddr('size') }}`:                    `256`,
+		`{{ '2001:db8::/32' | ipaddr('size') }}`:                      `79228162514264337593543950336`,
+		`{{ '2001:db8::5/64' | ipaddr('netmask') }}`:                  `ffff:ffff:ffff:ffff::`,
+		`{{ '192.168.0.0/24' | ipaddr(5) }}`:                          `192.168.0.5/24`,
+		`{{ '192.168.0.0/24' | ipaddr('-1') }}`:                       `192.168.0.255/24`,
+		`{{ '192.168.0.0/24' | ipaddr(300) }}`:                        `false`,
+		`{{ '192.168.0.0/24' | ipaddr('range_usable') }}`:             `192.168.0.1-192.168.0.254`,
+		`{{ '10.0.0.0/31' | ipaddr('last_usable') }}`:                 `10.0.0.1`,
+		`{{ '192.168.0.7/24' | ipaddr('next_usable') }}`:              `192.168.0.8`,
+		`{{ '192.168.1.10' | ipaddr('revdns') }}`:                     `10.1.168.192.in-addr.arpa.`,
+		`{{ '192.168.1.1' | ipaddr('ipv6') }}`:                        `::ffff:192.168.1.1/128`,
+		`{{ '::ffff:10.0.0.1' | ipaddr('ipv4') }}`:                    `10.0.0.1`,
+		`{{ '10.1.2.3' | ipaddr('private') }}`:                        `10.1.2.3`,
+		`{{ '8.8.8.8' | ipaddr('private') }}`:                         `false`,
+		`{{ '8.8.8.8' | ipaddr('public') }}`:                          `8.8.8.8`,
+		`{{ '10.1.2.3' | ipaddr('10.0.0.0/8') }}`:                     `10.1.2.3`,
+		`{{ '11.1.2.3' | ipaddr('10.0.0.0/8') }}`:                     `false`,
+		`{{ addrs | ipaddr | join(',') }}`:                            `192.168.1.10,2001:db8::1,10.0.0.0/8`,
+		`{{ addrs | ipv4 | join(',') }}`:                              `192.168.1.10,10.0.0.0/8`,
+		`{{ addrs | ipv6 | join(',') }}`:                              `2001:db8::1`,
+		`{{ addrs | ipv4('address') | join(',') }}`:                   `192.168.1.10`,
+		`{{ '10.0.0.5' | ipmath(10) }}`:                               `10.0.0.15`,
+		`{{ '10.0.0.5' | ipmath(-6) }}`:                               `9.255.255.255`,
+		`{{ '2001:db8::1' | ipmath(255) }}`:                           `2001:db8::100`,
+		`{{ '192.168.0.0/16' | ipsubnet(20) }}`:                       `16`,
+		`{{ '192.168.0.0/16' | ipsubnet(20, 0) }}`:                    `192.168.0.0/20`,
+		`{{ '192.168.0.0/16' | ipsubnet(20, -1) }}`:                   `192.168.240.0/20`,
+		`{{ '192.168.144.5' | ipsubnet(20) }}`:                        `192.168.144.0/20`,
+		`{{ '192.168.144.5' | ipsubnet(20, 1) }}`:                     `192.168.144.0/21`,
+		`{{ '192.168.144.0/20' | ipsubnet('192.168.0.0/16') }}`:       `10`,
+		`{{ nets | cidr_merge | join(',') }}`:                         `10.0.0.0/8,172.16.0.0/23,192.168.0.0/24`,
+		`{{ ['192.168.1.1', '192.168.1.100'] | cidr_merge('span') }}`: `192.168.1.0/25`,
+	})
+}
@@ -0,0 +1,527 @@
+package lib
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/google/uuid"
+	mj "github.com/mitsuhiko/minijinja/minijinja-go/v2"
+	"github.com/mitsuhiko/minijinja/minijinja-go/v2/value"
+	u "github.com/sunshine69/golang-tools/utils"
+)
+
+// Ansible path, string and encoding filters. Path filters follow python os.path semantics (basename of "a/b/" is
+// empty) rather than go filepath, as that is what the templates were written against.
+
+func addStringFilters(env *mj.Environment) {
+	env.AddFilter("basename", filterBasename)
+	env.AddFilter("dirname", filterDirname)
+	env.AddFilter("splitext", filterSplitext)
+	env.AddFilter("realpath", filterRealpath)
+	env.AddFilter("relpath", filterRelpath)
+	env.AddFilter("expanduser", filterExpanduser)
+	env.AddFilter("quote", filterQuote)
+	env.AddFilter("regex_findall", filterRegexFindall)
+	env.AddFilter("regex_escape", filterRegexEscape)
+	env.AddFilter("comment", filterComment)
+	env.AddFilter("urlsplit", filterUrlsplit)
+	env.AddFilter("to_uuid", filterToUuid)
+	env.AddFilter("human_readable", filterHumanReadable)
+	env.AddFilter("human_to_bytes", filterHumanToBytes)
+}
+
+func stringArg(name string, val value.Value) (string, error) {
+	if s, ok := val.AsString(); ok {
+		return s, nil
+	}
+	if val.IsUndefined() || val.IsNone() {
+		return "", fmt.Errorf("%s expects a string, got %s", name, val.Kind())
+	}
+	return val.String(), nil
+}
+
+// pyBasename is python os.path.basename
+func pyBasename(p string) string {
+	return p[strings.LastIndex(p, "/")+1:]
+}
+
+// pyDirname is python os.path.dirname
+func pyDirname(p string) string {
+	i := strings.LastIndex(p, "/") + 1
+	head := p[:i]
+	if head != "" && strings.Trim(head, "/") != "" {
+		head = strings.TrimRight(head, "/")
+	}
+	return head
+}
+
+func filterBasename(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	s, err := stringArg("basename", val)
+	if err != nil {
+		return value.Undefined(), err
+	}
+	return value.FromString(pyBasename(s)), nil
+}
+
+func filterDirname(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	s, err := stringArg("dirname", val)
+	if err != nil {
+		return value.Undefined(), err
+	}
+	return value.FromString(pyDirname(s)), nil
+}
+
+// splitext gives [root, ext] like python os.path.splitext; leading dots of the basename are not an extension
+func filterSplitext(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	s, err := stringArg("splitext", val)
+	if err != nil {
+		return value.Undefined(), err
+	}
+	base := pyBasename(s)
+	root, ext := s, ""
+	if i := strings.LastIndex(base, "."); i > 0 && strings.Trim(base[:i], ".") != "" {
+		cut := len(s) - len(base) + i
+		root, ext = s[:cut], s[cut:]
+	}
+	return value.FromSlice([]value.Value{value.FromString(root), value.FromString(ext)}), nil
+}
+
+func filterRealpath(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	s, err := stringArg("realpath", val)
+	if err != nil {
+		return value.Undefined(), err
+	}
+	p, err := filepath.Abs(s)
+	if err != nil {
+		return value.Undefined(), err
+	}
+	if resolved, err := filepath.EvalSymlinks(p); err == nil {
+		p = resolved
+	}
+	return value.FromString(p), nil
+}
+
+// relpath(start) - start defaults to the current dir
+func filterRelpath(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	s, err := stringArg("relpath", val)
+	if err != nil {
+		return value.Undefined(), err
+	}
+	start := "."
+	if v, ok := argOrKw(args, 0, kwargs, "start"); ok {
+		start = v.String()
+	}
+	target, err := filepath.Abs(s)
+	if err != nil {
+		return value.Undefined(), err
+	}
+	if start, err = filepath.Abs(start); err != nil {
+		return value.Undefined(), err
+	}
+	rel, err := filepath.Rel(start, target)
+	if err != nil {
+		return value.Undefined(), err
+	}
+	return value.FromString(rel), nil
+}
+
+func filterExpanduser(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	s, err := stringArg("expanduser", val)
+	if err != nil {
+		return value.Undefined(), err
+	}
+	if s == "~" || strings.HasPrefix(s, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return value.Undefined(), err
+		}
+		s = home + s[1:]
+	}
+	return value.FromString(s), nil
+}
+
+var ptnShellSafe = regexp.MustCompile(`^[\w@%+=:,./-]+$`)
+
+// quote is python shlex.quote
+func filterQuote(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	s := val.String()
+	if val.IsNone() || val.IsUndefined() {
+		s = ""
+	}
+	if ptnShellSafe.MatchString(s) {
+		return value.FromString(s), nil
+	}
+	return value.FromString(shellQuote(s)), nil
+}
+
+// compileRegex compiles pattern with the ansible ignorecase and multiline kwargs
+func compileRegex(pattern string, kwargs map[string]value.Value) (*regexp.Regexp, error) {
+	flags := ""
+	if kwBool(kwargs, "ignorecase", false) {
+		flags += "i"
+	}
+	if kwBool(kwargs, "multiline", false) {
+		flags += "m"
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	return regexp.Compile(pattern)
+}
+
+// regex_findall(pattern, ignorecase=False, multiline=False) - like python re.findall a pattern with one group gives
+// the group values and with several groups a list per match
+func filterRegexFindall(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	s, err := stringArg("regex_findall", val)
+	if err != nil {
+		return value.Undefined(), err
+	}
+	if len(args) == 0 {
+		return value.Undefined(), fmt.Errorf("regex_findall expects a pattern")
+	}
+	ptn, err := compileRegex(args[0].String(), kwargs)
+	if err != nil {
+		return value.Undefined(), fmt.Errorf("regex_findall: %w", err)
+	}
+	out := []value.Value{}
+	for _, m := range ptn.FindAllStringSubmatch(s, -1) {
+		switch len(m) {
+		case 1:
+			out = append(out, value.FromString(m[0]))
+		case 2:
+			out = append(out, value.FromString(m[1]))
+		default:
+			groups := make([]value.Value, len(m)-1)
+			for i, g := range m[1:] {
+				groups[i] = value.FromString(g)
+			}
+			out = append(out, value.FromSlice(groups))
+		}
+	}
+	return value.FromSlice(out), nil
+}
+
+var (
+	ptnPythonEscape     = regexp.MustCompile(`([()\[\]{}?*+\-|^$\\.&~# \t\n\r\v\f])`)
+	ptnPosixBasicEscape = regexp.MustCompile(`([\].\[^$*\\])`)
+)
+
+// regex_escape(re_type='python'), re_type can also be posix_basic
+func filterRegexEscape(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	s, err := stringArg("regex_escape", val)
+	if err != nil {
+		return value.Undefined(), err
+	}
+	reType := "python"
+	if v, ok := argOrKw(args, 0, kwargs, "re_type"); ok {
+		reType = v.String()
+	}
+	switch reType {
+	case "python":
+		return value.FromString(ptnPythonEscape.ReplaceAllString(s, `\$1`)), nil
+	case "posix_basic":
+		return value.FromString(ptnPosixBasicEscape.ReplaceAllString(s, `\$1`)), nil
+	default:
+		return value.Undefined(), fmt.Errorf("regex_escape: invalid re_type '%s', use python or posix_basic", reType)
+	}
+}
+
+// comment styles of the ansible comment filter
+var commentStyles = map[string]map[string]string{
+	"plain":  {"decoration": "# "},
+	"erlang": {"decoration": "% "},
+	"c":      {"decoration": "// "},
+	"cblock": {"beginning": "/*", "decoration": " * ", "end": " */"},
+	"xml":    {"beginning": "<!--", "decoration": " - ", "end": "-->"},
+}
+
+// comment(style='plain', decoration=, beginning=, end=, prefix=, prefix_count=1, postfix=, postfix_count=1,
+// newline='\n') - wraps the text in a comment block like ansible
+func filterComment(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	text := val.String()
+	style := "plain"
+	if v, ok := argOrKw(args, 0, kwargs, "style"); ok {
+		style = v.String()
+	}
+	preset, ok := commentStyles[style]
+	if !ok {
+		return value.Undefined(), fmt.Errorf("comment: unknown style '%s'", style)
+	}
+	p := map[string]string{"newline": "\n", "beginning": "", "end": ""}
+	for k, v := range preset {
+		p[k] = v
+	}
+	for _, k := range []string{"newline", "beginning", "decoration", "end"} {
+		p[k] = kwString(kwargs, k, p[k])
+	}
+	nl, decoration := p["newline"], p["decoration"]
+	prefix := kwString(kwargs, "prefix", strings.TrimRight(decoration, " "))
+	postfix := kwString(kwargs, "postfix", strings.TrimRight(decoration, " "))
+
+	var out strings.Builder
+	if p["beginning"] != "" {
+		out.WriteString(p["beginning"] + nl)
+	}
+	if prefix != "" {
+		if prefix == nl {
+			out.WriteString(strings.Repeat(nl, kwInt(kwargs, "prefix_count", 1)))
+		} else {
+			out.WriteString(strings.Repeat(prefix+nl, kwInt(kwargs, "prefix_count", 1)))
+		}
+	}
+	body := strings.ReplaceAll(decoration+text, nl, nl+decoration)
+	// no trailing space when a line only has the decoration
+	body = strings.ReplaceAll(body, decoration+nl, strings.TrimRight(decoration, " ")+nl)
+	out.WriteString(body)
+	for range kwInt(kwargs, "postfix_count", 1) {
+		out.WriteString(nl + postfix)
+	}
+	if p["end"] != "" {
+		out.WriteString(nl + p["end"])
+	}
+	return value.FromString(out.String()), nil
+}
+
+// urlsplit(query=”) returns the url parts as a dict, or one part if query is given
+func filterUrlsplit(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	s, err := stringArg("urlsplit", val)
+	if err != nil {
+		return value.Undefined(), err
+	}
+	pu, err := url.Parse(s)
+	if err != nil {
+		return value.Undefined(), fmt.Errorf("urlsplit: %w", err)
+	}
+	parts := map[string]value.Value{
+		"scheme":   value.FromString(pu.Scheme),
+		"netloc":   value.FromString(pu.Host),
+		"path":     value.FromString(pu.EscapedPath()),
+		"query":    value.FromString(pu.RawQuery),
+		"fragment": value.FromString(pu.Fragment),
+		"hostname": value.FromString(strings.ToLower(pu.Hostname())),
+		"port":     value.None(),
+		"username": value.None(),
+		"password": value.None(),
+	}
+	if pu.User != nil {
+		parts["netloc"] = value.FromString(pu.User.String() + "@" + pu.Host)
+		parts["username"] = value.FromString(pu.User.Username())
+		if pw, ok := pu.User.Password(); ok {
+			parts["password"] = value.FromString(pw)
+		}
+	}
+	if port, err := strconv.Atoi(pu.Port()); err == nil {
+		parts["port"] = value.FromInt(int64(port))
+	}
+	if pu.Hostname() == "" {
+		parts["hostname"] = value.None()
+	}
+	if q, ok := argOrKw(args, 0, kwargs, "query"); ok && q.String() != "" {
+		part, ok := parts[q.String()]
+		if !ok {
+			return value.Undefined(), fmt.Errorf("urlsplit: unknown URL component '%s'", q.String())
+		}
+		return part, nil
+	}
+	return value.FromMap(parts), nil
+}
+
+// ansibleUUIDNamespace is the default namespace of to_uuid
+var ansibleUUIDNamespace = uuid.MustParse("361E6D51-FAEC-444A-9079-341386DA8E2E")
+
+// to_uuid(namespace) gives a uuid5 of the string
+func filterToUuid(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	ns := ansibleUUIDNamespace
+	if v, ok := argOrKw(args, 0, kwargs, "namespace"); ok {
+		var err error
+		if ns, err = uuid.Parse(v.String()); err != nil {
+			return value.Undefined(), fmt.Errorf("to_uuid: invalid namespace: %w", err)
+		}
+	}
+	return value.FromString(uuid.NewSHA1(ns, []byte(val.String())).String()), nil
+}
+
+// size suffixes, largest first
+var sizeRanges = []struct {
+	suffix string
+	limit  float64
+}{{"Y", 1 << 80}, {"Z", 1 << 70}, {"E", 1 << 60}, {"P", 1 << 50}, {"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1}}
+
+// BytesToHuman formats a size like ansible human_readable - 1536 gives "1.50 KB"
+func BytesToHuman(size float64, isbits bool, unit string) string {
+	base := u.Ternary(isbits, "bits", "Bytes")
+	suffix, limit := "B", 1.0
+	for _, r := range sizeRanges {
+		suffix, limit = r.suffix, r.limit
+		if (unit == "" && size >= r.limit) || (unit != "" && strings.ToUpper(unit[:1]) == r.suffix) {
+			break
+		}
+	}
+	if limit != 1 {
+		suffix += base[:1]
+	} else {
+		suffix = base
+	}
+	return fmt.Sprintf("%.2f %s", size/limit, suffix)
+}
+
+var ptnHumanSize = regexp.MustCompile(`^\s*(\d*\.?\d*)\s*([A-Za-z]+)?\s*$`)
+
+// HumanToBytes parses a size like ansible human_to_bytes - "10M", "1.5 GB", "2KiB" or "10Mb" with isbits
+func HumanToBytes(s, defaultUnit string, isbits bool) (int64, error) {
+	m := ptnHumanSize.FindStringSubmatch(s)
+	if m == nil || m[1] == "" || m[1] == "." {
+		return 0, fmt.Errorf("human_to_bytes: can not interpret '%s'", s)
+	}
+	num, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("human_to_bytes: can not interpret '%s'", s)
+	}
+	unit := m[2]
+	if unit == "" {
+		unit = defaultUnit
+	}
+	if unit == "" {
+		return int64(math.Round(num)), nil
+	}
+	lower := strings.ToLower(unit)
+	if (!isbits && (lower == "b" || lower == "byte" || lower == "bytes")) || (isbits && (unit == "b" || lower == "bit" || lower == "bits")) {
+		return int64(math.Round(num)), nil
+	}
+	letter := strings.ToUpper(unit[:1])
+	rest := strings.TrimPrefix(unit[1:], "i")
+	for _, r := range sizeRanges {
+		if r.suffix != letter || r.suffix == "B" {
+			continue
+		}
+		if rest != "" && ((isbits && rest != "b") || (!isbits && rest != "B")) {
+			return 0, fmt.Errorf("human_to_bytes: unit '%s' does not match %s", unit, u.Ternary(isbits, "bits", "bytes"))
+		}
+		return int64(math.Round(num * r.limit)), nil
+	}
+	return 0, fmt.Errorf("human_to_bytes: unknown unit '%s' in '%s'", unit, s)
+}
+
+// human_readable(isbits=False, unit=None)
+func filterHumanReadable(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	size, ok := val.AsFloat()
+	if !ok {
+		f, err := strconv.ParseFloat(strings.TrimSpace(val.String()), 64)
+		if err != nil {
+			return value.Undefined(), fmt.Errorf("human_readable expects a number, got %s", val.Repr())
+		}
+		size = f
+	}
+	isbits := false
+	if v, ok := argOrKw(args, 0, kwargs, "isbits"); ok {
+		isbits = v.IsTrue()
+	}
+	unit := ""
+	if v, ok := argOrKw(args, 1, kwargs, "unit"); ok && !v.IsNone() {
+		unit = v.String()
+	}
+	return value.FromString(BytesToHuman(size, isbits, unit)), nil
+}
+
+// human_to_bytes(default_unit=None, isbits=False)
+func filterHumanToBytes(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	defaultUnit := ""
+	if v, ok := argOrKw(args, 0, kwargs, "default_unit"); ok && !v.IsNone() {
+		defaultUnit = v.String()
+	}
+	isbits := false
+	if v, ok := argOrKw(args, 1, kwargs, "isbits"); ok {
+		isbits = v.IsTrue()
+	}
+	n, err := HumanToBytes(val.String(), defaultUnit, isbits)
+	if err != nil {
+		return value.Undefined(), err
+	}
+	return value.FromInt(n), nil
+}
+
+// encodeText encodes s to bytes with a python codec name as used by the b64encode/b64decode encoding argument
+func encodeText(s, encoding string) ([]byte, error) {
+	switch strings.ReplaceAll(strings.ToLower(encoding), "_", "-") {
+	case "", "utf-8", "utf8":
+		return []byte(s), nil
+	case "utf-16-le", "utf-16le":
+		return utf16Bytes(s, false, false), nil
+	case "utf-16-be", "utf-16be":
+		return utf16Bytes(s, true, false), nil
+	case "utf-16", "utf16":
+		return utf16Bytes(s, false, true), nil
+	case "latin-1", "latin1", "iso-8859-1", "ascii":
+		out := make([]byte, 0, len(s))
+		for _, r := range s {
+			if r > 255 || (r > 127 && encoding == "ascii") {
+				return nil, fmt.Errorf("character %q can not be encoded in %s", r, encoding)
+			}
+			out = append(out, byte(r))
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unsupported encoding '%s'", encoding)
+}
+
+// decodeText is the reverse of encodeText
+func decodeText(b []byte, encoding string) (string, error) {
+	switch strings.ReplaceAll(strings.ToLower(encoding), "_", "-") {
+	case "", "utf-8", "utf8":
+		return string(b), nil
+	case "utf-16-le", "utf-16le":
+		return utf16String(b, false), nil
+	case "utf-16-be", "utf-16be":
+		return utf16String(b, true), nil
+	case "utf-16", "utf16":
+		if len(b) >= 2 && b[0] == 0xfe && b[1] == 0xff {
+			return utf16String(b[2:], true), nil
+		}
+		if len(b) >= 2 && b[0] == 0xff && b[1] == 0xfe {
+			b = b[2:]
+		}
+		return utf16String(b, false), nil
+	case "latin-1", "latin1", "iso-8859-1", "ascii":
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+		return string(runes), nil
+	}
+	return "", fmt.Errorf("unsupported encoding '%s'", encoding)
+}
+
+func utf16Bytes(s string, bigEndian, bom bool) []byte {
+	units := utf16.Encode([]rune(s))
+	if bom {
+		units = append([]uint16{0xfeff}, units...)
+	}
+	out := make([]byte, 0, len(units)*2)
+	for _, c := range units {
+		if bigEndian {
+			out = append(out, byte(c>>8), byte(c))
+		} else {
+			out = append(out, byte(c), byte(c>>8))
+		}
+	}
+	return out
+}
+
+func utf16String(b []byte, bigEndian bool) string {
+	units := make([]uint16, len(b)/2)
+	for i := range units {
+		if bigEndian {
+			units[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+		} else {
+			units[i] = uint16(b[2*i+1])<<8 | uint16(b[2*i])
+		}
+	}
+	return string(utf16.Decode(units))
+}
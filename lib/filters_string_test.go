@@ -0,0 +1,68 @@
+package lib
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestStringFilters(t *testing.T) {
+	home, _ := os.UserHomeDir()
+	renderCases(t, map[string]any{"size": 1536}, map[string]string{
+		`{{ '/etc/nginx/nginx.conf' | basename }}`:                                 `nginx.conf`,
+		`{{ '/etc/nginx/' | basename }}`:                                           ``,
+		`{{ '/etc/nginx/nginx.conf' | dirname }}`:                                  `/etc/nginx`,
+		`{{ '/etc' | dirname }}`:                                                   `/`,
+		`{{ 'nginx.conf' | dirname }}`:                                             ``,
+		`{{ 'a/b.tar.gz' | splitext | to_json }}`:                                  `["a/b.tar",".gz"]`,
+		`{{ '.bashrc' | splitext | to_json }}`:                                     `[".bashrc",""]`,
+		`{{ '/a/b/c' | relpath('/a') }}`:                                           `b/c`,
+		`{{ '~/x' | expanduser }}`:                                                 home + `/x`,
+		`{{ 'safe-word' | quote }}`:                                                `safe-word`,
+		`{{ "it's here" | quote }}`:                                                `'it'"'"'s here'`,
+		`{{ '' | quote }}`:                                                         `''`,
+		`{{ 'a1 b22 c333' | regex_findall('\\d+') | to_json }}`:                    `["1","22","333"]`,
+		`{{ 'k=v x=y' | regex_findall('(\\w)=(\\w)') | to_json }}`:                 `[["k","v"],["x","y"]]`,
+		`{{ 'A a' | regex_findall('a', ignorecase=true) | length }}`:               `2`,
+		`{{ "l1\nl2" | regex_findall('^l\\d$', multiline=true) | length }}`:        `2`,
+		`{{ 'a.b*c' | regex_escape }}`:                                             `a\.b\*c`,
+		`{{ 'a.b*c' | regex_escape('posix_basic') }}`:                              `a\.b\*c`,
+		`{{ 'text' | comment }}`:                                                   "#\n# text\n#",
+		`{{ "l1\nl2" | comment('c') }}`:                                            "//\n// l1\n// l2\n//",
+		`{{ 'text' | comment('cblock') }}`:                                         "/*\n *\n * text\n *\n */",
+		`{{ 'text' | comment('xml') }}`:                                            "<!--\n -\n - text\n -\n-->",
+		`{{ 'text' | comment(decoration='; ', prefix='', postfix='') }}`:           "; text\n",
+		`{{ 'https://u:p@Example.com:8443/p/a?x=1#frag' | urlsplit('hostname') }}`: `example.com`,
+		`{{ 'https://u:p@Example.com:8443/p/a?x=1#frag' | urlsplit('port') }}`:     `8443`,
+		`{{ ('https://u:p@Example.com:8443/p/a?x=1#frag' | urlsplit).query }}`:     `x=1`,
+		`{{ ('https://u:p@Example.com:8443/p/a?x=1#frag' | urlsplit).username }}`:  `u`,
+		`{{ 'example.com' | to_uuid }}`:                                            `ae780c3a-a3ab-53c2-bfb4-098da300b3fe`,
+		`{{ 'x' | to_uuid(namespace='6ba7b810-9dad-11d1-80b4-00c04fd430c8') }}`:    `05b16a01-46c6-56dd-bd6e-c6dfb4a1427a`,
+		`{{ size | human_readable }}`:                                              `1.50 KB`,
+		`{{ 100 | human_readable }}`:                                               `100.00 Bytes`,
+		`{{ 1048576 | human_readable(unit='K') }}`:                                 `1024.00 KB`,
+		`{{ 1024 | human_readable(isbits=true) }}`:                                 `1.00 Kb`,
+		`{{ '1.5 GB' | human_to_bytes }}`:                                          `1610612736`,
+		`{{ '10M' | human_to_bytes }}`:                                             `10485760`,
+		`{{ '2KiB' | human_to_bytes }}`:                                            `2048`,
+		`{{ '10' | human_to_bytes(default_unit='K') }}`:                            `10240`,
+		`{{ '1Kb' | human_to_bytes(isbits=true) }}`:                                `1024`,
+		`{{ 'hé' | b64encode(encoding='utf-16-le') }}`:                             `aADpAA==`,
+		`{{ 'aADpAA==' | b64decode(encoding='utf-16-le') }}`:                       `hé`,
+		`{{ 'aGk=' | b64decode }}`:                                                 `hi`,
+		`{{ 'abcdefgh' | b64encode(wrap=4) }}`:                                     "YWJj\nZGVm\nZ2g=",
+		`{{ 'aaa' | regex_replace('a', 'b', count=2) }}`:                           `bba`,
+		`{{ 'Hello' | regex_replace('hello', 'bye', ignorecase=true) }}`:           `bye`,
+		`{{ "x1\nx2" | regex_replace('^x', 'y', multiline=true) }}`:                "y1\ny2",
+		`{{ 'ab' | regex_replace('(?P<first>a)', '\\g<first>\\g<first>') }}`:       `aab`,
+		`{{ 'key: VAL' | regex_search('key: (val)', ignorecase=true) | first }}`:   `VAL`,
+	})
+
+	for _, src := range []string{`{{ 'x' | regex_replace('(', 'y') }}`, `{{ '1 XB' | human_to_bytes }}`, `{{ 'x' | comment('nope') }}`, `{{ 'a' | b64decode }}`} {
+		if _, err := TemplateStringWithConfig(src, nil); err == nil {
+			t.Errorf("%s: expected an error", src)
+		} else if strings.Contains(err.Error(), "panic") {
+			t.Errorf("%s: unexpected panic %v", src, err)
+		}
+	}
+}
@@ -0,0 +1,500 @@
+package lib
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	mj "github.com/mitsuhiko/minijinja/minijinja-go/v2"
+	"github.com/mitsuhiko/minijinja/minijinja-go/v2/value"
+)
+
+// Date and time filters. Formats are python strftime/strptime style like in ansible. to_datetime returns a
+// datetime object (attributes year, month, ... epoch; methods strftime, isoformat, timestamp, weekday) and
+// date_diff a timedelta (days, seconds, microseconds, total_seconds()). The template engine has no operator
+// overloading so instead of `a - b` use `a | date_diff(b)` and `a | date_add(days=30)` instead of `a + timedelta`.
+// Naive times are in the local timezone.
+
+func addTimeFilters(env *mj.Environment) {
+	env.AddFilter("to_datetime", filterToDatetime)
+	env.AddFilter("strftime", filterStrftime)
+	env.AddFilter("date_add", filterDateAdd)
+	env.AddFilter("date_diff", filterDateDiff)
+	env.AddFilter("duration", filterDuration)
+	env.AddFilter("humanize", filterHumanize)
+}
+
+// dateTime is the template value of a python like datetime
+type dateTime struct {
+	t time.Time
+}
+
+func (d *dateTime) GetAttr(name string) value.Value {
+	switch name {
+	case "year":
+		return value.FromInt(int64(d.t.Year()))
+	case "month":
+		return value.FromInt(int64(d.t.Month()))
+	case "day":
+		return value.FromInt(int64(d.t.Day()))
+	case "hour":
+		return value.FromInt(int64(d.t.Hour()))
+	case "minute":
+		return value.FromInt(int64(d.t.Minute()))
+	case "second":
+		return value.FromInt(int64(d.t.Second()))
+	case "microsecond":
+		return value.FromInt(int64(d.t.Nanosecond() / 1000))
+	case "epoch":
+		return value.FromInt(d.t.Unix())
+	}
+	return value.Undefined()
+}
+
+func (d *dateTime) CallMethod(_ value.State, name string, args []value.Value, _ map[string]value.Value) (value.Value, error) {
+	switch name {
+	case "strftime":
+		if len(args) != 1 {
+			return value.Undefined(), fmt.Errorf("strftime() takes a format argument")
+		}
+		return value.FromString(Strftime(d.t, args[0].String())), nil
+	case "isoformat":
+		return value.FromString(d.t.Format("2006-01-02T15:04:05.999999")), nil
+	case "timestamp":
+		return value.FromFloat(float64(d.t.UnixMicro()) / 1e6), nil
+	case "weekday":
+		return value.FromInt(int64((d.t.Weekday() + 6) % 7)), nil
+	case "isoweekday":
+		return value.FromInt(int64((d.t.Weekday()+6)%7 + 1)), nil
+	}
+	return value.Undefined(), value.ErrUnknownMethod
+}
+
+// String is python str(datetime), it is what the template renders
+func (d *dateTime) String() string {
+	if d.t.Nanosecond() >= 1000 {
+		return d.t.Format("2006-01-02 15:04:05.000000")
+	}
+	return d.t.Format("2006-01-02 15:04:05")
+}
+
+func (d *dateTime) ObjectCmp(other value.Object) (int, bool) {
+	if o, ok := other.(*dateTime); ok {
+		return d.t.Compare(o.t), true
+	}
+	return 0, false
+}
+
+// timeDelta is the template value of a python like timedelta
+type timeDelta struct {
+	d time.Duration
+}
+
+// parts returns the python normalised days, seconds and microseconds (only days can be negative)
+func (td *timeDelta) parts() (int64, int64, int64) {
+	us := td.d.Microseconds()
+	days := int64(math.Floor(float64(us) / 86400e6))
+	rest := us - days*86400e6
+	return days, rest / 1e6, rest % 1e6
+}
+
+func (td *timeDelta) GetAttr(name string) value.Value {
+	days, seconds, micro := td.parts()
+	switch name {
+	case "days":
+		return value.FromInt(days)
+	case "seconds":
+		return value.FromInt(seconds)
+	case "microseconds":
+		return value.FromInt(micro)
+	}
+	return value.Undefined()
+}
+
+func (td *timeDelta) CallMethod(_ value.State, name string, _ []value.Value, _ map[string]value.Value) (value.Value, error) {
+	if name == "total_seconds" {
+		return value.FromFloat(td.d.Seconds()), nil
+	}
+	return value.Undefined(), value.ErrUnknownMethod
+}
+
+// String is python str(timedelta), e.g. "1 day, 2:03:04"
+func (td *timeDelta) String() string {
+	days, seconds, micro := td.parts()
+	out := fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+	if micro != 0 {
+		out += fmt.Sprintf(".%06d", micro)
+	}
+	if days != 0 {
+		unit := "days"
+		if days == 1 || days == -1 {
+			unit = "day"
+		}
+		out = fmt.Sprintf("%d %s, %s", days, unit, out)
+	}
+	return out
+}
+
+func (td *timeDelta) ObjectCmp(other value.Object) (int, bool) {
+	if o, ok := other.(*timeDelta); ok {
+		return cmp.Compare(td.d, o.d), true
+	}
+	return 0, false
+}
+
+// Strftime formats t with a python strftime format
+func Strftime(t time.Time, format string) string {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i == len(format)-1 {
+			b.WriteByte(format[i])
+			continue
+		}
+		i++
+		switch c := format[i]; c {
+		case 'Y':
+			fmt.Fprintf(&b, "%04d", t.Year())
+		case 'y':
+			fmt.Fprintf(&b, "%02d", t.Year()%100)
+		case 'm':
+			fmt.Fprintf(&b, "%02d", int(t.Month()))
+		case 'd':
+			fmt.Fprintf(&b, "%02d", t.Day())
+		case 'e':
+			fmt.Fprintf(&b, "%2d", t.Day())
+		case 'H':
+			fmt.Fprintf(&b, "%02d", t.Hour())
+		case 'I':
+			fmt.Fprintf(&b, "%02d", (t.Hour()+11)%12+1)
+		case 'M':
+			fmt.Fprintf(&b, "%02d", t.Minute())
+		case 'S':
+			fmt.Fprintf(&b, "%02d", t.Second())
+		case 'f':
+			fmt.Fprintf(&b, "%06d", t.Nanosecond()/1000)
+		case 'p':
+			b.WriteString(t.Format("PM"))
+		case 'a':
+			b.WriteString(t.Format("Mon"))
+		case 'A':
+			b.WriteString(t.Format("Monday"))
+		case 'b', 'h':
+			b.WriteString(t.Format("Jan"))
+		case 'B':
+			b.WriteString(t.Format("January"))
+		case 'j':
+			fmt.Fprintf(&b, "%03d", t.YearDay())
+		case 'u':
+			fmt.Fprintf(&b, "%d", (t.Weekday()+6)%7+1)
+		case 'w':
+			fmt.Fprintf(&b, "%d", t.Weekday())
+		case 'U':
+			fmt.Fprintf(&b, "%02d", (t.YearDay()+6-int(t.Weekday()))/7)
+		case 'V':
+			_, week := t.ISOWeek()
+			fmt.Fprintf(&b, "%02d", week)
+		case 'G':
+			year, _ := t.ISOWeek()
+			fmt.Fprintf(&b, "%04d", year)
+		case 'z':
+			b.WriteString(t.Format("-0700"))
+		case 'Z':
+			b.WriteString(t.Format("MST"))
+		case 's':
+			fmt.Fprintf(&b, "%d", t.Unix())
+		case 'F':
+			b.WriteString(t.Format("2006-01-02"))
+		case 'T':
+			b.WriteString(t.Format("15:04:05"))
+		case 'D':
+			b.WriteString(t.Format("01/02/06"))
+		case 'c':
+			b.WriteString(t.Format("Mon Jan _2 15:04:05 2006"))
+		case 'x':
+			b.WriteString(t.Format("01/02/06"))
+		case 'X':
+			b.WriteString(t.Format("15:04:05"))
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// strptimeLayout converts a python strptime format to a go time layout
+func strptimeLayout(format string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			b.WriteByte(format[i])
+			continue
+		}
+		if i++; i == len(format) {
+			return "", fmt.Errorf("format '%s' ends with a lone %%", format)
+		}
+		layout, ok := map[byte]string{
+			'Y': "2006", 'y': "06", 'm': "01", 'd': "02", 'e': "_2", 'H': "15", 'I': "03", 'M': "04", 'S': "05",
+			'p': "PM", 'a': "Mon", 'A': "Monday", 'b': "Jan", 'h': "Jan", 'B': "January", 'j': "002",
+			'z': "-0700", 'Z': "MST", 'F': "2006-01-02", 'T': "15:04:05", '%': "%",
+		}[format[i]]
+		if format[i] == 'f' {
+			// go parses a fraction of any length right after the seconds, but only there
+			if !strings.HasSuffix(b.String(), "05.") {
+				return "", fmt.Errorf("%%f is only supported after %%S. in '%s'", format)
+			}
+			layout, ok = b.String()[:b.Len()-1], true
+			b.Reset()
+		}
+		if !ok {
+			return "", fmt.Errorf("unsupported directive %%%c in '%s'", format[i], format)
+		}
+		b.WriteString(layout)
+	}
+	return b.String(), nil
+}
+
+// toTime converts a datetime object, an epoch number or a date string to a time
+func toTime(val value.Value) (time.Time, error) {
+	if obj, ok := val.AsObject(); ok {
+		if d, ok := obj.(*dateTime); ok {
+			return d.t, nil
+		}
+	}
+	if val.IsActualInt() {
+		n, _ := val.AsInt()
+		return time.Unix(n, 0), nil
+	}
+	if f, ok := val.AsFloat(); ok {
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	}
+	s, ok := val.AsString()
+	if !ok {
+		return time.Time{}, fmt.Errorf("expected a datetime, epoch or date string, got %s", val.Kind())
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05.999999", "2006-01-02T15:04:05.999999", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot parse '%s' as a date", s)
+}
+
+// toDuration converts a timedelta object, a number of seconds or a duration string (go syntax plus d and w, e.g.
+// 1w2d, 1h30m) to a duration
+func toDuration(val value.Value) (time.Duration, error) {
+	if obj, ok := val.AsObject(); ok {
+		if td, ok := obj.(*timeDelta); ok {
+			return td.d, nil
+		}
+	}
+	if f, ok := val.AsFloat(); ok {
+		return time.Duration(f * float64(time.Second)), nil
+	}
+	s, ok := val.AsString()
+	if !ok {
+		return 0, fmt.Errorf("expected a duration, got %s", val.Kind())
+	}
+	s = strings.ReplaceAll(strings.TrimSpace(s), " ", "")
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimLeft(s, "+-")
+	var total time.Duration
+	for s != "" {
+		// split off the leading number and its unit
+		i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+		if i < 0 {
+			// a plain number is seconds
+			s, i = s+"s", len(s)
+		}
+		if i == 0 {
+			return 0, fmt.Errorf("invalid duration '%s'", val.String())
+		}
+		n, err := strconv.ParseFloat(s[:i], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration '%s'", val.String())
+		}
+		j := i + strings.IndexFunc(s[i:], func(r rune) bool { return r >= '0' && r <= '9' })
+		if j < i {
+			j = len(s)
+		}
+		unit, ok := map[string]time.Duration{
+			"w": 7 * 24 * time.Hour, "d": 24 * time.Hour, "h": time.Hour, "m": time.Minute, "s": time.Second,
+			"ms": time.Millisecond, "us": time.Microsecond, "µs": time.Microsecond, "ns": time.Nanosecond,
+		}[s[i:j]]
+		if !ok {
+			return 0, fmt.Errorf("unknown unit '%s' in duration '%s'", s[i:j], val.String())
+		}
+		total += time.Duration(n * float64(unit))
+		s = s[j:]
+	}
+	if neg {
+		total = -total
+	}
+	return total, nil
+}
+
+// filterToDatetime is ansible to_datetime(format='%Y-%m-%d %H:%M:%S')
+func filterToDatetime(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	format := "%Y-%m-%d %H:%M:%S"
+	if v, ok := argOrKw(args, 0, kwargs, "format"); ok {
+		format = v.String()
+	}
+	if !val.IsActualInt() {
+		if _, isString := val.AsString(); isString {
+			layout, err := strptimeLayout(format)
+			if err != nil {
+				return value.Undefined(), fmt.Errorf("to_datetime: %w", err)
+			}
+			t, err := time.ParseInLocation(layout, val.String(), time.Local)
+			if err != nil {
+				return value.Undefined(), fmt.Errorf("to_datetime: '%s' does not match format '%s'", val.String(), format)
+			}
+			return value.FromObject(&dateTime{t}), nil
+		}
+	}
+	t, err := toTime(val)
+	if err != nil {
+		return value.Undefined(), fmt.Errorf("to_datetime: %w", err)
+	}
+	return value.FromObject(&dateTime{t}), nil
+}
+
+// filterStrftime is ansible strftime: the value is the format, second the epoch (default now). A datetime value
+// can be formatted too: dt | strftime('%Y').
+func filterStrftime(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	if obj, ok := val.AsObject(); ok {
+		if d, ok := obj.(*dateTime); ok {
+			format, ok := argOrKw(args, 0, kwargs, "format")
+			if !ok {
+				return value.Undefined(), fmt.Errorf("strftime: missing format")
+			}
+			return value.FromString(Strftime(d.t, format.String())), nil
+		}
+	}
+	format, err := stringArg("strftime", val)
+	if err != nil {
+		return value.Undefined(), err
+	}
+	t := time.Now()
+	if v, ok := argOrKw(args, 0, kwargs, "second"); ok && !v.IsNone() {
+		if t, err = toTime(v); err != nil {
+			return value.Undefined(), fmt.Errorf("strftime: %w", err)
+		}
+	}
+	if v, ok := argOrKw(args, 1, kwargs, "utc"); ok && v.IsTrue() {
+		t = t.UTC()
+	}
+	return value.FromString(Strftime(t, format)), nil
+}
+
+// filterDateAdd adds a duration (positional, see toDuration) and/or years, months, weeks, days, hours, minutes
+// and seconds kwargs (which can be negative) to a date
+func filterDateAdd(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	t, err := toTime(val)
+	if err != nil {
+		return value.Undefined(), fmt.Errorf("date_add: %w", err)
+	}
+	if len(args) > 0 {
+		d, err := toDuration(args[0])
+		if err != nil {
+			return value.Undefined(), fmt.Errorf("date_add: %w", err)
+		}
+		t = t.Add(d)
+	}
+	t = t.AddDate(kwInt(kwargs, "years", 0), kwInt(kwargs, "months", 0), 7*kwInt(kwargs, "weeks", 0)+kwInt(kwargs, "days", 0))
+	for name, unit := range map[string]time.Duration{"hours": time.Hour, "minutes": time.Minute, "seconds": time.Second} {
+		if v, ok := kwargs[name]; ok {
+			f, _ := v.AsFloat()
+			t = t.Add(time.Duration(f * float64(unit)))
+		}
+	}
+	return value.FromObject(&dateTime{t}), nil
+}
+
+// filterDateDiff is python `value - other` on dates, a timedelta. other defaults to now.
+func filterDateDiff(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	t, err := toTime(val)
+	if err != nil {
+		return value.Undefined(), fmt.Errorf("date_diff: %w", err)
+	}
+	other := time.Now()
+	if v, ok := argOrKw(args, 0, kwargs, "other"); ok {
+		if other, err = toTime(v); err != nil {
+			return value.Undefined(), fmt.Errorf("date_diff: %w", err)
+		}
+	}
+	return value.FromObject(&timeDelta{t.Sub(other)}), nil
+}
+
+// filterDuration converts seconds or a duration string like 1d12h to a timedelta
+func filterDuration(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	d, err := toDuration(val)
+	if err != nil {
+		return value.Undefined(), fmt.Errorf("duration: %w", err)
+	}
+	return value.FromObject(&timeDelta{d}), nil
+}
+
+// HumanizeDuration returns d as text like "2 days 3 hours", keeping the precision biggest non zero units
+func HumanizeDuration(d time.Duration, precision int) string {
+	d = d.Abs().Round(time.Second)
+	units := []struct {
+		name string
+		size time.Duration
+	}{{"day", 24 * time.Hour}, {"hour", time.Hour}, {"minute", time.Minute}, {"second", time.Second}}
+	var parts []string
+	for _, unit := range units {
+		n := d / unit.size
+		if n == 0 || len(parts) == precision {
+			continue
+		}
+		name := unit.name
+		if n > 1 {
+			name += "s"
+		}
+		parts = append(parts, fmt.Sprintf("%d %s", n, name))
+		d -= n * unit.size
+	}
+	if len(parts) == 0 {
+		return "0 seconds"
+	}
+	return strings.Join(parts, " ")
+}
+
+// filterHumanize renders a duration (timedelta, seconds or duration string) as "2 days 3 hours", or a date
+// relative to now as "in 29 days" or "3 hours ago". precision is the number of units, default 2.
+func filterHumanize(_ mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	precision := 2
+	if v, ok := argOrKw(args, 0, kwargs, "precision"); ok {
+		if n, ok := v.AsInt(); ok && n > 0 {
+			precision = int(n)
+		}
+	}
+	if obj, ok := val.AsObject(); ok {
+		if d, ok := obj.(*dateTime); ok {
+			diff := time.Until(d.t)
+			if diff < 0 {
+				return value.FromString(HumanizeDuration(diff, precision) + " ago"), nil
+			}
+			return value.FromString("in " + HumanizeDuration(diff, precision)), nil
+		}
+	}
+	d, err := toDuration(val)
+	if err != nil {
+		return value.Undefined(), fmt.Errorf("humanize: %w", err)
+	}
+	return value.FromString(HumanizeDuration(d, precision)), nil
+}
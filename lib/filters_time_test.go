@@ -0,0 +1,41 @@
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeFilters(t *testing.T) {
+	data := map[string]any{"a": "2016-08-14 20:00:12", "b": "2015-12-25"}
+	renderCases(t, data, map[string]string{
+		`{{ a | to_datetime }}`: `2016-08-14 20:00:12`,
+		`{{ (a | to_datetime).year }}-{{ (a | to_datetime).month }}`:                       `2016-8`,
+		`{{ (b | to_datetime('%Y-%m-%d')).weekday() }}`:                                    `4`,
+		`{{ a | to_datetime | date_diff(b | to_datetime('%Y-%m-%d')) }}`:                   `233 days, 20:00:12`,
+		`{{ (a | to_datetime | date_diff(b | to_datetime('%Y-%m-%d'))).days }}`:            `233`,
+		`{{ (a | to_datetime | date_diff(b | to_datetime('%Y-%m-%d'))).total_seconds() }}`: `20203212.0`,
+		`{{ b | to_datetime('%Y-%m-%d') | date_diff(a | to_datetime) }}`:                   `-234 days, 3:59:48`,
+		`{{ a | to_datetime | date_add(days=30, hours=-1) }}`:                              `2016-09-13 19:00:12`,
+		`{{ a | date_add('1w12h') }}`:                                                      `2016-08-22 08:00:12`,
+		`{{ a | to_datetime | date_add(months=6) | strftime('%F') }}`:                      `2017-02-14`,
+		`{{ (a | to_datetime).strftime('%a %d %b %Y %I:%M %p %j %U') }}`:                   `Sun 14 Aug 2016 08:00 PM 227 33`,
+		`{{ '%Y-%m-%d %H:%M:%S' | strftime(0, utc=true) }}`:                                `1970-01-01 00:00:00`,
+		`{{ '14/08/2016 20:00:12.5' | to_datetime('%d/%m/%Y %H:%M:%S.%f') }}`:              `2016-08-14 20:00:12.500000`,
+		`{{ (a | to_datetime) < (b | to_datetime('%Y-%m-%d') | date_add(years=1)) }}`:      `true`,
+		`{{ '1d2h' | duration }}`:                                                          `1 day, 2:00:00`,
+		`{{ 90 | duration }}`:                                                              `0:01:30`,
+		`{{ '36h' | humanize }}`:                                                           `1 day 12 hours`,
+		`{{ 93784 | humanize(precision=3) }}`:                                              `1 day 2 hours 3 minutes`,
+		`{{ 0 | humanize }}`:                                                               `0 seconds`,
+		`{{ now(fmt='%Y') == now('2006') }}`:                                               `true`,
+		`{{ now(utc=true, fmt='%z') }}`:                                                    `+0000`,
+	})
+
+	expiry := time.Now().Add(49 * time.Hour).Format("2006-01-02 15:04:05")
+	if out, err := TemplateStringWithConfig(`{{ d | to_datetime | humanize(1) }}`, map[string]any{"d": expiry}); err != nil || out != "in 2 days" {
+		t.Errorf("expected 'in 2 days', got %q (%v)", out, err)
+	}
+	if _, err := TemplateStringWithConfig(`{{ '2016' | to_datetime }}`, nil); err == nil {
+		t.Errorf("expected a format mismatch error")
+	}
+}
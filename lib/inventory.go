@@ -705,6 +705,9 @@ func FlattenVar(key string, data map[string]any, visited map[string]any) (any, e
 		}
 		// Keep resolving until no more {{ }} patterns exist
 		maxIterations := 100 // Prevent infinite loops
+		// a single expression like "{{ ports }}" gives the value itself, no need to guess its type from the text
+		var native any
+		isNative := false
 		for i := 0; i < maxIterations; i++ {
 			// Check if there are any {{ or }} left (simple check for Jinja2 templates)
 			if !findCurly.MatchString(tempVal) {
@@ -726,8 +729,23 @@ func FlattenVar(key string, data map[string]any, visited map[string]any) (any, e
 					}
 				}
 			}
-			// Now template the current string
-			tempVal = TemplateString(tempVal, data)
+			// Now template the current string, the compiled templates are cached as the same values are
+			// flattened for every host
+			out, err := TemplateNative(tempVal, data)
+			if err := warnUndefined(err, os.Getenv("JINJA2_UNDEFINED")); err != nil {
+				return "", fmt.Errorf("key %s: %w", key, err)
+			}
+			if s, ok := out.(string); ok {
+				tempVal = s
+				continue
+			}
+			// keep the types the rendered text was parsed to: numbers are float64, none or undefined is ""
+			native, isNative = u.Ternary(out == nil, any(""), jsonNumbers(out)), true
+			break
+		}
+		if isNative {
+			decodedVal = native
+			break
 		}
 		// More detection - parser?
 		tempVal_, err := parseDynamicValue(tempVal)
@@ -803,17 +821,30 @@ func (inv *Inventory) SetFact(hostPtn string, args ...string) {
 
 // Parse all vars in correct order to preserve vars priorities. This is one stop calling after inv is created to get
 // all vars data ready to use.
+//
+// It panics on error, see ParseAllInventoryVarsErr.
 func (inv *Inventory) ParseAllInventoryVars(extraArgs ...string) {
-	u.CheckErr(inv.ParseGroupVars(inv.InventoryDir), "")
-	inv.ParseInventoryVars(inv.InventoryDir)
+	u.CheckErr(inv.ParseAllInventoryVarsErr(extraArgs...), "ParseAllInventoryVars")
+}
+
+// ParseAllInventoryVarsErr is ParseAllInventoryVars returning the errors
+func (inv *Inventory) ParseAllInventoryVarsErr(extraArgs ...string) error {
+	if err := inv.ParseGroupVars(inv.InventoryDir); err != nil {
+		return err
+	}
+	if err := inv.ParseInventoryVars(inv.InventoryDir); err != nil {
+		return err
+	}
 	inv.MergeGroupVars()
 	inv.MergeVars()
-	u.CheckErr(inv.ParseHostVars(inv.InventoryDir), "")
+	if err := inv.ParseHostVars(inv.InventoryDir); err != nil {
+		return err
+	}
 	inv.MergeVarNotOverriding()
 	if len(extraArgs) > 0 {
 		inv.SetFact("", extraArgs...)
 	}
-	u.CheckErr(inv.FlattenAllVars(), "")
+	return inv.FlattenAllVars()
 }
 
 // ParseGroupVars reads YAML files named <groupname>.yml from group_vars/
@@ -845,7 +876,16 @@ func (inv *Inventory) ParseGroupVars(invDir string) error {
 			}
 			break
 		}
-		inv.Groups["all"].Vars["inventory_dir"] = inv.InventoryDir
+		// without group_vars/all the all group is not in Groups yet
+		g, ok := inv.Groups["all"]
+		if !ok {
+			g = &Group{Name: "all"}
+			inv.Groups["all"] = g
+		}
+		if g.Vars == nil {
+			g.Vars = make(map[string]any)
+		}
+		g.Vars["inventory_dir"] = inv.InventoryDir
 	}
 	for groupName := range inv.Groups {
 		// Try .yml first, then .yaml
@@ -1009,6 +1049,27 @@ func parseDynamicValue(val string) (interface{}, error) {
 	return detected, nil
 }
 
+// jsonNumbers returns v with its numbers as float64, the type parseDynamicValue gives them
+func jsonNumbers(v any) any {
+	switch t := v.(type) {
+	case int64:
+		return float64(t)
+	case []any:
+		out := make([]any, len(t))
+		for i, item := range t {
+			out[i] = jsonNumbers(item)
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(t))
+		for k, item := range t {
+			out[k] = jsonNumbers(item)
+		}
+		return out
+	}
+	return v
+}
+
 // FlattenAllVars flattens Jinja2 templates and expressions in each host's Vars
 func (inv *Inventory) FlattenAllVars() error {
 	for _, host := range inv.Hosts {
@@ -1231,8 +1292,24 @@ func ReadFirstLevelFiles(dirPath string) ([]fs.DirEntry, error) {
 }
 
 // Parse all type inventory fiels in the dir, currently support generator and ini format.
+//
+// It prints the YAML files processed and panics on error, see ParseInventoryDirAllErr.
 func ParseInventoryDirAll(inventoryDir string) *Inventory {
-	invFiles := u.Must(ReadFirstLevelFiles(inventoryDir))
+	inv, err := parseInventoryDirAll(inventoryDir, true)
+	u.CheckErr(err, "ParseInventoryDirAll")
+	return inv
+}
+
+// ParseInventoryDirAllErr is ParseInventoryDirAll returning the errors, it prints nothing
+func ParseInventoryDirAllErr(inventoryDir string) (*Inventory, error) {
+	return parseInventoryDirAll(inventoryDir, false)
+}
+
+func parseInventoryDirAll(inventoryDir string, verbose bool) (*Inventory, error) {
+	invFiles, err := ReadFirstLevelFiles(inventoryDir)
+	if err != nil {
+		return nil, err
+	}
 	readers := []io.Reader{}
 
 	for _, invF := range invFiles {
@@ -1241,9 +1318,17 @@ func ParseInventoryDirAll(inventoryDir string) *Inventory {
 
 		switch ext {
 		case ".yaml", ".yml":
-			println("Processing YAML file: " + filePath)
+			if verbose {
+				println("Processing YAML file: " + filePath)
+			}
+			b, err := os.ReadFile(filePath)
+			if err != nil {
+				return nil, err
+			}
 			invConfig := GeneratorConfig{}
-			u.CheckErr(yaml.Unmarshal(u.Must(os.ReadFile(filePath)), &invConfig), "")
+			if err := yaml.Unmarshal(b, &invConfig); err != nil {
+				return nil, fmt.Errorf("%s: %w", filePath, err)
+			}
 			iniContent := GenerateIniFromConfig(&invConfig)
 			readers = append(readers, strings.NewReader(iniContent))
 		case ".ini":
@@ -1254,12 +1339,17 @@ func ParseInventoryDirAll(inventoryDir string) *Inventory {
 	}
 
 	// Start with base INI parsing (e.g., from inventoryDir/*.ini)
-	inv := u.Must(ParseInventoryDir(inventoryDir))
+	inv, err := ParseInventoryDir(inventoryDir)
+	if err != nil {
+		return nil, err
+	}
 	// Then layer on YAML→INI content
 	if len(readers) > 0 {
-		u.CheckErr(ParseInventory(io.MultiReader(readers...), inv), "")
+		if err := ParseInventory(io.MultiReader(readers...), inv); err != nil {
+			return nil, err
+		}
 	}
-	return inv
+	return inv, nil
 }
 
 // MatchHost returns all hostnames matching the given regex pattern
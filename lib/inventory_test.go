@@ -2,6 +2,8 @@ package lib
 
 import (
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -75,3 +77,66 @@ func TestGenerateINIFromConfig(t *testing.T) {
 	inv.FlattenAllVars()
 	println("[DEBUG] Parse inv after Flattern all vars:\n" + u.JsonDump(inv, ""))
 }
+
+func TestFlattenVarNative(t *testing.T) {
+	data := map[string]any{
+		"ports":   []any{80, 443},
+		"port":    8080,
+		"listen":  "{{ ports }}",
+		"next":    "{{ port + 1 }}",
+		"missing": "{{ nope }}",
+		"text":    "port {{ port }}",
+	}
+	vars, err := FlattenAllVars(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the numbers are float64 and an undefined value is "" as when the rendered text is parsed
+	expected := map[string]any{"listen": []any{float64(80), float64(443)}, "next": float64(8081), "missing": "", "text": "port 8080"}
+	for k, v := range expected {
+		if !reflect.DeepEqual(vars[k], v) {
+			t.Errorf("%s: expected %#v, got %#v", k, v, vars[k])
+		}
+	}
+}
+
+func TestParseGroupVarsWithoutAll(t *testing.T) {
+	tempDir := t.TempDir()
+	writeFiles(t, tempDir, map[string]string{"hosts": "[web]\nweb1\n", "group_vars/web.yml": "port: 80\n"})
+	inv, err := ParseInventoryDir(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inv.ParseGroupVars(""); err != nil {
+		t.Fatal(err)
+	}
+	if all := inv.Groups["all"]; all == nil || all.Vars["inventory_dir"] != tempDir {
+		t.Errorf("expected the all group with inventory_dir, got %+v", all)
+	}
+	if port := inv.Groups["web"].Vars["port"]; port != 80 {
+		t.Errorf("expected the web group vars, got %v", port)
+	}
+}
+
+func TestParseInventoryDirAllErr(t *testing.T) {
+	if _, err := ParseInventoryDirAllErr(filepath.Join(t.TempDir(), "nope")); err == nil {
+		t.Errorf("expected a missing directory error")
+	}
+	tempDir := t.TempDir()
+	writeFiles(t, tempDir, map[string]string{"hosts.yaml": "groups: [\n"})
+	if _, err := ParseInventoryDirAllErr(tempDir); err == nil || !strings.Contains(err.Error(), "hosts.yaml") {
+		t.Errorf("expected a yaml error, got %v", err)
+	}
+	tempDir = t.TempDir()
+	writeFiles(t, tempDir, map[string]string{"hosts": "[web]\nweb1\n", "host_vars/web1.yml": "port: 80\n"})
+	inv, err := ParseInventoryDirAllErr(tempDir)
+	if err == nil {
+		err = inv.ParseAllInventoryVarsErr()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := inv.Hosts["web1"]; h == nil || h.Vars["port"] != float64(80) {
+		t.Errorf("unexpected host %+v", h)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/fs"
 	"sort"
+	"strconv"
 	"time"
 
 	"github.com/mitsuhiko/minijinja/minijinja-go/v2/filters"
@@ -22,31 +23,6 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
-func parseJinja2Config(firstLine, prefix string) (foundConfig bool, whc syntax.WhitespaceConfig, cfg syntax.SyntaxConfig) {
-	whc = syntax.DefaultWhitespace()
-	cfg = syntax.DefaultSyntax()
-
-	for _, _token := range strings.Split(strings.TrimPrefix(firstLine, prefix), ",") {
-		_token0 := strings.TrimSpace(_token)
-		_data := strings.Split(_token0, ":")
-		switch _data[0] {
-		case "variable_start_string":
-			foundConfig = true
-			cfg.VarStart = strings.Trim(strings.Trim(_data[1], `'`), `"`)
-		case "variable_end_string":
-			foundConfig = true
-			cfg.VarEnd = strings.Trim(strings.Trim(_data[1], `'`), `"`)
-		case "trim_blocks":
-			foundConfig = true
-			whc.TrimBlocks = _data[1] == "True"
-		case "lstrip_blocks":
-			foundConfig = true
-			whc.LstripBlocks = _data[1] == "True"
-		}
-	}
-	return
-}
-
 func NewJinjaEnvironment(whc *syntax.WhitespaceConfig, cfg *syntax.SyntaxConfig) *mj.Environment {
 	env := mj.NewEnvironment()
 	if whc != nil {
@@ -80,6 +56,15 @@ func NewJinjaEnvironment(whc *syntax.WhitespaceConfig, cfg *syntax.SyntaxConfig)
 	env.AddFilter("contains_any", filterContainsAny)
 	env.AddFilter("keys", FilterKeys)
 	env.AddFilter("indent", filterIndent)
+	// Ansible compatible filters
+	addDataFilters(env)
+	addStringFilters(env)
+	addHashFilters(env)
+	addNetFilters(env)
+	addTimeFilters(env)
+	SetLookupOptions(env, DefaultLookupOptions())
+	// the RegisterFilter, RegisterTest, RegisterFunction and RegisterGlobal ones
+	applyRegistry(env)
 	return env
 }
 
@@ -176,14 +161,24 @@ func filterWrap(state mj.FilterState, val value.Value, args []value.Value, kwarg
 	// Return as safe string since we're generating HTML
 	return value.FromSafeString(result), nil
 }
+
+// filterNow is now(layout=time.RFC3339), the layout being a go time layout. Like ansible it also takes
+// utc=true and fmt, a python strftime format used instead of the layout.
 func filterNow(state *mj.State, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+	now := time.Now()
+	if kwBool(kwargs, "utc", false) {
+		now = now.UTC()
+	}
+	if f, ok := kwargs["fmt"]; ok && !f.IsNone() {
+		return value.FromString(Strftime(now, f.String())), nil
+	}
 	format := time.RFC3339
 	if len(args) > 0 {
 		if f, ok := args[0].AsString(); ok {
 			format = f
 		}
 	}
-	return value.FromString(time.Now().Format(format)), nil
+	return value.FromString(now.Format(format)), nil
 }
 
 func testStartWith(state mj.TestState, val value.Value, args []value.Value) (bool, error) {
@@ -274,13 +269,15 @@ func filterIndent(_ mj.FilterState, val value.Value, args []value.Value, kwargs
 
 // }
 
-var ptnPerlCapture *regexp.Regexp = regexp.MustCompile(`\\(\d+)`)
+var ptnPerlCapture *regexp.Regexp = regexp.MustCompile(`\\(\d+)|\\g<(\w+)>`)
 
 func convertPerlCapPattern(input string) string {
-	// Define the regular expression to match the pattern \d+
-	// Replace the matched pattern with $ and the digits
+	// Replace the python style \1 and \g<name> group references with ${1} and ${name}
 	result := ptnPerlCapture.ReplaceAllStringFunc(input, func(match string) string {
-		return "$" + match[1:]
+		if strings.HasPrefix(match, `\g<`) {
+			return "${" + match[3:len(match)-1] + "}"
+		}
+		return "${" + match[1:] + "}"
 	})
 
 	return result
@@ -308,10 +305,24 @@ func filterFuncRegexReplace(state mj.FilterState, val value.Value, args []value.
 	new, _ := args[1].AsString()
 	new = convertPerlCapPattern(new)
 
-	ptn := regexp.MustCompile(pattern)
-
-	output := ptn.ReplaceAllString(s, new)
-	return value.FromString(output), nil
+	// ignorecase, multiline and count like ansible. count 0 replaces all
+	ptn, err := compileRegex(pattern, kwargs)
+	if err != nil {
+		return value.Undefined(), fmt.Errorf("regex_replace: %w", err)
+	}
+	count := kwInt(kwargs, "count", 0)
+	if count <= 0 {
+		return value.FromString(ptn.ReplaceAllString(s, new)), nil
+	}
+	var output []byte
+	last := 0
+	for _, m := range ptn.FindAllStringSubmatchIndex(s, count) {
+		output = append(output, s[last:m[0]]...)
+		output = ptn.ExpandString(output, new, s, m)
+		last = m[1]
+	}
+	output = append(output, s[last:]...)
+	return value.FromString(string(output)), nil
 }
 
 func filterFuncRegexSearch(state mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
@@ -324,7 +335,10 @@ func filterFuncRegexSearch(state mj.FilterState, val value.Value, args []value.V
 		return value.Undefined(), fmt.Errorf("regex_search expects 1 arg: pattern")
 	}
 	ptnStr, _ := args[0].AsString()
-	ptn := regexp.MustCompile(ptnStr)
+	ptn, err := compileRegex(ptnStr, kwargs)
+	if err != nil {
+		return value.Undefined(), fmt.Errorf("regex_search: %w", err)
+	}
 
 	out := ptn.FindStringSubmatch(input)
 	if len(out) == 1 { // return a match
@@ -352,7 +366,7 @@ func filterFuncToYaml(state mj.FilterState, val value.Value, args []value.Value,
 	encoder.SetIndent(int(indent))
 
 	if err := encoder.Encode(input); err != nil {
-		panic(fmt.Sprintf("Error encoding YAML: %s\n", err))
+		return value.Undefined(), fmt.Errorf("to_yaml: %w", err)
 	}
 	return value.FromString(buf.String()), nil
 }
@@ -362,8 +376,20 @@ func filterFuncB64Encode(state mj.FilterState, val value.Value, args []value.Val
 	if !ok {
 		return value.Undefined(), fmt.Errorf("b64encode expects a string")
 	}
-	// wrap is unsupported in golang, try to implement it later on
-	o := b64.StdEncoding.EncodeToString([]byte(input))
+	data, err := encodeText(input, kwString(kwargs, "encoding", "utf-8"))
+	if err != nil {
+		return value.Undefined(), fmt.Errorf("b64encode: %w", err)
+	}
+	o := b64.StdEncoding.EncodeToString(data)
+	// wrap=N breaks the output in lines of N characters like base64 -w
+	if wrap := kwInt(kwargs, "wrap", 0); wrap > 0 {
+		lines := []string{}
+		for len(o) > wrap {
+			lines = append(lines, o[:wrap])
+			o = o[wrap:]
+		}
+		o = strings.Join(append(lines, o), "\n")
+	}
 	return value.FromString(o), nil
 }
 
@@ -372,8 +398,20 @@ func filterFuncB64Decode(state mj.FilterState, val value.Value, args []value.Val
 	if !ok {
 		return value.Undefined(), fmt.Errorf("b64decode expects a string")
 	}
-	o := u.Must(b64.StdEncoding.DecodeString(input))
-	return value.FromBytes(o), nil
+	o, err := b64.StdEncoding.DecodeString(input)
+	if err != nil {
+		return value.Undefined(), fmt.Errorf("b64decode: %w", err)
+	}
+	// without encoding keep the old behaviour of returning the raw bytes
+	encoding, ok := kwargs["encoding"]
+	if !ok {
+		return value.FromBytes(o), nil
+	}
+	out, err := decodeText(o, encoding.String())
+	if err != nil {
+		return value.Undefined(), fmt.Errorf("b64decode: %w", err)
+	}
+	return value.FromString(out), nil
 }
 
 func filterContainsAll(state mj.FilterState, val value.Value, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
@@ -423,20 +461,11 @@ func filterContainsAny(state mj.FilterState, val value.Value, args []value.Value
 //
 // The function uses the environment variable JINJA2_CONFIG_LINE_PREFIX
 // (default: "#jinja2:") to identify configuration lines.
+//
+// A malformed header is left in the text, use InspectTemplateHeader to get the error.
 func InspectTemplateString(text string) (foundConfig bool, remainText string, whc syntax.WhitespaceConfig, cfg syntax.SyntaxConfig) {
-	firstLine, newSrc := u.SplitFirstLine(text)
-	if newSrc == "" {
-		return false, text, syntax.DefaultWhitespace(), syntax.DefaultSyntax()
-	}
-	prefix := u.Getenv("JINJA2_CONFIG_LINE_PREFIX", `#jinja2:`)
-	_foundConfig, whc, cfg := parseJinja2Config(firstLine, prefix)
-	if !_foundConfig {
-		newSrc = text
-		foundConfig = false
-		whc.LstripBlocks = true
-		whc.TrimBlocks = true
-	}
-	return foundConfig, newSrc, whc, cfg
+	foundConfig, remainText, tc, _ := InspectTemplateHeader(text)
+	return foundConfig, remainText, tc.Whitespace, tc.Syntax
 }
 
 // InspectTemplateFile reads the content of a file and uses InspectTemplateString
@@ -445,61 +474,74 @@ func InspectTemplateString(text string) (foundConfig bool, remainText string, wh
 // Returns the processing flag, remaining text, and the parsed whitespace and
 // syntax configurations based on the file's contents.
 // Caller can always use the remainText as source of templateString
+// It panics if the file can not be read or the header is malformed, see InspectTemplateFileErr.
 func InspectTemplateFile(filePath string) (foundConfig bool, remainText string, whc syntax.WhitespaceConfig, cfg syntax.SyntaxConfig) {
-	data := string(u.Must(os.ReadFile(filePath)))
-	return InspectTemplateString(data)
+	foundConfig, remainText, whc, cfg, err := InspectTemplateFileErr(filePath)
+	u.CheckErr(err, "InspectTemplateFile")
+	return
+}
+
+// InspectTemplateFileErr is InspectTemplateFile returning the read error or the header *TemplateError
+func InspectTemplateFileErr(filePath string) (foundConfig bool, remainText string, whc syntax.WhitespaceConfig, cfg syntax.SyntaxConfig, err error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return false, "", whc, cfg, err
+	}
+	foundConfig, remainText, tc, err := InspectTemplateHeader(string(data))
+	if err != nil {
+		return false, string(data), tc.Whitespace, tc.Syntax, headerError(filePath, string(data), err)
+	}
+	return foundConfig, remainText, tc.Whitespace, tc.Syntax, nil
 }
 
 // Template a file using template string and convert windows new line to unix. This is
 // work around the gonja2 windows new line problem
+//
+// include, import and extends are resolved with the TemplateSearchPath of src. JINJA2_UNDEFINED works as for
+// TemplateString.
+//
+// It panics on error, see TemplateFileErr.
 func TemplateFile(src, dest string, data map[string]any, fileMode os.FileMode) {
-	if fileMode == 0 {
-		fileMode = 0o777
-	}
-	srcB := u.Must(os.ReadFile(src))
-	_, remain, whc, cfg := InspectTemplateString(string(srcB))
-	// println("FILE: " + src)
-	// println("SOURCE: " + string(srcB))
-	// println("REMAIN: " + remain)
-	env := NewJinjaEnvironment(&whc, &cfg)
-	tmpl := u.Must(env.TemplateFromString(remain))
-	destFile := u.Must(os.Create(dest))
-	u.CheckErr(destFile.Chmod(fileMode), fmt.Sprintf("[ERROR] can not chmod %d for file %s\n", fileMode, dest))
-	defer destFile.Close()
-	u.CheckErr(tmpl.RenderToWrite(data, destFile), "TemplateFile - RenderToWrite")
-	// out := u.Must(tmpl.Render(data))
-	// u.Must(destFile.WriteString(out))
-}
-
-func parseConfigVarArgs(opt []string) (syntax.WhitespaceConfig, syntax.SyntaxConfig, map[string]string) {
-	whc := syntax.DefaultWhitespace()
-	whc.TrimBlocks = true
-	whc.LstripBlocks = true
-	cfg := syntax.DefaultSyntax()
+	u.CheckErr(warnUndefined(TemplateFileErr(src, dest, data, fileMode), os.Getenv("JINJA2_UNDEFINED")), "TemplateFile")
+}
+
+// TemplateFileErr is TemplateFile returning the errors, a *TemplateError for the template errors. With
+// JINJA2_UNDEFINED=collect dest is written and the *UndefinedError returned. The compiled template is kept in
+// DefaultTemplateCache.
+func TemplateFileErr(src, dest string, data map[string]any, fileMode os.FileMode) error {
+	_, err := TemplateFileSafe(src, dest, data, WriteFileOptions{Mode: fileMode})
+	return err
+}
+
+// TemplateFileSafe is TemplateFileErr with the WriteFileAtomic options, it tells if dest changed
+func TemplateFileSafe(src, dest string, data map[string]any, opt WriteFileOptions) (WriteFileResult, error) {
+	mode, err := undefinedMode("")
+	if err != nil {
+		return WriteFileResult{Path: dest}, err
+	}
+	out, err := renderTemplateFile(src, data, mode)
+	return writeRenderOutput(dest, out, err, mode, opt)
+}
+
+// parseConfigVarArgs parses the key, value option pairs. The template settings are the same as the #jinja2: header
+// ones, see TemplateConfig, the others are returned in the extra config map.
+func parseConfigVarArgs(opt []string) (TemplateConfig, map[string]string, error) {
+	tc := DefaultTemplateConfig()
 	extraConfig := map[string]string{"replace_new_line": "True"}
 
 	optLength := len(opt)
 	if optLength >= 2 {
 		for i := 0; i <= optLength-2; i += 2 {
-			switch opt[i] {
-			case "variable_start_string":
-				cfg.VarStart = opt[i+1]
-			case "variable_end_string":
-				cfg.VarEnd = opt[i+1]
-			case "trim_blocks":
-				whc.TrimBlocks = opt[i+1] == "True"
-			case "lstrip_blocks":
-				whc.LstripBlocks = opt[i+1] == "True"
-			case "comment_start_string":
-				cfg.CommentStart = opt[i+1]
-			case "comment_end_string":
-				cfg.CommentEnd = opt[i+1]
-			default:
+			known, err := tc.Set(opt[i], opt[i+1])
+			if err != nil {
+				return tc, extraConfig, err
+			}
+			if !known {
 				extraConfig[opt[i]] = opt[i+1]
 			}
 		}
 	}
-	return whc, cfg, extraConfig
+	return tc, extraConfig, nil
 }
 
 // This func is suiatable to run on server as it wont crash but return err if tehre is err and have the most comprehensive options
@@ -507,99 +549,121 @@ func parseConfigVarArgs(opt []string) (syntax.WhitespaceConfig, syntax.SyntaxCon
 // It also take the config options and do not parse the config line in the file so there is no intermedeate copy to temp file
 // it a bit tiny faster esp when template large files > 10Mb for example
 // Note there is known the windows new line problems if you this func. To replace_new_line set it to true
+//
+// dest is written with WriteFileAtomic, the "backup" (True/False), "owner", "group" and "validate" options are the
+// WriteFileOptions ones. A fileMode of 0 keeps the mode of an existing dest.
 func TemplateFileWithConfig(src, dest string, data map[string]interface{}, fileMode os.FileMode, opt ...string) error {
-	if fileMode == 0 {
-		fileMode = 0o777
+	tc, extraConfig, err := parseConfigVarArgs(opt)
+	if err != nil {
+		return err
 	}
 
-	whc, cfg, extraConfig := parseConfigVarArgs(opt)
-
 	if extraConfig["DEBUG"] == "True" {
-		fmt.Fprintf(os.Stderr, "[DEBUG] %s\n", u.JsonDump(cfg, ""))
+		fmt.Fprintf(os.Stderr, "[DEBUG] %s\n", u.JsonDump(tc, ""))
 	}
 
-	env := NewJinjaEnvironment(&whc, &cfg)
+	env := NewJinjaEnvironment(&tc.Whitespace, &tc.Syntax)
+	setLookupConfig(env, extraConfig)
 
-	dataS := string(u.Must(os.ReadFile(src)))
-	tmpl, err := env.TemplateFromString(dataS)
+	dataS, err := os.ReadFile(src)
 	if err != nil {
 		return err
 	}
-	destFile, err := os.Create(dest)
+	tmpl, err := env.TemplateFromNamedString(src, string(dataS))
+	if err != nil {
+		return templateError(err, errorLocation{name: src, sources: map[string]string{src: string(dataS)}})
+	}
+	mode, err := undefinedMode(extraConfig["undefined"])
 	if err != nil {
 		return err
 	}
-	if err := u.CheckErrNonFatal(destFile.Chmod(fileMode), fmt.Sprintf("[ERROR] can not chmod %d for file %s\n", fileMode, dest)); err != nil {
+	env.SetUndefinedBehavior(undefinedBehavior(mode))
+	backup, _ := strconv.ParseBool(extraConfig["backup"])
+	wo := WriteFileOptions{Mode: fileMode, Owner: extraConfig["owner"], Group: extraConfig["group"], Backup: backup, Validate: extraConfig["validate"]}
+	out, undefinedErr := renderUndefined(env, tmpl, tc, data, mode, errorLocation{})
+	if undefinedFatal(undefinedErr, mode) {
+		return undefinedErr
+	}
+	if _, err := WriteFileAtomic(dest, []byte(tc.Apply(out)), wo); err != nil {
 		return err
 	}
-	defer destFile.Close()
-	return tmpl.RenderToWrite(data, destFile)
+	return undefinedErr
 }
 
 // TemplateStringWithConfig renders a Jinja2 template string with the specified
 // Whitespace and Syntax configurations.
 //
-// The opt argument allows passing whitespace and syntax options (e.g. "ignore:").
+// The opt argument allows passing the #jinja2: header settings as key, value pairs (see TemplateConfig), "lookup_root", dir to
+// limit the lookup plugins to dir, "lookup_allow", "env,lines" to allow the env and lines lookups and "undefined",
+// "strict" or "collect" to report undefined variables (see UndefinedError).
 func TemplateStringWithConfig(srcString string, data map[string]interface{}, opt ...string) (string, error) {
-	whc, cfg, _ := parseConfigVarArgs(opt)
-	env := NewJinjaEnvironment(&whc, &cfg)
-	tmpl, err := env.TemplateFromString(srcString)
+	tc, extraConfig, err := parseConfigVarArgs(opt)
+	if err != nil {
+		return "", err
+	}
+	mode, err := undefinedMode(extraConfig["undefined"])
 	if err != nil {
 		return "", err
 	}
-	return tmpl.Render(data)
+	env := NewJinjaEnvironment(&tc.Whitespace, &tc.Syntax)
+	env.SetUndefinedBehavior(undefinedBehavior(mode))
+	setLookupConfig(env, extraConfig)
+	tmpl, err := env.TemplateFromString(srcString)
+	if err != nil {
+		return "", templateError(err, errorLocation{name: "<string>", sources: map[string]string{"<string>": srcString}})
+	}
+	out, err := renderUndefined(env, tmpl, tc, data, mode, errorLocation{})
+	return tc.Apply(out), err
 }
 
 // If a configuration line is found, it renders the template body with the
 // specific settings. If no configuration is found, it renders the original
 // string with default settings.
+// With JINJA2_UNDEFINED=strict it panics on undefined variables, with collect they are printed to stderr.
+//
+// It panics on error, see TemplateStringErr.
 func TemplateString(srcString string, data map[string]interface{}) string {
-	_, newSrc, whc, cfg := InspectTemplateString(srcString)
-	if newSrc == "" {
-		newSrc = srcString
+	out, err := TemplateStringErr(srcString, data)
+	u.CheckErr(warnUndefined(err, os.Getenv("JINJA2_UNDEFINED")), "TemplateString")
+	return out
+}
+
+// TemplateStringErr is TemplateString returning the errors, a *TemplateError for the template errors. With
+// JINJA2_UNDEFINED=collect the output is returned with the *UndefinedError. The compiled templates are kept in
+// DefaultTemplateCache.
+func TemplateStringErr(srcString string, data map[string]interface{}) (string, error) {
+	ct, err := DefaultTemplateCache.String(srcString)
+	if err != nil {
+		return "", err
 	}
-	env := NewJinjaEnvironment(&whc, &cfg)
-	tmpl := u.Must(env.TemplateFromString(newSrc))
-	return u.Must(tmpl.Render(data))
+	return ct.Render(data, "")
 }
 
 // TemplateDirTree read all templates files in the src directory and template to the target directory keeping the directory structure the same as source.
 // Src and Target Path should be absolute path. They should not overlap to avoid recursive loop
+//
+// It panics on error, see TemplateDirTreeErr.
 func TemplateDirTree(srcDirpath, targetRoot string, tmplData map[string]interface{}) error {
-	if isExist, err := u.FileExists(srcDirpath); !isExist || err != nil {
-		panic("File " + srcDirpath + " does not exist\n")
-	}
-	filepath.Walk(srcDirpath, func(path string, info fs.FileInfo, err error) error {
-		if err != nil {
-			fmt.Printf("prevent panic by handling failure accessing a path %q: %v\n", srcDirpath, err)
-			return err
-		}
-		relPath, err := filepath.Rel(srcDirpath, path)
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() {
-			destFile := filepath.Join(targetRoot, relPath)
-			fmt.Printf("Going to template file %s => %s\n", path, destFile)
-			destDir := filepath.Dir(destFile)
-			u.CheckErr(os.MkdirAll(destDir, 0o777), "TemplateDirTree")
-			TemplateFile(path, destFile, tmplData, 0644)
-		} else {
-			u.CheckErr(os.MkdirAll(filepath.Join(targetRoot, relPath), 0755), "[ERROR] MkdirAll")
-		}
-		return nil
-	})
+	u.CheckErr(warnUndefined(TemplateDirTreeErr(srcDirpath, targetRoot, tmplData), os.Getenv("JINJA2_UNDEFINED")), "TemplateDirTree")
 	return nil
 }
 
+// TemplateDirTreeErr is TemplateDirTree returning the errors, see TemplateDirTreeWithOptions for the options and
+// the list of changed files.
+func TemplateDirTreeErr(srcDirpath, targetRoot string, tmplData map[string]interface{}) error {
+	_, err := TemplateDirTreeWithOptions(srcDirpath, targetRoot, tmplData, DirTreeOptions{})
+	return err
+}
+
 // LoadTemplatesInDirectory loads all template files from a directory and returns
 // a map of template names (relative paths) to their parsed template objects.
 //
 // The function walks through the directory recursively, ignoring directories
-// and processing only files. Template files are parsed using the default
-// Jinja2 environment settings.
+// and processing only files. All templates share one TemplateEnv rooted at dirPath
+// so they can include, import and extend each other; each file header is honoured.
 func LoadTemplatesInDirectory(dirPath string) (map[string]*mj.Template, error) {
 	templates := make(map[string]*mj.Template)
+	te := NewTemplateEnv(dirPath)
 
 	err := filepath.Walk(dirPath, func(path string, info fs.FileInfo, err error) error {
 		if err != nil {
@@ -611,13 +675,7 @@ func LoadTemplatesInDirectory(dirPath string) (map[string]*mj.Template, error) {
 			if err != nil {
 				return err
 			}
-
-			// Use InspectTemplateFile to get the parsed template
-			_, remain, whc, cfg := InspectTemplateFile(path)
-
-			// Create template with parsed settings
-			env := NewJinjaEnvironment(&whc, &cfg)
-			tmpl, err := env.TemplateFromString(remain)
+			tmpl, err := te.Template(filepath.ToSlash(relPath))
 			if err != nil {
 				return fmt.Errorf("failed to parse template %s: %w", path, err)
 			}
@@ -0,0 +1,405 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mitsuhiko/minijinja/minijinja-go/v2/syntax"
+	"github.com/sunshine69/automation-go/gonja"
+	u "github.com/sunshine69/golang-tools/utils"
+	"github.com/sunshine69/sonja/v2/exec"
+)
+
+// Template linting, the templates are parsed and analyzed but not rendered. cmd/j2lint is the command line of it.
+
+// LintRule is a check of LintTemplates, Level is the SARIF level of its issues: error, warning or note
+type LintRule struct {
+	ID          string `json:"id"`
+	Level       string `json:"level"`
+	Description string `json:"description"`
+}
+
+// LintRules are the rules checked, undefined-variable only when LintOptions.Vars is set
+var LintRules = []LintRule{
+	{"header", "error", "The #jinja2: header line is invalid"},
+	{"syntax", "error", "The template does not parse"},
+	{"unknown-filter", "error", "The filter is not in the environment"},
+	{"unknown-test", "error", "The test is not in the environment"},
+	{"unknown-function", "error", "The global function is not in the environment"},
+	{"undefined-variable", "warning", "The variable is not in the vars and not guarded by `is defined` or `| default`"},
+	{"mixed-indent", "warning", "The indentation before a block tag mixes tabs and spaces, lstrip_blocks strips it"},
+	{"trailing-whitespace", "warning", "Whitespace after a block tag is rendered, a - control would remove it"},
+}
+
+// LintFormats are the formats of WriteLintReport
+var LintFormats = []string{"text", "json", "sarif"}
+
+// LintIssue is a problem found in a template. Line and Column start at 1 and are 0 when unknown, Line counts the
+// #jinja2: header line.
+type LintIssue struct {
+	File    string `json:"file"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Rule    string `json:"rule"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+func (i LintIssue) String() string {
+	loc := i.File
+	if i.Line > 0 {
+		loc += ":" + strconv.Itoa(i.Line)
+		if i.Column > 0 {
+			loc += ":" + strconv.Itoa(i.Column)
+		}
+	}
+	return fmt.Sprintf("%s: %s %s: %s", loc, i.Level, i.Rule, i.Message)
+}
+
+// LintOptions are the options of LintTemplates
+type LintOptions struct {
+	// Engine is minijinja or gonja, when empty the engine: of the #jinja2: header else minijinja. Only the header of
+	// the gotemplate templates is checked.
+	Engine string
+	// Vars are the variables the templates get, the undefined-variable rule is checked when not nil
+	Vars map[string]any
+	// Extensions are the extensions of the files read in the directories, .j2, .jinja and .jinja2 by default
+	Extensions []string
+}
+
+// linter keeps the environments of the unknown name checks across the templates
+type linter struct {
+	opt      LintOptions
+	probe    *envProbe
+	gonjaEnv *exec.Environment
+}
+
+func newLinter(opt LintOptions) *linter {
+	return &linter{opt: opt}
+}
+
+// LintTemplateString lints the template text src, name is the File of the issues
+func LintTemplateString(name, src string, opt LintOptions) []LintIssue {
+	issues := newLinter(opt).lint(name, "", src)
+	sortLintIssues(issues)
+	return issues
+}
+
+// templateExtensions are the extensions of the template files looked for in the directories
+var templateExtensions = []string{".j2", ".jinja", ".jinja2"}
+
+// LintTemplates lints the template files of paths, the directories are walked for the files having one of the
+// Extensions. The issues are sorted by file and line; the error is only for unreadable paths.
+func LintTemplates(paths []string, opt LintOptions) ([]LintIssue, error) {
+	l := newLinter(opt)
+	exts := u.Ternary(len(opt.Extensions) > 0, opt.Extensions, templateExtensions)
+	issues := []LintIssue{}
+	lintFile := func(p string) error {
+		src, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		issues = append(issues, l.lint(filepath.ToSlash(p), filepath.Dir(p), string(src))...)
+		return nil
+	}
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			if err := lintFile(p); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		err = filepath.WalkDir(p, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || !containsStr(exts, filepath.Ext(path)) {
+				return err
+			}
+			return lintFile(path)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sortLintIssues(issues)
+	return issues, nil
+}
+
+func sortLintIssues(issues []LintIssue) {
+	sort.SliceStable(issues, func(i, j int) bool {
+		a, b := issues[i], issues[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+}
+
+// lint checks the template src of the file name in dir, dir is where gonja looks for the included templates
+func (l *linter) lint(name, dir, src string) []LintIssue {
+	issues := []LintIssue{}
+	add := func(line, column int, rule, format string, args ...any) {
+		level := ""
+		for _, r := range LintRules {
+			if r.ID == rule {
+				level = r.Level
+			}
+		}
+		issues = append(issues, LintIssue{File: name, Line: line, Column: column, Rule: rule, Level: level, Message: fmt.Sprintf(format, args...)})
+	}
+	src = strings.ReplaceAll(src, "\r\n", "\n")
+	found, body, tc, err := InspectTemplateHeader(src)
+	if err != nil {
+		// the rest is checked as if there was no header
+		add(1, 0, "header", "%s", err.Error())
+	}
+	offset := u.Ternary(found, 1, 0)
+	engine := l.opt.Engine
+	if engine == "" {
+		engine = u.Ternary(tc.Engine == "", EngineMinijinja, tc.Engine)
+	}
+	if engine == EngineGoTemplate {
+		return issues
+	}
+
+	if line, column, msg := l.parse(engine, name, dir, body, tc); msg != "" {
+		add(u.Ternary(line > 0, line+offset, 0), column, "syntax", "%s", msg)
+		return issues
+	}
+	for _, ws := range whitespaceIssues(body, tc) {
+		add(ws.line+offset, ws.column, ws.rule, "%s", ws.message)
+	}
+	ta, err := analyzeTemplate(name, body, tc.Syntax)
+	if err != nil {
+		return issues
+	}
+	tags, _ := splitTemplateTags(body, tc.Syntax)
+	at := func(pattern string) int {
+		line := findTagUse(tags, pattern)
+		return u.Ternary(line > 0, line+offset, 0)
+	}
+	for _, f := range ta.Filters {
+		if !l.known(engine, "filter", f) {
+			add(at(`\|\s*`+regexp.QuoteMeta(f)+`\b`), 0, "unknown-filter", "unknown filter %s for %s", f, engine)
+		}
+	}
+	for _, t := range ta.Tests {
+		if !l.known(engine, "test", t) {
+			add(at(`\bis\s+(not\s+)?`+regexp.QuoteMeta(t)+`\b`), 0, "unknown-test", "unknown test %s for %s", t, engine)
+		}
+	}
+	for _, f := range ta.Functions {
+		if !l.known(engine, "function", f) {
+			add(at(`\b`+regexp.QuoteMeta(f)+`\s*\(`), 0, "unknown-function", "unknown function %s for %s", f, engine)
+		}
+	}
+	if l.opt.Vars != nil {
+		for _, use := range ta.missing(l.opt.Vars) {
+			add(use.line+offset, 0, "undefined-variable", "%s is not in the vars", strings.Join(use.path, "."))
+		}
+	}
+	return issues
+}
+
+// gonjaErrRe matches the location the gonja parse errors end with
+var gonjaErrRe = regexp.MustCompile(`(?s)^(.*) \(Line: (\d+) Col: (\d+), near "(.*)"\)$`)
+
+// parse compiles body with engine and returns the error message and its line in body
+func (l *linter) parse(engine, name, dir, body string, tc TemplateConfig) (line, column int, msg string) {
+	if engine == EngineGonja {
+		_, err := gonja.TemplateFromStringWithEnvironment(body, dir, gonjaConfig(tc), l.gonja())
+		if err == nil {
+			return 0, 0, ""
+		}
+		msg = strings.TrimPrefix(err.Error(), "failed to parse template '"+body+"': ")
+		if m := gonjaErrRe.FindStringSubmatch(msg); m != nil {
+			line, _ = strconv.Atoi(m[2])
+			column, _ = strconv.Atoi(m[3])
+			return line, column, m[1]
+		}
+		return 0, 0, msg
+	}
+	env := NewJinjaEnvironment(&tc.Whitespace, &tc.Syntax)
+	if _, err := env.TemplateFromNamedString(name, body); err != nil {
+		if te, ok := templateError(err, errorLocation{name: name, sources: map[string]string{name: body}}).(*TemplateError); ok {
+			return te.Line, te.Column, te.Message
+		}
+		return 0, 0, err.Error()
+	}
+	return 0, 0, ""
+}
+
+func (l *linter) gonja() *exec.Environment {
+	if l.gonjaEnv == nil {
+		l.gonjaEnv = gonja.CustomEnvironment()
+	}
+	return l.gonjaEnv
+}
+
+// known tells if the filter, test or function name is in the environment of engine
+func (l *linter) known(engine, kind, name string) bool {
+	if engine == EngineGonja {
+		env := l.gonja()
+		switch kind {
+		case "filter":
+			return env.Filters.Exists(name)
+		case "test":
+			return env.Tests.Exists(name)
+		}
+		return env.Context.Has(name)
+	}
+	if l.probe == nil {
+		l.probe = newEnvProbe(NewJinjaEnvironment(nil, nil))
+	}
+	switch kind {
+	case "filter":
+		return l.probe.filter(name)
+	case "test":
+		return l.probe.test(name)
+	}
+	return l.probe.function(name)
+}
+
+// findTagUse returns the line of the first tag matching pattern, 0 if none does
+func findTagUse(tags []templateTag, pattern string) int {
+	re := regexp.MustCompile(pattern)
+	for _, tag := range tags {
+		if loc := re.FindStringIndex(tag.text); loc != nil {
+			return tag.line + strings.Count(tag.text[:loc[0]], "\n")
+		}
+	}
+	return 0
+}
+
+type whitespaceIssue struct {
+	line, column  int
+	rule, message string
+}
+
+// whitespaceIssues checks the lines having block tags: the mixed indentation lstrip_blocks strips, the whitespace
+// after the last tag trim_blocks does not remove, and without trim_blocks the lines of block tags only that render
+// an empty line. The raw blocks are skipped.
+func whitespaceIssues(body string, tc TemplateConfig) []whitespaceIssue {
+	start, end := tc.Syntax.BlockStart, tc.Syntax.BlockEnd
+	rawRe := regexp.MustCompile(regexp.QuoteMeta(start) + `[-+]?\s*(end)?raw\s*[-+]?` + regexp.QuoteMeta(end))
+	issues := []whitespaceIssue{}
+	lines := strings.Split(body, "\n")
+	inRaw := false
+	for i, line := range lines {
+		if m := rawRe.FindAllStringSubmatch(line, -1); m != nil {
+			inRaw = m[len(m)-1][1] == ""
+			continue
+		}
+		if inRaw || !strings.Contains(line, start) {
+			continue
+		}
+		trimmed := strings.TrimLeft(line, " \t")
+		indent := line[:len(line)-len(trimmed)]
+		if tc.Whitespace.LstripBlocks && strings.HasPrefix(trimmed, start) && strings.Contains(indent, " ") && strings.Contains(indent, "\t") {
+			issues = append(issues, whitespaceIssue{i + 1, 1, "mixed-indent", "the indentation before " + start + " mixes tabs and spaces"})
+		}
+		if idx := strings.LastIndex(line, end); idx >= 0 {
+			after := line[idx+len(end):]
+			if after != "" && strings.TrimRight(after, " \t") == "" && !strings.HasSuffix(line[:idx], "-") {
+				issues = append(issues, whitespaceIssue{i + 1, idx + len(end) + 1, "trailing-whitespace",
+					fmt.Sprintf("the whitespace after %s is rendered, trim_blocks only removes the newline right after it; remove it or use -%s", end, end)})
+				continue
+			}
+		}
+		if !tc.Whitespace.TrimBlocks && i < len(lines)-1 {
+			if only, trimmedEnd := blockTagsOnly(trimmed, tc.Syntax); only && !trimmedEnd {
+				issues = append(issues, whitespaceIssue{i + 1, len(line) + 1, "trailing-whitespace",
+					fmt.Sprintf("this line of block tags renders an empty line as trim_blocks is off, use -%s", end)})
+			}
+		}
+	}
+	return issues
+}
+
+// blockTagsOnly tells if s is only block tags and if the last one ends with -
+func blockTagsOnly(s string, cfg syntax.SyntaxConfig) (only, trimmedEnd bool) {
+	rest := s
+	for strings.HasPrefix(rest, cfg.BlockStart) {
+		idx := strings.Index(rest[len(cfg.BlockStart):], cfg.BlockEnd)
+		if idx < 0 {
+			return false, false
+		}
+		tagEnd := len(cfg.BlockStart) + idx
+		trimmedEnd = strings.HasSuffix(rest[:tagEnd], "-")
+		rest = strings.TrimLeft(rest[tagEnd+len(cfg.BlockEnd):], " \t")
+		only = true
+	}
+	return only && rest == "", trimmedEnd
+}
+
+// WriteLintReport writes issues to w in format, one of LintFormats. sarif is a SARIF 2.1.0 log of the tool
+// j2lint, for the code scanning and code review tools.
+func WriteLintReport(w io.Writer, issues []LintIssue, format string) error {
+	switch format {
+	case "text":
+		for _, i := range issues {
+			if _, err := fmt.Fprintln(w, i.String()); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(u.Ternary(issues == nil, []LintIssue{}, issues))
+	case "sarif":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(lintSarif(issues))
+	}
+	return fmt.Errorf("unknown lint report format %q, expected one of %s", format, strings.Join(LintFormats, ", "))
+}
+
+func lintSarif(issues []LintIssue) map[string]any {
+	rules := []map[string]any{}
+	for _, r := range LintRules {
+		rules = append(rules, map[string]any{
+			"id":                   r.ID,
+			"shortDescription":     map[string]any{"text": r.Description},
+			"defaultConfiguration": map[string]any{"level": r.Level},
+		})
+	}
+	results := []map[string]any{}
+	for _, i := range issues {
+		location := map[string]any{"artifactLocation": map[string]any{"uri": filepath.ToSlash(i.File)}}
+		if i.Line > 0 {
+			region := map[string]any{"startLine": i.Line}
+			if i.Column > 0 {
+				region["startColumn"] = i.Column
+			}
+			location["region"] = region
+		}
+		results = append(results, map[string]any{
+			"ruleId":    i.Rule,
+			"level":     i.Level,
+			"message":   map[string]any{"text": i.Message},
+			"locations": []map[string]any{{"physicalLocation": location}},
+		})
+	}
+	return map[string]any{
+		"version": "2.1.0",
+		"$schema": "https://json.schemastore.org/sarif-2.1.0.json",
+		"runs": []map[string]any{{
+			"tool":    map[string]any{"driver": map[string]any{"name": "j2lint", "rules": rules}},
+			"results": results,
+		}},
+	}
+}
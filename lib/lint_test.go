@@ -0,0 +1,138 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLintTemplateString(t *testing.T) {
+	rules := func(issues []LintIssue) []string {
+		out := []string{}
+		for _, i := range issues {
+			out = append(out, i.Rule+"@"+string(rune('0'+i.Line)))
+		}
+		return out
+	}
+	tests := []struct {
+		name, src string
+		opt       LintOptions
+		expected  []string
+	}{
+		{"clean", "{% if x %}\n  {{ x | upper }}\n{% endif %}\n", LintOptions{}, []string{}},
+		{"syntax", "a\n{% if x %}\nb\n", LintOptions{}, []string{"syntax@3"}},
+		{"syntax gonja", "a\n{{ x + }}\n", LintOptions{Engine: EngineGonja}, []string{"syntax@2"}},
+		{"header", "#jinja2: trim_blocks: maybe\nx\n", LintOptions{}, []string{"header@1"}},
+		{"header engine", "#jinja2: engine: gotemplate\n{{ .x | bad }\n", LintOptions{}, []string{}},
+		{"unknown filter", "a\n{{ x | no_such }}\n", LintOptions{}, []string{"unknown-filter@2"}},
+		{"unknown filter gonja", "{{ x | reverse_str }}\n{{ x | no_such }}\n", LintOptions{Engine: EngineGonja}, []string{"unknown-filter@2"}},
+		{"unknown test", "#jinja2: trim_blocks: True\n{% if x is no_such %}{% endif %}\n", LintOptions{}, []string{"unknown-test@2"}},
+		{"unknown function", "{{ no_such(1) }}\n{{ range(2) | list }}\n", LintOptions{}, []string{"unknown-function@1"}},
+		{"unknown function gonja", "{{ range(2) | list }} {{ now() }}\n{{ no_such() }}\n", LintOptions{Engine: EngineGonja}, []string{"unknown-function@2"}},
+		{"undefined", "{{ a }} {{ b | default(1) }}\n{{ db.host }} {{ db.port }}\n", LintOptions{Vars: map[string]any{"db": map[string]any{"port": 1}}}, []string{"undefined-variable@1", "undefined-variable@2"}},
+		{"mixed indent", "x\n \t{% if x %}\n\t\t{% endif %}\n", LintOptions{}, []string{"mixed-indent@2"}},
+		{"mixed indent without lstrip", "#jinja2: trim_blocks: True, lstrip_blocks: False\nx\n \t{% if x %}{% endif %}\n", LintOptions{}, []string{}},
+		{"trailing whitespace", "{% if x %}  \na\n{% endif -%}  \n", LintOptions{}, []string{"trailing-whitespace@1"}},
+		{"without trim_blocks", "#jinja2: trim_blocks: False\n{% if x %}\na\n{%- endif -%}\n{% set y = 1 %}{% set z = 2 %}\n{{ y }}\n", LintOptions{}, []string{"trailing-whitespace@2", "trailing-whitespace@5"}},
+		{"raw", "{% raw %}\n{% if  %}  \n{% endraw %}\n", LintOptions{}, []string{}},
+		{"custom delims", "#jinja2: block_start_string: '[%', block_end_string: '%]'\n[% if x %]  \n[% endif %]\n", LintOptions{}, []string{"trailing-whitespace@2", "trailing-whitespace@3"}},
+	}
+	for _, tt := range tests {
+		issues := LintTemplateString(tt.name, tt.src, tt.opt)
+		if got := rules(issues); strings.Join(got, " ") != strings.Join(tt.expected, " ") {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, issues)
+		}
+	}
+
+	issues := LintTemplateString("t.j2", "{{ x | no_such }}", LintOptions{})
+	if len(issues) != 1 || issues[0].String() != "t.j2:1: error unknown-filter: unknown filter no_such for minijinja" {
+		t.Errorf("unexpected issue %v", issues)
+	}
+	issues = LintTemplateString("t.j2", "a\n{% for %}\n", LintOptions{})
+	if len(issues) != 1 || issues[0].Line != 2 || issues[0].Level != "error" || !strings.HasPrefix(issues[0].Message, "SyntaxError") {
+		t.Errorf("expected a located syntax error, got %#v", issues)
+	}
+}
+
+func TestLintTemplates(t *testing.T) {
+	dir := t.TempDir()
+	for name, src := range map[string]string{
+		"a.j2":        "{{ x | no_such }}\n",
+		"sub/b.jinja": "{% if x %}\n",
+		"c.txt":       "{{ x | no_such }}\n",
+		"d.j2":        "#jinja2: engine: gonja\n{{ x | to_json }}\n",
+	} {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	issues, err := LintTemplates([]string{dir, filepath.Join(dir, "c.txt")}, LintOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []string{}
+	for _, i := range issues {
+		files = append(files, strings.TrimPrefix(i.File, filepath.ToSlash(dir)+"/")+":"+i.Rule)
+	}
+	if strings.Join(files, " ") != "a.j2:unknown-filter c.txt:unknown-filter sub/b.jinja:syntax" {
+		t.Errorf("unexpected issues %v", files)
+	}
+	if _, err := LintTemplates([]string{filepath.Join(dir, "nope")}, LintOptions{}); err == nil {
+		t.Errorf("expected a missing path error")
+	}
+
+	var buf bytes.Buffer
+	if err := WriteLintReport(&buf, issues, "text"); err != nil || strings.Count(buf.String(), "\n") != 3 {
+		t.Errorf("unexpected text report %q %v", buf.String(), err)
+	}
+	buf.Reset()
+	var decoded []LintIssue
+	if err := WriteLintReport(&buf, nil, "json"); err != nil || json.Unmarshal(buf.Bytes(), &decoded) != nil || decoded == nil {
+		t.Errorf("expected an empty json list, got %q %v", buf.String(), err)
+	}
+	buf.Reset()
+	if err := WriteLintReport(&buf, issues, "sarif"); err != nil {
+		t.Fatal(err)
+	}
+	var sarif struct {
+		Version string `json:"version"`
+		Runs    []struct {
+			Tool struct {
+				Driver struct {
+					Rules []struct {
+						ID string `json:"id"`
+					} `json:"rules"`
+				} `json:"driver"`
+			} `json:"tool"`
+			Results []struct {
+				RuleID    string `json:"ruleId"`
+				Level     string `json:"level"`
+				Locations []struct {
+					PhysicalLocation struct {
+						Region struct {
+							StartLine int `json:"startLine"`
+						} `json:"region"`
+					} `json:"physicalLocation"`
+				} `json:"locations"`
+			} `json:"results"`
+		} `json:"runs"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &sarif); err != nil {
+		t.Fatal(err)
+	}
+	if sarif.Version != "2.1.0" || len(sarif.Runs) != 1 || len(sarif.Runs[0].Tool.Driver.Rules) != len(LintRules) ||
+		len(sarif.Runs[0].Results) != 3 || sarif.Runs[0].Results[2].RuleID != "syntax" || sarif.Runs[0].Results[2].Level != "error" ||
+		sarif.Runs[0].Results[0].Locations[0].PhysicalLocation.Region.StartLine != 1 {
+		t.Errorf("unexpected sarif report %s", buf.String())
+	}
+	if err := WriteLintReport(&buf, issues, "xml"); err == nil {
+		t.Errorf("expected an unknown format error")
+	}
+}
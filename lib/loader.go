@@ -0,0 +1,337 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	mj "github.com/mitsuhiko/minijinja/minijinja-go/v2"
+	"github.com/mitsuhiko/minijinja/minijinja-go/v2/syntax"
+	"github.com/mitsuhiko/minijinja/minijinja-go/v2/value"
+	u "github.com/sunshine69/golang-tools/utils"
+)
+
+// TemplateEnv is a set of jinja2 environments with a search path loader so that include, import and extends can
+// resolve other template files.
+//
+// Template names are slash separated paths relative to one of the SearchPaths, the first path having the file
+// wins. Names starting with ./ or ../ are relative to the template doing the include. Names can not escape the
+// search paths. Every file is parsed with the settings of its own #jinja2: header line, or trim_blocks and
+// lstrip_blocks on if it has none, the same as TemplateFile. There is one environment per distinct settings as
+// minijinja parses with the settings of the environment; a file included from a file with other settings is
+// rendered in its own environment with the variables of the include. Extends and import need the same settings.
+//
+// Undefined is the undefined variable mode of Render and RenderFile (see UndefinedError), JINJA2_UNDEFINED if empty.
+//
+// Templates are loaded on first use and cached; call Reload to pick up changed files. A TemplateEnv is safe for
+// concurrent rendering.
+type TemplateEnv struct {
+	// Env is the environment of the templates without a header. Use Setup to add filters to all environments
+	Env         *mj.Environment
+	SearchPaths []string
+	Undefined   string
+
+	mu sync.Mutex
+	// the environments are never changed once made, but by Setup
+	envs   map[envKey]*mj.Environment
+	setups []func(env *mj.Environment)
+	files  map[string]*templateFile
+}
+
+// envKey is what an environment of a TemplateEnv parses and renders with
+type envKey struct {
+	whitespace syntax.WhitespaceConfig
+	syntax     syntax.SyntaxConfig
+	strict     bool
+}
+
+// templateFile is a loaded template file
+type templateFile struct {
+	config TemplateConfig
+	// 1 if the header line was removed, for the undefined variable and error line numbers
+	headerLines int
+	// source without the header line
+	source string
+	// the file read and its stat when read, see changed
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+// includeFunction renders an included template having other header settings than the including one
+const includeFunction = "_include_with_header"
+
+// NewTemplateEnv returns a TemplateEnv looking up templates in searchPaths, in order
+func NewTemplateEnv(searchPaths ...string) *TemplateEnv {
+	te := &TemplateEnv{SearchPaths: searchPaths, envs: map[envKey]*mj.Environment{}, files: map[string]*templateFile{}}
+	te.Env = te.env(DefaultTemplateConfig(), false)
+	return te
+}
+
+// Setup calls f on all the environments, now and when they are made. It is how filters are added.
+func (te *TemplateEnv) Setup(f func(env *mj.Environment)) {
+	te.mu.Lock()
+	defer te.mu.Unlock()
+	te.setups = append(te.setups, f)
+	for _, env := range te.envs {
+		f(env)
+	}
+}
+
+// env returns the environment of the tc settings, with the strict undefined behavior if strict
+func (te *TemplateEnv) env(tc TemplateConfig, strict bool) *mj.Environment {
+	key := envKey{whitespace: tc.Whitespace, syntax: tc.Syntax, strict: strict}
+	te.mu.Lock()
+	defer te.mu.Unlock()
+	if env, ok := te.envs[key]; ok {
+		return env
+	}
+	env := NewJinjaEnvironment(&tc.Whitespace, &tc.Syntax)
+	if strict {
+		env.SetUndefinedBehavior(mj.UndefinedStrict)
+	}
+	env.SetLoader(te.loader(key))
+	env.SetPathJoinCallback(joinTemplatePath)
+	env.AddFunction(includeFunction, te.includeOther(strict))
+	for _, f := range te.setups {
+		f(env)
+	}
+	te.envs[key] = env
+	return env
+}
+
+// TemplateSearchPath returns the search path used to render the template file src: the directory of src, the
+// nearest parent templates/ directory (the role or playbook templates dir) and the JINJA2_TEMPLATE_PATH entries.
+func TemplateSearchPath(src string) []string {
+	dir := filepath.Dir(src)
+	paths := []string{dir}
+	for d := dir; ; d = filepath.Dir(d) {
+		if filepath.Base(d) == "templates" {
+			if d != dir {
+				paths = append(paths, d)
+			}
+			break
+		}
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+	for _, p := range filepath.SplitList(os.Getenv("JINJA2_TEMPLATE_PATH")) {
+		if p != "" && !containsStr(paths, p) {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// joinTemplatePath resolves ./ and ../ names relative to the parent template, other names are taken as they are
+func joinTemplatePath(name, parent string) string {
+	if strings.HasPrefix(name, "./") || strings.HasPrefix(name, "../") {
+		return path.Join(path.Dir(parent), name)
+	}
+	return name
+}
+
+// resolve returns the file path of the template name
+func (te *TemplateEnv) resolve(name string) (string, bool) {
+	clean := path.Clean(name)
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", false
+	}
+	for _, root := range te.SearchPaths {
+		p := filepath.Join(root, filepath.FromSlash(clean))
+		if fi, err := os.Stat(p); err == nil && !fi.IsDir() {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// file reads the template file name, once
+func (te *TemplateEnv) file(name string) (*templateFile, error) {
+	te.mu.Lock()
+	f, ok := te.files[name]
+	te.mu.Unlock()
+	if ok {
+		return f, nil
+	}
+	p, ok := te.resolve(name)
+	if !ok {
+		return nil, mj.NewError(mj.ErrTemplateNotFound, fmt.Sprintf("%s (search path %s)", name, strings.Join(te.SearchPaths, string(os.PathListSeparator))))
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	src, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	found, remain, tc, err := InspectTemplateHeader(string(src))
+	if err != nil {
+		return nil, headerError(name, string(src), err)
+	}
+	f = &templateFile{config: tc, headerLines: u.Ternary(found, 1, 0), source: remain, path: p, modTime: fi.ModTime(), size: fi.Size()}
+	te.mu.Lock()
+	te.files[name] = f
+	te.mu.Unlock()
+	return f, nil
+}
+
+// loader is the loader of the environment of key. A file with other header settings is loaded as a call of
+// includeFunction, as the environment can only parse with its own settings.
+func (te *TemplateEnv) loader(key envKey) mj.LoaderFunc {
+	return func(name string) (string, error) {
+		f, err := te.file(name)
+		if err != nil {
+			return "", err
+		}
+		if f.config.Whitespace == key.whitespace && f.config.Syntax == key.syntax {
+			return f.source, nil
+		}
+		return fmt.Sprintf("%s %s(%q) %s", key.syntax.VarStart, includeFunction, name, key.syntax.VarEnd), nil
+	}
+}
+
+// includeOther renders the template name in the environment of its header settings with the variables of the
+// calling template
+func (te *TemplateEnv) includeOther(strict bool) mj.FunctionFunc {
+	return func(state *mj.State, args []value.Value, _ map[string]value.Value) (value.Value, error) {
+		if len(args) != 1 {
+			return value.Undefined(), fmt.Errorf("%s expects the template name", includeFunction)
+		}
+		name := args[0].String()
+		f, err := te.file(name)
+		if err != nil {
+			return value.Undefined(), err
+		}
+		tmpl, err := te.env(f.config, strict).GetTemplate(name)
+		if err != nil {
+			return value.Undefined(), err
+		}
+		out, err := tmpl.Render(stateVars(state))
+		return value.FromSafeString(out), err
+	}
+}
+
+// Template returns the parsed template name. The errors are *TemplateError.
+func (te *TemplateEnv) Template(name string) (*mj.Template, error) {
+	f, err := te.file(name)
+	if err != nil {
+		return nil, templateError(err, errorLocation{name: name, loaded: te.sources, lineOffset: te.lineOffset})
+	}
+	tmpl, err := te.env(f.config, false).GetTemplate(name)
+	if err != nil {
+		return nil, templateError(err, errorLocation{name: name, loaded: te.sources, lineOffset: te.lineOffset})
+	}
+	return tmpl, nil
+}
+
+// Render renders the template name with data. The errors are *TemplateError or *UndefinedError.
+func (te *TemplateEnv) Render(name string, data map[string]any) (string, error) {
+	return te.render(name, data, te.Undefined)
+}
+
+// render is Render in the undefined mode, the Undefined field is not used so the TemplateEnv can be shared
+func (te *TemplateEnv) render(name string, data map[string]any, mode string) (string, error) {
+	tmpl, err := te.Template(name)
+	if err != nil {
+		return "", err
+	}
+	mode, err = undefinedMode(mode)
+	if err != nil {
+		return "", err
+	}
+	f, _ := te.file(name)
+	out, err := renderUndefined(te.env(f.config, mode == UndefinedStrict), tmpl, f.config, data, mode, te.errorLocation())
+	return f.config.Apply(out), err
+}
+
+func (te *TemplateEnv) lineOffset(name string) int {
+	te.mu.Lock()
+	defer te.mu.Unlock()
+	if f, ok := te.files[name]; ok {
+		return f.headerLines
+	}
+	return 0
+}
+
+// sources returns the loaded sources, for the error excerpts
+func (te *TemplateEnv) sources() map[string]string {
+	te.mu.Lock()
+	defer te.mu.Unlock()
+	sources := make(map[string]string, len(te.files))
+	for name, f := range te.files {
+		sources[name] = f.source
+	}
+	return sources
+}
+
+func (te *TemplateEnv) errorLocation() errorLocation {
+	return errorLocation{loaded: te.sources, lineOffset: te.lineOffset}
+}
+
+// RenderFile renders the template name to the file dest with fileMode, see RenderFileSafe
+func (te *TemplateEnv) RenderFile(name, dest string, data map[string]any, fileMode os.FileMode) error {
+	_, err := te.RenderFileSafe(name, dest, data, WriteFileOptions{Mode: fileMode})
+	return err
+}
+
+// RenderFileSafe renders the template name and writes it to dest with WriteFileAtomic, so a render or validate
+// error leaves dest as it was. In collect undefined mode dest is written and the *UndefinedError returned.
+func (te *TemplateEnv) RenderFileSafe(name, dest string, data map[string]any, opt WriteFileOptions) (WriteFileResult, error) {
+	mode, err := undefinedMode(te.Undefined)
+	if err != nil {
+		return WriteFileResult{Path: dest}, err
+	}
+	out, err := te.render(name, data, mode)
+	return writeRenderOutput(dest, out, err, mode, opt)
+}
+
+// writeRenderOutput writes the render output out to dest unless renderErr is fatal in the undefined mode, the
+// collected *UndefinedError is returned after the write
+func writeRenderOutput(dest, out string, renderErr error, mode string, opt WriteFileOptions) (WriteFileResult, error) {
+	if undefinedFatal(renderErr, mode) {
+		return WriteFileResult{Path: dest}, renderErr
+	}
+	res, err := WriteFileAtomic(dest, []byte(out), opt)
+	if err != nil {
+		return res, err
+	}
+	return res, renderErr
+}
+
+// changed is true if a loaded file changed since it was read, or its name now resolves to another file
+func (te *TemplateEnv) changed() bool {
+	te.mu.Lock()
+	files := make(map[string]*templateFile, len(te.files))
+	for name, f := range te.files {
+		files[name] = f
+	}
+	te.mu.Unlock()
+	for name, f := range files {
+		p, ok := te.resolve(name)
+		if !ok || p != f.path {
+			return true
+		}
+		fi, err := os.Stat(p)
+		if err != nil || !fi.ModTime().Equal(f.modTime) || fi.Size() != f.size {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload drops the cached templates so they are read again on next use
+func (te *TemplateEnv) Reload() {
+	te.mu.Lock()
+	defer te.mu.Unlock()
+	for _, env := range te.envs {
+		env.ClearTemplates()
+	}
+	te.files = map[string]*templateFile{}
+}
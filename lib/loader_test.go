@@ -0,0 +1,76 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLoader(t *testing.T) {
+	tempDir := t.TempDir()
+	writeFiles(t, tempDir, map[string]string{
+		"site/base.j2":            "<{% block body %}base{% endblock %}>",
+		"site/page.j2":            "{% extends \"base.j2\" %}{% import \"macros.j2\" as m %}{% block body %}{% include \"partials/header.j2\" %}|{{ m.greet(name) }}{% endblock %}",
+		"site/partials/header.j2": "{% import \"macros.j2\" as m2 %}header {{ m2.greet('inc') }}",
+		"site/sub/rel.j2":         "{% include \"./sibling.j2\" %}+{% include \"../base.j2\" %}",
+		"site/sub/sibling.j2":     "sibling",
+		"site/custom.j2":          "#jinja2:variable_start_string:'[[', variable_end_string:']]'\n[[ name ]] {{ name }}",
+		"site/uses_custom.j2":     "{% include \"custom.j2\" %}/{{ name }}",
+		"site/custom_plain.j2":    "#jinja2:variable_start_string:'[[', variable_end_string:']]'\n{% set n = 'x' %}{% include \"plain.j2\" %}[[ name ]]",
+		"site/plain.j2":           "{{ n }}{{ name }}{% if true %}\n{% endif %}|",
+		"shared/macros.j2":        "{% macro greet(who) %}hi {{ who }}{% endmacro %}",
+		"shared/base.j2":          "shadowed",
+		"site/escape.j2":          "{% include \"../../secret\" %}",
+	})
+	te := NewTemplateEnv(filepath.Join(tempDir, "site"), filepath.Join(tempDir, "shared"))
+	data := map[string]any{"name": "bob"}
+	for name, expected := range map[string]string{
+		"page.j2":         "<header hi inc|hi bob>",
+		"sub/rel.j2":      "sibling+<base>",
+		"uses_custom.j2":  "bob {{ name }}/bob",
+		"custom_plain.j2": "xbob|bob",
+	} {
+		out, err := te.Render(name, data)
+		if err != nil || out != expected {
+			t.Errorf("%s: expected %q, got %q (%v)", name, expected, out, err)
+		}
+	}
+	// the environments do not change, the templates render concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			te := NewTemplateEnv(filepath.Join(tempDir, "site"), filepath.Join(tempDir, "shared"))
+			for _, name := range []string{"custom.j2", "uses_custom.j2", "plain.j2", "custom_plain.j2"} {
+				if _, err := te.Render(name, data); err != nil {
+					t.Errorf("%s: %v", name, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if _, err := te.Render("escape.j2", nil); err == nil {
+		t.Errorf("expected an error including outside the search paths")
+	}
+	if _, err := te.Render("missing.j2", nil); err == nil || !strings.Contains(err.Error(), "missing.j2") {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+
+	// TemplateFile searches the dir of src and the nearest templates/ dir
+	writeFiles(t, tempDir, map[string]string{
+		"role/templates/partials/port.j2": "port={{ port }}",
+		"role/templates/etc/app.conf.j2":  "[app]\n{% include \"partials/port.j2\" %}\n",
+	})
+	dest := filepath.Join(tempDir, "app.conf")
+	TemplateFile(filepath.Join(tempDir, "role/templates/etc/app.conf.j2"), dest, map[string]any{"port": 80}, 0o644)
+	if b, _ := os.ReadFile(dest); string(b) != "[app]\nport=80" {
+		t.Errorf("unexpected TemplateFile output %q", b)
+	}
+	ro := &Role{Name: "role", Path: filepath.Join(tempDir, "role")}
+	if out, err := ro.TemplateEnv().Render("etc/app.conf.j2", map[string]any{"port": 81}); err != nil || out != "[app]\nport=81" {
+		t.Errorf("role template env: got %q (%v)", out, err)
+	}
+}
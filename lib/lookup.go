@@ -0,0 +1,574 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	mj "github.com/mitsuhiko/minijinja/minijinja-go/v2"
+	"github.com/mitsuhiko/minijinja/minijinja-go/v2/value"
+	u "github.com/sunshine69/golang-tools/utils"
+)
+
+// Ansible like lookup plugins: lookup('file', 'motd.txt'), query('fileglob', '*.conf') or q(...).
+//
+// lookup joins the results with a comma unless wantlist=true, query always returns a list. errors='warn' or
+// 'ignore' turns a plugin error into an empty result.
+//
+// File access can be limited to a root directory with the JINJA2_LOOKUP_ROOT env var, the lookup_root option of
+// TemplateStringWithConfig/TemplateFileWithConfig or SetLookupRoot. Relative paths are then relative to the root,
+// paths resolving outside of it (.., symlinks) are refused and the lines plugin, which runs commands, is disabled.
+//
+// The env plugin (it exposes the process environment) and the lines plugin are off unless allowed with the
+// JINJA2_LOOKUP_ALLOW env var or the lookup_allow option, a comma separated list like "env,lines", or
+// SetLookupOptions.
+
+// LookupOptions is what the lookup plugins of an environment may reach
+type LookupOptions struct {
+	// Root limits file access when not empty
+	Root string
+	// Env allows lookup('env', ...)
+	Env bool
+	// Commands allows the lines plugin, which runs shell commands. It stays off with a Root
+	Commands bool
+}
+
+// DefaultLookupOptions reads the JINJA2_LOOKUP_ROOT and JINJA2_LOOKUP_ALLOW env vars
+func DefaultLookupOptions() LookupOptions {
+	opt := LookupOptions{Root: os.Getenv("JINJA2_LOOKUP_ROOT")}
+	opt.Env, opt.Commands = parseLookupAllow(os.Getenv("JINJA2_LOOKUP_ALLOW"))
+	return opt
+}
+
+// parseLookupAllow reads a comma separated list of the opt-in plugins, env and lines
+func parseLookupAllow(allow string) (env, commands bool) {
+	for _, name := range strings.Split(allow, ",") {
+		switch strings.TrimSpace(name) {
+		case "env":
+			env = true
+		case "lines":
+			commands = true
+		}
+	}
+	return env, commands
+}
+
+// LookupContext is given to lookup plugins
+type LookupContext struct {
+	State *mj.State
+	LookupOptions
+	// templates are the template lookups being rendered, outermost first
+	templates []string
+}
+
+// lookupTemplatesVar holds the template lookup stack in the variables of a template lookup render, so the lookups
+// of the nested template see it
+const lookupTemplatesVar = "__lookup_templates"
+
+// maxLookupTemplateDepth is how deep template lookups can nest
+const maxLookupTemplateDepth = 8
+
+// LookupPlugin returns the results for the terms (the lookup args after the plugin name)
+type LookupPlugin func(lc *LookupContext, terms []value.Value, kwargs map[string]value.Value) ([]value.Value, error)
+
+var (
+	lookupMu      sync.RWMutex
+	lookupPlugins = map[string]LookupPlugin{}
+)
+
+func init() {
+	// registered here as the template plugin refers back to the environment using lookupPlugins
+	for name, plugin := range map[string]LookupPlugin{
+		"file":        lookupFile,
+		"fileglob":    lookupFileglob,
+		"env":         lookupEnv,
+		"template":    lookupTemplate,
+		"lines":       lookupLines,
+		"csvfile":     lookupCsvfile,
+		"ini":         lookupIni,
+		"first_found": lookupFirstFound,
+		"vault":       lookupVault,
+	} {
+		RegisterLookup(name, plugin)
+	}
+}
+
+// RegisterLookup adds or replaces a lookup plugin for all environments
+func RegisterLookup(name string, plugin LookupPlugin) {
+	lookupMu.Lock()
+	defer lookupMu.Unlock()
+	lookupPlugins[name] = plugin
+}
+
+// SetLookupRoot limits the file access of the lookup plugins of env to root, empty removes the limit. The opt-in
+// plugins are allowed as in JINJA2_LOOKUP_ALLOW.
+func SetLookupRoot(env *mj.Environment, root string) {
+	opt := DefaultLookupOptions()
+	opt.Root = root
+	SetLookupOptions(env, opt)
+}
+
+// SetLookupOptions sets what the lookup plugins of env may reach
+func SetLookupOptions(env *mj.Environment, opt LookupOptions) {
+	env.AddFunction("lookup", lookupFunction(opt, false))
+	env.AddFunction("query", lookupFunction(opt, true))
+	env.AddFunction("q", lookupFunction(opt, true))
+}
+
+// setLookupConfig applies the lookup_root and lookup_allow options of TemplateStringWithConfig and
+// TemplateFileWithConfig to env
+func setLookupConfig(env *mj.Environment, extraConfig map[string]string) {
+	root, hasRoot := extraConfig["lookup_root"]
+	allow, hasAllow := extraConfig["lookup_allow"]
+	if !hasRoot && !hasAllow {
+		return
+	}
+	opt := DefaultLookupOptions()
+	if hasRoot {
+		opt.Root = root
+	}
+	if hasAllow {
+		opt.Env, opt.Commands = parseLookupAllow(allow)
+	}
+	SetLookupOptions(env, opt)
+}
+
+func lookupFunction(opt LookupOptions, wantList bool) mj.FunctionFunc {
+	return func(state *mj.State, args []value.Value, kwargs map[string]value.Value) (value.Value, error) {
+		if len(args) == 0 {
+			return value.Undefined(), fmt.Errorf("lookup requires the plugin name")
+		}
+		name := args[0].String()
+		lookupMu.RLock()
+		plugin, ok := lookupPlugins[name]
+		lookupMu.RUnlock()
+		if !ok {
+			return value.Undefined(), fmt.Errorf("lookup plugin '%s' not found", name)
+		}
+		opts := map[string]value.Value{}
+		for k, v := range kwargs {
+			opts[k] = v
+		}
+		delete(opts, "wantlist")
+		delete(opts, "errors")
+		lc := &LookupContext{State: state, LookupOptions: opt}
+		if v := state.Lookup(lookupTemplatesVar); v.Kind() == value.KindSeq {
+			lc.templates = termStrings(v.Iter())
+		}
+		results, err := plugin(lc, args[1:], opts)
+		if err != nil {
+			switch kwString(kwargs, "errors", "strict") {
+			case "ignore":
+				results = nil
+			case "warn":
+				fmt.Fprintf(os.Stderr, "[WARN] lookup %s: %v\n", name, err)
+				results = nil
+			default:
+				return value.Undefined(), fmt.Errorf("lookup %s: %w", name, err)
+			}
+		}
+		if wantList || kwBool(kwargs, "wantlist", false) {
+			return value.FromSlice(results), nil
+		}
+		return joinLookupResults(results), nil
+	}
+}
+
+// joinLookupResults is what ansible lookup returns without wantlist: strings joined with a comma, a single
+// non string result as is, otherwise the list
+func joinLookupResults(results []value.Value) value.Value {
+	strs := make([]string, 0, len(results))
+	for _, r := range results {
+		s, ok := r.AsString()
+		if !ok {
+			if len(results) == 1 {
+				return r
+			}
+			return value.FromSlice(results)
+		}
+		strs = append(strs, s)
+	}
+	if len(results) == 0 {
+		return value.FromSlice(results)
+	}
+	return value.FromString(strings.Join(strs, ","))
+}
+
+// Path resolves p, relative to the root if one is set, and refuses paths outside of the root
+func (lc *LookupContext) Path(p string) (string, error) {
+	if lc.Root == "" {
+		return p, nil
+	}
+	root, err := filepath.Abs(lc.Root)
+	if err != nil {
+		return "", err
+	}
+	if r, err := filepath.EvalSymlinks(root); err == nil {
+		root = r
+	}
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(root, p)
+	}
+	p = filepath.Clean(p)
+	resolved := p
+	if r, err := filepath.EvalSymlinks(p); err == nil {
+		resolved = r
+	}
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("'%s' is outside of the lookup root %s", p, lc.Root)
+	}
+	return p, nil
+}
+
+// ReadFile reads the file p, see Path
+func (lc *LookupContext) ReadFile(p string) ([]byte, error) {
+	p, err := lc.Path(p)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(p)
+}
+
+// Vars returns the variables visible at the lookup call
+func (lc *LookupContext) Vars() map[string]any {
+	return stateVars(lc.State)
+}
+
+// stateVars returns the variables visible in state, but the callables
+func stateVars(state *mj.State) map[string]any {
+	vars := map[string]any{}
+	for _, name := range state.KnownVariables() {
+		if v := state.Lookup(name); v.Kind() != value.KindCallable && !v.IsUndefined() {
+			vars[name] = ValueToNative(v)
+		}
+	}
+	return vars
+}
+
+// termStrings flattens list terms into strings
+func termStrings(terms []value.Value) []string {
+	out := []string{}
+	for _, t := range terms {
+		if t.Kind() == value.KindSeq {
+			out = append(out, termStrings(t.Iter())...)
+			continue
+		}
+		out = append(out, t.String())
+	}
+	return out
+}
+
+// parseTermOptions splits an ansible style term "key opt=val ..." into the key and its options, the options
+// default to the kwargs
+func parseTermOptions(term string, kwargs map[string]value.Value) (string, map[string]string) {
+	opts := map[string]string{}
+	for k, v := range kwargs {
+		opts[k] = v.String()
+	}
+	fields := strings.Fields(term)
+	key := []string{}
+	for _, f := range fields {
+		if k, v, ok := strings.Cut(f, "="); ok && len(key) > 0 {
+			opts[k] = unquote(v)
+			continue
+		}
+		key = append(key, f)
+	}
+	return strings.Join(key, " "), opts
+}
+
+func stringResults(strs ...string) []value.Value {
+	out := make([]value.Value, len(strs))
+	for i, s := range strs {
+		out[i] = value.FromString(s)
+	}
+	return out
+}
+
+// lookupFile returns the file contents, trailing whitespace removed unless rstrip=false; lstrip=true strips the
+// start too
+func lookupFile(lc *LookupContext, terms []value.Value, kwargs map[string]value.Value) ([]value.Value, error) {
+	out := []string{}
+	for _, p := range termStrings(terms) {
+		data, err := lc.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		s := string(data)
+		if kwBool(kwargs, "rstrip", true) {
+			s = strings.TrimRight(s, " \t\r\n")
+		}
+		if kwBool(kwargs, "lstrip", false) {
+			s = strings.TrimLeft(s, " \t\r\n")
+		}
+		out = append(out, s)
+	}
+	return stringResults(out...), nil
+}
+
+// lookupFileglob returns the files (not dirs) matching the patterns
+func lookupFileglob(lc *LookupContext, terms []value.Value, kwargs map[string]value.Value) ([]value.Value, error) {
+	out := []string{}
+	for _, pattern := range termStrings(terms) {
+		if lc.Root != "" && !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(lc.Root, pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			if _, err := lc.Path(m); err != nil {
+				continue
+			}
+			if fi, err := os.Stat(m); err == nil && !fi.IsDir() {
+				out = append(out, m)
+			}
+		}
+	}
+	return stringResults(out...), nil
+}
+
+// lookupEnv returns the env vars, or default (empty) when not set
+func lookupEnv(lc *LookupContext, terms []value.Value, kwargs map[string]value.Value) ([]value.Value, error) {
+	if !lc.Env {
+		return nil, fmt.Errorf("the env lookup is not allowed, see JINJA2_LOOKUP_ALLOW")
+	}
+	out := []string{}
+	for _, name := range termStrings(terms) {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			v = kwString(kwargs, "default", "")
+		}
+		out = append(out, v)
+	}
+	return stringResults(out...), nil
+}
+
+// lookupTemplate renders the template files with the current vars plus the template_vars kwarg
+func lookupTemplate(lc *LookupContext, terms []value.Value, kwargs map[string]value.Value) ([]value.Value, error) {
+	vars := lc.Vars()
+	if extra, ok := kwargs["template_vars"]; ok {
+		if m, ok := ValueToNative(extra).(map[string]any); ok {
+			for k, v := range m {
+				vars[k] = v
+			}
+		}
+	}
+	out := []string{}
+	for _, p := range termStrings(terms) {
+		// a template looking itself up, directly or not, would recurse until the stack overflows
+		full, err := lc.Path(p)
+		if err != nil {
+			return nil, err
+		}
+		if abs, err := filepath.Abs(full); err == nil {
+			full = abs
+		}
+		if containsStr(lc.templates, full) {
+			return nil, fmt.Errorf("template lookup cycle: %s -> %s", strings.Join(lc.templates, " -> "), full)
+		}
+		if len(lc.templates) >= maxLookupTemplateDepth {
+			return nil, fmt.Errorf("template lookups nested deeper than %d: %s", maxLookupTemplateDepth, strings.Join(append(lc.templates, full), " -> "))
+		}
+		vars[lookupTemplatesVar] = append(slices.Clone(lc.templates), full)
+		data, err := os.ReadFile(full)
+		if err != nil {
+			return nil, err
+		}
+		env := lc.State.Env()
+		foundConfig, src, whc, cfg := InspectTemplateString(string(data))
+		if foundConfig {
+			env = NewJinjaEnvironment(&whc, &cfg)
+			SetLookupOptions(env, lc.LookupOptions)
+		}
+		tmpl, err := env.TemplateFromNamedString(p, src)
+		if err != nil {
+			return nil, err
+		}
+		rendered, err := tmpl.Render(vars)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, rendered)
+	}
+	return stringResults(out...), nil
+}
+
+// lookupLines runs each term as a shell command, the result is the output lines
+func lookupLines(lc *LookupContext, terms []value.Value, kwargs map[string]value.Value) ([]value.Value, error) {
+	if lc.Root != "" {
+		return nil, fmt.Errorf("the lines lookup is disabled when a lookup root is set")
+	}
+	if !lc.Commands {
+		return nil, fmt.Errorf("the lines lookup is not allowed, see JINJA2_LOOKUP_ALLOW")
+	}
+	out := []string{}
+	for _, command := range termStrings(terms) {
+		output, err := exec.Command("sh", "-c", command).Output()
+		if err != nil {
+			return nil, fmt.Errorf("command '%s': %w", command, err)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(output))
+		for scanner.Scan() {
+			out = append(out, scanner.Text())
+		}
+	}
+	return stringResults(out...), nil
+}
+
+// lookupCsvfile returns column col (default 1) of the row whose first column is the key. Options (as kwargs or
+// in the term like ansible, 'key file=users.csv col=2'): file (default ansible.csv), delimiter (default TAB),
+// col and default.
+func lookupCsvfile(lc *LookupContext, terms []value.Value, kwargs map[string]value.Value) ([]value.Value, error) {
+	out := []value.Value{}
+	for _, term := range termStrings(terms) {
+		key, opts := parseTermOptions(term, kwargs)
+		file := u.Ternary(opts["file"] != "", opts["file"], "ansible.csv")
+		data, err := lc.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		r := csv.NewReader(bytes.NewReader(data))
+		r.Comma = '\t'
+		if d := opts["delimiter"]; d != "" && d != "TAB" && d != "\\t" {
+			r.Comma = []rune(d)[0]
+		}
+		r.FieldsPerRecord = -1
+		r.LazyQuotes = true
+		rows, err := r.ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		col := 1
+		if c := opts["col"]; c != "" {
+			if col, err = strconv.Atoi(c); err != nil {
+				return nil, fmt.Errorf("invalid col '%s'", c)
+			}
+		}
+		result := value.None()
+		if d, ok := opts["default"]; ok {
+			result = value.FromString(d)
+		}
+		for _, row := range rows {
+			if len(row) > 0 && row[0] == key {
+				if col >= len(row) {
+					return nil, fmt.Errorf("%s: no column %d for key '%s'", file, col, key)
+				}
+				result = value.FromString(row[col])
+				break
+			}
+		}
+		out = append(out, result)
+	}
+	return out, nil
+}
+
+// lookupIni returns the value of the key with IniGetVal. Options (kwargs or in the term, 'key section=db
+// file=app.ini'): file (default ansible.ini), section (default global), type=properties for a file without
+// sections, and default.
+func lookupIni(lc *LookupContext, terms []value.Value, kwargs map[string]value.Value) ([]value.Value, error) {
+	out := []string{}
+	for _, term := range termStrings(terms) {
+		key, opts := parseTermOptions(term, kwargs)
+		file, err := lc.Path(u.Ternary(opts["file"] != "", opts["file"], "ansible.ini"))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(file); err != nil {
+			return nil, err
+		}
+		section := u.Ternary(opts["section"] != "", opts["section"], "global")
+		if opts["type"] == "properties" {
+			section = ""
+		}
+		v := IniGetVal(file, section, key)
+		if v == "" {
+			v = opts["default"]
+		}
+		out = append(out, v)
+	}
+	return stringResults(out...), nil
+}
+
+// lookupFirstFound returns the first existing file. Terms are file names or lists of them, or maps with files
+// and paths like ansible; the paths kwarg is searched too. skip=true returns nothing instead of an error when no
+// file is found.
+func lookupFirstFound(lc *LookupContext, terms []value.Value, kwargs map[string]value.Value) ([]value.Value, error) {
+	files, paths := []string{}, []string{}
+	if v, ok := kwargs["files"]; ok {
+		files = append(files, termStrings([]value.Value{v})...)
+	}
+	if v, ok := kwargs["paths"]; ok {
+		paths = append(paths, termStrings([]value.Value{v})...)
+	}
+	for _, term := range terms {
+		if m, ok := term.AsMap(); ok {
+			if v, ok := m["files"]; ok {
+				files = append(files, termStrings([]value.Value{v})...)
+			}
+			if v, ok := m["paths"]; ok {
+				paths = append(paths, termStrings([]value.Value{v})...)
+			}
+			continue
+		}
+		files = append(files, termStrings([]value.Value{term})...)
+	}
+	candidates := []string{}
+	for _, f := range files {
+		if len(paths) == 0 || filepath.IsAbs(f) {
+			candidates = append(candidates, f)
+			continue
+		}
+		for _, dir := range paths {
+			candidates = append(candidates, filepath.Join(dir, f))
+		}
+	}
+	for _, c := range candidates {
+		p, err := lc.Path(c)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(p); err == nil {
+			return stringResults(p), nil
+		}
+	}
+	if kwBool(kwargs, "skip", false) {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("no file found in %s", strings.Join(candidates, ", "))
+}
+
+// lookupVault decrypts the terms with the password kwarg or VAULT_PASSWORD, like the <vault> values of the
+// inventory. With file=true the terms are files holding the encrypted data.
+func lookupVault(lc *LookupContext, terms []value.Value, kwargs map[string]value.Value) ([]value.Value, error) {
+	password := kwString(kwargs, "password", os.Getenv("VAULT_PASSWORD"))
+	if password == "" {
+		return nil, fmt.Errorf("no vault password, set VAULT_PASSWORD or the password option")
+	}
+	out := []string{}
+	for _, term := range termStrings(terms) {
+		if kwBool(kwargs, "file", false) {
+			data, err := lc.ReadFile(term)
+			if err != nil {
+				return nil, err
+			}
+			term = string(data)
+		}
+		decrypted, err := u.Decrypt(strings.TrimSpace(term), password, u.DefaultEncryptionConfig())
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, decrypted)
+	}
+	return stringResults(out...), nil
+}
@@ -0,0 +1,115 @@
+package lib
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mitsuhiko/minijinja/minijinja-go/v2/value"
+)
+
+func TestLookup(t *testing.T) {
+	tempDir := t.TempDir()
+	writeFiles(t, tempDir, map[string]string{
+		"motd.txt":        "hello\n\n",
+		"conf.d/a.conf":   "a",
+		"conf.d/b.conf":   "b",
+		"users.csv":       "alice,1000,/home/alice\nbob,1001,/bin/false\n",
+		"app.ini":         "[db]\nhost = db1\n",
+		"header.j2":       "# {{ name }} on {{ port }}",
+		"vars/web1.yml":   "x: 1",
+		"vars/default.j2": "",
+	})
+	t.Setenv("LOOKUP_TEST_VAR", "from-env")
+	t.Setenv("JINJA2_LOOKUP_ALLOW", "env,lines")
+	data := map[string]any{"dir": tempDir, "name": "web1"}
+	renderCases(t, data, map[string]string{
+		`{{ lookup('file', dir ~ '/motd.txt') }}!`:                                                             `hello!`,
+		`{{ query('fileglob', dir ~ '/conf.d/*.conf') | map('basename') | join(',') }}`:                        `a.conf,b.conf`,
+		`{{ lookup('env', 'LOOKUP_TEST_VAR') }}`:                                                               `from-env`,
+		`{{ lookup('env', 'LOOKUP_TEST_UNSET', default='dflt') }}`:                                             `dflt`,
+		`{% set port = 8080 %}{{ lookup('template', dir ~ '/header.j2') }}`:                                    `# web1 on 8080`,
+		`{{ lookup('template', dir ~ '/header.j2', template_vars={'port': 1}) }}`:                              `# web1 on 1`,
+		`{{ lookup('lines', 'printf "a\nb\n"') }}`:                                                             `a,b`,
+		`{{ q('lines', 'printf "a\nb\n"') | length }}`:                                                         `2`,
+		`{{ lookup('csvfile', 'bob file=' ~ dir ~ '/users.csv delimiter=, col=2') }}`:                          `/bin/false`,
+		`{{ lookup('csvfile', 'alice', file=dir ~ '/users.csv', delimiter=',') }}`:                             `1000`,
+		`{{ lookup('csvfile', 'carol', file=dir ~ '/users.csv', delimiter=',', default='-') }}`:                `-`,
+		`{{ lookup('ini', 'host section=db file=' ~ dir ~ '/app.ini') }}`:                                      `db1`,
+		`{{ lookup('ini', 'port', section='db', file=dir ~ '/app.ini', default='5432') }}`:                     `5432`,
+		`{{ lookup('first_found', [name ~ '.yml', 'default.yml'], paths=[dir ~ '/vars']) | basename }}`:        `web1.yml`,
+		`{{ lookup('first_found', {'files': ['x.yml', 'default.j2'], 'paths': [dir ~ '/vars']}) | basename }}`: `default.j2`,
+		`{{ query('first_found', 'missing.yml', skip=true) | length }}`:                                        `0`,
+		`{{ lookup('file', 'missing.txt', errors='ignore') | length }}`:                                        `0`,
+	})
+
+	if _, err := TemplateStringWithConfig(`{{ lookup('vault', 'data', password='') }}`, nil); err == nil || !strings.Contains(err.Error(), "vault password") {
+		t.Errorf("expected a missing vault password error, got %v", err)
+	}
+	if _, err := TemplateStringWithConfig(`{{ lookup('nope') }}`, nil); err == nil {
+		t.Errorf("expected an unknown plugin error")
+	}
+
+	RegisterLookup("upper", func(lc *LookupContext, terms []value.Value, kwargs map[string]value.Value) ([]value.Value, error) {
+		return stringResults(strings.ToUpper(termStrings(terms)[0])), nil
+	})
+	if out, err := TemplateStringWithConfig(`{{ lookup('upper', 'x') }}`, nil); err != nil || out != "X" {
+		t.Errorf("custom plugin: got %q %v", out, err)
+	}
+
+	// a template lookup cycle or a too deep chain is an error, not a stack overflow
+	chain := map[string]string{
+		"self.j2":  "{{ lookup('template', dir ~ '/self.j2') }}",
+		"a.j2":     "a{{ lookup('template', dir ~ '/b.j2') }}",
+		"b.j2":     "b{{ lookup('template', dir ~ '/a.j2') }}",
+		"outer.j2": "{{ lookup('template', dir ~ '/header.j2') }}|{{ lookup('template', dir ~ '/header.j2') }}",
+	}
+	for i := range maxLookupTemplateDepth + 1 {
+		chain[fmt.Sprintf("d%d.j2", i)] = fmt.Sprintf("{{ lookup('template', dir ~ '/d%d.j2') }}", i+1)
+	}
+	writeFiles(t, tempDir, chain)
+	for _, name := range []string{"self.j2", "a.j2", "d0.j2"} {
+		if _, err := TemplateStringWithConfig(`{{ lookup('template', dir ~ '/`+name+`') }}`, data); err == nil || !strings.Contains(err.Error(), "template lookup") {
+			t.Errorf("%s: expected a template lookup cycle or depth error, got %v", name, err)
+		}
+	}
+	if out, err := TemplateStringWithConfig(`{{ lookup('template', dir ~ '/outer.j2', template_vars={'port': 2}) }}`, data); err != nil || out != "# web1 on 2|# web1 on 2" {
+		t.Errorf("expected the same template twice in a lookup, got %q %v", out, err)
+	}
+
+	// env and lines are opt-in
+	t.Setenv("JINJA2_LOOKUP_ALLOW", "")
+	for _, src := range []string{`{{ lookup('env', 'LOOKUP_TEST_VAR') }}`, `{{ lookup('lines', 'echo a') }}`} {
+		if _, err := TemplateStringWithConfig(src, nil); err == nil || !strings.Contains(err.Error(), "not allowed") {
+			t.Errorf("%s: expected a not allowed error, got %v", src, err)
+		}
+	}
+	if out, err := TemplateStringWithConfig(`{{ lookup('env', 'LOOKUP_TEST_VAR') }}`, nil, "lookup_allow", "env"); err != nil || out != "from-env" {
+		t.Errorf("expected the allowed env lookup, got %q %v", out, err)
+	}
+	if _, err := TemplateStringWithConfig(`{{ lookup('lines', 'echo a') }}`, nil, "lookup_allow", "env"); err == nil {
+		t.Errorf("expected lines to stay off with lookup_allow env")
+	}
+
+	// with a root, relative paths are under it and nothing outside is readable
+	root := filepath.Join(tempDir, "conf.d")
+	out, err := TemplateStringWithConfig(`{{ lookup('file', 'a.conf') }}`, nil, "lookup_root", root)
+	if err != nil || out != "a" {
+		t.Errorf("expected the root relative file, got %q %v", out, err)
+	}
+	for _, src := range []string{
+		`{{ lookup('file', '../motd.txt') }}`,
+		`{{ lookup('file', '` + filepath.Join(tempDir, "motd.txt") + `') }}`,
+		`{{ lookup('template', '../header.j2') }}`,
+		`{{ lookup('lines', 'cat /etc/passwd') }}`,
+	} {
+		if _, err := TemplateStringWithConfig(src, nil, "lookup_root", root); err == nil {
+			t.Errorf("%s: expected an error with a lookup root", src)
+		}
+	}
+	t.Setenv("JINJA2_LOOKUP_ROOT", root)
+	if out, err := TemplateStringWithConfig(`{{ query('fileglob', '*.conf') | length }}`, nil); err != nil || out != "2" {
+		t.Errorf("expected the env root to be used, got %q %v", out, err)
+	}
+}
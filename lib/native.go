@@ -0,0 +1,140 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+
+	mj "github.com/mitsuhiko/minijinja/minijinja-go/v2"
+	"github.com/mitsuhiko/minijinja/minijinja-go/v2/syntax"
+	"github.com/mitsuhiko/minijinja/minijinja-go/v2/value"
+	u "github.com/sunshine69/golang-tools/utils"
+)
+
+// TemplateNative is TemplateString returning the value itself when src is a single expression like
+// "{{ ports }}" (surrounding whitespace ignored), as ansible jinja2_native does: a list stays a []any, a number is an
+// int64 or float64 and none or undefined is nil. Any other template returns the rendered string.
+//
+// With JINJA2_UNDEFINED=strict or collect an undefined expression returns an *UndefinedError.
+func TemplateNative(src string, data map[string]any) (any, error) {
+	found, body, tc, err := InspectTemplateHeader(src)
+	if err != nil {
+		return TemplateStringErr(src, data)
+	}
+	expr, line, ok := singleExpression(body, tc.Syntax)
+	if !ok {
+		return TemplateStringErr(src, data)
+	}
+	mode, err := undefinedMode("")
+	if err != nil {
+		return nil, err
+	}
+	// the value is set as a variable of the template state, on the line of the expression
+	header := src[:len(src)-len(body)]
+	nativeSrc := header + strings.Repeat("\n", line-1) + fmt.Sprintf("%s set __native = (%s) %s", tc.Syntax.BlockStart, expr, tc.Syntax.BlockEnd)
+	ct, err := DefaultTemplateCache.String(nativeSrc)
+	var state *mj.State
+	if err == nil {
+		state, err = ct.Template.EvalToState(data)
+	}
+	if err != nil {
+		// rendering src gives the error location in it
+		if _, serr := TemplateStringErr(src, data); serr != nil {
+			return nil, serr
+		}
+		return nil, err
+	}
+	v := state.Exports()["__native"]
+	if v.Kind() == value.KindUndefined && mode != UndefinedLenient {
+		return nil, &UndefinedError{Refs: []UndefinedRef{{Name: expr, Template: "<string>", Line: line + u.Ternary(found, 1, 0)}}}
+	}
+	return ValueToNative(v), nil
+}
+
+// singleExpression returns the expression and its line if body is only one variable tag
+func singleExpression(body string, cfg syntax.SyntaxConfig) (string, int, bool) {
+	trimmed := strings.TrimSpace(body)
+	if !strings.HasPrefix(trimmed, cfg.VarStart) || !strings.HasSuffix(trimmed, cfg.VarEnd) || len(trimmed) < len(cfg.VarStart)+len(cfg.VarEnd) {
+		return "", 0, false
+	}
+	tags, err := splitTemplateTags(trimmed, cfg)
+	if err != nil || len(tags) != 1 || tags[0].block {
+		return "", 0, false
+	}
+	// the tag must span the whole text, "{{ a }} {{ b }}" has two
+	inner := strings.Trim(trimmed[len(cfg.VarStart):len(trimmed)-len(cfg.VarEnd)], "-+ \t\r\n")
+	if inner != tags[0].text {
+		return "", 0, false
+	}
+	return inner, strings.Count(body[:strings.Index(body, trimmed)], "\n") + 1, true
+}
+
+// TemplateData returns a copy of v with the strings of its maps and lists rendered with TemplateNative, so a
+// "{{ ports }}" leaf becomes the list itself. Map keys and the strings that are not templates are kept as they are.
+// The error tells the path of the failing leaf, e.g. "servers[1].name".
+func TemplateData(v any, data map[string]any) (any, error) {
+	return templateData(v, data, "")
+}
+
+func templateData(v any, data map[string]any, path string) (any, error) {
+	join := func(key string) string { return u.Ternary(path == "", key, path+"."+key) }
+	switch t := v.(type) {
+	case string:
+		if !isTemplateString(t) {
+			return t, nil
+		}
+		out, err := TemplateNative(t, data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", u.Ternary(path == "", "value", path), err)
+		}
+		return out, nil
+	case map[string]any:
+		out := make(map[string]any, len(t))
+		for k, item := range t {
+			r, err := templateData(item, data, join(k))
+			if err != nil {
+				return nil, err
+			}
+			out[k] = r
+		}
+		return out, nil
+	case map[any]any:
+		out := make(map[any]any, len(t))
+		for k, item := range t {
+			r, err := templateData(item, data, join(fmt.Sprint(k)))
+			if err != nil {
+				return nil, err
+			}
+			out[k] = r
+		}
+		return out, nil
+	case map[string]string:
+		m := make(map[string]any, len(t))
+		for k, item := range t {
+			m[k] = item
+		}
+		return templateData(m, data, path)
+	case []any:
+		out := make([]any, len(t))
+		for i, item := range t {
+			r, err := templateData(item, data, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			out[i] = r
+		}
+		return out, nil
+	case []string:
+		l := make([]any, len(t))
+		for i, item := range t {
+			l[i] = item
+		}
+		return templateData(l, data, path)
+	}
+	return v, nil
+}
+
+// isTemplateString is true if s has a tag of the default syntax or a #jinja2: header
+func isTemplateString(s string) bool {
+	return strings.Contains(s, "{{") || strings.Contains(s, "{%") || strings.Contains(s, "{#") ||
+		strings.HasPrefix(s, u.Getenv("JINJA2_CONFIG_LINE_PREFIX", "#jinja2:"))
+}
@@ -0,0 +1,97 @@
+package lib
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTemplateNative(t *testing.T) {
+	data := map[string]any{
+		"ports": []any{80, 443},
+		"port":  8080,
+		"ratio": 0.5,
+		"app":   map[string]any{"name": "web"},
+		"name":  "web",
+	}
+	tests := []struct {
+		src      string
+		expected any
+	}{
+		{"{{ ports }}", []any{int64(80), int64(443)}},
+		{"  {{ port + 1 }}\n", int64(8081)},
+		{"{{ ratio }}", 0.5},
+		{"{{ app }}", map[string]any{"name": "web"}},
+		{"{{ none }}", nil},
+		{"{{ port > 1 }}", true},
+		{"{{ name }}", "web"},
+		{"{{ name }}-{{ port }}", "web-8080"},
+		{"{{ ports }} {{ port }}", "[80, 443] 8080"},
+		{"port {{ port }}", "port 8080"},
+		{"plain", "plain"},
+		{"{% if port %}{{ ports }}{% endif %}", "[80, 443]"},
+		{"#jinja2: variable_start_string: '[[', variable_end_string: ']]'\n[[ ports ]]", []any{int64(80), int64(443)}},
+	}
+	for _, tt := range tests {
+		out, err := TemplateNative(tt.src, data)
+		if err != nil {
+			t.Errorf("%q: %v", tt.src, err)
+			continue
+		}
+		if !reflect.DeepEqual(out, tt.expected) {
+			t.Errorf("%q: expected %#v, got %#v", tt.src, tt.expected, out)
+		}
+	}
+
+	if out, err := TemplateNative("{{ missing }}", data); err != nil || out != nil {
+		t.Errorf("lenient undefined should be nil, got %#v %v", out, err)
+	}
+	t.Setenv("JINJA2_UNDEFINED", "strict")
+	var ue *UndefinedError
+	if _, err := TemplateNative("{{ missing }}", data); !errors.As(err, &ue) || ue.Refs[0].Name != "missing" {
+		t.Errorf("expected an UndefinedError, got %v", err)
+	}
+	var te *TemplateError
+	if _, err := TemplateNative("\n{{ port | no_such_filter }}", data); !errors.As(err, &te) || te.Line != 2 {
+		t.Errorf("expected a TemplateError on line 2, got %v", err)
+	}
+}
+
+func TestTemplateData(t *testing.T) {
+	data := map[string]any{"ports": []any{80, 443}, "name": "web"}
+	v := map[string]any{
+		"listen": "{{ ports }}",
+		"servers": []any{
+			map[string]any{"name": "{{ name }}-1", "port": 80},
+			map[any]any{"tags": []string{"{{ name }}", "static"}},
+		},
+		"env":  map[string]string{"APP": "{{ name | upper }}"},
+		"keep": "no template",
+	}
+	out, err := TemplateData(v, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]any{
+		"listen": []any{int64(80), int64(443)},
+		"servers": []any{
+			map[string]any{"name": "web-1", "port": 80},
+			map[any]any{"tags": []any{"web", "static"}},
+		},
+		"env":  map[string]any{"APP": "WEB"},
+		"keep": "no template",
+	}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("expected\n%#v\ngot\n%#v", expected, out)
+	}
+	if v["listen"] != "{{ ports }}" {
+		t.Errorf("the input should be left alone")
+	}
+
+	t.Setenv("JINJA2_UNDEFINED", "strict")
+	_, err = TemplateData(map[string]any{"servers": []any{"ok", map[string]any{"name": "{{ nope }}"}}}, data)
+	if err == nil || !strings.HasPrefix(err.Error(), "servers[1].name: ") {
+		t.Errorf("expected the path of the failing leaf, got %v", err)
+	}
+}
@@ -0,0 +1,912 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	u "github.com/sunshine69/golang-tools/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// A mini playbook format. It is not ansible and never will be, just enough structure so projects stop writing the
+// same glue code for every automation. Example:
+//
+//	- name: configure web
+//	  hosts: web
+//	  vars:
+//	    http_port: 8080
+//	  tasks:
+//	    - name: render nginx config
+//	      template:
+//	        src: templates/nginx.conf.j2
+//	        dest: /etc/nginx/nginx.conf
+//	        mode: "0644"
+//	      notify: reload nginx
+//	    - name: set listen port
+//	      lineinfile:
+//	        path: /etc/default/app
+//	        regexp: '^PORT='
+//	        line: 'PORT={{ http_port }}'
+//	    - name: make dirs
+//	      shell: mkdir -p /var/www/{{ item }}
+//	      loop: [site1, site2]
+//	      when: inventory_hostname is startswith "web"
+//	      register: mkdir_out
+//	  handlers:
+//	    - name: reload nginx
+//	      shell: systemctl reload nginx
+//
+// Tasks are executed on the machine running the program (like ansible connection=local), once per matched host
+// with that host's vars. Use the template option `remote: true` with PlaybookRunner.SshFor to copy the rendered
+// file to the host via GoTemplate. Local templates also take the ansible `owner`, `group`, `backup` and
+// `validate` options and are replaced atomically (see WriteFileAtomic).
+
+// TaskModules is the list of modules the runner understands
+var TaskModules = []string{"template", "lineinfile", "blockinfile", "ini", "copy", "shell"}
+
+// Play is a set of tasks and handlers applied to hosts matching Hosts.
+type Play struct {
+	Name        string         `yaml:"name" json:"name"`
+	Hosts       string         `yaml:"hosts" json:"hosts"`
+	Vars        map[string]any `yaml:"vars" json:"vars,omitempty"`
+	GatherFacts bool           `yaml:"gather_facts" json:"gather_facts,omitempty"` // gather the host facts into its vars first
+	Roles       []RoleRef      `yaml:"roles" json:"roles,omitempty"`               // run before Tasks, see ResolveRoles
+	Tasks       []Task         `yaml:"tasks" json:"tasks"`
+	Handlers    []Task         `yaml:"handlers" json:"handlers,omitempty"`
+}
+
+// Task is one module call with its control keywords.
+type Task struct {
+	Name         string         `json:"name"`
+	Module       string         `json:"module"`
+	Args         map[string]any `json:"args"`
+	When         string         `json:"when,omitempty"`
+	Loop         any            `json:"loop,omitempty"`
+	Register     string         `json:"register,omitempty"`
+	Notify       []string       `json:"notify,omitempty"`
+	IgnoreErrors bool           `json:"ignore_errors,omitempty"`
+	Vars         map[string]any `json:"vars,omitempty"`
+	// role the task comes from, nil for play tasks
+	role *Role
+}
+
+// UnmarshalYAML picks the control keywords and the single module key out of a task mapping
+func (t *Task) UnmarshalYAML(node *yaml.Node) error {
+	raw := map[string]any{}
+	if err := node.Decode(&raw); err != nil {
+		return err
+	}
+	for k, v := range raw {
+		switch k {
+		case "name":
+			t.Name = fmt.Sprint(v)
+		case "when":
+			// a list of conditions must all be true, as in ansible
+			if l, ok := v.([]any); ok {
+				conds := make([]string, len(l))
+				for i, c := range l {
+					conds[i] = "(" + fmt.Sprint(c) + ")"
+				}
+				t.When = strings.Join(conds, " and ")
+			} else {
+				t.When = fmt.Sprint(v)
+			}
+		case "loop", "with_items":
+			t.Loop = v
+		case "register":
+			t.Register = fmt.Sprint(v)
+		case "notify":
+			switch n := v.(type) {
+			case string:
+				t.Notify = []string{n}
+			case []any:
+				t.Notify = u.ConvertListIfaceToListStr(n)
+			}
+		case "ignore_errors":
+			t.IgnoreErrors, _ = v.(bool)
+		case "vars":
+			t.Vars, _ = v.(map[string]any)
+		default:
+			if !containsStr(TaskModules, k) {
+				return fmt.Errorf("line %d: unknown task keyword or module '%s'", node.Line, k)
+			}
+			if t.Module != "" {
+				return fmt.Errorf("line %d: task has more than one module: %s and %s", node.Line, t.Module, k)
+			}
+			t.Module = k
+			switch a := v.(type) {
+			case map[string]any:
+				t.Args = a
+			case string: // free form like `shell: ls -l`
+				t.Args = map[string]any{"cmd": a}
+			default:
+				return fmt.Errorf("line %d: module '%s' args must be a map or a string", node.Line, k)
+			}
+		}
+	}
+	if t.Module == "" {
+		return fmt.Errorf("line %d: task '%s' has no module. Supported: %s", node.Line, t.Name, strings.Join(TaskModules, ", "))
+	}
+	return nil
+}
+
+// TaskResult is the outcome of one task on one host. For looped tasks Results holds one entry per item.
+type TaskResult struct {
+	Host    string       `json:"host"`
+	Task    string       `json:"task"`
+	Changed bool         `json:"changed"`
+	Failed  bool         `json:"failed"`
+	Skipped bool         `json:"skipped"`
+	Ignored bool         `json:"ignored,omitempty"` // failed but ignore_errors, the play goes on
+	Msg     string       `json:"msg,omitempty"`
+	Stdout  string       `json:"stdout,omitempty"`
+	Stderr  string       `json:"stderr,omitempty"`
+	Rc      int          `json:"rc"`
+	Diff    string       `json:"diff,omitempty"`
+	Results []TaskResult `json:"results,omitempty"`
+}
+
+// AsMap is what a `register` saves into the host vars
+func (r TaskResult) AsMap() map[string]any {
+	out := map[string]any{
+		"changed": r.Changed,
+		"failed":  r.Failed,
+		"skipped": r.Skipped,
+		"msg":     r.Msg,
+		"stdout":  r.Stdout,
+		"stderr":  r.Stderr,
+		"rc":      r.Rc,
+		"diff":    r.Diff,
+	}
+	out["stdout_lines"] = strings.Split(strings.TrimRight(r.Stdout, "\n"), "\n")
+	if len(r.Results) > 0 {
+		out["results"] = u.SliceWalk(r.Results, func(i TaskResult) *any { m := any(i.AsMap()); return &m })
+	}
+	return out
+}
+
+// PlayResult holds all task results of a play run, in execution order
+type PlayResult struct {
+	Play    string       `json:"play"`
+	Results []TaskResult `json:"results"`
+}
+
+// Failed returns true if any task failed (and was not ignored)
+func (p *PlayResult) Failed() bool {
+	for _, r := range p.Results {
+		if r.Failed && !r.Ignored {
+			return true
+		}
+	}
+	return false
+}
+
+// Summary counts ok/changed/failed/skipped/ignored per host, like the ansible recap
+func (p *PlayResult) Summary() map[string]map[string]int {
+	out := map[string]map[string]int{}
+	for _, r := range p.Results {
+		if _, ok := out[r.Host]; !ok {
+			out[r.Host] = map[string]int{"ok": 0, "changed": 0, "failed": 0, "skipped": 0, "ignored": 0}
+		}
+		switch {
+		case r.Ignored:
+			out[r.Host]["ignored"]++
+		case r.Failed:
+			out[r.Host]["failed"]++
+		case r.Skipped:
+			out[r.Host]["skipped"]++
+		case r.Changed:
+			out[r.Host]["changed"]++
+			out[r.Host]["ok"]++
+		default:
+			out[r.Host]["ok"]++
+		}
+	}
+	return out
+}
+
+// LoadPlaybook reads a yaml file containing a list of plays
+func LoadPlaybook(playbookFile string) ([]Play, error) {
+	data, err := os.ReadFile(playbookFile)
+	if err != nil {
+		return nil, err
+	}
+	plays := []Play{}
+	if err := yaml.Unmarshal(data, &plays); err != nil {
+		return nil, fmt.Errorf("playbook %s: %w", playbookFile, err)
+	}
+	return plays, nil
+}
+
+// PlaybookRunner executes plays against an Inventory. The inventory vars should be ready, that is
+// ParseAllInventoryVars was called.
+type PlaybookRunner struct {
+	Inventory *Inventory
+	// BaseDir is used to resolve relative src paths of template and copy tasks. Default is current dir
+	BaseDir string
+	// SshFor returns the ssh connection of a host for the template module with `remote: true`.
+	SshFor func(host *Host) *u.SshExec
+	// Check runs in check mode - file tasks compute what they would change but write nothing, shell tasks are skipped
+	Check bool
+	// Diff records the unified diff of file changes in TaskResult.Diff
+	Diff bool
+	// RolesPath is where play roles are searched. Default is `roles` in BaseDir
+	RolesPath []string
+}
+
+func NewPlaybookRunner(inv *Inventory, baseDir string) *PlaybookRunner {
+	return &PlaybookRunner{Inventory: inv, BaseDir: baseDir}
+}
+
+// RunPlaybookFile loads and runs all plays in the file. BaseDir defaults to the playbook dir.
+func (r *PlaybookRunner) RunPlaybookFile(playbookFile string) ([]*PlayResult, error) {
+	plays, err := LoadPlaybook(playbookFile)
+	if err != nil {
+		return nil, err
+	}
+	if r.BaseDir == "" {
+		r.BaseDir = filepath.Dir(playbookFile)
+	}
+	out := []*PlayResult{}
+	for _, p := range plays {
+		res := r.RunPlay(p)
+		out = append(out, res)
+		if res.Failed() {
+			return out, fmt.Errorf("play '%s' failed", p.Name)
+		}
+	}
+	return out, nil
+}
+
+// HostsOf resolves a hosts pattern: `all`, a group name (including its children), or a regex on host names.
+// Several patterns can be separated by `:` or `,`.
+func (inv *Inventory) HostsOf(pattern string) []string {
+	seen := map[string]bool{}
+	for _, p := range regexp.MustCompile(`[:,]`).Split(pattern, -1) {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		var hosts []string
+		if p == "all" {
+			hosts = u.MapKeysToSlice(inv.Hosts)
+		} else if _, ok := inv.Groups[p]; ok {
+			hosts = inv.groupHosts(p, map[string]bool{})
+		} else {
+			hosts = inv.MatchHost(p)
+		}
+		for _, h := range hosts {
+			seen[h] = true
+		}
+	}
+	out := u.MapKeysToSlice(seen)
+	sort.Strings(out)
+	return out
+}
+
+func (inv *Inventory) groupHosts(group string, visited map[string]bool) []string {
+	g, ok := inv.Groups[group]
+	if !ok || visited[group] {
+		return nil
+	}
+	visited[group] = true
+	out := append([]string{}, g.Hosts...)
+	for _, c := range g.Children {
+		out = append(out, inv.groupHosts(c, visited)...)
+	}
+	return out
+}
+
+// RunPlay runs the play on every matched host. A host stops at its first failed task; other hosts carry on.
+// Notified handlers run at the end of the play, once per host, in the order they are defined.
+func (r *PlaybookRunner) RunPlay(play Play) *PlayResult {
+	res := &PlayResult{Play: play.Name}
+	tasks, handlers, err := r.playTasks(play)
+	if err != nil {
+		res.Results = append(res.Results, TaskResult{Task: "Loading roles", Failed: true, Msg: err.Error()})
+		return res
+	}
+	for _, hostname := range r.Inventory.HostsOf(play.Hosts) {
+		host := r.Inventory.Hosts[hostname]
+		if play.GatherFacts {
+			// the facts of the collectors which worked are set, a failing one is only a warning
+			if err := r.Inventory.GatherHostFacts("^"+regexp.QuoteMeta(hostname)+"$", r.SshFor); err != nil {
+				fmt.Fprintf(os.Stderr, "[WARN] %s: gathering facts: %v\n", hostname, err)
+				res.Results = append(res.Results, TaskResult{Host: hostname, Task: "Gathering Facts", Msg: err.Error()})
+			}
+		}
+		vars := map[string]any{}
+		for k, v := range host.Vars {
+			vars[k] = v
+		}
+		for k, v := range play.Vars {
+			vars[k] = v
+		}
+		vars["inventory_hostname"] = hostname
+		vars["group_names"] = host.Groups
+		vars["playbook_dir"] = r.BaseDir
+
+		notified := map[string]bool{}
+		for _, task := range tasks {
+			tr := r.runTaskInScope(host, task, vars)
+			tr.Ignored = tr.Failed && task.IgnoreErrors
+			res.Results = append(res.Results, tr)
+			if tr.Changed {
+				for _, h := range task.Notify {
+					notified[h] = true
+				}
+			}
+			if tr.Failed && !tr.Ignored {
+				notified = map[string]bool{}
+				break
+			}
+		}
+		for _, handler := range handlers {
+			if notified[handler.Name] {
+				res.Results = append(res.Results, r.runTaskInScope(host, handler, vars))
+			}
+		}
+	}
+	return res
+}
+
+// playTasks returns the tasks and handlers of the play with the ones of its roles first
+func (r *PlaybookRunner) playTasks(play Play) (tasks, handlers []Task, err error) {
+	if len(play.Roles) > 0 {
+		rolesPath := r.RolesPath
+		if len(rolesPath) == 0 {
+			rolesPath = []string{r.path("roles")}
+		}
+		roles, err := ResolveRoles(play.Roles, rolesPath...)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, role := range roles {
+			for _, t := range role.Tasks {
+				t.role = role
+				tasks = append(tasks, t)
+			}
+			for _, t := range role.Handlers {
+				t.role = role
+				handlers = append(handlers, t)
+			}
+		}
+	}
+	return append(tasks, play.Tasks...), append(handlers, play.Handlers...), nil
+}
+
+// runTaskInScope runs a task with the role vars merged in for role tasks. Registered results go back to the host
+// scope so later tasks and roles see them.
+func (r *PlaybookRunner) runTaskInScope(host *Host, task Task, vars map[string]any) TaskResult {
+	if task.role == nil {
+		return r.RunTask(host, task, vars)
+	}
+	scope := task.role.MergeVars(vars)
+	tr := r.RunTask(host, task, scope)
+	if task.Register != "" {
+		vars[task.Register] = scope[task.Register]
+	}
+	return tr
+}
+
+// RunTask runs one task for a host; vars is the host scope and is updated by `register`
+func (r *PlaybookRunner) RunTask(host *Host, task Task, vars map[string]any) (res TaskResult) {
+	res = TaskResult{Host: host.Name, Task: task.Name}
+	scope := vars
+	if len(task.Vars) > 0 {
+		scope = map[string]any{}
+		for k, v := range vars {
+			scope[k] = v
+		}
+		for k, v := range task.Vars {
+			scope[k] = v
+		}
+	}
+	defer func() {
+		if task.Register != "" {
+			vars[task.Register] = res.AsMap()
+		}
+	}()
+
+	if task.Loop == nil {
+		if ok, err := evalWhen(task.When, scope); err != nil {
+			res.Failed, res.Msg = true, err.Error()
+			return res
+		} else if !ok {
+			res.Skipped = true
+			return res
+		}
+		return r.runModule(host, task, scope, res)
+	}
+
+	items, err := loopItems(task.Loop, scope)
+	if err != nil {
+		res.Failed, res.Msg = true, err.Error()
+		return res
+	}
+	res.Skipped = true
+	for _, item := range items {
+		itemScope := map[string]any{}
+		for k, v := range scope {
+			itemScope[k] = v
+		}
+		itemScope["item"] = item
+		itemRes := TaskResult{Host: host.Name, Task: task.Name}
+		if ok, err := evalWhen(task.When, itemScope); err != nil {
+			itemRes.Failed, itemRes.Msg = true, err.Error()
+		} else if !ok {
+			itemRes.Skipped = true
+		} else {
+			itemRes = r.runModule(host, task, itemScope, itemRes)
+		}
+		res.Results = append(res.Results, itemRes)
+		res.Changed = res.Changed || itemRes.Changed
+		res.Skipped = res.Skipped && itemRes.Skipped
+		if itemRes.Failed {
+			res.Failed, res.Msg = true, itemRes.Msg
+			break
+		}
+	}
+	return res
+}
+
+// evalWhen evaluates an ansible `when` expression. Empty means true.
+func evalWhen(expr string, vars map[string]any) (bool, error) {
+	if strings.TrimSpace(expr) == "" {
+		return true, nil
+	}
+	expr = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(expr), "{{"), "}}")
+	out, err := TemplateStringWithConfig("{% if "+expr+" %}True{% else %}False{% endif %}", vars)
+	if err != nil {
+		return false, fmt.Errorf("when '%s': %w", expr, err)
+	}
+	return out == "True", nil
+}
+
+// loopItems returns the list to loop over. A string is a template expression which must give a list.
+func loopItems(loop any, vars map[string]any) ([]any, error) {
+	switch l := loop.(type) {
+	case []any:
+		out := make([]any, len(l))
+		for i, item := range l {
+			if s, ok := item.(string); ok {
+				rendered, err := TemplateStringWithConfig(s, vars)
+				if err != nil {
+					return nil, err
+				}
+				out[i] = rendered
+			} else {
+				out[i] = item
+			}
+		}
+		return out, nil
+	case string:
+		expr := strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(l), "{{"), "}}")
+		out, err := TemplateStringWithConfig("{{ ("+expr+") | tojson }}", vars)
+		if err != nil {
+			return nil, fmt.Errorf("loop '%s': %w", l, err)
+		}
+		items := []any{}
+		if err := json.Unmarshal([]byte(out), &items); err != nil {
+			return nil, fmt.Errorf("loop '%s' is not a list: %s", l, out)
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("loop must be a list or an expression, got %T", loop)
+	}
+}
+
+// renderArgs templates every string arg with the task scope
+func renderArgs(args map[string]any, vars map[string]any) (map[string]any, error) {
+	out := make(map[string]any, len(args))
+	for k, v := range args {
+		switch val := v.(type) {
+		case string:
+			rendered, err := TemplateStringWithConfig(val, vars)
+			if err != nil {
+				return nil, fmt.Errorf("arg %s: %w", k, err)
+			}
+			out[k] = rendered
+		case []any:
+			items := make([]any, len(val))
+			for i, item := range val {
+				if s, ok := item.(string); ok {
+					rendered, err := TemplateStringWithConfig(s, vars)
+					if err != nil {
+						return nil, fmt.Errorf("arg %s: %w", k, err)
+					}
+					items[i] = rendered
+				} else {
+					items[i] = item
+				}
+			}
+			out[k] = items
+		default:
+			out[k] = v
+		}
+	}
+	return out, nil
+}
+
+func argStr(args map[string]any, key, defaultVal string) string {
+	if v, ok := args[key]; ok && v != nil {
+		return fmt.Sprint(v)
+	}
+	return defaultVal
+}
+
+func argBool(args map[string]any, key string) bool {
+	switch v := args[key].(type) {
+	case bool:
+		return v
+	case string:
+		b, _ := strconv.ParseBool(v)
+		return b || v == "yes"
+	}
+	return false
+}
+
+// argMode parses a file mode given as octal string "0644" or a yaml int
+func argMode(args map[string]any, key string) (os.FileMode, error) {
+	switch v := args[key].(type) {
+	case nil:
+		return 0, nil
+	case int:
+		// yaml reads 0644 as octal already
+		return os.FileMode(v), nil
+	case string:
+		m, err := strconv.ParseUint(v, 8, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid mode '%s': %w", v, err)
+		}
+		return os.FileMode(m), nil
+	default:
+		return 0, fmt.Errorf("invalid mode %v", v)
+	}
+}
+
+func argList(args map[string]any, key string) []string {
+	switch v := args[key].(type) {
+	case nil:
+		return []string{}
+	case []any:
+		return u.ConvertListIfaceToListStr(v)
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
+
+func (r *PlaybookRunner) path(p string) string {
+	if p == "" || filepath.IsAbs(p) || r.BaseDir == "" {
+		return p
+	}
+	return filepath.Join(r.BaseDir, p)
+}
+
+// catchPanic turns a panic of the u.Must/u.CheckErr style helpers into an error so one bad task does not take
+// down the whole run
+func catchPanic(f func()) (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("%v", rec)
+		}
+	}()
+	f()
+	return nil
+}
+
+// fileSnapshot returns the content of a file or nil if it does not exist, used to detect changes
+func fileSnapshot(path string) []byte {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// record sets the changed flag and, in diff mode, the diff of a file change
+func (r *PlaybookRunner) record(res *TaskResult, fc FileChange) {
+	res.Changed = res.Changed || fc.Changed
+	if r.Diff {
+		res.Diff += fc.Diff
+	}
+}
+
+// editFile runs an in place edit of path, or of a temporary copy in check mode, and records the change
+func (r *PlaybookRunner) editFile(path string, res *TaskResult, edit func(p string) error) error {
+	if r.Check {
+		fc, err := CheckOnCopy(path, edit)
+		if err != nil {
+			return err
+		}
+		r.record(res, fc)
+		return nil
+	}
+	before, err := readExisting(path)
+	if err != nil {
+		return err
+	}
+	if err := edit(path); err != nil {
+		return err
+	}
+	after, err := readExisting(path)
+	if err != nil {
+		return err
+	}
+	if before == nil && after == nil {
+		return nil
+	}
+	r.record(res, NewFileChange(path, before, after))
+	return nil
+}
+
+// touchMissing creates an empty file if path does not exist
+func touchMissing(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	return u.FileTouch(path)
+}
+
+func (r *PlaybookRunner) runModule(host *Host, task Task, vars map[string]any, res TaskResult) TaskResult {
+	args, err := renderArgs(task.Args, vars)
+	if err != nil {
+		res.Failed, res.Msg = true, err.Error()
+		return res
+	}
+	if src := argStr(args, "src", ""); src != "" && task.role != nil {
+		args["src"] = u.Ternary(task.Module == "template", task.role.TemplatePath(src), task.role.FilePath(src))
+	}
+	switch task.Module {
+	case "template":
+		err = r.moduleTemplate(host, args, vars, &res)
+	case "copy":
+		err = r.moduleCopy(args, &res)
+	case "lineinfile":
+		err = r.moduleLineInFile(args, &res)
+	case "blockinfile":
+		err = r.moduleBlockInFile(args, &res)
+	case "ini":
+		err = r.moduleIni(args, &res)
+	case "shell":
+		err = r.moduleShell(args, &res)
+	default:
+		err = fmt.Errorf("unsupported module %s", task.Module)
+	}
+	if err != nil {
+		res.Failed = true
+		if res.Msg == "" {
+			res.Msg = err.Error()
+		}
+	}
+	return res
+}
+
+func (r *PlaybookRunner) moduleTemplate(host *Host, args, vars map[string]any, res *TaskResult) error {
+	src, dest := r.path(argStr(args, "src", "")), argStr(args, "dest", "")
+	if src == "" || dest == "" {
+		return fmt.Errorf("template requires src and dest")
+	}
+	mode, err := argMode(args, "mode")
+	if err != nil {
+		return err
+	}
+	if argBool(args, "remote") {
+		if r.SshFor == nil {
+			return fmt.Errorf("template remote=true but the runner has no SshFor")
+		}
+		s := r.SshFor(host)
+		if s == nil {
+			return fmt.Errorf("no ssh connection for host %s", host.Name)
+		}
+		fc, err := GoTemplateCheck(s, src, dest, vars)
+		if err != nil {
+			return err
+		}
+		r.record(res, fc)
+		if !fc.Changed || r.Check {
+			return nil
+		}
+		return GoTemplate(s, src, dest, vars, mode)
+	}
+	undefined, err := undefinedMode("")
+	if err != nil {
+		return err
+	}
+	// rendered once so the diff is what gets written
+	out, renderErr := renderTemplateFile(src, vars, undefined)
+	if undefinedFatal(renderErr, undefined) {
+		return renderErr
+	}
+	before, err := readExisting(dest)
+	if err != nil {
+		return err
+	}
+	r.record(res, NewFileChange(dest, before, []byte(out)))
+	if r.Check {
+		return warnUndefined(renderErr, undefined)
+	}
+	wr, err := writeRenderOutput(dest, out, renderErr, undefined, WriteFileOptions{
+		Mode:     mode,
+		Owner:    argStr(args, "owner", ""),
+		Group:    argStr(args, "group", ""),
+		Backup:   argBool(args, "backup"),
+		Validate: argStr(args, "validate", ""),
+	})
+	res.Changed = res.Changed || wr.Changed
+	return warnUndefined(err, undefined)
+}
+
+func (r *PlaybookRunner) moduleCopy(args map[string]any, res *TaskResult) error {
+	dest := argStr(args, "dest", "")
+	if dest == "" {
+		return fmt.Errorf("copy requires dest")
+	}
+	var content []byte
+	if c, ok := args["content"]; ok {
+		content = []byte(fmt.Sprint(c))
+	} else if src := argStr(args, "src", ""); src != "" {
+		data, err := os.ReadFile(r.path(src))
+		if err != nil {
+			return err
+		}
+		content = data
+	} else {
+		return fmt.Errorf("copy requires src or content")
+	}
+	mode, err := argMode(args, "mode")
+	if err != nil {
+		return err
+	}
+	before, err := readExisting(dest)
+	if err != nil {
+		return err
+	}
+	fc := NewFileChange(dest, before, content)
+	r.record(res, fc)
+	if !fc.Changed {
+		// without a mode the existing one is kept
+		if fi, err := os.Stat(dest); err == nil && (mode == 0 || fi.Mode().Perm() == mode.Perm()) {
+			return nil
+		}
+		res.Changed = true
+	}
+	if r.Check {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+	_, err = WriteFileAtomic(dest, content, WriteFileOptions{Mode: mode})
+	return err
+}
+
+func (r *PlaybookRunner) moduleLineInFile(args map[string]any, res *TaskResult) error {
+	path := argStr(args, "path", argStr(args, "dest", ""))
+	if path == "" {
+		return fmt.Errorf("lineinfile requires path")
+	}
+	if _, err := os.Stat(path); err != nil && !argBool(args, "create") {
+		return fmt.Errorf("file %s does not exist, set create: true to create it", path)
+	}
+	opt := u.NewLineInfileOpt(&u.LineInfileOpt{
+		Insertafter:   argStr(args, "insertafter", ""),
+		Insertbefore:  argStr(args, "insertbefore", ""),
+		Line:          argStr(args, "line", ""),
+		Regexp:        argStr(args, "regexp", ""),
+		Search_string: argStr(args, "search_string", ""),
+		State:         argStr(args, "state", "present"),
+		Backup:        argBool(args, "backup"),
+	})
+	return r.editFile(path, res, func(p string) error {
+		if err := touchMissing(p); err != nil {
+			return err
+		}
+		var err error
+		if perr := catchPanic(func() { err, _ = u.LineInFile(p, opt) }); perr != nil {
+			return perr
+		}
+		return err
+	})
+}
+
+// blockinfile with ansible style markers `# {mark} ANSIBLE MANAGED BLOCK` where {mark} is BEGIN or END.
+func (r *PlaybookRunner) moduleBlockInFile(args map[string]any, res *TaskResult) error {
+	path := argStr(args, "path", argStr(args, "dest", ""))
+	if path == "" {
+		return fmt.Errorf("blockinfile requires path")
+	}
+	marker := argStr(args, "marker", "# {mark} ANSIBLE MANAGED BLOCK")
+	begin := strings.ReplaceAll(marker, "{mark}", argStr(args, "marker_begin", "BEGIN"))
+	end := strings.ReplaceAll(marker, "{mark}", argStr(args, "marker_end", "END"))
+	block := strings.TrimRight(argStr(args, "block", ""), "\n")
+	state := argStr(args, "state", "present")
+	if _, err := os.Stat(path); err != nil && !argBool(args, "create") {
+		return fmt.Errorf("file %s does not exist, set create: true to create it", path)
+	}
+	newBlock := begin + "\n" + block + "\n" + end
+	if state == "absent" {
+		newBlock = ""
+	}
+	return r.editFile(path, res, func(p string) error {
+		if err := touchMissing(p); err != nil {
+			return err
+		}
+		before := fileSnapshot(p)
+		if !bytes.Contains(before, []byte(begin)) {
+			if state == "absent" {
+				return nil
+			}
+			content := string(before)
+			if content != "" && !strings.HasSuffix(content, "\n") {
+				content += "\n"
+			}
+			return os.WriteFile(p, []byte(content+newBlock+"\n"), 0o644)
+		}
+		return catchPanic(func() {
+			u.BlockInFile(p, []string{"^" + regexp.QuoteMeta(begin) + "$"}, []string{"^" + regexp.QuoteMeta(end) + "$"}, []string{".*"}, newBlock, false, argBool(args, "backup"), 0, map[string]any{"insertIfNotFound": false})
+		})
+	})
+}
+
+func (r *PlaybookRunner) moduleIni(args map[string]any, res *TaskResult) error {
+	path := argStr(args, "path", argStr(args, "dest", ""))
+	section, option := argStr(args, "section", ""), argStr(args, "option", "")
+	if path == "" || option == "" {
+		return fmt.Errorf("ini requires path and option")
+	}
+	val := argStr(args, "value", "")
+	if _, err := os.Stat(path); err == nil && IniGetVal(path, section, option) == val {
+		return nil
+	}
+	fc, err := IniSetValCheck(path, section, option, val)
+	if err != nil {
+		return err
+	}
+	fc.Changed = true
+	r.record(res, fc)
+	if r.Check {
+		return nil
+	}
+	return IniSetVal(path, section, option, val)
+}
+
+func (r *PlaybookRunner) moduleShell(args map[string]any, res *TaskResult) error {
+	cmdStr := argStr(args, "cmd", "")
+	if cmdStr == "" {
+		return fmt.Errorf("shell requires a command")
+	}
+	if creates := argStr(args, "creates", ""); creates != "" {
+		if _, err := os.Stat(creates); err == nil {
+			res.Msg = "skipped, since " + creates + " exists"
+			return nil
+		}
+	}
+	if r.Check {
+		res.Skipped, res.Msg = true, "skipped in check mode"
+		return nil
+	}
+	cmd := exec.Command(argStr(args, "executable", "/bin/sh"), "-c", cmdStr)
+	cmd.Dir = argStr(args, "chdir", r.BaseDir)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	res.Changed = true
+	res.Stdout, res.Stderr = stdout.String(), stderr.String()
+	if cmd.ProcessState != nil {
+		res.Rc = cmd.ProcessState.ExitCode()
+	}
+	if err != nil {
+		res.Msg = fmt.Sprintf("non-zero return code %d: %s", res.Rc, strings.TrimSpace(res.Stderr))
+		return err
+	}
+	return nil
+}
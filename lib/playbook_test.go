@@ -0,0 +1,216 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	mj "github.com/mitsuhiko/minijinja/minijinja-go/v2"
+	"github.com/mitsuhiko/minijinja/minijinja-go/v2/value"
+	"gopkg.in/yaml.v3"
+)
+
+func TestRunPlaybook(t *testing.T) {
+	tempDir := t.TempDir()
+	inv := NewInventory(tempDir)
+	web := inv.AddGroup("web")
+	for _, h := range []string{"web1", "web2", "db1"} {
+		host := inv.AddHost(h)
+		host.Vars["port"] = 8000 + len(h)
+		if strings.HasPrefix(h, "web") {
+			web.Hosts = append(web.Hosts, h)
+			host.Groups = append(host.Groups, "web")
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(tempDir, "app.conf.j2"), []byte("host={{ inventory_hostname }}\nport={{ port }}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	playbook := `
+- name: web play
+  hosts: web
+  vars:
+    out: ` + tempDir + `
+  tasks:
+    - name: render
+      template:
+        src: app.conf.j2
+        dest: "{{ out }}/{{ inventory_hostname }}.conf"
+        mode: "0640"
+      notify: restart
+    - name: ini
+      ini:
+        path: "{{ out }}/{{ inventory_hostname }}.ini"
+        section: main
+        option: port
+        value: "{{ port }}"
+    - name: loop
+      shell: echo {{ item }}
+      loop: ["a", "b"]
+      register: echo_out
+    - name: skipped
+      copy:
+        content: never
+        dest: "{{ out }}/never"
+      when: inventory_hostname == "nohost"
+    - name: use registered
+      copy:
+        content: "{{ echo_out.results | map(attribute='stdout') | join('') }}"
+        dest: "{{ out }}/{{ inventory_hostname }}.echo"
+  handlers:
+    - name: restart
+      shell: touch {{ out }}/{{ inventory_hostname }}.restarted
+`
+	pbFile := filepath.Join(tempDir, "play.yml")
+	if err := os.WriteFile(pbFile, []byte(playbook), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	runner := NewPlaybookRunner(inv, "")
+	results, err := runner.RunPlaybookFile(pbFile)
+	if err != nil {
+		t.Fatalf("RunPlaybookFile: %v - %+v", err, results)
+	}
+	summary := results[0].Summary()
+	if _, ok := summary["db1"]; ok {
+		t.Errorf("db1 is not in group web but tasks ran on it")
+	}
+	if summary["web1"]["skipped"] != 1 || summary["web1"]["failed"] != 0 {
+		t.Errorf("unexpected summary %v", summary)
+	}
+
+	out, _ := os.ReadFile(filepath.Join(tempDir, "web2.conf"))
+	if string(out) != "host=web2\nport=8004" && string(out) != "host=web2\nport=8004\n" {
+		t.Errorf("unexpected template output %q", out)
+	}
+	if fi, err := os.Stat(filepath.Join(tempDir, "web2.conf")); err != nil || fi.Mode().Perm() != 0o640 {
+		t.Errorf("expected mode 0640 got %v", fi.Mode().Perm())
+	}
+	if IniGetVal(filepath.Join(tempDir, "web1.ini"), "main", "port") != "8004" {
+		t.Errorf("ini value not set")
+	}
+	if out, _ := os.ReadFile(filepath.Join(tempDir, "web1.echo")); string(out) != "a\nb\n" {
+		t.Errorf("register did not work, got %q", out)
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "web1.restarted")); err != nil {
+		t.Errorf("handler not run")
+	}
+
+	// Second run must be idempotent for template and ini, so the handler is not notified again
+	os.Remove(filepath.Join(tempDir, "web1.restarted"))
+	results, err = runner.RunPlaybookFile(pbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results[0].Results {
+		if (r.Task == "render" || r.Task == "ini") && r.Changed {
+			t.Errorf("task %s on %s changed on second run", r.Task, r.Host)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "web1.restarted")); err == nil {
+		t.Errorf("handler run without change")
+	}
+}
+
+func TestTaskFailure(t *testing.T) {
+	inv := NewInventory("")
+	inv.AddHost("h1")
+	play := Play{Name: "fail", Hosts: "all", Tasks: []Task{
+		{Name: "boom", Module: "shell", Args: map[string]any{"cmd": "exit 3"}},
+		{Name: "not reached", Module: "shell", Args: map[string]any{"cmd": "true"}},
+	}}
+	res := NewPlaybookRunner(inv, t.TempDir()).RunPlay(play)
+	if !res.Failed() || len(res.Results) != 1 || res.Results[0].Rc != 3 {
+		t.Errorf("expected a single failed task with rc 3, got %+v", res.Results)
+	}
+}
+
+func TestTaskWhenList(t *testing.T) {
+	var task Task
+	if err := yaml.Unmarshal([]byte("shell: echo\nwhen:\n  - a == 1\n  - b or c\n"), &task); err != nil {
+		t.Fatal(err)
+	}
+	if task.When != "(a == 1) and (b or c)" {
+		t.Errorf("unexpected when %q", task.When)
+	}
+	for _, tt := range []struct {
+		vars     map[string]any
+		expected bool
+	}{
+		{map[string]any{"a": 1, "b": false, "c": true}, true},
+		{map[string]any{"a": 1, "b": false, "c": false}, false},
+		{map[string]any{"a": 2, "b": true, "c": true}, false},
+	} {
+		if ok, err := evalWhen(task.When, tt.vars); err != nil || ok != tt.expected {
+			t.Errorf("%v: expected %v, got %v %v", tt.vars, tt.expected, ok, err)
+		}
+	}
+}
+
+func TestTaskIgnoreErrors(t *testing.T) {
+	inv := NewInventory("")
+	inv.AddHost("h1")
+	play := Play{Name: "ignore", Hosts: "all", Tasks: []Task{
+		{Name: "boom", Module: "shell", Args: map[string]any{"cmd": "exit 3"}, IgnoreErrors: true},
+		{Name: "reached", Module: "shell", Args: map[string]any{"cmd": "true"}},
+	}}
+	res := NewPlaybookRunner(inv, t.TempDir()).RunPlay(play)
+	if res.Failed() || len(res.Results) != 2 || !res.Results[0].Failed || !res.Results[0].Ignored {
+		t.Errorf("expected an ignored failure and the play to go on, got %+v", res.Results)
+	}
+	if s := res.Summary()["h1"]; s["failed"] != 0 || s["ignored"] != 1 || s["ok"] != 1 {
+		t.Errorf("unexpected summary %v", s)
+	}
+}
+
+func TestCopyKeepsMode(t *testing.T) {
+	tempDir := t.TempDir()
+	dest := filepath.Join(tempDir, "secret")
+	if err := os.WriteFile(dest, []byte("old"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	inv := NewInventory("")
+	inv.AddHost("h1")
+	play := Play{Name: "copy", Hosts: "all", Tasks: []Task{
+		{Name: "copy", Module: "copy", Args: map[string]any{"content": "new", "dest": dest}},
+	}}
+	res := NewPlaybookRunner(inv, tempDir).RunPlay(play)
+	if res.Failed() || !res.Results[0].Changed {
+		t.Fatalf("expected a change, got %+v", res.Results)
+	}
+	// without mode the existing one is kept
+	if fi, err := os.Stat(dest); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("expected mode 0600, got %v %v", fi.Mode().Perm(), err)
+	}
+	if b, _ := os.ReadFile(dest); string(b) != "new" {
+		t.Errorf("unexpected content %q", b)
+	}
+}
+
+func TestTemplateRendersOnce(t *testing.T) {
+	calls := 0
+	RegisterFilter("next_id", func(_ mj.FilterState, _ value.Value, _ []value.Value, _ map[string]value.Value) (value.Value, error) {
+		calls++
+		return value.FromInt(int64(calls)), nil
+	})
+	t.Cleanup(func() { RegisterFilter("next_id", nil) })
+	tempDir := t.TempDir()
+	writeFiles(t, tempDir, map[string]string{"id.j2": "id={{ 0 | next_id }}\n"})
+	dest := filepath.Join(tempDir, "id.conf")
+	inv := NewInventory("")
+	inv.AddHost("h1")
+	play := Play{Name: "template", Hosts: "all", Tasks: []Task{
+		{Name: "id", Module: "template", Args: map[string]any{"src": "id.j2", "dest": dest}},
+	}}
+	r := NewPlaybookRunner(inv, tempDir)
+	r.Diff = true
+	res := r.RunPlay(play)
+	if res.Failed() || !res.Results[0].Changed || calls != 1 {
+		t.Fatalf("expected one render and a change, got %d %+v", calls, res.Results)
+	}
+	// the diff is the written content
+	if b, _ := os.ReadFile(dest); string(b) != "id=1" || !strings.Contains(res.Results[0].Diff, "+id=1") {
+		t.Errorf("unexpected content %q for the diff %q", b, res.Results[0].Diff)
+	}
+}
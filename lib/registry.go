@@ -0,0 +1,85 @@
+package lib
+
+import (
+	"sync"
+
+	mj "github.com/mitsuhiko/minijinja/minijinja-go/v2"
+	"github.com/mitsuhiko/minijinja/minijinja-go/v2/value"
+)
+
+// The filters, tests, functions and globals registered by the library users. NewJinjaEnvironment adds them after
+// the built in ones so a registered name replaces a built in one. They are taken by every environment created
+// afterwards: TemplateFile, TemplateString, TemplateEnv, LoadTemplatesInDirectory, FlattenVar and the playbook tasks.
+// The registry is minijinja only: the gonja engine (NewRenderer("gonja"), gonja.CustomEnvironment) does not get it,
+// Renderer.AddFilter adds a filter to any engine. registryVersion lets TemplateCache drop the environments made
+// before a registration.
+var (
+	registryMu          sync.RWMutex
+	registeredFilters   = map[string]mj.FilterFunc{}
+	registeredTests     = map[string]mj.TestFunc{}
+	registeredFunctions = map[string]mj.FunctionFunc{}
+	registeredGlobals   = map[string]value.Value{}
+	registryVersion     int
+)
+
+// RegisterFilter adds or replaces the filter name of all environments, nil removes it. NativeFilter turns a Filter on
+// plain go values into one.
+func RegisterFilter(name string, f mj.FilterFunc) {
+	register(registeredFilters, name, f, f == nil)
+}
+
+// RegisterTest adds or replaces the test name of all environments, nil removes it
+func RegisterTest(name string, f mj.TestFunc) {
+	register(registeredTests, name, f, f == nil)
+}
+
+// RegisterFunction adds or replaces the global function name of all environments, nil removes it
+func RegisterFunction(name string, f mj.FunctionFunc) {
+	register(registeredFunctions, name, f, f == nil)
+}
+
+// RegisterGlobal adds or replaces the global variable name of all environments, v is converted with
+// value.FromAny. The template data wins over a global of the same name.
+func RegisterGlobal(name string, v any) {
+	register(registeredGlobals, name, value.FromAny(v), false)
+}
+
+// UnregisterGlobal removes the global variable name
+func UnregisterGlobal(name string) {
+	register(registeredGlobals, name, value.Value{}, true)
+}
+
+func register[T any](m map[string]T, name string, v T, remove bool) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if remove {
+		delete(m, name)
+	} else {
+		m[name] = v
+	}
+	registryVersion++
+}
+
+// applyRegistry adds the registered filters, tests, functions and globals to env
+func applyRegistry(env *mj.Environment) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	for name, f := range registeredFilters {
+		env.AddFilter(name, f)
+	}
+	for name, f := range registeredTests {
+		env.AddTest(name, f)
+	}
+	for name, f := range registeredFunctions {
+		env.AddFunction(name, f)
+	}
+	for name, v := range registeredGlobals {
+		env.AddGlobal(name, v)
+	}
+}
+
+func currentRegistryVersion() int {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return registryVersion
+}
@@ -0,0 +1,67 @@
+package lib
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	mj "github.com/mitsuhiko/minijinja/minijinja-go/v2"
+	"github.com/mitsuhiko/minijinja/minijinja-go/v2/value"
+)
+
+func TestRegistry(t *testing.T) {
+	// compiled before the registration, the cache must not keep the old environment
+	if _, err := TemplateStringErr("{{ 'web' | org_tag }}", nil); err == nil {
+		t.Fatalf("expected an unknown filter error")
+	}
+	RegisterFilter("org_tag", func(_ mj.FilterState, val value.Value, args []value.Value, _ map[string]value.Value) (value.Value, error) {
+		return value.FromString("acme-" + val.String()), nil
+	})
+	RegisterTest("acme", func(_ mj.TestState, val value.Value, _ []value.Value) (bool, error) {
+		return strings.HasPrefix(val.String(), "acme-"), nil
+	})
+	RegisterFunction("region", func(_ *mj.State, _ []value.Value, _ map[string]value.Value) (value.Value, error) {
+		return value.FromString("eu"), nil
+	})
+	RegisterGlobal("org", map[string]any{"name": "acme"})
+	t.Cleanup(func() {
+		RegisterFilter("org_tag", nil)
+		RegisterTest("acme", nil)
+		RegisterFunction("region", nil)
+		UnregisterGlobal("org")
+	})
+
+	src := "{{ 'web' | org_tag }} {{ 'acme-x' is acme }} {{ region() }} {{ org.name }}"
+	expected := "acme-web true eu acme"
+	if out, err := TemplateStringErr(src, nil); err != nil || out != expected {
+		t.Errorf("TemplateString: expected %q, got %q %v", expected, out, err)
+	}
+	if out, err := TemplateStringWithConfig(src, nil, "undefined", UndefinedStrict); err != nil || out != expected {
+		t.Errorf("TemplateStringWithConfig: expected %q, got %q %v", expected, out, err)
+	}
+	if out, err := TemplateStringErr("{{ org.name }}", map[string]any{"org": map[string]any{"name": "mine"}}); err != nil || out != "mine" {
+		t.Errorf("the data should win over a global, got %q %v", out, err)
+	}
+
+	tempDir := t.TempDir()
+	writeFiles(t, tempDir, map[string]string{"a.j2": src})
+	templates, err := LoadTemplatesInDirectory(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := templates["a.j2"].Render(nil); err != nil || out != expected {
+		t.Errorf("LoadTemplatesInDirectory: expected %q, got %q %v", expected, out, err)
+	}
+	dest := filepath.Join(tempDir, "a.out")
+	if err := TemplateFileErr(filepath.Join(tempDir, "a.j2"), dest, nil, 0); err != nil {
+		t.Errorf("TemplateFile: %v", err)
+	}
+	if v, err := FlattenVar("tag", map[string]any{"tag": "{{ 'db' | org_tag }}"}, map[string]any{}); err != nil || v != "acme-db" {
+		t.Errorf("FlattenVar: got %v %v", v, err)
+	}
+
+	RegisterFilter("org_tag", nil)
+	if _, err := TemplateStringErr("{{ 'web' | org_tag }}", nil); err == nil {
+		t.Errorf("expected the removed filter to be unknown")
+	}
+}
@@ -0,0 +1,431 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	mj "github.com/mitsuhiko/minijinja/minijinja-go/v2"
+	"github.com/mitsuhiko/minijinja/minijinja-go/v2/value"
+	"github.com/sunshine69/automation-go/gonja"
+	u "github.com/sunshine69/golang-tools/utils"
+	"github.com/sunshine69/sonja/v2/config"
+	"github.com/sunshine69/sonja/v2/exec"
+)
+
+// The template engines of NewRenderer
+const (
+	EngineMinijinja  = "minijinja"
+	EngineGonja      = "gonja"
+	EngineGoTemplate = "gotemplate"
+)
+
+// Engines are the known engine names
+var Engines = []string{EngineMinijinja, EngineGonja, EngineGoTemplate}
+
+func init() {
+	// so now(fmt=...) formats the same with gonja
+	gonja.Strftime = Strftime
+}
+
+// Filter is an engine neutral filter on plain go values, in is the filtered value. In go templates it is a function
+// taking the piped value last, so `{{ .name | wrap "b" }}` calls the filter with in .name and args ["b"].
+type Filter func(in any, args ...any) (any, error)
+
+// Renderer renders templates with one engine so the callers can switch engines without rewriting code. All of them
+// take the #jinja2: header line (for gotemplate only the variable start and end strings, used as delims, and
+// newline_sequence) and JINJA2_UNDEFINED=strict; collect only reports the undefined variables with minijinja, the
+// other engines render them as with lenient.
+//
+// A Renderer is not safe for concurrent AddFilter calls.
+type Renderer interface {
+	// Engine is the engine name, one of Engines
+	Engine() string
+	// RenderString renders the template source src
+	RenderString(src string, data map[string]any) (string, error)
+	// RenderFile renders the template file src to dest with WriteFileAtomic
+	RenderFile(src, dest string, data map[string]any, opt WriteFileOptions) (WriteFileResult, error)
+	// RenderToWriter renders the template file src to w
+	RenderToWriter(w io.Writer, src string, data map[string]any) error
+	// AddFilter adds or replaces the filter name of this renderer
+	AddFilter(name string, f Filter) error
+}
+
+// NewRenderer returns a Renderer of engine, minijinja if empty
+func NewRenderer(engine string) (Renderer, error) {
+	switch engine {
+	case "", EngineMinijinja:
+		return &minijinjaRenderer{filters: map[string]Filter{}}, nil
+	case EngineGonja:
+		return &gonjaRenderer{filters: map[string]exec.FilterFunction{}}, nil
+	case EngineGoTemplate:
+		return &goTemplateRenderer{funcs: goTemplateFuncs()}, nil
+	}
+	return nil, fmt.Errorf("unknown template engine %q, expected one of %s", engine, strings.Join(Engines, ", "))
+}
+
+// DetectEngine returns the engine of the template name with source src: the engine of its #jinja2: header, else
+// gotemplate for a #gotmpl: header or the .gotmpl and .go.tmpl files, and minijinja for the others. A plain .tmpl
+// file is jinja2.
+func DetectEngine(name, src string) (string, error) {
+	_, _, tc, err := InspectTemplateHeader(src)
+	if err != nil {
+		return "", headerError(name, src, err)
+	}
+	if tc.Engine != "" {
+		return tc.Engine, nil
+	}
+	line, _ := u.SplitFirstLine(src)
+	if found, _, _ := ParseTemplateHeader(line, goTemplateHeaderPrefix); found || isGoTemplateName(name) {
+		return EngineGoTemplate, nil
+	}
+	return EngineMinijinja, nil
+}
+
+// isGoTemplateName is true for the .gotmpl and .go.tmpl file names
+func isGoTemplateName(name string) bool {
+	return strings.HasSuffix(name, ".gotmpl") || strings.HasSuffix(name, ".go.tmpl")
+}
+
+// NewRendererForFile returns the Renderer of engine, or of the DetectEngine one of the file p if engine is empty
+func NewRendererForFile(p, engine string) (Renderer, error) {
+	if engine == "" {
+		src, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		if engine, err = DetectEngine(p, string(src)); err != nil {
+			return nil, err
+		}
+	}
+	return NewRenderer(engine)
+}
+
+var filterNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func checkFilter(name string, f Filter) error {
+	if !filterNameRe.MatchString(name) {
+		return fmt.Errorf("invalid filter name %q", name)
+	}
+	if f == nil {
+		return fmt.Errorf("filter %s is nil", name)
+	}
+	return nil
+}
+
+// writeRendered renders the file src with r and writes it to dest
+func writeRendered(r Renderer, src, dest string, data map[string]any, opt WriteFileOptions) (WriteFileResult, error) {
+	var buf bytes.Buffer
+	if err := r.RenderToWriter(&buf, src, data); err != nil {
+		return WriteFileResult{Path: dest}, err
+	}
+	return WriteFileAtomic(dest, buf.Bytes(), opt)
+}
+
+// minijinjaRenderer is the lib engine, the one of TemplateString and TemplateFile
+type minijinjaRenderer struct {
+	filters map[string]Filter
+}
+
+func (r *minijinjaRenderer) Engine() string { return EngineMinijinja }
+
+func (r *minijinjaRenderer) AddFilter(name string, f Filter) error {
+	if err := checkFilter(name, f); err != nil {
+		return err
+	}
+	r.filters[name] = f
+	return nil
+}
+
+func (r *minijinjaRenderer) setup(env *mj.Environment) {
+	for name, f := range r.filters {
+		env.AddFilter(name, NativeFilter(name, f))
+	}
+}
+
+func (r *minijinjaRenderer) RenderString(src string, data map[string]any) (string, error) {
+	// without its own filters the cached environments do
+	if len(r.filters) == 0 {
+		return TemplateStringErr(src, data)
+	}
+	found, body, tc, err := InspectTemplateHeader(src)
+	if err != nil {
+		return "", headerError("<string>", src, err)
+	}
+	mode, err := undefinedMode("")
+	if err != nil {
+		return "", err
+	}
+	env := NewJinjaEnvironment(&tc.Whitespace, &tc.Syntax)
+	env.SetUndefinedBehavior(undefinedBehavior(mode))
+	r.setup(env)
+	offset := func(string) int { return u.Ternary(found, 1, 0) }
+	tmpl, err := env.TemplateFromNamedString("<string>", body)
+	if err != nil {
+		return "", templateError(err, errorLocation{name: "<string>", sources: map[string]string{"<string>": body}, lineOffset: offset})
+	}
+	out, err := renderUndefined(env, tmpl, tc, data, mode, errorLocation{lineOffset: offset})
+	return tc.Apply(out), err
+}
+
+func (r *minijinjaRenderer) templateEnv(src string) (*TemplateEnv, error) {
+	mode, err := undefinedMode("")
+	if err != nil {
+		return nil, err
+	}
+	te := NewTemplateEnv(TemplateSearchPath(src)...)
+	te.Undefined = mode
+	te.Setup(r.setup)
+	return te, nil
+}
+
+func (r *minijinjaRenderer) RenderFile(src, dest string, data map[string]any, opt WriteFileOptions) (WriteFileResult, error) {
+	if len(r.filters) == 0 {
+		return TemplateFileSafe(src, dest, data, opt)
+	}
+	te, err := r.templateEnv(src)
+	if err != nil {
+		return WriteFileResult{Path: dest}, err
+	}
+	return te.RenderFileSafe(filepath.Base(src), dest, data, opt)
+}
+
+func (r *minijinjaRenderer) RenderToWriter(w io.Writer, src string, data map[string]any) error {
+	te, err := r.templateEnv(src)
+	if err != nil {
+		return err
+	}
+	out, undefinedErr := te.Render(filepath.Base(src), data)
+	if undefinedFatal(undefinedErr, te.Undefined) {
+		return undefinedErr
+	}
+	if _, err := io.WriteString(w, out); err != nil {
+		return err
+	}
+	return undefinedErr
+}
+
+// NativeFilter adapts the Filter f to minijinja, for RegisterFilter. The keyword arguments are not passed and the
+// errors are prefixed with name.
+func NativeFilter(name string, f Filter) mj.FilterFunc {
+	return func(_ mj.FilterState, val value.Value, args []value.Value, _ map[string]value.Value) (value.Value, error) {
+		in := make([]any, len(args))
+		for i, a := range args {
+			in[i] = ValueToNative(a)
+		}
+		out, err := f(ValueToNative(val), in...)
+		if err != nil {
+			return value.Undefined(), fmt.Errorf("%s: %w", name, err)
+		}
+		return value.FromAny(out), nil
+	}
+}
+
+// gonjaRenderer is the gonja package engine
+type gonjaRenderer struct {
+	filters map[string]exec.FilterFunction
+}
+
+func (r *gonjaRenderer) Engine() string { return EngineGonja }
+
+func (r *gonjaRenderer) AddFilter(name string, f Filter) error {
+	if err := checkFilter(name, f); err != nil {
+		return err
+	}
+	r.filters[name] = func(_ *exec.Evaluator, in *exec.Value, params *exec.VarArgs) *exec.Value {
+		args := make([]any, len(params.Args))
+		for i, a := range params.Args {
+			args[i] = a.Interface()
+		}
+		out, err := f(in.Interface(), args...)
+		if err != nil {
+			return exec.AsValue(fmt.Errorf("%s: %w", name, err))
+		}
+		return exec.AsValue(out)
+	}
+	return nil
+}
+
+func (r *gonjaRenderer) render(src, dir string, data map[string]any) (string, error) {
+	_, body, tc, err := InspectTemplateHeader(strings.ReplaceAll(src, "\r\n", "\n"))
+	if err != nil {
+		return "", headerError(u.Ternary(dir == "", "<string>", dir), src, err)
+	}
+	mode, err := undefinedMode("")
+	if err != nil {
+		return "", err
+	}
+	if !tc.Whitespace.KeepTrailingNewline {
+		// jinja2 drops the trailing newline of the source, gonja always keeps it
+		body = strings.TrimSuffix(body, "\n")
+	}
+	cfg := gonjaConfig(tc)
+	cfg.StrictUndefined = mode == UndefinedStrict
+	tmpl, err := gonja.TemplateFromStringWithEnvironment(body, dir, cfg, gonja.NewEnvironment(r.filters))
+	if err != nil {
+		return "", err
+	}
+	out, err := tmpl.ExecuteToString(exec.NewContext(data))
+	return tc.Apply(out), err
+}
+
+// gonjaConfig is the gonja config of tc
+func gonjaConfig(tc TemplateConfig) *config.Config {
+	cfg := config.New()
+	cfg.BlockStartString, cfg.BlockEndString = tc.Syntax.BlockStart, tc.Syntax.BlockEnd
+	cfg.VariableStartString, cfg.VariableEndString = tc.Syntax.VarStart, tc.Syntax.VarEnd
+	cfg.CommentStartString, cfg.CommentEndString = tc.Syntax.CommentStart, tc.Syntax.CommentEnd
+	cfg.TrimBlocks, cfg.LeftStripBlocks = tc.Whitespace.TrimBlocks, tc.Whitespace.LstripBlocks
+	return cfg
+}
+
+func (r *gonjaRenderer) RenderString(src string, data map[string]any) (string, error) {
+	return r.render(src, "", data)
+}
+
+func (r *gonjaRenderer) RenderFile(src, dest string, data map[string]any, opt WriteFileOptions) (WriteFileResult, error) {
+	return writeRendered(r, src, dest, data, opt)
+}
+
+func (r *gonjaRenderer) RenderToWriter(w io.Writer, src string, data map[string]any) error {
+	b, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	out, err := r.render(string(b), filepath.Dir(src), data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", src, err)
+	}
+	_, err = io.WriteString(w, out)
+	return err
+}
+
+// goTemplateHeaderPrefix is the header line prefix of the utils GoTemplateString templates, it takes the same
+// settings as the #jinja2: one
+const goTemplateHeaderPrefix = "#gotmpl:"
+
+// goTemplateRenderer is the go text/template engine, rendering the utils GoTemplateString and GoTemplateFile
+// templates the same way
+type goTemplateRenderer struct {
+	funcs template.FuncMap
+}
+
+// goTemplateFilters are the lib filters given to go templates, the ones working on plain values without keyword
+// arguments
+var goTemplateFilters = map[string]mj.FilterFunc{
+	"regex_replace": filterFuncRegexReplace,
+	"regex_search":  filterFuncRegexSearch,
+	"to_yaml":       filterFuncToYaml,
+	"b64encode":     filterFuncB64Encode,
+	"b64decode":     filterFuncB64Decode,
+	"contains":      filterContainsAll,
+	"contains_any":  filterContainsAny,
+	"keys":          FilterKeys,
+	"indent":        filterIndent,
+	"wrap":          filterWrap,
+	"reverse_str":   filterReverseStr,
+}
+
+// goTemplateUtilsFuncs are the functions of the utils GoTemplateString templates
+var goTemplateUtilsFuncs = template.FuncMap{
+	"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"make_slice": func(items ...any) []any { return items },
+	"add":        func(a, b int) int { return a + b },
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+}
+
+func goTemplateFuncs() template.FuncMap {
+	funcs := template.FuncMap{}
+	for name, f := range goTemplateUtilsFuncs {
+		funcs[name] = f
+	}
+	for name, f := range goTemplateFilters {
+		funcs[name] = goTemplateFunc(name, func(in any, args ...any) (any, error) {
+			vals := make([]value.Value, len(args))
+			for i, a := range args {
+				vals[i] = value.FromAny(a)
+			}
+			out, err := f(nil, value.FromAny(in), vals, nil)
+			return ValueToNative(out), err
+		})
+	}
+	return funcs
+}
+
+// goTemplateFunc adapts f to a go template function taking the piped value last
+func goTemplateFunc(name string, f Filter) func(args ...any) (any, error) {
+	return func(args ...any) (any, error) {
+		if len(args) == 0 {
+			return nil, fmt.Errorf("%s: missing the filtered value", name)
+		}
+		return f(args[len(args)-1], args[:len(args)-1]...)
+	}
+}
+
+func (r *goTemplateRenderer) Engine() string { return EngineGoTemplate }
+
+func (r *goTemplateRenderer) AddFilter(name string, f Filter) error {
+	if err := checkFilter(name, f); err != nil {
+		return err
+	}
+	r.funcs[name] = goTemplateFunc(name, f)
+	return nil
+}
+
+func (r *goTemplateRenderer) render(w io.Writer, name, src string, data map[string]any) error {
+	found, body, tc, err := InspectTemplateHeader(src)
+	if err != nil {
+		return headerError(name, src, err)
+	}
+	if !found {
+		// or the #gotmpl: header of the utils templates
+		line, rest := u.SplitFirstLine(src)
+		gotmpl, gtc, err := ParseTemplateHeader(line, goTemplateHeaderPrefix)
+		if err != nil {
+			return headerError(name, src, err)
+		}
+		if gotmpl {
+			body, tc = rest, gtc
+		}
+	}
+	mode, err := undefinedMode("")
+	if err != nil {
+		return err
+	}
+	tmpl, err := template.New(name).Delims(tc.Syntax.VarStart, tc.Syntax.VarEnd).Funcs(r.funcs).
+		Option("missingkey=" + u.Ternary(mode == UndefinedStrict, "error", "default")).Parse(body)
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(tc.Writer(w), data)
+}
+
+func (r *goTemplateRenderer) RenderString(src string, data map[string]any) (string, error) {
+	var sb strings.Builder
+	err := r.render(&sb, "<string>", src, data)
+	return sb.String(), err
+}
+
+func (r *goTemplateRenderer) RenderFile(src, dest string, data map[string]any, opt WriteFileOptions) (WriteFileResult, error) {
+	return writeRendered(r, src, dest, data, opt)
+}
+
+func (r *goTemplateRenderer) RenderToWriter(w io.Writer, src string, data map[string]any) error {
+	b, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	// render to a buffer first so w gets nothing on error
+	var buf bytes.Buffer
+	if err := r.render(&buf, filepath.Base(src), string(b), data); err != nil {
+		return err
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,105 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderer(t *testing.T) {
+	shout := func(in any, args ...any) (any, error) {
+		s, ok := in.(string)
+		if !ok {
+			return nil, errors.New("expected a string")
+		}
+		return strings.ToUpper(s) + strings.Repeat("!", len(args)), nil
+	}
+	data := map[string]any{"name": "web", "port": 80}
+	tests := []struct {
+		engine, src, expected string
+	}{
+		{EngineMinijinja, "{{ name | shout('x') }}:{{ port }}", "WEB!:80"},
+		{EngineGonja, "{{ name | shout('x') }}:{{ port }}", "WEB!:80"},
+		{EngineGoTemplate, `{{ .name | shout "x" }}:{{ .port }}`, "WEB!:80"},
+		{EngineGoTemplate, `{{ .name | regex_replace "w(e)b" "\\1" }}`, "e"},
+		{EngineGonja, "#jinja2: variable_start_string: '[[', variable_end_string: ']]'\n[[ name ]]", "web"},
+		{EngineGoTemplate, "#jinja2: variable_start_string: '[[', variable_end_string: ']]'\n[[ .name ]]", "web"},
+	}
+	for _, tt := range tests {
+		r, err := NewRenderer(tt.engine)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.AddFilter("shout", shout); err != nil {
+			t.Fatal(err)
+		}
+		if out, err := r.RenderString(tt.src, data); err != nil || out != tt.expected {
+			t.Errorf("%s %q: expected %q, got %q %v", tt.engine, tt.src, tt.expected, out, err)
+		}
+		if _, err := r.RenderString(strings.Replace(tt.src, "name", "port", 1), data); err == nil && strings.Contains(tt.src, "shout") {
+			t.Errorf("%s: expected the filter error", tt.engine)
+		}
+		if r.AddFilter("bad-name", shout) == nil {
+			t.Errorf("%s: expected an invalid filter name error", tt.engine)
+		}
+	}
+	if _, err := NewRenderer("jinja3"); err == nil {
+		t.Errorf("expected an unknown engine error")
+	}
+
+	tempDir := t.TempDir()
+	writeFiles(t, tempDir, map[string]string{
+		"app.conf.j2":     "{% include 'inc.j2' %}={{ port }}\n\n",
+		"inc.j2":          "{{ name }}",
+		"app.conf.gotmpl": "{{ .name }}={{ .port }}\n",
+		"utils.tmpl":      "#gotmpl:variable_start_string:'{$', variable_end_string:'$}'\n{$ .name | upper | replace \"WEB\" \"web\" $}={$ add .port 0 $}\n",
+		"gonja.txt":       "#jinja2: engine: gonja\n{{ name }}={{ port }}\n\n",
+	})
+	for file, engine := range map[string]string{"app.conf.j2": EngineMinijinja, "app.conf.gotmpl": EngineGoTemplate, "utils.tmpl": EngineGoTemplate, "gonja.txt": EngineGonja} {
+		src := filepath.Join(tempDir, file)
+		r, err := NewRendererForFile(src, "")
+		if err != nil || r.Engine() != engine {
+			t.Fatalf("%s: expected engine %s, got %v %v", file, engine, r, err)
+		}
+		var buf bytes.Buffer
+		if err := r.RenderToWriter(&buf, src, data); err != nil || buf.String() != "web=80\n" {
+			t.Errorf("%s: expected %q, got %q %v", file, "web=80\n", buf.String(), err)
+		}
+		dest := filepath.Join(tempDir, file+".out")
+		if res, err := r.RenderFile(src, dest, data, WriteFileOptions{}); err != nil || !res.Changed {
+			t.Errorf("%s: %+v %v", file, res, err)
+		}
+		if b, _ := os.ReadFile(dest); string(b) != "web=80\n" {
+			t.Errorf("%s: unexpected output %q", file, b)
+		}
+	}
+	if r, err := NewRendererForFile(filepath.Join(tempDir, "app.conf.j2"), EngineGonja); err != nil || r.Engine() != EngineGonja {
+		t.Errorf("the engine option should win, got %v %v", r, err)
+	}
+	for name, engine := range map[string]string{"x.tmpl": EngineMinijinja, "x.go.tmpl": EngineGoTemplate, "x.gotmpl": EngineGoTemplate} {
+		if e, err := DetectEngine(name, "{{ x }}"); err != nil || e != engine {
+			t.Errorf("%s: expected engine %s, got %s %v", name, engine, e, err)
+		}
+	}
+	if _, err := DetectEngine("x.j2", "#jinja2: engine: jinja3\n{{ x }}"); err == nil {
+		t.Errorf("expected an unknown header engine error")
+	}
+
+	t.Setenv("JINJA2_UNDEFINED", "strict")
+	for _, engine := range Engines {
+		r, _ := NewRenderer(engine)
+		if _, err := r.RenderString(engineSrc(engine, "{{ missing }}", "{{ .missing }}"), data); err == nil {
+			t.Errorf("%s: expected a strict undefined error", engine)
+		}
+	}
+}
+
+func engineSrc(engine, jinja, gotmpl string) string {
+	if engine == EngineGoTemplate {
+		return gotmpl
+	}
+	return jinja
+}
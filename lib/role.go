@@ -0,0 +1,255 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Ansible style roles. A role is a directory with optional defaults/main.yml, vars/main.yml, tasks/main.yml,
+// handlers/main.yml, meta/main.yml, templates/ and files/.
+//
+// Var precedence, lowest first: role defaults < inventory vars (group then host) < play vars < role vars < role
+// params (the vars given where the role is referenced) < task vars.
+
+// RoleRef is a reference to a role in a play `roles:` list or in meta/main.yml `dependencies:`. It is either a
+// role name or a map with a `role` (or `name`) key; the other keys (or the `vars` map) are the role params.
+type RoleRef struct {
+	Name   string         `json:"role"`
+	Params map[string]any `json:"params,omitempty"`
+}
+
+func (r *RoleRef) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		r.Name = node.Value
+		return nil
+	}
+	raw := map[string]any{}
+	if err := node.Decode(&raw); err != nil {
+		return err
+	}
+	r.Params = map[string]any{}
+	for k, v := range raw {
+		switch k {
+		case "role", "name":
+			r.Name = fmt.Sprint(v)
+		case "vars":
+			if m, ok := v.(map[string]any); ok {
+				for vk, vv := range m {
+					r.Params[vk] = vv
+				}
+			}
+		default:
+			r.Params[k] = v
+		}
+	}
+	if r.Name == "" {
+		return fmt.Errorf("line %d: role reference without a role name", node.Line)
+	}
+	return nil
+}
+
+// Role is a loaded role directory
+type Role struct {
+	Name         string         `json:"name"`
+	Path         string         `json:"path"`
+	Defaults     map[string]any `json:"defaults,omitempty"`
+	Vars         map[string]any `json:"vars,omitempty"`
+	Params       map[string]any `json:"params,omitempty"`
+	Dependencies []RoleRef      `json:"dependencies,omitempty"`
+	Tasks        []Task         `json:"tasks,omitempty"`
+	Handlers     []Task         `json:"handlers,omitempty"`
+}
+
+// findRole returns the directory of the role. name can be a path to the role dir, otherwise it is searched in
+// rolesPath in order. Default rolesPath is `roles` in the current dir.
+func findRole(name string, rolesPath []string) (string, error) {
+	if strings.ContainsRune(name, filepath.Separator) {
+		if fi, err := os.Stat(name); err == nil && fi.IsDir() {
+			return filepath.Abs(name)
+		}
+	}
+	if len(rolesPath) == 0 {
+		rolesPath = []string{"roles"}
+	}
+	for _, dir := range rolesPath {
+		p := filepath.Join(dir, name)
+		if fi, err := os.Stat(p); err == nil && fi.IsDir() {
+			return filepath.Abs(p)
+		}
+	}
+	return "", fmt.Errorf("role '%s' not found in %s", name, strings.Join(rolesPath, ", "))
+}
+
+// roleFile returns the path of <dir>/main.yml or <dir>/main.yaml, or empty if none exists
+func roleFile(rolePath, dir string) string {
+	for _, name := range []string{"main.yml", "main.yaml"} {
+		p := filepath.Join(rolePath, dir, name)
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return ""
+}
+
+// LoadRole loads the role name (see findRole) without its dependencies
+func LoadRole(name string, rolesPath ...string) (*Role, error) {
+	rolePath, err := findRole(name, rolesPath)
+	if err != nil {
+		return nil, err
+	}
+	role := &Role{Name: filepath.Base(rolePath), Path: rolePath, Defaults: map[string]any{}, Vars: map[string]any{}, Params: map[string]any{}}
+	for _, vf := range []struct {
+		dir  string
+		dest *map[string]any
+	}{{"defaults", &role.Defaults}, {"vars", &role.Vars}} {
+		if f := roleFile(rolePath, vf.dir); f != "" {
+			vars, err := parseYAMLFile(f)
+			if err != nil {
+				return nil, err
+			}
+			if vars != nil {
+				*vf.dest = vars
+			}
+		}
+	}
+	if f := roleFile(rolePath, "meta"); f != "" {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		meta := struct {
+			Dependencies []RoleRef `yaml:"dependencies"`
+		}{}
+		if err := yaml.Unmarshal(data, &meta); err != nil {
+			return nil, fmt.Errorf("role %s meta: %w", role.Name, err)
+		}
+		role.Dependencies = meta.Dependencies
+	}
+	for _, tf := range []struct {
+		dir  string
+		dest *[]Task
+	}{{"tasks", &role.Tasks}, {"handlers", &role.Handlers}} {
+		if f := roleFile(rolePath, tf.dir); f != "" {
+			data, err := os.ReadFile(f)
+			if err != nil {
+				return nil, err
+			}
+			if err := yaml.Unmarshal(data, tf.dest); err != nil {
+				return nil, fmt.Errorf("role %s %s: %w", role.Name, tf.dir, err)
+			}
+		}
+	}
+	return role, nil
+}
+
+// ResolveRoles loads the referenced roles and their meta dependencies, recursively. The result is in run order,
+// dependencies before the roles needing them. Like ansible a role referenced again with the same params is only
+// included once.
+func ResolveRoles(refs []RoleRef, rolesPath ...string) ([]*Role, error) {
+	out := []*Role{}
+	seen := map[string]bool{}
+	var resolve func(refs []RoleRef, stack []string) error
+	resolve = func(refs []RoleRef, stack []string) error {
+		for _, ref := range refs {
+			if containsStr(stack, ref.Name) {
+				return fmt.Errorf("role dependency cycle: %s -> %s", strings.Join(stack, " -> "), ref.Name)
+			}
+			role, err := LoadRole(ref.Name, rolesPath...)
+			if err != nil {
+				return err
+			}
+			if err := resolve(role.Dependencies, append(stack, ref.Name)); err != nil {
+				return err
+			}
+			key := role.Path
+			if len(ref.Params) > 0 {
+				params, _ := json.Marshal(ref.Params)
+				key += string(params)
+			}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			if len(ref.Params) > 0 {
+				role.Params = ref.Params
+			}
+			out = append(out, role)
+		}
+		return nil
+	}
+	return out, resolve(refs, nil)
+}
+
+// MergeVars returns the vars of a task in the role: vars is the inventory and play scope of the host, the role
+// defaults are under it, the role vars and params over it. role_name and role_path are set too.
+func (ro *Role) MergeVars(vars map[string]any) map[string]any {
+	out := map[string]any{}
+	for _, m := range []map[string]any{ro.Defaults, vars, ro.Vars, ro.Params} {
+		for k, v := range m {
+			out[k] = v
+		}
+	}
+	out["role_name"] = ro.Name
+	out["role_path"] = ro.Path
+	return out
+}
+
+// lookupPath returns the first existing of <role>/<dir>/p and <role>/p, or p unchanged if none exists or p is
+// absolute
+func (ro *Role) lookupPath(dir, p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	for _, candidate := range []string{filepath.Join(ro.Path, dir, p), filepath.Join(ro.Path, p)} {
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate
+		}
+	}
+	return p
+}
+
+// TemplatePath resolves a template path relative to the role templates/ dir
+func (ro *Role) TemplatePath(p string) string {
+	return ro.lookupPath("templates", p)
+}
+
+// FilePath resolves a file path relative to the role files/ dir
+func (ro *Role) FilePath(p string) string {
+	return ro.lookupPath("files", p)
+}
+
+// TemplateEnv returns a TemplateEnv searching the role templates/ dir then extraPaths, so role templates can
+// include, import and extend each other by their path relative to templates/
+func (ro *Role) TemplateEnv(extraPaths ...string) *TemplateEnv {
+	return NewTemplateEnv(append([]string{filepath.Join(ro.Path, "templates")}, extraPaths...)...)
+}
+
+// TemplateFile is TemplateFile with src relative to the role templates/ dir
+func (ro *Role) TemplateFile(src, dest string, data map[string]any, fileMode os.FileMode) {
+	TemplateFile(ro.TemplatePath(src), dest, data, fileMode)
+}
+
+// TemplateFileErr is TemplateFileErr with src relative to the role templates/ dir
+func (ro *Role) TemplateFileErr(src, dest string, data map[string]any, fileMode os.FileMode) error {
+	return TemplateFileErr(ro.TemplatePath(src), dest, data, fileMode)
+}
+
+// TemplateDirTree is TemplateDirTree with srcDirpath relative to the role templates/ dir
+func (ro *Role) TemplateDirTree(srcDirpath, targetRoot string, tmplData map[string]any) error {
+	return TemplateDirTree(ro.TemplatePath(srcDirpath), targetRoot, tmplData)
+}
+
+// TemplateDirTreeErr is TemplateDirTreeErr with srcDirpath relative to the role templates/ dir
+func (ro *Role) TemplateDirTreeErr(srcDirpath, targetRoot string, tmplData map[string]any) error {
+	return TemplateDirTreeErr(ro.TemplatePath(srcDirpath), targetRoot, tmplData)
+}
+
+// TemplateDirTreeWithOptions is TemplateDirTreeWithOptions with srcDirpath relative to the role templates/ dir
+func (ro *Role) TemplateDirTreeWithOptions(srcDirpath, targetRoot string, tmplData map[string]any, opt DirTreeOptions) ([]DirTreeChange, error) {
+	return TemplateDirTreeWithOptions(ro.TemplatePath(srcDirpath), targetRoot, tmplData, opt)
+}
@@ -0,0 +1,76 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeFiles creates the files (relative path => content) under dir
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRoles(t *testing.T) {
+	tempDir := t.TempDir()
+	writeFiles(t, tempDir, map[string]string{
+		"roles/common/defaults/main.yml": "motd: hello\n",
+		"roles/common/tasks/main.yml":    "- name: motd\n  copy:\n    src: motd.txt\n    dest: \"{{ out }}/motd\"\n",
+		"roles/common/files/motd.txt":    "static motd\n",
+		"roles/web/defaults/main.yml":    "port: 80\nworkers: 2\nserver_name: default\n",
+		"roles/web/vars/main.yml":        "workers: 4\n",
+		"roles/web/meta/main.yml":        "dependencies:\n  - common\n",
+		"roles/web/templates/site.j2":    "{{ server_name }}:{{ port }} workers={{ workers }} role={{ role_name }}",
+		"roles/web/tasks/main.yml":       "- name: site\n  template:\n    src: site.j2\n    dest: \"{{ out }}/site\"\n",
+		"roles/loop1/meta/main.yml":      "dependencies: [loop2]\n",
+		"roles/loop2/meta/main.yml":      "dependencies: [loop1]\n",
+	})
+
+	roles, err := ResolveRoles([]RoleRef{{Name: "web"}, {Name: "common"}}, filepath.Join(tempDir, "roles"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles) != 2 || roles[0].Name != "common" || roles[1].Name != "web" {
+		t.Fatalf("expected common then web once each, got %+v", roles)
+	}
+	web := roles[1]
+	vars := web.MergeVars(map[string]any{"port": 8080, "workers": 8})
+	if vars["port"] != 8080 || vars["workers"] != 4 || vars["server_name"] != "default" {
+		t.Errorf("wrong precedence: %v", vars)
+	}
+	if p := web.TemplatePath("site.j2"); p != filepath.Join(web.Path, "templates", "site.j2") {
+		t.Errorf("unexpected template path %s", p)
+	}
+	if _, err := ResolveRoles([]RoleRef{{Name: "loop1"}}, filepath.Join(tempDir, "roles")); err == nil {
+		t.Errorf("expected a dependency cycle error")
+	}
+
+	inv := NewInventory("")
+	inv.AddHost("web1").Vars["port"] = 8080
+	writeFiles(t, tempDir, map[string]string{"site.yml": `
+- hosts: all
+  vars:
+    out: ` + tempDir + `
+  roles:
+    - role: web
+      server_name: example.com
+`})
+	if _, err := NewPlaybookRunner(inv, "").RunPlaybookFile(filepath.Join(tempDir, "site.yml")); err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := os.ReadFile(filepath.Join(tempDir, "site")); string(out) != "example.com:8080 workers=4 role=web" {
+		t.Errorf("unexpected role template output %q", out)
+	}
+	if out, _ := os.ReadFile(filepath.Join(tempDir, "motd")); string(out) != "static motd\n" {
+		t.Errorf("dependency role did not run, got %q", out)
+	}
+}
@@ -0,0 +1,179 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WriteFileOptions are the options of WriteFileAtomic, the same as the ansible template module ones
+type WriteFileOptions struct {
+	// Mode of the file, 0 keeps the mode of the existing file or is 0644 for a new one
+	Mode os.FileMode
+	// Owner and Group are names or numeric ids, empty keeps the existing ones
+	Owner string
+	Group string
+	// Backup copies the existing file to dest.PID.YYYY-MM-DD@HH:MM:SS~ before replacing it
+	Backup bool
+	// Validate is a command run on the new content before the replace, %s is the temporary file path, e.g.
+	// "visudo -cf %s". It is not run through a shell.
+	Validate string
+}
+
+// WriteFileResult is the outcome of WriteFileAtomic
+type WriteFileResult struct {
+	Path string `json:"path"`
+	// Changed is false when the content, mode and owner were already the wanted ones
+	Changed bool `json:"changed"`
+	// Backup is the backup file path, empty if none was made
+	Backup string `json:"backup,omitempty"`
+}
+
+// WriteFileAtomic writes content to dest without leaving a partial file: the content goes to a temporary file in
+// the dest directory which is synced, validated and renamed over dest. An existing file with the same content is
+// not rewritten, only its mode and owner are fixed. When the file is replaced the existing owner is kept if the
+// process is allowed to.
+func WriteFileAtomic(dest string, content []byte, opt WriteFileOptions) (WriteFileResult, error) {
+	res := WriteFileResult{Path: dest}
+	fi, err := os.Stat(dest)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return res, err
+	}
+	if exists && fi.IsDir() {
+		return res, fmt.Errorf("%s is a directory", dest)
+	}
+	mode := opt.Mode.Perm()
+	if mode == 0 {
+		mode = 0o644
+		if exists {
+			mode = fi.Mode().Perm()
+		}
+	}
+	uid, gid, err := lookupOwner(opt.Owner, opt.Group)
+	if err != nil {
+		return res, err
+	}
+
+	var before []byte
+	if exists {
+		if before, err = os.ReadFile(dest); err != nil {
+			return res, err
+		}
+		if bytes.Equal(before, content) {
+			if fi.Mode().Perm() != mode {
+				if err := os.Chmod(dest, mode); err != nil {
+					return res, err
+				}
+				res.Changed = true
+			}
+			if curUID, curGID, ok := fileOwner(fi); (uid != -1 || gid != -1) && (!ok || (uid != -1 && uid != curUID) || (gid != -1 && gid != curGID)) {
+				if err := os.Chown(dest, uid, gid); err != nil {
+					return res, err
+				}
+				res.Changed = true
+			}
+			return res, nil
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".tmp*")
+	if err != nil {
+		return res, err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return res, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return res, err
+	}
+	if err := tmp.Close(); err != nil {
+		return res, err
+	}
+	if err := os.Chmod(tmpName, mode); err != nil {
+		return res, fmt.Errorf("can not chmod %o for file %s: %w", mode, dest, err)
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(tmpName, uid, gid); err != nil {
+			return res, fmt.Errorf("can not chown %s:%s for file %s: %w", opt.Owner, opt.Group, dest, err)
+		}
+	} else if curUID, curGID, ok := fileOwner(fi); exists && ok {
+		// keeping the owner of the replaced file needs privileges, a user rewriting its own files does not care
+		os.Chown(tmpName, curUID, curGID)
+	}
+	if opt.Validate != "" {
+		if err := validateFile(opt.Validate, tmpName); err != nil {
+			return res, err
+		}
+	}
+	if exists && opt.Backup {
+		res.Backup = fmt.Sprintf("%s.%d.%s~", dest, os.Getpid(), time.Now().Format("2006-01-02@15:04:05"))
+		if err := os.WriteFile(res.Backup, before, fi.Mode().Perm()); err != nil {
+			return res, fmt.Errorf("backup of %s: %w", dest, err)
+		}
+	}
+	if err := os.Rename(tmpName, dest); err != nil {
+		return res, err
+	}
+	// persist the rename, not supported on every platform
+	if d, err := os.Open(filepath.Dir(dest)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	res.Changed = true
+	return res, nil
+}
+
+// validateFile runs the validate command with %s replaced by path, the command must succeed
+func validateFile(command, path string) error {
+	if !strings.Contains(command, "%s") {
+		return fmt.Errorf("validate command %q must contain %%s", command)
+	}
+	args := strings.Fields(command)
+	for i, a := range args {
+		args[i] = strings.ReplaceAll(a, "%s", path)
+	}
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("validate %q failed: %w - %s", command, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// lookupOwner returns the uid and gid of the owner and group names or ids, -1 for the empty ones
+func lookupOwner(owner, group string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if owner != "" {
+		if uid, err = strconv.Atoi(owner); err != nil {
+			usr, err := user.Lookup(owner)
+			if err != nil {
+				return -1, -1, err
+			}
+			if uid, err = strconv.Atoi(usr.Uid); err != nil {
+				return -1, -1, fmt.Errorf("user %s has no numeric uid", owner)
+			}
+		}
+	}
+	if group != "" {
+		if gid, err = strconv.Atoi(group); err != nil {
+			grp, err := user.LookupGroup(group)
+			if err != nil {
+				return -1, -1, err
+			}
+			if gid, err = strconv.Atoi(grp.Gid); err != nil {
+				return -1, -1, fmt.Errorf("group %s has no numeric gid", group)
+			}
+		}
+	}
+	return uid, gid, nil
+}
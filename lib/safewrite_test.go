@@ -0,0 +1,67 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	tempDir := t.TempDir()
+	dest := filepath.Join(tempDir, "app.conf")
+	mode := func() os.FileMode {
+		fi, err := os.Stat(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Mode().Perm()
+	}
+
+	if res, err := WriteFileAtomic(dest, []byte("a\n"), WriteFileOptions{}); err != nil || !res.Changed || mode() != 0o644 {
+		t.Fatalf("new file: %+v %v %o", res, err, mode())
+	}
+	if res, err := WriteFileAtomic(dest, []byte("a\n"), WriteFileOptions{Owner: strconv.Itoa(os.Getuid())}); err != nil || res.Changed {
+		t.Errorf("same content should not change: %+v %v", res, err)
+	}
+	if res, err := WriteFileAtomic(dest, []byte("a\n"), WriteFileOptions{Mode: 0o600}); err != nil || !res.Changed || mode() != 0o600 {
+		t.Errorf("mode only change: %+v %v %o", res, err, mode())
+	}
+	// the mode of the existing file is kept and the old content backed up
+	res, err := WriteFileAtomic(dest, []byte("b\n"), WriteFileOptions{Backup: true, Validate: "test -f %s"})
+	if err != nil || !res.Changed || mode() != 0o600 || res.Backup == "" {
+		t.Fatalf("replace: %+v %v %o", res, err, mode())
+	}
+	if b, _ := os.ReadFile(res.Backup); string(b) != "a\n" {
+		t.Errorf("unexpected backup content %q", b)
+	}
+	if b, _ := os.ReadFile(dest); string(b) != "b\n" {
+		t.Errorf("unexpected content %q", b)
+	}
+
+	// a failed validation or render leaves the file alone
+	if _, err := WriteFileAtomic(dest, []byte("c\n"), WriteFileOptions{Validate: "test ! -f %s"}); err == nil {
+		t.Errorf("expected a validate error")
+	}
+	if _, err := WriteFileAtomic(dest, []byte("c\n"), WriteFileOptions{Validate: "true"}); err == nil {
+		t.Errorf("expected an error for a validate command without %%s")
+	}
+	writeFiles(t, tempDir, map[string]string{"bad.j2": "{{ 1 / 0 }}", "good.j2": "{{ x }}\n\n"})
+	if _, err := TemplateFileSafe(filepath.Join(tempDir, "bad.j2"), dest, nil, WriteFileOptions{}); err == nil {
+		t.Errorf("expected a render error")
+	}
+	if b, _ := os.ReadFile(dest); string(b) != "b\n" {
+		t.Errorf("the file should be untouched, got %q", b)
+	}
+	entries, _ := os.ReadDir(tempDir)
+	if len(entries) != 4 {
+		t.Errorf("expected no temporary file left, got %d entries", len(entries))
+	}
+
+	if res, err := TemplateFileSafe(filepath.Join(tempDir, "good.j2"), dest, map[string]any{"x": "b"}, WriteFileOptions{}); err != nil || res.Changed {
+		t.Errorf("same rendered content should not change: %+v %v", res, err)
+	}
+	if _, err := WriteFileAtomic(dest, nil, WriteFileOptions{Owner: "no-such-user-here"}); err == nil {
+		t.Errorf("expected an unknown user error")
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+
+package lib
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileOwner returns the uid and gid of fi
+func fileOwner(fi os.FileInfo) (uid, gid int, ok bool) {
+	if fi == nil {
+		return -1, -1, false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return -1, -1, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
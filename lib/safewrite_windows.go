@@ -0,0 +1,10 @@
+//go:build windows
+
+package lib
+
+import "os"
+
+// fileOwner is not supported on windows
+func fileOwner(fi os.FileInfo) (uid, gid int, ok bool) {
+	return -1, -1, false
+}
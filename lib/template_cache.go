@@ -0,0 +1,248 @@
+package lib
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	mj "github.com/mitsuhiko/minijinja/minijinja-go/v2"
+	u "github.com/sunshine69/golang-tools/utils"
+)
+
+// TemplateCache is a size bounded LRU cache of compiled templates, safe for concurrent use. Sources are keyed by
+// their sha256, files by their path, mtime and size. The templates are compiled with the settings of their #jinja2: header, one environment per distinct
+// settings, the size most recently used ones are kept. A registration (RegisterFilter and co) drops the cached
+// templates so they get it.
+type TemplateCache struct {
+	mu      sync.Mutex
+	size    int
+	lru     *list.List
+	entries map[string]*list.Element
+	envLRU  *list.List
+	envs    map[TemplateConfig]*list.Element
+	stats   TemplateCacheStats
+	// the registry version of envs, see RegisterFilter
+	version int
+}
+
+// TemplateCacheStats are the counters of a TemplateCache
+type TemplateCacheStats struct {
+	Hits      int `json:"hits"`
+	Misses    int `json:"misses"`
+	Evictions int `json:"evictions"`
+}
+
+// CachedTemplate is a compiled template and the header settings it was compiled with
+type CachedTemplate struct {
+	Template *mj.Template
+	Config   TemplateConfig
+	// lineOffset is 1 if the header line was removed from the source
+	lineOffset int
+	key        string
+	env        *mj.Environment
+	// te and name are the loader and name of a file template, see TemplateCache.File
+	te   *TemplateEnv
+	name string
+}
+
+// cachedEnv is an environment of TemplateCache and the settings it has
+type cachedEnv struct {
+	tc  TemplateConfig
+	env *mj.Environment
+}
+
+// DefaultTemplateCache is used by TemplateString, TemplateFile and FlattenVar. Its size is JINJA2_TEMPLATE_CACHE_SIZE, 1024 if
+// unset, 0 disables it.
+var DefaultTemplateCache = NewTemplateCache(func() int {
+	if n, err := strconv.Atoi(os.Getenv("JINJA2_TEMPLATE_CACHE_SIZE")); err == nil {
+		return n
+	}
+	return 1024
+}())
+
+// NewTemplateCache returns a cache holding at most size templates, size 0 caches nothing
+func NewTemplateCache(size int) *TemplateCache {
+	return &TemplateCache{size: size, lru: list.New(), entries: map[string]*list.Element{}, envLRU: list.New(), envs: map[TemplateConfig]*list.Element{}}
+}
+
+// String returns the compiled template of src
+func (c *TemplateCache) String(src string) (*CachedTemplate, error) {
+	// the header prefix changes how src is compiled
+	sum := sha256.Sum256([]byte(os.Getenv("JINJA2_CONFIG_LINE_PREFIX") + "\x00" + src))
+	return c.get("src:"+hex.EncodeToString(sum[:]), func(key string) (*CachedTemplate, error) { return c.compile(key, "<string>", src) })
+}
+
+// File returns the compiled template of the file p, named by its base name. Its include, import and extends are
+// resolved with the TemplateSearchPath of p, it is compiled again if one of them changed.
+func (c *TemplateCache) File(p string) (*CachedTemplate, error) {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if abs, err := filepath.Abs(p); err == nil {
+		p = abs
+	}
+	paths := TemplateSearchPath(p)
+	key := fmt.Sprintf("file:%s:%d:%d:%s:%s", p, fi.ModTime().UnixNano(), fi.Size(), strings.Join(paths, string(os.PathListSeparator)), os.Getenv("JINJA2_CONFIG_LINE_PREFIX"))
+	return c.get(key, func(key string) (*CachedTemplate, error) {
+		te := NewTemplateEnv(paths...)
+		name := filepath.Base(p)
+		tmpl, err := te.Template(name)
+		if err != nil {
+			return nil, err
+		}
+		f, err := te.file(name)
+		if err != nil {
+			return nil, err
+		}
+		return &CachedTemplate{Template: tmpl, Config: f.config, lineOffset: f.headerLines, key: key, env: te.Env, te: te, name: name}, nil
+	})
+}
+
+// compile compiles src with the environment of its header settings
+func (c *TemplateCache) compile(key, name, src string) (*CachedTemplate, error) {
+	found, body, tc, err := InspectTemplateHeader(src)
+	if err != nil {
+		return nil, headerError(name, src, err)
+	}
+	ct := &CachedTemplate{Config: tc, lineOffset: u.Ternary(found, 1, 0), key: key}
+
+	c.mu.Lock()
+	env := c.env(tc)
+	c.mu.Unlock()
+	// the environments are never changed so they can parse concurrently
+	ct.env = env
+	if ct.Template, err = env.TemplateFromNamedString(name, body); err != nil {
+		return nil, templateError(err, errorLocation{name: name, sources: map[string]string{name: body}, lineOffset: ct.offset})
+	}
+	return ct, nil
+}
+
+func (c *TemplateCache) get(key string, compile func(key string) (*CachedTemplate, error)) (*CachedTemplate, error) {
+	c.mu.Lock()
+	if v := currentRegistryVersion(); v != c.version {
+		// the cached templates use environments without the latest registered filters
+		c.purge()
+		c.envLRU.Init()
+		c.envs = map[TemplateConfig]*list.Element{}
+		c.version = v
+	}
+	el, ok := c.entries[key]
+	c.mu.Unlock()
+	// a file template is stale if one of the files it includes changed
+	if ok && el.Value.(*CachedTemplate).stale() {
+		c.mu.Lock()
+		if c.entries[key] == el {
+			c.lru.Remove(el)
+			delete(c.entries, key)
+		}
+		c.mu.Unlock()
+		ok = false
+	}
+	c.mu.Lock()
+	if ok {
+		c.lru.MoveToFront(el)
+		c.stats.Hits++
+		c.mu.Unlock()
+		return el.Value.(*CachedTemplate), nil
+	}
+	c.stats.Misses++
+	c.mu.Unlock()
+
+	ct, err := compile(key)
+	if err != nil {
+		return nil, err
+	}
+	if c.size <= 0 {
+		return ct, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		// compiled by another goroutine meanwhile
+		c.lru.MoveToFront(el)
+		return el.Value.(*CachedTemplate), nil
+	}
+	c.entries[key] = c.lru.PushFront(ct)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*CachedTemplate).key)
+		c.stats.Evictions++
+	}
+	return ct, nil
+}
+
+// Len returns the number of cached templates
+func (c *TemplateCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Stats returns the cache counters
+func (c *TemplateCache) Stats() TemplateCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// Purge drops all the cached templates
+func (c *TemplateCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.purge()
+}
+
+// env returns the environment of the settings tc, past size environments the least recently used one is dropped.
+// The templates compiled with it keep it.
+func (c *TemplateCache) env(tc TemplateConfig) *mj.Environment {
+	if el, ok := c.envs[tc]; ok {
+		c.envLRU.MoveToFront(el)
+		return el.Value.(*cachedEnv).env
+	}
+	env := NewJinjaEnvironment(&tc.Whitespace, &tc.Syntax)
+	c.envs[tc] = c.envLRU.PushFront(&cachedEnv{tc, env})
+	for c.envLRU.Len() > max(c.size, 1) {
+		oldest := c.envLRU.Back()
+		c.envLRU.Remove(oldest)
+		delete(c.envs, oldest.Value.(*cachedEnv).tc)
+	}
+	return env
+}
+
+func (c *TemplateCache) purge() {
+	c.lru.Init()
+	c.entries = map[string]*list.Element{}
+}
+
+func (ct *CachedTemplate) offset(string) int { return ct.lineOffset }
+
+// stale is true if the file template or one of its includes changed since it was compiled
+func (ct *CachedTemplate) stale() bool { return ct.te != nil && ct.te.changed() }
+
+// Render renders the template with data in the undefined mode (JINJA2_UNDEFINED if empty), with the newline
+// sequence of its header. The strict and collect modes use a fresh environment so the cached one is never changed.
+func (ct *CachedTemplate) Render(data map[string]any, mode string) (string, error) {
+	if ct.te != nil {
+		return ct.te.render(ct.name, data, mode)
+	}
+	mode, err := undefinedMode(mode)
+	if err != nil {
+		return "", err
+	}
+	loc := errorLocation{lineOffset: ct.offset}
+	env := ct.env
+	if mode != UndefinedLenient {
+		env = NewJinjaEnvironment(&ct.Config.Whitespace, &ct.Config.Syntax)
+		env.SetUndefinedBehavior(undefinedBehavior(mode))
+	}
+	out, err := renderUndefined(env, ct.Template, ct.Config, data, mode, loc)
+	return ct.Config.Apply(out), err
+}
@@ -0,0 +1,120 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTemplateCache(t *testing.T) {
+	c := NewTemplateCache(2)
+	render := func(src string, data map[string]any) string {
+		ct, err := c.String(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ct.Render(data, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	if out := render("{{ a }}", map[string]any{"a": 1}); out != "1" {
+		t.Errorf("unexpected output %q", out)
+	}
+	if out := render("{{ a }}", map[string]any{"a": 2}); out != "2" {
+		t.Errorf("unexpected output %q", out)
+	}
+	render("#jinja2: variable_start_string: '[[', variable_end_string: ']]', newline_sequence: '\\r\\n'\n[[ a ]]\n{{ a }}", nil)
+	if out := render("#jinja2: variable_start_string: '[[', variable_end_string: ']]', newline_sequence: '\\r\\n'\n[[ a ]]\n{{ a }}", map[string]any{"a": 3}); out != "3\r\n{{ a }}" {
+		t.Errorf("unexpected header output %q", out)
+	}
+	render("{{ b }}", nil)
+	if s := c.Stats(); s != (TemplateCacheStats{Hits: 2, Misses: 3, Evictions: 1}) || c.Len() != 2 {
+		t.Errorf("unexpected stats %+v, len %d", s, c.Len())
+	}
+	if _, err := c.String("{{ a "); err == nil {
+		t.Errorf("expected a parse error")
+	}
+	if c.Len() != 2 {
+		t.Errorf("failed templates should not be cached")
+	}
+
+	// strict mode does not touch the cached environment
+	ct, _ := c.String("{{ b }}")
+	var ue *UndefinedError
+	if _, err := ct.Render(nil, UndefinedStrict); !errors.As(err, &ue) {
+		t.Errorf("expected an undefined error, got %v", err)
+	}
+	if out, err := ct.Render(nil, ""); err != nil || out != "" {
+		t.Errorf("expected a lenient render, got %q %v", out, err)
+	}
+
+	// the environments of the header settings are bounded too
+	for i := range 5 {
+		render(fmt.Sprintf("#jinja2: variable_start_string: '[%d', variable_end_string: ']]'\n[%d a ]]", i, i), nil)
+	}
+	if len(c.envs) != 2 || c.envLRU.Len() != 2 {
+		t.Errorf("expected 2 environments, got %d", len(c.envs))
+	}
+
+	// files are keyed by path, mtime and size, and compiled again when an include changed
+	tempDir := t.TempDir()
+	p := filepath.Join(tempDir, "t.j2")
+	writeFiles(t, tempDir, map[string]string{"t.j2": "v1 {{ a }} {% include 'inc.j2' %}", "inc.j2": "i1"})
+	ct1, err := c.File(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct2, _ := c.File(p); ct2 != ct1 {
+		t.Errorf("expected the cached file template")
+	}
+	if out, err := ct1.Render(map[string]any{"a": 1}, ""); err != nil || out != "v1 1 i1" {
+		t.Errorf("unexpected file output %q %v", out, err)
+	}
+	later := time.Now().Add(time.Second)
+	os.WriteFile(p, []byte("v2 {{ a }} {% include 'inc.j2' %}"), 0o644)
+	os.Chtimes(p, later, later)
+	ct2, _ := c.File(p)
+	if ct2 == ct1 || ct2.Template.Source() != "v2 {{ a }} {% include 'inc.j2' %}" {
+		t.Errorf("expected the changed file to be compiled again")
+	}
+	if out, err := ct2.Render(map[string]any{"a": 2}, ""); err != nil || out != "v2 2 i1" {
+		t.Errorf("unexpected file output %q %v", out, err)
+	}
+	os.WriteFile(filepath.Join(tempDir, "inc.j2"), []byte("i2"), 0o644)
+	os.Chtimes(filepath.Join(tempDir, "inc.j2"), later, later)
+	if ct3, _ := c.File(p); ct3 == ct2 {
+		t.Errorf("expected the changed include to compile the file again")
+	} else if out, err := ct3.Render(map[string]any{"a": 2}, ""); err != nil || out != "v2 2 i2" {
+		t.Errorf("unexpected file output %q %v", out, err)
+	}
+	if _, err := c.File(filepath.Join(tempDir, "nope.j2")); !os.IsNotExist(err) {
+		t.Errorf("expected a not exist error, got %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			src := fmt.Sprintf("{{ n }}-%d", i%3)
+			ct, err := c.String(src)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if out, err := ct.Render(map[string]any{"n": i}, ""); err != nil || out != fmt.Sprintf("%d-%d", i, i%3) {
+				t.Errorf("unexpected concurrent output %q %v", out, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if c.Len() != 2 {
+		t.Errorf("the cache should stay bounded, got %d", c.Len())
+	}
+}
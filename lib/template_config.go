@@ -0,0 +1,238 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/mitsuhiko/minijinja/minijinja-go/v2/syntax"
+	u "github.com/sunshine69/golang-tools/utils"
+)
+
+// TemplateConfig is the environment settings of one template, from its #jinja2: header line or from the
+// TemplateStringWithConfig options. Both accept the same keys:
+//
+//	variable_start_string, variable_end_string, block_start_string, block_end_string,
+//	comment_start_string, comment_end_string, line_statement_prefix, line_comment_prefix,
+//	trim_blocks, lstrip_blocks, keep_trailing_newline, newline_sequence, engine
+//
+// minijinja always renders \n so NewlineSequence is applied to the output. Engine is only used to pick the
+// Renderer of a file, see DetectEngine.
+type TemplateConfig struct {
+	Whitespace      syntax.WhitespaceConfig
+	Syntax          syntax.SyntaxConfig
+	NewlineSequence string
+	Engine          string
+}
+
+// DefaultTemplateConfig is the config of a template without a header: trim_blocks and lstrip_blocks on
+func DefaultTemplateConfig() TemplateConfig {
+	tc := TemplateConfig{Whitespace: syntax.DefaultWhitespace(), Syntax: syntax.DefaultSyntax(), NewlineSequence: "\n"}
+	tc.Whitespace.TrimBlocks, tc.Whitespace.LstripBlocks = true, true
+	return tc
+}
+
+// Set sets one config key. known is false if key is not a template setting, the caller decides if it is an error.
+func (tc *TemplateConfig) Set(key, val string) (known bool, err error) {
+	str := map[string]*string{
+		"variable_start_string": &tc.Syntax.VarStart,
+		"variable_end_string":   &tc.Syntax.VarEnd,
+		"block_start_string":    &tc.Syntax.BlockStart,
+		"block_end_string":      &tc.Syntax.BlockEnd,
+		"comment_start_string":  &tc.Syntax.CommentStart,
+		"comment_end_string":    &tc.Syntax.CommentEnd,
+		"line_statement_prefix": &tc.Syntax.LineStatementPrefix,
+		"line_comment_prefix":   &tc.Syntax.LineCommentPrefix,
+	}
+	flags := map[string]*bool{
+		"trim_blocks":           &tc.Whitespace.TrimBlocks,
+		"lstrip_blocks":         &tc.Whitespace.LstripBlocks,
+		"keep_trailing_newline": &tc.Whitespace.KeepTrailingNewline,
+	}
+	if p, ok := str[key]; ok {
+		*p = val
+		return true, nil
+	}
+	if p, ok := flags[key]; ok {
+		switch strings.ToLower(val) {
+		case "true", "yes", "1":
+			*p = true
+		case "false", "no", "0":
+			*p = false
+		default:
+			return true, fmt.Errorf("%s: expected True or False, got %q", key, val)
+		}
+		return true, nil
+	}
+	if key == "engine" {
+		if !containsStr(Engines, val) {
+			return true, fmt.Errorf("engine must be one of %s, got %q", strings.Join(Engines, ", "), val)
+		}
+		tc.Engine = val
+		return true, nil
+	}
+	if key == "newline_sequence" {
+		// the options are plain strings so also take the escaped forms
+		switch seq := unescapeHeaderValue(val); seq {
+		case "\n", "\r", "\r\n":
+			tc.NewlineSequence = seq
+		default:
+			return true, fmt.Errorf("newline_sequence must be one of \\n, \\r or \\r\\n, got %q", val)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// Apply returns out with the newlines converted to NewlineSequence
+func (tc TemplateConfig) Apply(out string) string {
+	if tc.NewlineSequence == "" || tc.NewlineSequence == "\n" {
+		return out
+	}
+	return strings.ReplaceAll(out, "\n", tc.NewlineSequence)
+}
+
+// Writer wraps w so the newlines written are converted to NewlineSequence
+func (tc TemplateConfig) Writer(w io.Writer) io.Writer {
+	if tc.NewlineSequence == "" || tc.NewlineSequence == "\n" {
+		return w
+	}
+	return newlineWriter{w, []byte(tc.NewlineSequence)}
+}
+
+type newlineWriter struct {
+	w   io.Writer
+	seq []byte
+}
+
+func (nw newlineWriter) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p))
+	for _, b := range p {
+		if b == '\n' {
+			out = append(out, nw.seq...)
+		} else {
+			out = append(out, b)
+		}
+	}
+	if _, err := nw.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ParseTemplateHeader parses a header line like
+//
+//	#jinja2: variable_start_string: '[%', variable_end_string: '%]', trim_blocks: False
+//
+// Values may be quoted with ' or " (with \n, \r, \t, \\ and quote escapes) so they can hold , and :. When a header
+// is found the whitespace settings start from the jinja2 defaults (no trim_blocks or lstrip_blocks) as in ansible.
+// found is false if the line does not start with prefix.
+func ParseTemplateHeader(line, prefix string) (found bool, tc TemplateConfig, err error) {
+	tc = TemplateConfig{Whitespace: syntax.DefaultWhitespace(), Syntax: syntax.DefaultSyntax(), NewlineSequence: "\n"}
+	line = strings.TrimRight(line, "\r")
+	if !strings.HasPrefix(line, prefix) {
+		return false, tc, nil
+	}
+	pairs, err := splitHeaderPairs(strings.TrimPrefix(line, prefix))
+	if err != nil {
+		return true, tc, err
+	}
+	if len(pairs) == 0 {
+		return true, tc, fmt.Errorf("empty %s header", prefix)
+	}
+	for _, kv := range pairs {
+		known, err := tc.Set(kv[0], kv[1])
+		if err != nil {
+			return true, tc, err
+		}
+		if !known {
+			return true, tc, fmt.Errorf("unknown %s header setting %q", prefix, kv[0])
+		}
+	}
+	return true, tc, nil
+}
+
+// splitHeaderPairs splits `key: value, key: 'value'` into key, value pairs
+func splitHeaderPairs(s string) ([][2]string, error) {
+	pairs := [][2]string{}
+	i, n := 0, len(s)
+	skipSpace := func() {
+		for i < n && (s[i] == ' ' || s[i] == '\t') {
+			i++
+		}
+	}
+	for {
+		skipSpace()
+		if i >= n {
+			return pairs, nil
+		}
+		start := i
+		for i < n && s[i] != ':' && s[i] != ',' {
+			i++
+		}
+		key := strings.TrimSpace(s[start:i])
+		if i >= n || s[i] != ':' || key == "" {
+			return nil, fmt.Errorf("expected key: value at %q", s[start:])
+		}
+		i++
+		skipSpace()
+		var val string
+		if i < n && (s[i] == '\'' || s[i] == '"') {
+			quote := s[i]
+			i++
+			var sb strings.Builder
+			for ; i < n && s[i] != quote; i++ {
+				if s[i] == '\\' && i+1 < n {
+					i++
+					sb.WriteString(unescapeHeaderValue(`\` + string(s[i])))
+					continue
+				}
+				sb.WriteByte(s[i])
+			}
+			if i >= n {
+				return nil, fmt.Errorf("unterminated string for %s", key)
+			}
+			i++
+			val = sb.String()
+			skipSpace()
+		} else {
+			start := i
+			for i < n && s[i] != ',' {
+				i++
+			}
+			val = strings.TrimSpace(s[start:i])
+		}
+		pairs = append(pairs, [2]string{key, val})
+		if i < n {
+			if s[i] != ',' {
+				return nil, fmt.Errorf("expected , after %s at %q", key, s[i:])
+			}
+			i++
+		}
+	}
+}
+
+// unescapeHeaderValue replaces the \n, \r, \t, \\, \' and \" escapes, other backslashes are kept like python does
+func unescapeHeaderValue(s string) string {
+	return strings.NewReplacer(`\n`, "\n", `\r`, "\r", `\t`, "\t", `\\`, `\`, `\'`, `'`, `\"`, `"`).Replace(s)
+}
+
+// InspectTemplateHeader is InspectTemplateString returning the full TemplateConfig and the header error if the
+// first line is a malformed header. Without a header remainText is text and tc is DefaultTemplateConfig.
+func InspectTemplateHeader(text string) (foundConfig bool, remainText string, tc TemplateConfig, err error) {
+	firstLine, newSrc := u.SplitFirstLine(text)
+	if newSrc == "" {
+		tc = DefaultTemplateConfig()
+		tc.Whitespace = syntax.DefaultWhitespace()
+		return false, text, tc, nil
+	}
+	prefix := u.Getenv("JINJA2_CONFIG_LINE_PREFIX", `#jinja2:`)
+	foundConfig, tc, err = ParseTemplateHeader(firstLine, prefix)
+	if err != nil {
+		return false, text, DefaultTemplateConfig(), err
+	}
+	if !foundConfig {
+		return false, text, DefaultTemplateConfig(), nil
+	}
+	return true, newSrc, tc, nil
+}
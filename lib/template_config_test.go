@@ -0,0 +1,49 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTemplateHeader(t *testing.T) {
+	found, tc, err := ParseTemplateHeader(`#jinja2: variable_start_string: '[%', variable_end_string: "%]", block_start_string: '<%', block_end_string: '%>', comment_start_string: '<#', comment_end_string: '#>', trim_blocks: False, keep_trailing_newline: True, newline_sequence: '\r\n', line_statement_prefix: '##'`, "#jinja2:")
+	if !found || err != nil {
+		t.Fatalf("expected a header, got %v %v", found, err)
+	}
+	if tc.Syntax.VarStart != "[%" || tc.Syntax.VarEnd != "%]" || tc.Syntax.BlockStart != "<%" || tc.Syntax.CommentEnd != "#>" ||
+		tc.Syntax.LineStatementPrefix != "##" || tc.Whitespace.TrimBlocks || !tc.Whitespace.KeepTrailingNewline || tc.NewlineSequence != "\r\n" {
+		t.Errorf("unexpected config %+v", tc)
+	}
+	// quoted values can hold , and :
+	if _, tc, err := ParseTemplateHeader(`#jinja2:variable_start_string:'a:,b', variable_end_string:'c\'d'`, "#jinja2:"); err != nil || tc.Syntax.VarStart != "a:,b" || tc.Syntax.VarEnd != "c'd" {
+		t.Errorf("unexpected quoted values %q %q (%v)", tc.Syntax.VarStart, tc.Syntax.VarEnd, err)
+	}
+	for _, bad := range []string{`#jinja2: trim_blocks: maybe`, `#jinja2: foo: 1`, `#jinja2: variable_start_string: '[%`, `#jinja2: newline_sequence: 'x'`, `#jinja2: trim_blocks`, `#jinja2: engine: jinja3`} {
+		if _, _, err := ParseTemplateHeader(bad, "#jinja2:"); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+	if found, _, _ := ParseTemplateHeader("# just a comment", "#jinja2:"); found {
+		t.Errorf("expected no header")
+	}
+
+	src := "#jinja2: block_start_string: '<%', block_end_string: '%>', keep_trailing_newline: True, newline_sequence: '\\r\\n'\n<% for i in items %>{{ i }}\n<% endfor %>{% raw %}\n"
+	if out := TemplateString(src, map[string]any{"items": []int{1, 2}}); out != "1\r\n2\r\n{% raw %}\r\n" {
+		t.Errorf("unexpected TemplateString output %q", out)
+	}
+	if out, err := TemplateStringWithConfig("{% for i in items %}{{ i }}\n{% endfor %}", map[string]any{"items": []int{1, 2}}, "newline_sequence", `\r\n`, "keep_trailing_newline", "True"); err != nil || out != "1\r\n2\r\n" {
+		t.Errorf("unexpected TemplateStringWithConfig output %q (%v)", out, err)
+	}
+	if _, err := TemplateStringWithConfig("x", nil, "trim_blocks", "maybe"); err == nil {
+		t.Errorf("expected an option error")
+	}
+
+	tempDir := t.TempDir()
+	writeFiles(t, tempDir, map[string]string{"ls.j2": "#jinja2: line_statement_prefix: '%%'\n%% for i in items\n- {{ i }}\n%% endfor\n"})
+	dest := filepath.Join(tempDir, "out")
+	TemplateFile(filepath.Join(tempDir, "ls.j2"), dest, map[string]any{"items": []string{"a", "b"}}, 0o644)
+	if b, _ := os.ReadFile(dest); string(b) != "- a\n- b\n" {
+		t.Errorf("unexpected line statement output %q", b)
+	}
+}
@@ -0,0 +1,166 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	mj "github.com/mitsuhiko/minijinja/minijinja-go/v2"
+	u "github.com/sunshine69/golang-tools/utils"
+)
+
+// TemplateError is a parse or render error located in a template. Line and Column start at 1 and are 0 when
+// unknown, Line counts the #jinja2: header line. Excerpt is the source line with a caret under the column.
+type TemplateError struct {
+	Name    string `json:"name"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Message string `json:"message"`
+	Excerpt string `json:"excerpt,omitempty"`
+	Err     error  `json:"-"`
+}
+
+func (e *TemplateError) Error() string {
+	loc := e.Name
+	if e.Line > 0 {
+		loc += fmt.Sprintf(" line %d", e.Line)
+	}
+	if e.Column > 0 {
+		loc += fmt.Sprintf(" col %d", e.Column)
+	}
+	if e.Excerpt == "" {
+		return loc + ": " + e.Message
+	}
+	return loc + ": " + e.Message + "\n" + e.Excerpt
+}
+
+func (e *TemplateError) Unwrap() error { return e.Err }
+
+// parseErrRe matches the message of the minijinja parse errors, they only have a line
+var parseErrRe = regexp.MustCompile(`^(?s)(.*) \(line (\d+)\)$`)
+
+// errorLocation is what templateError needs to locate an error
+type errorLocation struct {
+	// name is the template rendered, the errors in included templates are located in them
+	name    string
+	sources map[string]string
+	// loaded returns the sources loaded while rendering, when not nil they are added to sources
+	loaded     func() map[string]string
+	lineOffset func(name string) int
+	// prelude is the length of the text renderUndefined added at the start of the first line of name
+	prelude int
+}
+
+// templateError turns the minijinja error err into a *TemplateError. The *UndefinedError and *TemplateError are
+// returned as is.
+func templateError(err error, loc errorLocation) error {
+	var ue *UndefinedError
+	var te *TemplateError
+	if err == nil || errors.As(err, &ue) {
+		return err
+	}
+	if errors.As(err, &te) {
+		return te
+	}
+	tErr := &TemplateError{Name: loc.name, Message: err.Error(), Err: err}
+	var spanless *mj.Error
+	// the deepest error with a location wins, include errors name the template the next ones are in
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		me, ok := e.(*mj.Error)
+		if !ok {
+			if m := parseErrRe.FindStringSubmatch(e.Error()); m != nil {
+				tErr.Message, tErr.Column = m[1], 0
+				tErr.Line, _ = strconv.Atoi(m[2])
+			}
+			continue
+		}
+		tErr.Message = fmt.Sprintf("%s: %s", me.Kind, me.Message)
+		if me.Kind == mj.ErrBadInclude {
+			if m := includeErrRe.FindStringSubmatch(me.Message); m != nil {
+				tErr.Name, tErr.Line, tErr.Column = m[1], 0, 0
+				continue
+			}
+		}
+		spanless = u.Ternary(me.Span == nil, me, nil)
+		if me.Span != nil {
+			tErr.Line, tErr.Column = int(me.Span.StartLine), int(me.Span.StartCol)+1
+			if tErr.Name == loc.name && tErr.Line == 1 && tErr.Column > loc.prelude {
+				tErr.Column -= loc.prelude
+			}
+		}
+	}
+	lines := strings.Split(loc.allSources()[tErr.Name], "\n")
+	if tErr.Line == 0 && spanless != nil {
+		tErr.Line, tErr.Column = searchErrorName(lines, spanless)
+	}
+	if tErr.Line > 0 {
+		if tErr.Line <= len(lines) {
+			tErr.Excerpt = sourceExcerpt(lines[tErr.Line-1], tErr.Column)
+		}
+		if loc.lineOffset != nil {
+			tErr.Line += loc.lineOffset(tErr.Name)
+		}
+	}
+	return tErr
+}
+
+// searchErrorName returns the line and column of the first use of the unknown filter of me, the minijinja error
+// has no span for it
+func searchErrorName(lines []string, me *mj.Error) (int, int) {
+	if me.Kind != mj.ErrUnknownFilter {
+		return 0, 0
+	}
+	re := regexp.MustCompile(`\|\s*(` + regexp.QuoteMeta(me.Message) + `)\b`)
+	for i, line := range lines {
+		if m := re.FindStringSubmatchIndex(line); m != nil {
+			return i + 1, m[2] + 1
+		}
+	}
+	return 0, 0
+}
+
+// sourceExcerpt is the indented line with a caret under column, tabs are kept so the caret lines up
+func sourceExcerpt(line string, column int) string {
+	line = strings.TrimRight(line, "\r")
+	if column < 1 || column > len(line)+1 {
+		return "  " + line
+	}
+	caret := strings.Map(func(r rune) rune { return u.Ternary(r == '\t', '\t', ' ') }, line[:column-1])
+	return "  " + line + "\n  " + caret + "^"
+}
+
+// allSources returns sources and the loaded ones
+func (loc errorLocation) allSources() map[string]string {
+	if loc.loaded == nil {
+		return loc.sources
+	}
+	sources := loc.loaded()
+	for name, src := range loc.sources {
+		sources[name] = src
+	}
+	return sources
+}
+
+// headerError is the error of a malformed #jinja2: header line of the template name
+func headerError(name, src string, err error) error {
+	first, _, _ := strings.Cut(src, "\n")
+	return &TemplateError{Name: name, Line: 1, Message: err.Error(), Excerpt: sourceExcerpt(first, 0), Err: err}
+}
+
+// templateSources returns the sources of tmpl, of the templates env has loaded and the other ones
+func templateSources(env *mj.Environment, tmpl *mj.Template, other map[string]string) map[string]string {
+	sources := map[string]string{}
+	for name, src := range other {
+		sources[name] = src
+	}
+	for name, t := range env.Templates() {
+		// other wins, a TemplateEnv environment has stand-ins for the templates of other environments
+		if _, ok := sources[name]; !ok {
+			sources[name] = t.Source()
+		}
+	}
+	sources[tmpl.Name()] = tmpl.Source()
+	return sources
+}
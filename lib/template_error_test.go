@@ -0,0 +1,88 @@
+package lib
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTemplateError(t *testing.T) {
+	for _, tc := range []struct {
+		src              string
+		line, column     int
+		message, excerpt string
+	}{
+		{"a\n{{ x }", 2, 0, "SyntaxError: unexpected `}`, expected end of variable block", "  {{ x }"},
+		{"a\n\t{{ 1 / 0 }}", 2, 5, "invalid operation: division by zero", "  \t{{ 1 / 0 }}\n  \t   ^"},
+		{"#jinja2: trim_blocks: False\n\n {{ 'a' + 1 }}", 3, 5, "invalid operation: cannot add string and number", "   {{ 'a' + 1 }}\n      ^"},
+		{"{{ 1 }}\n{{ x | nofilter }}", 2, 8, "unknown filter: nofilter", "  {{ x | nofilter }}\n         ^"},
+		{"{{ nofunc(1) }}", 1, 4, "unknown function: unknown callable", "  {{ nofunc(1) }}\n     ^"},
+		{"#jinja2: trim_blocks: maybe\nx", 1, 0, `trim_blocks: expected True or False, got "maybe"`, "  #jinja2: trim_blocks: maybe"},
+	} {
+		_, err := TemplateStringErr(tc.src, nil)
+		var te *TemplateError
+		if !errors.As(err, &te) {
+			t.Errorf("%q: expected a TemplateError, got %v", tc.src, err)
+			continue
+		}
+		if te.Name != "<string>" || te.Line != tc.line || te.Column != tc.column || te.Message != tc.message || te.Excerpt != tc.excerpt {
+			t.Errorf("%q: unexpected error %#v", tc.src, te)
+		}
+	}
+	if out, err := TemplateStringErr("{{ x }}", map[string]any{"x": 1}); err != nil || out != "1" {
+		t.Errorf("unexpected output %q %v", out, err)
+	}
+	if err := catchPanic(func() { TemplateString("{{ x }", nil) }); err == nil {
+		t.Errorf("expected TemplateString to panic")
+	}
+
+	// strict mode reports the column of the source, not the one of the tracked copy
+	_, err := TemplateStringWithConfig("{{ 1 / 0 }}", map[string]any{"a": 1}, "undefined", "strict")
+	var te *TemplateError
+	if !errors.As(err, &te) || te.Line != 1 || te.Column != 4 {
+		t.Errorf("unexpected strict error %v", err)
+	}
+
+	// the errors of included templates are located in them
+	tempDir := t.TempDir()
+	writeFiles(t, tempDir, map[string]string{
+		"main.j2":   "#jinja2: trim_blocks: True\nmain\n{% include 'inc.j2' %}",
+		"inc.j2":    "#jinja2: trim_blocks: True\n\n  {{ 1 / 0 }}",
+		"bad.j2":    "x\n{% include 'badinc.j2' %}",
+		"badinc.j2": "y\n{% if %}",
+	})
+	te2 := NewTemplateEnv(tempDir)
+	for name, expected := range map[string]TemplateError{
+		"main.j2": {Name: "inc.j2", Line: 3, Column: 6, Excerpt: "    {{ 1 / 0 }}\n       ^"},
+		"bad.j2":  {Name: "badinc.j2", Line: 2, Excerpt: "  {% if %}"},
+	} {
+		for _, mode := range []string{UndefinedLenient, UndefinedStrict} {
+			te2.Undefined = mode
+			_, err := te2.Render(name, nil)
+			if !errors.As(err, &te) || te.Name != expected.Name || te.Line != expected.Line || te.Column != expected.Column || te.Excerpt != expected.Excerpt {
+				t.Errorf("%s %s: unexpected error %#v", name, mode, err)
+			}
+		}
+	}
+
+	dest := filepath.Join(tempDir, "out.txt")
+	if err := TemplateFileErr(filepath.Join(tempDir, "bad.j2"), dest, nil, 0o644); !errors.As(err, &te) || te.Name != "badinc.j2" {
+		t.Errorf("unexpected TemplateFileErr error %v", err)
+	}
+	if err := TemplateFileErr(filepath.Join(tempDir, "nope.j2"), dest, nil, 0o644); err == nil {
+		t.Errorf("expected a not found error")
+	}
+	if err := TemplateDirTreeErr(filepath.Join(tempDir, "nope"), dest, nil); err == nil {
+		t.Errorf("expected a missing dir error")
+	}
+	if err := TemplateDirTreeErr(tempDir, filepath.Join(tempDir, "out"), nil); !errors.As(err, &te) {
+		t.Errorf("expected a TemplateError for the tree, got %v", err)
+	}
+	if err := catchPanic(func() { TemplateDirTree(filepath.Join(tempDir, "nope"), dest, nil) }); err == nil {
+		t.Errorf("expected TemplateDirTree to panic")
+	}
+	if _, _, _, _, err := InspectTemplateFileErr(filepath.Join(tempDir, "nope.j2")); !os.IsNotExist(err) {
+		t.Errorf("expected a not exist error, got %v", err)
+	}
+}
@@ -0,0 +1,267 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	mj "github.com/mitsuhiko/minijinja/minijinja-go/v2"
+	"github.com/mitsuhiko/minijinja/minijinja-go/v2/value"
+	u "github.com/sunshine69/golang-tools/utils"
+)
+
+// Undefined variable handling. The mode is the "undefined" option of TemplateStringWithConfig and
+// TemplateFileWithConfig, the TemplateEnv Undefined field or the JINJA2_UNDEFINED env var:
+//
+//	lenient  (default) undefined variables render as empty strings
+//	strict   rendering fails on the first undefined variable with an *UndefinedError
+//	collect  the template renders fully, the *UndefinedError lists every undefined variable
+//
+// The reads guarded with `is defined` or `| default(...)` are not reported, the other reads of the same variable are.
+const (
+	UndefinedLenient = "lenient"
+	UndefinedStrict  = "strict"
+	UndefinedCollect = "collect"
+)
+
+// UndefinedRef is an undefined variable used by a template
+type UndefinedRef struct {
+	Name     string `json:"name"`
+	Template string `json:"template"`
+	Line     int    `json:"line"`
+}
+
+func (r UndefinedRef) String() string {
+	if r.Name == "" {
+		return fmt.Sprintf("%s: undefined value", r.Template) + u.Ternary(r.Line > 0, fmt.Sprintf(" at line %d", r.Line), "")
+	}
+	if r.Line > 0 {
+		return fmt.Sprintf("%s line %d: '%s' is undefined", r.Template, r.Line, r.Name)
+	}
+	return fmt.Sprintf("%s: '%s' is undefined", r.Template, r.Name)
+}
+
+// UndefinedError is returned in the strict (one ref) and collect (all refs) modes
+type UndefinedError struct {
+	Refs []UndefinedRef
+	// Err is the render error in strict mode
+	Err error
+}
+
+func (e *UndefinedError) Error() string {
+	refs := make([]string, len(e.Refs))
+	for i, r := range e.Refs {
+		refs[i] = r.String()
+	}
+	return "undefined variable: " + strings.Join(refs, ", ")
+}
+
+func (e *UndefinedError) Unwrap() error { return e.Err }
+
+// undefinedMode returns mode or the JINJA2_UNDEFINED default
+func undefinedMode(mode string) (string, error) {
+	if mode == "" {
+		mode = os.Getenv("JINJA2_UNDEFINED")
+	}
+	switch mode {
+	case "", UndefinedLenient:
+		return UndefinedLenient, nil
+	case UndefinedStrict, UndefinedCollect:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown undefined mode %q, expected lenient, strict or collect", mode)
+}
+
+// undefinedTracker is the render context recording the lookups of missing variables
+type undefinedTracker struct {
+	data    map[string]any
+	missing []string
+}
+
+func (ut *undefinedTracker) GetAttr(name string) value.Value {
+	if v, ok := ut.data[name]; ok {
+		return value.FromAny(v)
+	}
+	if !containsStr(ut.missing, name) {
+		ut.missing = append(ut.missing, name)
+	}
+	return value.Undefined()
+}
+
+func (ut *undefinedTracker) Keys() []string {
+	keys := make([]string, 0, len(ut.data))
+	for k := range ut.data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var (
+	// exprRe matches the variable and attributes at the start of an error span, after the stmtRe statement
+	exprRe       = regexp.MustCompile(`^[A-Za-z_][\w.]*`)
+	stmtRe       = regexp.MustCompile(`^(if|elif|for\s+[\w\s,]+\s+in|not)\s+`)
+	includeErrRe = regexp.MustCompile(`error in "(.+)"`)
+)
+
+// undefinedBehavior is the behavior of the environments rendering in the undefined mode
+func undefinedBehavior(mode string) mj.UndefinedBehavior {
+	return u.Ternary(mode == UndefinedStrict, mj.UndefinedStrict, mj.UndefinedLenient)
+}
+
+// identRe matches the data keys usable as template variables
+var identRe = regexp.MustCompile(`^[A-Za-z_]\w*$`)
+
+// renderUndefined renders tmpl of env with data in the undefined mode. tc is the config tmpl was parsed with, loc
+// has the sources of the templates env failed to parse and the line offsets of the header lines removed from the
+// sources. The other errors are *TemplateError. env is not changed; it has the syntax of tc and, in strict mode,
+// the undefinedBehavior of the mode.
+//
+// The missing variables are recorded by a context object. Included templates do not see the context of their
+// parent, only its variables, so the data is also set as variables at the start of tmpl (on its first line to keep
+// the line numbers). The variables missing in included templates are only caught in strict mode. The line of a
+// missing variable is the one of its first read not guarded by `is defined` or `| default`, or the error span in
+// strict mode.
+func renderUndefined(env *mj.Environment, tmpl *mj.Template, tc TemplateConfig, data map[string]any, mode string, loc errorLocation) (string, error) {
+	mode, err := undefinedMode(mode)
+	if err != nil {
+		return "", err
+	}
+	loc.name = tmpl.Name()
+	if mode == UndefinedLenient {
+		out, err := tmpl.Render(data)
+		loc.sources = templateSources(env, tmpl, loc.allSources())
+		return out, templateError(err, loc)
+	}
+	ut := &undefinedTracker{data: data}
+	var prelude strings.Builder
+	for _, k := range ut.Keys() {
+		if identRe.MatchString(k) {
+			fmt.Fprintf(&prelude, "%s set %s = %s %s", tc.Syntax.BlockStart, k, k, tc.Syntax.BlockEnd)
+		}
+	}
+	tracked, err := env.TemplateFromNamedString(tmpl.Name(), prelude.String()+tmpl.Source())
+	if err != nil {
+		return "", err
+	}
+	out, err := tracked.Render(value.FromObject(ut))
+
+	sources := templateSources(env, tmpl, loc.allSources())
+	names := []string{tmpl.Name()}
+	for name := range sources {
+		if name != tmpl.Name() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names[1:])
+	lineOffset := loc.lineOffset
+	if lineOffset == nil {
+		lineOffset = func(string) int { return 0 }
+	}
+	analyses := map[string]*TemplateAnalysis{}
+	analysis := func(name string) *TemplateAnalysis {
+		if _, ok := analyses[name]; !ok {
+			analyses[name], _ = analyzeTemplate(name, sources[name], tc.Syntax)
+		}
+		return analyses[name]
+	}
+	refs := []UndefinedRef{}
+	for _, name := range ut.missing {
+		if undefinedGlobal(env, tc, name) {
+			continue
+		}
+	search:
+		for _, tn := range names {
+			ta := analysis(tn)
+			if ta == nil {
+				continue
+			}
+			for _, use := range ta.uses {
+				// a guard on an attribute path needs the variable
+				if use.path[0] == name && use.guard != 1 {
+					refs = append(refs, UndefinedRef{Name: name, Template: tn, Line: use.line + lineOffset(tn)})
+					break search
+				}
+			}
+		}
+	}
+
+	if err != nil {
+		// the undefined error can be the cause of an include error
+		var me *mj.Error
+		ref := UndefinedRef{Template: tmpl.Name()}
+		for e := err; e != nil; e = errors.Unwrap(e) {
+			if ee, ok := e.(*mj.Error); ok && ee.Kind == mj.ErrUndefinedVar {
+				me = ee
+			} else if ok && ee.Kind == mj.ErrBadInclude {
+				if m := includeErrRe.FindStringSubmatch(ee.Message); m != nil {
+					ref.Template = m[1]
+				}
+			}
+		}
+		if me == nil {
+			loc.sources, loc.prelude = sources, prelude.Len()
+			return out, templateError(err, loc)
+		}
+		if len(refs) > 0 {
+			ref = refs[len(refs)-1]
+		}
+		// the span is the failing expression when there is one, it can be a missing attribute of a defined variable
+		if me.Span != nil {
+			if me.Name != "" {
+				ref.Template = me.Name
+			}
+			ref.Line = int(me.Span.StartLine) + lineOffset(ref.Template)
+			start, end := int(me.Span.StartOffset), int(me.Span.EndOffset)
+			if ref.Template == tmpl.Name() {
+				start, end = start-prelude.Len(), end-prelude.Len()
+			}
+			if src := sources[ref.Template]; start >= 0 && end <= len(src) {
+				ref.Name = u.Ternary(len(refs) > 0, ref.Name, exprRe.FindString(stmtRe.ReplaceAllString(src[start:end], "")))
+			}
+		}
+		return "", &UndefinedError{Refs: []UndefinedRef{ref}, Err: err}
+	}
+	if len(refs) == 0 {
+		return out, nil
+	}
+	if mode == UndefinedStrict {
+		return "", &UndefinedError{Refs: refs[:1]}
+	}
+	return out, &UndefinedError{Refs: refs}
+}
+
+// undefinedFatal is false if err is nil or only the list of the collect mode
+func undefinedFatal(err error, mode string) bool {
+	var ue *UndefinedError
+	return err != nil && (mode != UndefinedCollect || !errors.As(err, &ue))
+}
+
+// warnUndefined prints the undefined variables of the collect mode to stderr, the other errors are returned. It is
+// for the funcs that panic on error.
+func warnUndefined(err error, mode string) error {
+	if undefinedFatal(err, mode) {
+		return err
+	}
+	var ue *UndefinedError
+	if errors.As(err, &ue) {
+		for _, r := range ue.Refs {
+			fmt.Fprintf(os.Stderr, "[WARN] %s\n", r)
+		}
+	}
+	return nil
+}
+
+// undefinedGlobal is true for the names looked up in the context that are not variables, the functions and
+// globals of env
+func undefinedGlobal(env *mj.Environment, tc TemplateConfig, name string) bool {
+	t, err := env.TemplateFromString(tc.Syntax.VarStart + " " + name + " is defined " + tc.Syntax.VarEnd)
+	if err != nil {
+		return false
+	}
+	out, err := t.Render(nil)
+	return err == nil && out == "true"
+}
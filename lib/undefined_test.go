@@ -0,0 +1,104 @@
+package lib
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUndefined(t *testing.T) {
+	src := "{% macro m(x) %}{{ x }}{% endmacro %}{{ now('2006') | length }}{{ m(1) }}\n" +
+		"{{ host }}:{{ port }}\n" +
+		"{{ opt | default('-') }}{% if extra is defined %}{{ extra }}{% endif %}{{ 'x' ~ suffix }}\n" +
+		"{% for i in items %}{{ i }}{% endfor %}{% set local = 1 %}{{ local }}"
+	data := map[string]any{"host": "web1"}
+
+	out, err := TemplateStringWithConfig(src, data, "undefined", "collect")
+	var ue *UndefinedError
+	if !errors.As(err, &ue) {
+		t.Fatalf("expected an UndefinedError, got %v", err)
+	}
+	expected := []UndefinedRef{{"port", "<string>", 2}, {"suffix", "<string>", 3}, {"items", "<string>", 4}}
+	if !reflect.DeepEqual(ue.Refs, expected) {
+		t.Errorf("expected %v, got %v", expected, ue.Refs)
+	}
+	if out != "41\nweb1:\n-x\n1" {
+		t.Errorf("collect should render fully, got %q", out)
+	}
+
+	out, err = TemplateStringWithConfig(src, data, "undefined", "strict")
+	if !errors.As(err, &ue) || len(ue.Refs) != 1 || ue.Refs[0].Name != "port" || out != "" {
+		t.Errorf("expected a strict error on port, got %q %v", out, err)
+	}
+	if !strings.Contains(err.Error(), "<string> line 2: 'port' is undefined") {
+		t.Errorf("unexpected message %s", err)
+	}
+	if out, err := TemplateStringWithConfig(src, data); err != nil || out != "41\nweb1:\n-x\n1" {
+		t.Errorf("lenient is the default, got %q %v", out, err)
+	}
+	if _, err := TemplateStringWithConfig(src, data, "undefined", "nope"); err == nil {
+		t.Errorf("expected an unknown mode error")
+	}
+
+	// the line numbers are the ones of the file, the header line included, and includes are searched
+	tempDir := t.TempDir()
+	writeFiles(t, tempDir, map[string]string{
+		"main.j2":    "#jinja2: trim_blocks: True\nname={{ name }}\n{% include 'inc.j2' %}",
+		"inc.j2":     "\n\n{{ missing_in_inc }}",
+		"strict.j2":  "{{ d.nope }}",
+		"partial.j2": "ok {{ absent }}",
+	})
+	te := NewTemplateEnv(tempDir)
+	te.Undefined = UndefinedCollect
+	if out, err := te.Render("main.j2", map[string]any{"name": "x", "missing_in_inc": 1}); err != nil || out != "name=x\n\n\n1" {
+		t.Errorf("included templates should see the data, got %q %v", out, err)
+	}
+	if _, err := te.Render("main.j2", map[string]any{}); !errors.As(err, &ue) || !reflect.DeepEqual(ue.Refs, []UndefinedRef{{"name", "main.j2", 2}}) {
+		t.Errorf("unexpected refs %v", err)
+	}
+	te.Undefined = UndefinedStrict
+	if _, err := te.Render("main.j2", map[string]any{"name": "x"}); !errors.As(err, &ue) {
+		t.Errorf("expected a strict error in the included template, got %v", err)
+	}
+	if _, err := te.Render("strict.j2", map[string]any{"d": map[string]any{}}); !errors.As(err, &ue) {
+		t.Errorf("expected a strict error on a missing attribute, got %v", err)
+	}
+
+	dest := filepath.Join(tempDir, "out")
+	if err := TemplateFileWithConfig(filepath.Join(tempDir, "partial.j2"), dest, nil, 0o644, "undefined", "strict"); err == nil {
+		t.Errorf("expected a strict error")
+	}
+	if _, err := os.Stat(dest); err == nil {
+		t.Errorf("nothing should be written in strict mode")
+	}
+	if err := TemplateFileWithConfig(filepath.Join(tempDir, "partial.j2"), dest, nil, 0o644, "undefined", "collect"); !errors.As(err, &ue) {
+		t.Errorf("expected the collected refs, got %v", err)
+	}
+	if b, _ := os.ReadFile(dest); string(b) != "ok " {
+		t.Errorf("collect should write the file, got %q", b)
+	}
+
+	// the guarded reads are skipped, not the other reads of the variable
+	_, err = TemplateStringWithConfig("{{ 'port' }} {{ port | default(1) }}\n{% if port is defined %}{{ port }}{% endif %}\n{{ port }}", nil, "undefined", "collect")
+	if !errors.As(err, &ue) || !reflect.DeepEqual(ue.Refs, []UndefinedRef{{"port", "<string>", 3}}) {
+		t.Errorf("expected port at line 3, got %v", err)
+	}
+
+	// the environment of the caller is not changed
+	env := NewJinjaEnvironment(nil, nil)
+	tmpl, _ := env.TemplateFromString("{{ absent }}")
+	if _, err := renderUndefined(env, tmpl, DefaultTemplateConfig(), nil, UndefinedStrict, errorLocation{}); !errors.As(err, &ue) {
+		t.Errorf("expected the undefined ref, got %v", err)
+	}
+	if out, err := tmpl.Render(nil); err != nil || out != "" {
+		t.Errorf("the environment should stay lenient, got %q %v", out, err)
+	}
+
+	t.Setenv("JINJA2_UNDEFINED", "strict")
+	if err := catchPanic(func() { TemplateString("{{ absent }}", nil) }); err == nil {
+		t.Errorf("expected TemplateString to panic with JINJA2_UNDEFINED=strict")
+	}
+}
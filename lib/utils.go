@@ -528,16 +528,33 @@ func CheckPasswordStrength(password string) (PasswordStrength, float64, error) {
 	return StrongPassword, entropy, nil
 }
 
-// Take local jinja2 template file, template it and copy to remote hosts
+// Take local jinja2 template file, template it and copy to remote hosts. The undefined variables of
+// JINJA2_UNDEFINED=collect are printed to stderr as for TemplateFile, the other errors are returned.
 func GoTemplate(s *u.SshExec, src, dest string, data map[string]any, mode os.FileMode) (err error) {
 	if s.SshExecHost == "localhost" || s.SshExecHost == "127.0.0.1" {
-		TemplateFile(src, dest, data, mode)
-		return nil
+		return warnUndefined(TemplateFileErr(src, dest, data, mode), os.Getenv("JINJA2_UNDEFINED"))
+	}
+	tempDir, err := os.MkdirTemp("", "")
+	if err != nil {
+		return err
 	}
-	tempDir := u.Must(os.MkdirTemp("", ""))
 	defer os.RemoveAll(tempDir)
 	tempFile := tempDir + "/" + uuid.NewString()
-	TemplateFile(src, tempFile, data, mode)
-	u.Must(s.CopyFile(dest, tempFile))
+	if err := warnUndefined(TemplateFileErr(src, tempFile, data, mode), os.Getenv("JINJA2_UNDEFINED")); err != nil {
+		return err
+	}
+	if _, err := s.CopyFile(dest, tempFile); err != nil {
+		return fmt.Errorf("copy %s to %s:%s: %w", src, s.SshExecHost, dest, err)
+	}
 	return nil
 }
+
+// sshOutput runs a command on the SshExec host over its connection, so its user, key, password and port are used,
+// and returns its output
+func sshOutput(s *u.SshExec, command string) (string, error) {
+	out, err := s.Exec(command)
+	if err != nil {
+		return out, fmt.Errorf("ssh %s '%s': %w", s.SshExecHost, command, err)
+	}
+	return out, nil
+}
@@ -480,3 +480,20 @@ func TestIsLikelyPasswordOrToken_LetterWord(t *testing.T) {
 	}
 	// os.WriteFile("debug-word-src.json", []byte(u.JsonDump(word_src, "")), 0o644)
 }
+
+func TestGoTemplateErrors(t *testing.T) {
+	tempDir := t.TempDir()
+	writeFiles(t, tempDir, map[string]string{"ok.j2": "{{ a }}", "bad.j2": "{% if %}"})
+	s := &u.SshExec{SshExecHost: "localhost"}
+	dest := filepath.Join(tempDir, "out")
+	if err := GoTemplate(s, filepath.Join(tempDir, "ok.j2"), dest, map[string]any{"a": "x"}, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(dest); string(b) != "x" {
+		t.Errorf("unexpected output %q", b)
+	}
+	// returned, not panicked
+	if err := GoTemplate(s, filepath.Join(tempDir, "bad.j2"), dest, nil, 0o644); err == nil {
+		t.Errorf("expected a template error")
+	}
+}